@@ -45,7 +45,9 @@ const (
 	AlertBadCertificateStatsResponse Alert = 113
 	AlertBadCertificateHashValue     Alert = 114
 	AlertUnknownPSKIdentity          Alert = 115
+	AlertCertificateRequired         Alert = 116
 	AlertNoApplicationProtocol       Alert = 120
+	AlertECHRequired                 Alert = 121
 	AlertStatelessRetry              Alert = 253
 	AlertWouldBlock                  Alert = 254
 	AlertNoAlert                     Alert = 255
@@ -81,7 +83,9 @@ var alertText = map[Alert]string{
 	AlertBadCertificateStatsResponse: "bad certificate status response",
 	AlertBadCertificateHashValue:     "bad certificate hash value",
 	AlertUnknownPSKIdentity:          "unknown PSK identity",
+	AlertCertificateRequired:         "certificate required",
 	AlertNoApplicationProtocol:       "no application protocol",
+	AlertECHRequired:                 "encrypted client hello required",
 	AlertNoRenegotiation:             "no renegotiation",
 	AlertStatelessRetry:              "stateless retry",
 	AlertWouldBlock:                  "would have blocked",
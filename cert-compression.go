@@ -0,0 +1,159 @@
+package mint
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The largest Certificate message we are willing to decompress.  This bounds
+// the memory a peer can make us allocate with a small CompressedCertificate.
+const maxDecompressedCertificateLen = 1 << 17
+
+// A CertificateCompressor implements a certificate compression algorithm
+// (RFC 8879).
+type CertificateCompressor interface {
+	Algorithm() CertificateCompressionAlgorithm
+	Compress(data []byte) ([]byte, error)
+	// Decompress must fail rather than return more than uncompressedLength
+	// bytes.
+	Decompress(data []byte, uncompressedLength int) ([]byte, error)
+}
+
+// ZlibCertificateCompressor compresses certificates with zlib.
+type ZlibCertificateCompressor struct{}
+
+func (z ZlibCertificateCompressor) Algorithm() CertificateCompressionAlgorithm {
+	return CertificateCompressionZlib
+}
+
+func (z ZlibCertificateCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (z ZlibCertificateCompressor) Decompress(data []byte, uncompressedLength int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// Read one byte more than expected, so that overlong output is detected
+	// without reading all of it
+	out, err := ioutil.ReadAll(io.LimitReader(r, int64(uncompressedLength)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) != uncompressedLength {
+		return nil, fmt.Errorf("tls.compression: Decompressed length does not match")
+	}
+	return out, nil
+}
+
+func certificateCompressionAlgorithms(compressors []CertificateCompressor) []CertificateCompressionAlgorithm {
+	algorithms := make([]CertificateCompressionAlgorithm, len(compressors))
+	for i, compressor := range compressors {
+		algorithms[i] = compressor.Algorithm()
+	}
+	return algorithms
+}
+
+// Returns the first of our compressors that the peer offered, or nil
+func selectCertificateCompressor(compressors []CertificateCompressor, offered []CertificateCompressionAlgorithm) CertificateCompressor {
+	for _, compressor := range compressors {
+		for _, algorithm := range offered {
+			if compressor.Algorithm() == algorithm {
+				return compressor
+			}
+		}
+	}
+	return nil
+}
+
+func compressCertificate(compressor CertificateCompressor, certificate *CertificateBody) (*CompressedCertificateBody, error) {
+	data, err := certificate.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CompressedCertificateBody{
+		Algorithm:                    compressor.Algorithm(),
+		UncompressedLength:           len(data),
+		CompressedCertificateMessage: compressed,
+	}, nil
+}
+
+func decompressCertificate(compressors []CertificateCompressor, compressed *CompressedCertificateBody) ([]byte, error) {
+	var compressor CertificateCompressor
+	for _, c := range compressors {
+		if c.Algorithm() == compressed.Algorithm {
+			compressor = c
+			break
+		}
+	}
+	if compressor == nil {
+		return nil, fmt.Errorf("tls.compression: Unsupported algorithm [%d]", compressed.Algorithm)
+	}
+
+	if compressed.UncompressedLength > maxDecompressedCertificateLen {
+		return nil, fmt.Errorf("tls.compression: Uncompressed length too large [%d]", compressed.UncompressedLength)
+	}
+
+	data, err := compressor.Decompress(compressed.CompressedCertificateMessage, compressed.UncompressedLength)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't rely on the compressor to enforce the length
+	if len(data) != compressed.UncompressedLength {
+		return nil, fmt.Errorf("tls.compression: Decompressed length does not match")
+	}
+	return data, nil
+}
+
+// Reads a Certificate message, which may have been sent as a
+// CompressedCertificate if we offered any compression algorithms
+func readCertificateMessage(hm *HandshakeMessage, certType CertificateType, compressors []CertificateCompressor) (*CertificateBody, Alert) {
+	data := hm.body
+	if hm.msgType == HandshakeTypeCompressedCertificate {
+		if len(compressors) == 0 {
+			logf(logTypeHandshake, "Unexpected CompressedCertificate")
+			return nil, AlertUnexpectedMessage
+		}
+
+		compressed := &CompressedCertificateBody{}
+		if err := safeUnmarshal(compressed, hm.body); err != nil {
+			logf(logTypeHandshake, "Error decoding CompressedCertificate: %v", err)
+			return nil, AlertDecodeError
+		}
+
+		var err error
+		data, err = decompressCertificate(compressors, compressed)
+		if err != nil {
+			logf(logTypeHandshake, "Error decompressing certificate: %v", err)
+			return nil, AlertBadCertificate
+		}
+	}
+
+	cert := &CertificateBody{CertificateType: certType}
+	if err := safeUnmarshal(cert, data); err != nil {
+		logf(logTypeHandshake, "Error decoding Certificate: %v", err)
+		return nil, AlertDecodeError
+	}
+	return cert, AlertNoAlert
+}
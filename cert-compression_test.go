@@ -0,0 +1,69 @@
+package mint
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZlibCertificateCompressor(t *testing.T) {
+	zlib := ZlibCertificateCompressor{}
+	assertEquals(t, zlib.Algorithm(), CertificateCompressionZlib)
+
+	data := bytes.Repeat([]byte("certificate"), 100)
+	compressed, err := zlib.Compress(data)
+	assertNotError(t, err, "Failed to compress")
+	assertTrue(t, len(compressed) < len(data), "Compression did not shrink data")
+
+	decompressed, err := zlib.Decompress(compressed, len(data))
+	assertNotError(t, err, "Failed to decompress")
+	assertByteEquals(t, decompressed, data)
+
+	// Output longer or shorter than the stated length is rejected
+	_, err = zlib.Decompress(compressed, len(data)-1)
+	assertError(t, err, "Decompressed more than the stated length")
+	_, err = zlib.Decompress(compressed, len(data)+1)
+	assertError(t, err, "Decompressed less than the stated length")
+
+	_, err = zlib.Decompress([]byte{0x00, 0x01, 0x02}, len(data))
+	assertError(t, err, "Decompressed invalid data")
+}
+
+func TestDecompressCertificate(t *testing.T) {
+	compressors := []CertificateCompressor{ZlibCertificateCompressor{}}
+	certificate := &CertificateBody{
+		CertificateList: []CertificateEntry{{CertData: certificates[0].Chain[0]}},
+	}
+
+	compressed, err := compressCertificate(compressors[0], certificate)
+	assertNotError(t, err, "Failed to compress certificate")
+
+	data, err := decompressCertificate(compressors, compressed)
+	assertNotError(t, err, "Failed to decompress certificate")
+	expected, err := certificate.Marshal()
+	assertNotError(t, err, "Failed to marshal certificate")
+	assertByteEquals(t, data, expected)
+
+	// An algorithm we don't support is rejected
+	unknown := *compressed
+	unknown.Algorithm = CertificateCompressionBrotli
+	_, err = decompressCertificate(compressors, &unknown)
+	assertError(t, err, "Decompressed with an unsupported algorithm")
+
+	// A bomb is rejected before decompressing, based on the stated length
+	bomb, err := compressors[0].Compress(make([]byte, maxDecompressedCertificateLen+1))
+	assertNotError(t, err, "Failed to compress bomb")
+	_, err = decompressCertificate(compressors, &CompressedCertificateBody{
+		Algorithm:                    CertificateCompressionZlib,
+		UncompressedLength:           maxDecompressedCertificateLen + 1,
+		CompressedCertificateMessage: bomb,
+	})
+	assertError(t, err, "Decompressed a certificate over the size limit")
+
+	// ... or while decompressing, if the stated length is a lie
+	_, err = decompressCertificate(compressors, &CompressedCertificateBody{
+		Algorithm:                    CertificateCompressionZlib,
+		UncompressedLength:           len(expected),
+		CompressedCertificateMessage: bomb,
+	})
+	assertError(t, err, "Decompressed more than the stated length")
+}
@@ -0,0 +1,559 @@
+package mint
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/x509"
+)
+
+// TLS 1.2 Client State Machine
+//
+// A client that offered TLS 1.2 leaves the TLS 1.3 state machine in WAIT_SH
+// if the ServerHello selects TLS 1.2.
+//
+//                           WAIT_SH
+//                              | Recv ServerHello (TLS 1.2)
+//                              v
+//                          WAIT_CERT
+//                              | Recv Certificate
+//                              v
+//                          WAIT_SKE <--+ Recv CertificateStatus
+//                              |       |
+//                              +-------+
+//                              | Recv ServerKeyExchange
+//                              v
+//                          WAIT_SHD <--+ Recv CertificateRequest
+//                              |       |
+//                              +-------+
+//                              | Recv ServerHelloDone
+//                              | [Send Certificate]
+//                              | Send ClientKeyExchange
+//                              | [Send CertificateVerify]
+//                              | Send ChangeCipherSpec, Finished
+//                              v
+//                        WAIT_FINISHED
+//                              | Recv ChangeCipherSpec, Finished
+//                              v
+//                          CONNECTED
+//
+//  State          Instructions
+//  WAIT_SH        {}
+//  WAIT_CERT      {}
+//  WAIT_SKE       {}
+//  WAIT_SHD       [Send(Cert);] Send(CKE); [Send(CV);] SendCCS; RekeyOut; Send(Fin); RekeyIn
+//  WAIT_FINISHED  {}
+
+// The state of a TLS 1.2 handshake that carries over from one message to the
+// next, on either side
+type handshakeTLS12 struct {
+	suite                tls12CipherSuite
+	clientRandom         [32]byte
+	serverRandom         [32]byte
+	extendedMasterSecret bool
+	statusRequested      bool
+
+	// TLS 1.2 signs the handshake messages themselves, so we keep them all,
+	// rather than a running hash
+	messages []byte
+}
+
+func (hs *handshakeTLS12) add(hm *HandshakeMessage) {
+	hs.messages = append(hs.messages, hm.Marshal()...)
+}
+
+func (hs handshakeTLS12) helloRandoms() []byte {
+	return append(append([]byte{}, hs.clientRandom[:]...), hs.serverRandom[:]...)
+}
+
+func (state clientStateWaitSH) negotiateTLS12(hm *HandshakeMessage, sh *ServerHelloBody) (HandshakeState, []HandshakeAction, Alert) {
+	// 1. Check that the server provided a ciphersuite we offered
+	supportedCipherSuite := false
+	for _, suite := range state.Config.cipherSuitesFor(tls12Version) {
+		supportedCipherSuite = supportedCipherSuite || (suite == sh.CipherSuite)
+	}
+	if !supportedCipherSuite {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported TLS 1.2 ciphersuite [%04x]", sh.CipherSuite)
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	// 2. A server that supports TLS 1.3 marks its random when it negotiates
+	// TLS 1.2, so that a downgrade by an attacker is detected
+	if versionListContains(state.offeredVersions, tls13Version) &&
+		bytes.Equal(sh.Random[len(sh.Random)-len(downgradeSentinelTLS12):], downgradeSentinelTLS12[:]) {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Downgrade to TLS 1.2 detected")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	// Handle external extensions.
+	if state.Config.ExtensionHandler != nil {
+		err := state.Config.ExtensionHandler.Receive(HandshakeTypeServerHello, &sh.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientWaitSH] Error running external extension handler [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
+	serverALPN := &ALPNExtension{}
+	serverEMS := &ExtendedMasterSecretExtension{}
+	serverRenegotiation := &RenegotiationInfoExtension{}
+	serverStatusRequest := &StatusRequestExtension{HandshakeType: HandshakeTypeServerHello}
+	serverPointFormats := &ECPointFormatsExtension{}
+
+	foundExts, err := sh.Extensions.Parse(
+		[]ExtensionBody{
+			serverALPN,
+			serverEMS,
+			serverRenegotiation,
+			serverStatusRequest,
+			serverPointFormats,
+		})
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Error processing extensions [%v]", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	// We never renegotiate, so there's nothing to bind to
+	if foundExts[ExtensionTypeRenegotiationInfo] && len(serverRenegotiation.RenegotiatedConnection) > 0 {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Non-empty renegotiation_info")
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	if foundExts[ExtensionTypeECPointFormats] && !bytes.Contains(serverPointFormats.Formats, []byte{pointFormatUncompressed}) {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Server does not support uncompressed points")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	if foundExts[ExtensionTypeALPN] {
+		if len(serverALPN.Protocols) != 1 || !stringListContains(state.Opts.NextProtos, serverALPN.Protocols[0]) {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Server selected an unoffered protocol %v", serverALPN.Protocols)
+			return nil, nil, AlertIllegalParameter
+		}
+		state.Params.NextProto = serverALPN.Protocols[0]
+	}
+
+	state.Params.Version = tls12Version
+	state.Params.CipherSuite = sh.CipherSuite
+	state.Params.UsingDH = true
+
+	hs := handshakeTLS12{
+		suite:                tls12CipherSuiteMap[sh.CipherSuite],
+		clientRandom:         state.clientRandom,
+		serverRandom:         sh.Random,
+		extendedMasterSecret: foundExts[ExtensionTypeExtendedMasterSecret],
+		statusRequested:      foundExts[ExtensionTypeStatusRequest],
+	}
+	hs.add(state.clientHello)
+	hs.add(hm)
+
+	logf(logTypeHandshake, "[ClientStateWaitSH] -> [ClientStateWaitCertTLS12]")
+	nextState := clientStateWaitCertTLS12{
+		Config: state.Config,
+		Params: state.Params,
+		hsCtx:  state.hsCtx,
+		hs:     hs,
+	}
+	return nextState, nil, AlertNoAlert
+}
+
+func stringListContains(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
+
+type clientStateWaitCertTLS12 struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+}
+
+var _ HandshakeState = &clientStateWaitCertTLS12{}
+
+func (state clientStateWaitCertTLS12) State() State {
+	return StateClientWaitCert
+}
+
+func (state clientStateWaitCertTLS12) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeCertificate {
+		logf(logTypeHandshake, "[ClientStateWaitCertTLS12] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	cert := &certificateBodyTLS12{}
+	if err := safeUnmarshal(cert, hm.body); err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitCertTLS12] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	if len(cert.Certificates) == 0 {
+		logf(logTypeHandshake, "[ClientStateWaitCertTLS12] Server sent no certificates")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	// The server's key has to be the kind the ciphersuite signs with
+	if !state.hs.suite.validForKey(cert.Certificates[0].PublicKey) {
+		logf(logTypeHandshake, "[ClientStateWaitCertTLS12] Certificate key does not match ciphersuite")
+		return nil, nil, AlertUnsupportedCertificate
+	}
+
+	state.hs.add(hm)
+
+	logf(logTypeHandshake, "[ClientStateWaitCertTLS12] -> [ClientStateWaitSKE]")
+	nextState := clientStateWaitSKE{
+		Config:            state.Config,
+		Params:            state.Params,
+		hsCtx:             state.hsCtx,
+		hs:                state.hs,
+		serverCertificate: cert.Certificates,
+	}
+	return nextState, nil, AlertNoAlert
+}
+
+type clientStateWaitSKE struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	serverCertificate []*x509.Certificate
+	ocspResponse      []byte
+}
+
+var _ HandshakeState = &clientStateWaitSKE{}
+
+func (state clientStateWaitSKE) State() State {
+	return StateClientWaitSKE
+}
+
+func (state clientStateWaitSKE) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+
+	// A stapled OCSP response comes between the Certificate and the
+	// ServerKeyExchange, if we asked for one
+	if hm != nil && hm.msgType == HandshakeTypeCertificateStatus && state.hs.statusRequested && state.ocspResponse == nil {
+		status := &CertificateStatusBody{}
+		if err := safeUnmarshal(status, hm.body); err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSKE] Error decoding message: %v", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		state.hs.add(hm)
+		state.ocspResponse = status.OCSPResponse
+
+		logf(logTypeHandshake, "[ClientStateWaitSKE] -> [ClientStateWaitSKE]")
+		return state, nil, AlertNoAlert
+	}
+
+	if hm == nil || hm.msgType != HandshakeTypeServerKeyExchange {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	ske := &ServerKeyExchangeBody{}
+	if err := safeUnmarshal(ske, hm.body); err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	// The server can only use a group and signature scheme we offered
+	if !namedGroupListContains(groupsTLS12(state.Config.Groups), ske.Group) {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Server selected unoffered group [%04x]", ske.Group)
+		return nil, nil, AlertIllegalParameter
+	}
+	if !schemeListContains(signatureSchemesTLS12(state.Config.SignatureSchemes), ske.Algorithm) {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Server selected unoffered signature scheme [%04x]", ske.Algorithm)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	serverPublicKey := state.serverCertificate[0].PublicKey
+	sigInput := ske.signatureInput(state.hs.clientRandom, state.hs.serverRandom)
+	if err := verify(ske.Algorithm, serverPublicKey, sigInput, ske.Signature); err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Server signature failed to verify")
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	verifiedChains, alert := verifyServerCertificates(state.Config, state.Params.ServerName,
+		state.serverCertificate, state.ocspResponse, nil)
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+
+	pub, priv, err := newKeyShare(ske.Group)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Error generating key share [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	preMasterSecret, err := keyAgreement(ske.Group, ske.Point, priv)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSKE] Error in key agreement [%v]", err)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	state.hs.add(hm)
+
+	logf(logTypeHandshake, "[ClientStateWaitSKE] -> [ClientStateWaitSHD]")
+	nextState := clientStateWaitSHD{
+		Config:            state.Config,
+		Params:            state.Params,
+		hsCtx:             state.hsCtx,
+		hs:                state.hs,
+		serverCertificate: state.serverCertificate,
+		verifiedChains:    verifiedChains,
+		ocspResponse:      state.ocspResponse,
+		dhPublic:          pub,
+		preMasterSecret:   preMasterSecret,
+	}
+	return nextState, nil, AlertNoAlert
+}
+
+func namedGroupListContains(groups []NamedGroup, group NamedGroup) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+type clientStateWaitSHD struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	serverCertificate        []*x509.Certificate
+	verifiedChains           [][]*x509.Certificate
+	ocspResponse             []byte
+	serverCertificateRequest *certificateRequestBodyTLS12
+
+	dhPublic        []byte
+	preMasterSecret []byte
+}
+
+var _ HandshakeState = &clientStateWaitSHD{}
+
+func (state clientStateWaitSHD) State() State {
+	return StateClientWaitSHD
+}
+
+func (state clientStateWaitSHD) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+
+	if hm != nil && hm.msgType == HandshakeTypeCertificateRequest && state.serverCertificateRequest == nil {
+		cr := &certificateRequestBodyTLS12{}
+		if err := safeUnmarshal(cr, hm.body); err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSHD] Error decoding message: %v", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		state.hs.add(hm)
+		state.serverCertificateRequest = cr
+
+		logf(logTypeHandshake, "[ClientStateWaitSHD] -> [ClientStateWaitSHD]")
+		return state, nil, AlertNoAlert
+	}
+
+	if hm == nil || hm.msgType != HandshakeTypeServerHelloDone {
+		logf(logTypeHandshake, "[ClientStateWaitSHD] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	if err := safeUnmarshal(&ServerHelloDoneBody{}, hm.body); err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSHD] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	state.hs.add(hm)
+
+	toSend := []HandshakeAction{}
+	var cert *Certificate
+	var certScheme SignatureScheme
+	if cr := state.serverCertificateRequest; cr != nil {
+		// Select a certificate, only offering ones the server will accept.
+		// Raw public keys and delegated credentials need TLS 1.3.
+		candidates := []*Certificate{}
+		for _, c := range certificatesOfType(state.Config.Certificates, CertificateTypeX509) {
+			if c.DelegatedCredential == nil && cr.allowsKey(c.PrivateKey) {
+				candidates = append(candidates, c)
+			}
+		}
+		if len(cr.Authorities) > 0 {
+			candidates = certificatesForAuthorities(candidates, cr.Authorities)
+		}
+		if state.Config.GetClientCertificate != nil {
+			info := &CertificateRequestInfo{
+				SignatureSchemes: cr.SignatureSchemes,
+				AcceptableCAs:    cr.Authorities,
+			}
+			c, err := state.Config.GetClientCertificate(info)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateWaitSHD] Error getting client certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+
+			candidates = nil
+			if c != nil {
+				candidates = certificatesOfType([]*Certificate{c}, CertificateTypeX509)
+			}
+		}
+
+		var err error
+		cert, certScheme, err = CertificateSelection(nil, signatureSchemesTLS12(cr.SignatureSchemes), candidates)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSHD] WARNING no appropriate certificate found [%v]", err)
+			cert = nil
+		}
+
+		certificate := &certificateBodyTLS12{}
+		if cert != nil {
+			certificate.Certificates = cert.Chain
+		}
+		certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificate)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSHD] Error marshaling Certificate [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		toSend = append(toSend, QueueHandshakeMessage{certm})
+		state.hs.add(certm)
+	}
+
+	ckem, err := state.hsCtx.hOut.HandshakeMessageFromBody(&ClientKeyExchangeBody{Point: state.dhPublic})
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSHD] Error marshaling ClientKeyExchange [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	toSend = append(toSend, QueueHandshakeMessage{ckem})
+	state.hs.add(ckem)
+
+	params := state.hs.suite.params
+	masterSecret := masterSecretTLS12(params, state.preMasterSecret, state.hs.extendedMasterSecret,
+		state.hs.messages, state.hs.helloRandoms())
+	logf(logTypeCrypto, "master secret: [%d] %x", len(masterSecret), masterSecret)
+
+	if cert != nil {
+		// The CertificateVerify signs all of the handshake messages so far
+		sig, err := sign(certScheme, cert.PrivateKey, state.hs.messages)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSHD] Error signing CertificateVerify [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		certVerify := &CertificateVerifyBody{Algorithm: certScheme, Signature: sig}
+		certvm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certVerify)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitSHD] Error marshaling CertificateVerify [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		toSend = append(toSend, QueueHandshakeMessage{certvm})
+		state.hs.add(certvm)
+	}
+
+	clientKeys, serverKeys := makeTrafficKeysTLS12(params, masterSecret, state.hs.clientRandom, state.hs.serverRandom)
+
+	fin := &FinishedBody{
+		VerifyDataLen: verifyDataLenTLS12,
+		VerifyData:    computeFinishedDataTLS12(params, masterSecret, labelClientFinishedTLS12, state.hs.messages),
+	}
+	finm, err := state.hsCtx.hOut.HandshakeMessageFromBody(fin)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitSHD] Error marshaling client Finished [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	state.hs.add(finm)
+
+	toSend = append(toSend, []HandshakeAction{
+		SendQueuedHandshake{},
+		SendChangeCipherSpec{},
+		RekeyOut{epoch: EpochApplicationData, KeySet: clientKeys},
+		QueueHandshakeMessage{finm},
+		SendQueuedHandshake{},
+		RekeyIn{epoch: EpochApplicationData, KeySet: serverKeys},
+	}...)
+
+	logf(logTypeHandshake, "[ClientStateWaitSHD] -> [ClientStateWaitFinishedTLS12]")
+	nextState := clientStateWaitFinishedTLS12{
+		Params:            state.Params,
+		hsCtx:             state.hsCtx,
+		hs:                state.hs,
+		masterSecret:      masterSecret,
+		serverCertificate: state.serverCertificate,
+		verifiedChains:    state.verifiedChains,
+		ocspResponse:      state.ocspResponse,
+	}
+	return nextState, toSend, AlertNoAlert
+}
+
+type clientStateWaitFinishedTLS12 struct {
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	masterSecret      []byte
+	serverCertificate []*x509.Certificate
+	verifiedChains    [][]*x509.Certificate
+	ocspResponse      []byte
+}
+
+var _ HandshakeState = &clientStateWaitFinishedTLS12{}
+
+func (state clientStateWaitFinishedTLS12) State() State {
+	return StateClientWaitFinished
+}
+
+func (state clientStateWaitFinishedTLS12) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeFinished || !state.hsCtx.hIn.receivedCCS {
+		logf(logTypeHandshake, "[ClientStateWaitFinishedTLS12] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	params := state.hs.suite.params
+	serverFinishedData := computeFinishedDataTLS12(params, state.masterSecret, labelServerFinishedTLS12, state.hs.messages)
+
+	fin := &FinishedBody{VerifyDataLen: verifyDataLenTLS12}
+	if err := safeUnmarshal(fin, hm.body); err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitFinishedTLS12] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	if !hmac.Equal(fin.VerifyData, serverFinishedData) {
+		logf(logTypeHandshake, "[ClientStateWaitFinishedTLS12] Server's Finished failed to verify [%x] != [%x]",
+			fin.VerifyData, serverFinishedData)
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	logf(logTypeHandshake, "[ClientStateWaitFinishedTLS12] -> [StateConnected]")
+	nextState := stateConnected{
+		Params:           state.Params,
+		hsCtx:            state.hsCtx,
+		isClient:         true,
+		cryptoParams:     params,
+		peerCertificates: state.serverCertificate,
+		verifiedChains:   state.verifiedChains,
+		ocspResponse:     state.ocspResponse,
+		helloRandoms:     state.hs.helloRandoms(),
+	}
+	if state.hs.extendedMasterSecret {
+		nextState.exporterSecret = state.masterSecret
+	}
+	return nextState, nil, AlertNoAlert
+}
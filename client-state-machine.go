@@ -5,6 +5,7 @@ import (
 	"crypto"
 	"crypto/x509"
 	"hash"
+	"sort"
 	"time"
 )
 
@@ -41,7 +42,7 @@ import (
 //  here
 //
 //  State							Instructions
-//  START							Send(CH); [RekeyOut; SendEarlyData]
+//  START							[SendCCS;] Send(CH); [SendCCS; RekeyOut; SendEarlyData]
 //  WAIT_SH						Send(CH) || RekeyIn
 //  WAIT_EE						{}
 //  WAIT_CERT_CR			{}
@@ -50,15 +51,73 @@ import (
 //  WAIT_FINISHED			RekeyIn; [Send(EOED);] RekeyOut; [SendCert; SendCV;] SendFin; RekeyOut;
 //  CONNECTED					StoreTicket || (RekeyIn; [RekeyOut])
 
+// The PSKs a client offers a server, in the order they appear in the
+// ClientHello: tickets from the most recently received to the oldest, then
+// external PSKs.  Tickets come from the ClientSessionCache and external PSKs
+// from PSKs, by server name.  PSKs that have expired or are for ciphersuites
+// that aren't offered are left out.
+func clientPSKCandidates(config *Config, opts ConnectionOptions, suites []CipherSuite) []PreSharedKey {
+	var stored []PreSharedKey
+	if config.ClientSessionCache != nil {
+		stored = config.ClientSessionCache.Get(opts.SessionCacheKey)
+	}
+	if lister, ok := config.PSKs.(PreSharedKeyLister); ok {
+		stored = append(stored, lister.GetAll(opts.ServerName)...)
+	} else if key, ok := config.PSKs.Get(opts.ServerName); ok {
+		stored = append(stored, key)
+	}
+
+	offeredHashes := map[crypto.Hash]bool{}
+	for _, suite := range suites {
+		if params, ok := cipherSuiteMap[suite]; ok {
+			offeredHashes[params.Hash] = true
+		}
+	}
+
+	now := time.Now()
+	tickets := []PreSharedKey{}
+	external := []PreSharedKey{}
+	for _, key := range stored {
+		if key.expired(now) {
+			logf(logTypeHandshake, "Not offering expired PSK with id = %x", key.Identity)
+			continue
+		}
+
+		params, ok := cipherSuiteMap[key.CipherSuite]
+		if !ok || !offeredHashes[params.Hash] {
+			logf(logTypeHandshake, "Not offering PSK with id = %x for ciphersuite [%04x]", key.Identity, uint16(key.CipherSuite))
+			continue
+		}
+
+		if key.IsResumption {
+			tickets = append(tickets, key)
+		} else {
+			external = append(external, key)
+		}
+	}
+
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].ReceivedAt.After(tickets[j].ReceivedAt)
+	})
+	return append(tickets, external...)
+}
+
 type clientStateStart struct {
 	Config *Config
 	Opts   ConnectionOptions
 	Params ConnectionParameters
 
 	cookie            []byte
+	legacySessionID   []byte
+	grease            *greaseValues
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 	hsCtx             *HandshakeContext
+
+	// The ECH we offered before a HelloRetryRequest, and the hash of the
+	// first ClientHelloInner
+	ech                   *echOffer
+	firstInnerClientHello *HandshakeMessage
 }
 
 var _ HandshakeState = &clientStateStart{}
@@ -68,13 +127,40 @@ func (state clientStateStart) State() State {
 }
 
 func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
-	// key_shares
+	// Pick the versions to offer.  ECH needs TLS 1.3, so a client that
+	// encrypts its ClientHello doesn't offer anything older.
+	offeredVersions := state.Config.supportedVersions()
+	offerTLS13 := versionListContains(offeredVersions, tls13Version)
+
+	// After a HelloRetryRequest, we keep offering ECH with the same config and
+	// HPKE context
+	ech := state.ech
+	if ech == nil && len(state.Config.ECHConfigs) > 0 && !state.Config.UseDTLS && offerTLS13 {
+		if echConfig, echSuite := selectECHConfig(state.Config.ECHConfigs); echConfig != nil {
+			var err error
+			ech, err = newECHOffer(echConfig, echSuite)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateStart] Error setting up ECH [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+	}
+	if ech != nil {
+		offeredVersions = []uint16{tls13Version}
+	}
+	offerTLS12 := versionListContains(offeredVersions, tls12Version)
+
+	// key_shares, which only mean anything in TLS 1.3
+	var shareGroups []NamedGroup
+	if offerTLS13 {
+		shareGroups = state.Config.Groups
+	}
 	offeredDH := map[NamedGroup][]byte{}
 	ks := KeyShareExtension{
 		HandshakeType: HandshakeTypeClientHello,
-		Shares:        make([]KeyShareEntry, len(state.Config.Groups)),
+		Shares:        make([]KeyShareEntry, len(shareGroups)),
 	}
-	for i, group := range state.Config.Groups {
+	for i, group := range shareGroups {
 		pub, priv, err := newKeyShare(group)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error generating key share [%v]", err)
@@ -88,11 +174,14 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 
 	logf(logTypeHandshake, "opts: %+v", state.Opts)
 
-	// supported_versions, supported_groups, signature_algorithms, server_name
-	sv := SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello, Versions: []uint16{tls13Version}}
+	// supported_versions, supported_groups, signature_algorithms, server_name,
+	// status_request, signed_certificate_timestamp
+	sv := SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello, Versions: offeredVersions}
 	sni := ServerNameExtension(state.Opts.ServerName)
 	sg := SupportedGroupsExtension{Groups: state.Config.Groups}
 	sa := SignatureAlgorithmsExtension{Algorithms: state.Config.SignatureSchemes}
+	sr := StatusRequestExtension{HandshakeType: HandshakeTypeClientHello}
+	sct := SCTExtension{HandshakeType: HandshakeTypeClientHello}
 
 	state.Params.ServerName = state.Opts.ServerName
 
@@ -105,14 +194,63 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 	// Construct base ClientHello
 	ch := &ClientHelloBody{
 		LegacyVersion: wireVersion(state.hsCtx.hIn),
-		CipherSuites:  state.Config.CipherSuites,
+		CipherSuites:  state.Config.cipherSuitesFor(offeredVersions...),
 	}
 	_, err := prng.Read(ch.Random[:])
 	if err != nil {
 		logf(logTypeHandshake, "[ClientStateStart] Error creating ClientHello random [%v]", err)
 		return nil, nil, AlertInternalError
 	}
-	for _, ext := range []ExtensionBody{&sv, &sni, &ks, &sg, &sa} {
+
+	// In middlebox compatibility mode, a TLS 1.3 client sends a session ID,
+	// so that the handshake looks like a TLS 1.2 resumption.  The second
+	// ClientHello reuses the first one's.
+	if offerTLS13 && !state.Config.UseDTLS {
+		ch.LegacySessionID = state.legacySessionID
+		if ch.LegacySessionID == nil {
+			ch.LegacySessionID = make([]byte, 32)
+			_, err := prng.Read(ch.LegacySessionID)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateStart] Error creating ClientHello session ID [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+	}
+
+	// GREASE goes at the front of each list, and a second ClientHello reuses
+	// the first one's values
+	grease := state.grease
+	if state.Config.GREASE && grease == nil {
+		grease, err = newGREASEValues()
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error creating GREASE values [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if grease != nil {
+		ch.CipherSuites = append([]CipherSuite{grease.cipherSuite}, ch.CipherSuites...)
+		sv.Versions = append([]uint16{grease.version}, sv.Versions...)
+		sg.Groups = append([]NamedGroup{grease.group}, sg.Groups...)
+		sa.Algorithms = append([]SignatureScheme{grease.signatureScheme}, sa.Algorithms...)
+		if alpn != nil {
+			alpn.Protocols = append([]string{grease.alpn}, alpn.Protocols...)
+		}
+	}
+	baseExtensions := []ExtensionBody{&sv, &sni, &ks, &sg, &sa, &sr, &sct}
+	if !offerTLS13 {
+		baseExtensions = []ExtensionBody{&sni, &sg, &sa, &sr, &sct}
+	}
+	if grease != nil {
+		baseExtensions = append([]ExtensionBody{&greaseExtension{grease.extension}}, baseExtensions...)
+	}
+	if offerTLS12 {
+		// We don't renegotiate, so renegotiation_info is always empty
+		baseExtensions = append(baseExtensions,
+			&ExtendedMasterSecretExtension{},
+			&RenegotiationInfoExtension{},
+			&ECPointFormatsExtension{Formats: []uint8{pointFormatUncompressed}})
+	}
+	for _, ext := range baseExtensions {
 		err := ch.Extensions.Add(ext)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error adding extension type=[%v] [%v]", ext.Type(), err)
@@ -135,8 +273,56 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 			return nil, nil, AlertInternalError
 		}
 	}
+	if len(state.Config.CertificateSignatureSchemes) > 0 {
+		sac := &SignatureAlgorithmsCertExtension{Algorithms: state.Config.CertificateSignatureSchemes}
+		err := ch.Extensions.Add(sac)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding signature_algorithms_cert extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if certTypes := state.Config.serverCertTypes(); certTypes != nil && offerTLS13 {
+		err := ch.Extensions.Add(&ServerCertTypeExtension{HandshakeType: HandshakeTypeClientHello, CertificateTypes: certTypes})
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding server_certificate_type extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if certTypes := state.Config.clientCertTypes(); certTypes != nil && offerTLS13 {
+		err := ch.Extensions.Add(&ClientCertTypeExtension{HandshakeType: HandshakeTypeClientHello, CertificateTypes: certTypes})
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding client_certificate_type extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if len(state.Config.CertificateCompressors) > 0 && offerTLS13 {
+		algorithms := certificateCompressionAlgorithms(state.Config.CertificateCompressors)
+		err := ch.Extensions.Add(&CompressCertificateExtension{Algorithms: algorithms})
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding compress_certificate extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if state.Config.AcceptDelegatedCredentials && offerTLS13 {
+		dc := &DelegatedCredentialExtension{HandshakeType: HandshakeTypeClientHello, Algorithms: state.Config.SignatureSchemes}
+		err := ch.Extensions.Add(dc)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding delegated_credential extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if state.Config.SendCertificateAuthorities && state.Config.RootCAs != nil && offerTLS13 {
+		authorities := state.Config.RootCAs.Subjects()
+		if len(authorities) > 0 {
+			err := ch.Extensions.Add(&CertificateAuthoritiesExtension{Authorities: authorities})
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateStart] Error adding certificate_authorities extension [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+	}
 
-	if len(state.Config.PSKModes) != 0 {
+	if len(state.Config.PSKModes) != 0 && offerTLS13 {
 		kem := &PSKKeyExchangeModesExtension{KEModes: state.Config.PSKModes}
 		err = ch.Extensions.Add(kem)
 		if err != nil {
@@ -154,37 +340,47 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		}
 	}
 
+	// Everything so far goes in the ClientHelloInner if we're offering ECH
+	if ech != nil {
+		err := ch.Extensions.Add(&ECHExtension{HandshakeType: HandshakeTypeClientHello, ClientHelloType: ECHClientHelloInner})
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error adding encrypted_client_hello extension [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
 	// Handle PSK and EarlyData just before transmitting, so that we can
-	// calculate the PSK binder value
+	// calculate the PSK binder values
 	var psk *PreSharedKeyExtension
 	var ed *EarlyDataExtension
-	var offeredPSK PreSharedKey
-	var earlyHash crypto.Hash
-	var earlySecret []byte
 	var clientEarlyTrafficKeys KeySet
 	var clientHello *HandshakeMessage
-	if key, ok := state.Config.PSKs.Get(state.Opts.ServerName); ok {
-		offeredPSK = key
-
-		// Narrow ciphersuites to ones that match PSK hash
-		params, ok := cipherSuiteMap[key.CipherSuite]
-		if !ok {
-			logf(logTypeHandshake, "[ClientStateStart] PSK for unknown ciphersuite")
-			return nil, nil, AlertInternalError
+	var offeredPSKs []PreSharedKey
+	if offerTLS13 {
+		offeredPSKs = clientPSKCandidates(state.Config, state.Opts, ch.CipherSuites)
+	}
+	if len(offeredPSKs) > 0 {
+		// Narrow TLS 1.3 ciphersuites to ones that match a PSK hash, leaving
+		// TLS 1.2 and GREASE ones alone
+		pskHashes := map[crypto.Hash]bool{}
+		for _, key := range offeredPSKs {
+			pskHashes[cipherSuiteMap[key.CipherSuite].Hash] = true
 		}
 
 		compatibleSuites := []CipherSuite{}
 		for _, suite := range ch.CipherSuites {
-			if cipherSuiteMap[suite].Hash == params.Hash {
+			params, tls13 := cipherSuiteMap[suite]
+			if !tls13 || pskHashes[params.Hash] {
 				compatibleSuites = append(compatibleSuites, suite)
 			}
 		}
 		ch.CipherSuites = compatibleSuites
 
-		// TODO(ekr@rtfm.com): Check that the ticket can be used for early
-		// data.
-		// Signal early data if we're going to do it
-		if state.Config.AllowEarlyData && state.helloRetryRequest == nil {
+		// Signal early data if we're going to do it.  Early data is always
+		// protected under the first PSK offered, so that PSK has to allow it,
+		// and it isn't sent if the server might pick TLS 1.2 instead.
+		canSendEarlyData := offeredPSKs[0].MaxEarlyDataSize > 0
+		if state.Config.AllowEarlyData && canSendEarlyData && state.helloRetryRequest == nil && !offerTLS12 {
 			state.Params.ClientSendingEarlyData = true
 			ed = &EarlyDataExtension{}
 			err = ch.Extensions.Add(ed)
@@ -201,51 +397,42 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		}
 
 		// Add the shim PSK extension to the ClientHello
-		logf(logTypeHandshake, "Adding PSK extension with id = %x", key.Identity)
-		psk = &PreSharedKeyExtension{
-			HandshakeType: HandshakeTypeClientHello,
-			Identities: []PSKIdentity{
-				{
-					Identity:            key.Identity,
-					ObfuscatedTicketAge: uint32(time.Since(key.ReceivedAt)/time.Millisecond) + key.TicketAgeAdd,
-				},
-			},
-			Binders: []PSKBinderEntry{
-				// Note: Stub to get the length fields right
-				{Binder: bytes.Repeat([]byte{0x00}, params.Hash.Size())},
-			},
+		psk = &PreSharedKeyExtension{HandshakeType: HandshakeTypeClientHello}
+		for _, key := range offeredPSKs {
+			logf(logTypeHandshake, "Adding PSK extension with id = %x", key.Identity)
+			psk.Identities = append(psk.Identities, PSKIdentity{
+				Identity:            key.Identity,
+				ObfuscatedTicketAge: uint32(time.Since(key.ReceivedAt)/time.Millisecond) + key.TicketAgeAdd,
+			})
+
+			// Note: Stub to get the length fields right
+			hashSize := cipherSuiteMap[key.CipherSuite].Hash.Size()
+			psk.Binders = append(psk.Binders, PSKBinderEntry{Binder: bytes.Repeat([]byte{0x00}, hashSize)})
 		}
 		ch.Extensions.Add(psk)
 
-		// Compute the binder key
-		h0 := params.Hash.New().Sum(nil)
-		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
-
-		earlyHash = params.Hash
-		earlySecret = HkdfExtract(params.Hash, zero, key.Key)
-		logf(logTypeCrypto, "early secret: [%d] %x", len(earlySecret), earlySecret)
-
-		binderLabel := labelExternalBinder
-		if key.IsResumption {
-			binderLabel = labelResumptionBinder
-		}
-		binderKey := deriveSecret(params, earlySecret, binderLabel, h0)
-		logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
-
-		// Compute the binder value
+		// Compute the binder values, each with its own PSK's hash
 		trunc, err := ch.Truncated()
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateStart] Error marshaling truncated ClientHello [%v]", err)
 			return nil, nil, AlertInternalError
 		}
 
-		truncHash := params.Hash.New()
-		truncHash.Write(trunc)
+		for i, key := range offeredPSKs {
+			params := cipherSuiteMap[key.CipherSuite]
+			earlySecret := pskEarlySecret(params, key)
+			logf(logTypeCrypto, "early secret: [%d] %x", len(earlySecret), earlySecret)
 
-		binder := computeFinishedData(params, binderKey, truncHash.Sum(nil))
+			h0 := params.Hash.New().Sum(nil)
+			binderKey := deriveSecret(params, earlySecret, key.binderLabel(), h0)
+			logf(logTypeCrypto, "binder key: [%d] %x", len(binderKey), binderKey)
+
+			truncHash := params.Hash.New()
+			truncHash.Write(trunc)
+			psk.Binders[i].Binder = computeFinishedData(params, binderKey, truncHash.Sum(nil))
+		}
 
 		// Replace the PSK extension
-		psk.Binders[0].Binder = binder
 		ch.Extensions.Add(psk)
 
 		// If we got here, the earlier marshal succeeded (in ch.Truncated()), so
@@ -253,11 +440,12 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		clientHello, _ = state.hsCtx.hOut.HandshakeMessageFromBody(ch)
 
 		// Compute early traffic keys
+		params := cipherSuiteMap[offeredPSKs[0].CipherSuite]
 		h := params.Hash.New()
 		h.Write(clientHello.Marshal())
 		chHash := h.Sum(nil)
 
-		earlyTrafficSecret := deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
+		earlyTrafficSecret := deriveSecret(params, pskEarlySecret(params, offeredPSKs[0]), labelEarlyTrafficSecret, chHash)
 		logf(logTypeCrypto, "early traffic secret: [%d] %x", len(earlyTrafficSecret), earlyTrafficSecret)
 		clientEarlyTrafficKeys = makeTrafficKeys(params, earlyTrafficSecret)
 	} else {
@@ -268,29 +456,57 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		}
 	}
 
+	// Wrap the ClientHello we built in a ClientHelloOuter
+	if ech != nil {
+		outer, err := sealClientHelloOuter(ch, state.Opts.ServerName, ech)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error encrypting ClientHelloInner [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		ech.innerRandom = ch.Random[:]
+		ech.innerClientHello = clientHello
+		clientHello, err = state.hsCtx.hOut.HandshakeMessageFromBody(outer)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateStart] Error marshaling ClientHelloOuter [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
 	logf(logTypeHandshake, "[ClientStateStart] -> [ClientStateWaitSH]")
 	state.hsCtx.SetVersion(tls12Version) // Everything after this should be 1.2.
 	nextState := clientStateWaitSH{
-		Config:     state.Config,
-		Opts:       state.Opts,
-		Params:     state.Params,
-		hsCtx:      state.hsCtx,
-		OfferedDH:  offeredDH,
-		OfferedPSK: offeredPSK,
-
-		earlySecret: earlySecret,
-		earlyHash:   earlyHash,
-
+		Config:      state.Config,
+		Opts:        state.Opts,
+		Params:      state.Params,
+		hsCtx:       state.hsCtx,
+		OfferedDH:   offeredDH,
+		OfferedPSKs: offeredPSKs,
+
+		offeredVersions:   offeredVersions,
+		clientRandom:      ch.Random,
+		legacySessionID:   ch.LegacySessionID,
+		grease:            grease,
 		firstClientHello:  state.firstClientHello,
 		helloRetryRequest: state.helloRetryRequest,
 		clientHello:       clientHello,
+
+		ech:                   ech,
+		firstInnerClientHello: state.firstInnerClientHello,
 	}
 
-	toSend := []HandshakeAction{
+	// The ChangeCipherSpec goes before the second ClientHello, or right after
+	// the first one if early data follows it
+	toSend := []HandshakeAction{}
+	if state.helloRetryRequest != nil {
+		toSend = append(toSend, state.hsCtx.compatibilityCCS()...)
+	}
+	toSend = append(toSend, []HandshakeAction{
 		QueueHandshakeMessage{clientHello},
 		SendQueuedHandshake{},
-	}
+	}...)
 	if state.Params.ClientSendingEarlyData {
+		toSend = append(toSend, state.hsCtx.compatibilityCCS()...)
 		toSend = append(toSend, []HandshakeAction{
 			RekeyOut{epoch: EpochEarlyData, KeySet: clientEarlyTrafficKeys},
 		}...)
@@ -300,20 +516,24 @@ func (state clientStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 }
 
 type clientStateWaitSH struct {
-	Config     *Config
-	Opts       ConnectionOptions
-	Params     ConnectionParameters
-	hsCtx      *HandshakeContext
-	OfferedDH  map[NamedGroup][]byte
-	OfferedPSK PreSharedKey
-	PSK        []byte
-
-	earlySecret []byte
-	earlyHash   crypto.Hash
-
+	Config      *Config
+	Opts        ConnectionOptions
+	Params      ConnectionParameters
+	hsCtx       *HandshakeContext
+	OfferedDH   map[NamedGroup][]byte
+	OfferedPSKs []PreSharedKey
+	PSK         []byte
+
+	offeredVersions   []uint16
+	clientRandom      [32]byte
+	legacySessionID   []byte
+	grease            *greaseValues
 	firstClientHello  *HandshakeMessage
 	helloRetryRequest *HandshakeMessage
 	clientHello       *HandshakeMessage
+
+	ech                   *echOffer
+	firstInnerClientHello *HandshakeMessage
 }
 
 var _ HandshakeState = &clientStateWaitSH{}
@@ -354,22 +574,33 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 		return nil, nil, AlertDecodeError
 	}
 	if !foundSupportedVersions {
+		// A TLS 1.2 ServerHello can't follow a HelloRetryRequest
+		tls12 := versionListContains(state.offeredVersions, tls12Version)
+		if tls12 && state.helloRetryRequest == nil && sh.Random != hrrRandomSentinel {
+			return state.negotiateTLS12(hm, sh)
+		}
+
 		logf(logTypeHandshake, "[ClientStateWaitSH] no supported_versions extension")
 		return nil, nil, AlertMissingExtension
 	}
-	if supportedVersions.Versions[0] != tls13Version {
+	if supportedVersions.Versions[0] != tls13Version || !versionListContains(state.offeredVersions, tls13Version) {
 		logf(logTypeHandshake, "[ClientStateWaitSH] unsupported version [%x]", supportedVersions.Versions[0])
 		return nil, nil, AlertProtocolVersion
 	}
 	// 3. Check that the server provided a supported ciphersuite
 	supportedCipherSuite := false
-	for _, suite := range state.Config.CipherSuites {
+	for _, suite := range state.Config.cipherSuitesFor(tls13Version) {
 		supportedCipherSuite = supportedCipherSuite || (suite == sh.CipherSuite)
 	}
 	if !supportedCipherSuite {
 		logf(logTypeHandshake, "[ClientStateWaitSH] Unsupported ciphersuite [%04x]", sh.CipherSuite)
 		return nil, nil, AlertHandshakeFailure
 	}
+	// 4. Check that the server echoed our session ID
+	if !bytes.Equal(sh.LegacySessionID, state.legacySessionID) {
+		logf(logTypeHandshake, "[ClientStateWaitSH] Session ID not echoed [%x]", sh.LegacySessionID)
+		return nil, nil, AlertIllegalParameter
+	}
 
 	// Now check for the sentinel.
 
@@ -391,14 +622,28 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 
 		// The only thing we know how to respond to in an HRR is the Cookie
 		// extension, so if there is either no Cookie extension or anything other
-		// than a Cookie extension and SupportedVersions we have to fail.
+		// than a Cookie extension, SupportedVersions and an ECH confirmation we
+		// have to fail.
 		serverCookie := new(CookieExtension)
 		foundCookie, err := hrr.Extensions.Find(serverCookie)
 		if err != nil {
 			logf(logTypeHandshake, "[ClientStateWaitSH] Invalid server cookie extension [%v]", err)
 			return nil, nil, AlertDecodeError
 		}
-		if !foundCookie || len(hrr.Extensions) != 2 {
+		hrrECH := &ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+		foundECH := false
+		if state.ech != nil {
+			foundECH, err = hrr.Extensions.Find(hrrECH)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Invalid encrypted_client_hello extension [%v]", err)
+				return nil, nil, AlertDecodeError
+			}
+		}
+		expectedExts := 2
+		if foundECH {
+			expectedExts = 3
+		}
+		if !foundCookie || len(hrr.Extensions) != expectedExts {
 			logf(logTypeHandshake, "[ClientStateWaitSH] No Cookie or extra extensions [%v] [%d]", foundCookie, len(hrr.Extensions))
 			return nil, nil, AlertIllegalParameter
 		}
@@ -413,6 +658,34 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 			body:    h.Sum(nil),
 		}
 
+		// Keep both transcripts, and check whether the server confirmed that
+		// it is following the ClientHelloInner
+		var ech *echOffer
+		var firstInnerClientHello *HandshakeMessage
+		if state.ech != nil {
+			h := params.Hash.New()
+			h.Write(state.ech.innerClientHello.Marshal())
+			firstInnerClientHello = &HandshakeMessage{
+				msgType: HandshakeTypeMessageHash,
+				body:    h.Sum(nil),
+			}
+
+			retried := *state.ech
+			retried.retried = true
+			if foundECH {
+				zeroed, err := zeroECHHRRConfirmation(hm, hrr)
+				if err != nil {
+					logf(logTypeHandshake, "[ClientStateWaitSH] Error marshaling HelloRetryRequest [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+				confirmation := echAcceptConfirmation(params, echHRRAcceptConfirmationLabel, state.ech.innerRandom,
+					firstInnerClientHello, zeroed)
+				retried.hrrAccepted = bytes.Equal(hrrECH.Confirmation, confirmation)
+			}
+			logf(logTypeHandshake, "[ClientStateWaitSH] Server accepted ECH in HelloRetryRequest: %v", retried.hrrAccepted)
+			ech = &retried
+		}
+
 		state.hsCtx.receivedEndOfFlight()
 
 		// TODO(ekr@rtfm.com): Need to rekey with cleartext if we are on 0-RTT
@@ -425,8 +698,13 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 			Opts:              state.Opts,
 			hsCtx:             state.hsCtx,
 			cookie:            serverCookie.Cookie,
+			legacySessionID:   state.legacySessionID,
+			grease:            state.grease,
 			firstClientHello:  firstClientHello,
 			helloRetryRequest: hm,
+
+			ech:                   ech,
+			firstInnerClientHello: firstInnerClientHello,
 		}, []HandshakeAction{ResetOut{1}}, AlertNoAlert
 	}
 
@@ -454,8 +732,19 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 		return nil, nil, AlertDecodeError
 	}
 
-	if foundExts[ExtensionTypePreSharedKey] && (serverPSK.SelectedIdentity == 0) {
+	var selectedPSK *PreSharedKey
+	if foundExts[ExtensionTypePreSharedKey] {
+		if int(serverPSK.SelectedIdentity) >= len(state.OfferedPSKs) {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Server selected a PSK we didn't offer [%d]", serverPSK.SelectedIdentity)
+			return nil, nil, AlertIllegalParameter
+		}
 		state.Params.UsingPSK = true
+		selectedPSK = &state.OfferedPSKs[serverPSK.SelectedIdentity]
+
+		// A ticket is only used once
+		if remover, ok := state.Config.ClientSessionCache.(ClientSessionRemover); ok && selectedPSK.IsResumption {
+			remover.Remove(state.Opts.SessionCacheKey, selectedPSK.Identity)
+		}
 	}
 
 	var dhSecret []byte
@@ -472,6 +761,7 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 	}
 
 	suite := sh.CipherSuite
+	state.Params.Version = tls13Version
 	state.Params.CipherSuite = suite
 
 	params, ok := cipherSuiteMap[suite]
@@ -480,6 +770,37 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 		return nil, nil, AlertHandshakeFailure
 	}
 
+	// If we offered ECH, the server random tells us whether the server is
+	// following the ClientHelloInner or the ClientHelloOuter
+	if state.ech != nil {
+		confirmation := echAcceptConfirmation(params, echAcceptConfirmationLabel, state.ech.innerRandom,
+			state.firstInnerClientHello, state.helloRetryRequest, state.ech.innerClientHello, zeroECHAcceptConfirmation(hm))
+		accepted := bytes.Equal(sh.Random[len(sh.Random)-echAcceptConfirmationLen:], confirmation)
+
+		// The server has to stick with what it told us in the HelloRetryRequest
+		if state.ech.retried && accepted != state.ech.hrrAccepted {
+			logf(logTypeHandshake, "[ClientStateWaitSH] ECH acceptance changed after HelloRetryRequest")
+			return nil, nil, AlertIllegalParameter
+		}
+
+		if accepted {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Server accepted ECH")
+			state.Params.UsingECH = true
+			state.firstClientHello = state.firstInnerClientHello
+			state.clientHello = state.ech.innerClientHello
+		} else {
+			// The server must authenticate as the public name, and can't have
+			// used the PSK that we only offered in the ClientHelloInner
+			logf(logTypeHandshake, "[ClientStateWaitSH] Server rejected ECH")
+			state.Params.RejectedECH = true
+			state.Params.ServerName = state.ech.config.PublicName
+			if state.Params.UsingPSK {
+				logf(logTypeHandshake, "[ClientStateWaitSH] Server selected a PSK after rejecting ECH")
+				return nil, nil, AlertIllegalParameter
+			}
+		}
+	}
+
 	// Start up the handshake hash
 	handshakeHash := params.Hash.New()
 	handshakeHash.Write(state.firstClientHello.Marshal())
@@ -492,12 +813,15 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 
 	var earlySecret []byte
 	if state.Params.UsingPSK {
-		if params.Hash != state.earlyHash {
-			logf(logTypeCrypto, "Change of hash between early and normal init early=[%02x] suite=[%04x] hash=[%02x]",
-				state.earlyHash, suite, params.Hash)
+		// The server must pick a ciphersuite with the selected PSK's hash
+		pskHash := cipherSuiteMap[selectedPSK.CipherSuite].Hash
+		if params.Hash != pskHash {
+			logf(logTypeHandshake, "[ClientStateWaitSH] Ciphersuite hash does not match PSK suite=[%04x] hash=[%02x]",
+				suite, pskHash)
+			return nil, nil, AlertIllegalParameter
 		}
 
-		earlySecret = state.earlySecret
+		earlySecret = pskEarlySecret(params, *selectedPSK)
 	} else {
 		earlySecret = HkdfExtract(params.Hash, zero, zero)
 	}
@@ -532,6 +856,8 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 		masterSecret:                 masterSecret,
 		clientHandshakeTrafficSecret: clientHandshakeTrafficSecret,
 		serverHandshakeTrafficSecret: serverHandshakeTrafficSecret,
+		selectedPSK:                  selectedPSK,
+		selectedIdentity:             serverPSK.SelectedIdentity,
 	}
 	toSend := []HandshakeAction{
 		RekeyIn{epoch: EpochHandshakeData, KeySet: serverHandshakeKeys},
@@ -539,6 +865,7 @@ func (state clientStateWaitSH) Next(hr handshakeMessageReader) (HandshakeState,
 	// We're definitely not going to have to send anything with
 	// early data.
 	if !state.Params.ClientSendingEarlyData {
+		toSend = append(toSend, state.hsCtx.compatibilityCCS()...)
 		toSend = append(toSend, RekeyOut{epoch: EpochHandshakeData,
 			KeySet: makeTrafficKeys(params, clientHandshakeTrafficSecret)})
 	}
@@ -555,6 +882,8 @@ type clientStateWaitEE struct {
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
 	serverHandshakeTrafficSecret []byte
+	selectedPSK                  *PreSharedKey
+	selectedIdentity             uint16
 }
 
 var _ HandshakeState = &clientStateWaitEE{}
@@ -590,18 +919,57 @@ func (state clientStateWaitEE) Next(hr handshakeMessageReader) (HandshakeState,
 
 	serverALPN := &ALPNExtension{}
 	serverEarlyData := &EarlyDataExtension{}
+	clientCertType := &ClientCertTypeExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
+	serverCertType := &ServerCertTypeExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
+	serverECH := &ECHExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
 
 	foundExts, err := ee.Extensions.Parse(
 		[]ExtensionBody{
 			serverALPN,
 			serverEarlyData,
+			clientCertType,
+			serverCertType,
+			serverECH,
 		})
 	if err != nil {
 		logf(logTypeHandshake, "[ClientStateWaitEE] Error decoding extensions: %v", err)
 		return nil, nil, AlertDecodeError
 	}
 
+	// The server may only select certificate types that we offered
+	if foundExts[ExtensionTypeServerCertType] {
+		state.Params.ServerCertificateType = serverCertType.CertificateTypes[0]
+		if !certTypeListContains(state.Config.serverCertTypes(), state.Params.ServerCertificateType) {
+			logf(logTypeHandshake, "[ClientStateWaitEE] Server selected unoffered certificate type [%d]", state.Params.ServerCertificateType)
+			return nil, nil, AlertIllegalParameter
+		}
+	}
+	if foundExts[ExtensionTypeClientCertType] {
+		state.Params.ClientCertificateType = clientCertType.CertificateTypes[0]
+		if !certTypeListContains(state.Config.clientCertTypes(), state.Params.ClientCertificateType) {
+			logf(logTypeHandshake, "[ClientStateWaitEE] Server selected unoffered certificate type [%d]", state.Params.ClientCertificateType)
+			return nil, nil, AlertIllegalParameter
+		}
+	}
+
+	// Retry configs are only sent by a server rejecting ECH
+	if foundExts[ExtensionTypeECH] {
+		if !state.Params.RejectedECH {
+			logf(logTypeHandshake, "[ClientStateWaitEE] Unexpected ECH retry configs")
+			return nil, nil, AlertUnsupportedExtension
+		}
+		state.Params.ECHRetryConfigs = serverECH.RetryConfigs
+	}
+
+	// Early data is only ever sent under the first PSK we offered, so the
+	// server can only accept it if it selected that one
+	if foundExts[ExtensionTypeEarlyData] && (!state.Params.UsingPSK || state.selectedIdentity != 0) {
+		logf(logTypeHandshake, "[ClientStateWaitEE] Server accepted early data without selecting the first PSK")
+		return nil, nil, AlertIllegalParameter
+	}
+
 	state.Params.UsingEarlyData = foundExts[ExtensionTypeEarlyData]
+	state.Params.RejectedEarlyData = state.Params.ClientSendingEarlyData && !state.Params.UsingEarlyData
 
 	if foundExts[ExtensionTypeALPN] && len(serverALPN.Protocols) > 0 {
 		state.Params.NextProto = serverALPN.Protocols[0]
@@ -618,13 +986,17 @@ func (state clientStateWaitEE) Next(hr handshakeMessageReader) (HandshakeState,
 	}
 
 	if state.Params.UsingPSK {
+		// The server authenticated in the handshake that issued the ticket
 		logf(logTypeHandshake, "[ClientStateWaitEE] -> [ClientStateWaitFinished]")
 		nextState := clientStateWaitFinished{
 			Params:                       state.Params,
 			hsCtx:                        state.hsCtx,
 			cryptoParams:                 state.cryptoParams,
 			handshakeHash:                state.handshakeHash,
-			certificates:                 state.Config.Certificates,
+			Config:                       state.Config,
+			peerCertificates:             state.selectedPSK.PeerCertificates,
+			verifiedChains:               state.selectedPSK.VerifiedChains,
+			peerPublicKey:                state.selectedPSK.PeerPublicKey,
 			masterSecret:                 state.masterSecret,
 			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
 			serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
@@ -673,10 +1045,23 @@ func (state clientStateWaitCertCR) Next(hr handshakeMessageReader) (HandshakeSta
 		return nil, nil, AlertUnexpectedMessage
 	}
 
-	bodyGeneric, err := hm.ToBody()
-	if err != nil {
-		logf(logTypeHandshake, "[ClientStateWaitCertCR] Error decoding message: %v", err)
-		return nil, nil, AlertDecodeError
+	// The type of certificate was negotiated in EncryptedExtensions, so the
+	// Certificate message can't be decoded without context
+	var bodyGeneric HandshakeMessageBody
+	if hm.msgType == HandshakeTypeCertificate || hm.msgType == HandshakeTypeCompressedCertificate {
+		cert, alert := readCertificateMessage(hm, state.Params.ServerCertificateType, state.Config.CertificateCompressors)
+		if alert != AlertNoAlert {
+			logf(logTypeHandshake, "[ClientStateWaitCertCR] Error reading certificate")
+			return nil, nil, alert
+		}
+		bodyGeneric = cert
+	} else {
+		var err error
+		bodyGeneric, err = hm.ToBody()
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCertCR] Error decoding message: %v", err)
+			return nil, nil, AlertDecodeError
+		}
 	}
 
 	state.handshakeHash.Write(hm.Marshal())
@@ -700,7 +1085,7 @@ func (state clientStateWaitCertCR) Next(hr handshakeMessageReader) (HandshakeSta
 	case *CertificateRequestBody:
 		// A certificate request in the handshake should have a zero-length context
 		if len(body.CertificateRequestContext) > 0 {
-			logf(logTypeHandshake, "[ClientStateWaitCertCR] Certificate request with non-empty context: %v", err)
+			logf(logTypeHandshake, "[ClientStateWaitCertCR] Certificate request with non-empty context")
 			return nil, nil, AlertIllegalParameter
 		}
 
@@ -749,15 +1134,15 @@ func (state clientStateWaitCert) Next(hr handshakeMessageReader) (HandshakeState
 	if alert != AlertNoAlert {
 		return nil, nil, alert
 	}
-	if hm == nil || hm.msgType != HandshakeTypeCertificate {
+	if hm == nil || (hm.msgType != HandshakeTypeCertificate && hm.msgType != HandshakeTypeCompressedCertificate) {
 		logf(logTypeHandshake, "[ClientStateWaitCert] Unexpected message")
 		return nil, nil, AlertUnexpectedMessage
 	}
 
-	cert := &CertificateBody{}
-	if err := safeUnmarshal(cert, hm.body); err != nil {
-		logf(logTypeHandshake, "[ClientStateWaitCert] Error decoding message: %v", err)
-		return nil, nil, AlertDecodeError
+	cert, alert := readCertificateMessage(hm, state.Params.ServerCertificateType, state.Config.CertificateCompressors)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "[ClientStateWaitCert] Error reading certificate")
+		return nil, nil, alert
 	}
 
 	state.handshakeHash.Write(hm.Marshal())
@@ -818,25 +1203,133 @@ func (state clientStateWaitCV) Next(hr handshakeMessageReader) (HandshakeState,
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
+	// A raw public key is authenticated by matching one of the pinned keys,
+	// in place of building a chain
+	if state.Params.ServerCertificateType == CertificateTypeRawPublicKey {
+		serverPublicKey, err := verifyPinnedPublicKey(state.serverCertificate.CertificateList[0].RawPublicKey, state.Config.PeerPublicKeys)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Raw public key verification failed: %s", err)
+			return nil, nil, AlertBadCertificate
+		}
+
+		if err := certVerify.Verify(serverPublicKey, hcv); err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Server signature failed to verify")
+			return nil, nil, AlertHandshakeFailure
+		}
+
+		state.handshakeHash.Write(hm.Marshal())
+
+		logf(logTypeHandshake, "[ClientStateWaitCV] -> [ClientStateWaitFinished]")
+		nextState := clientStateWaitFinished{
+			Params:                       state.Params,
+			hsCtx:                        state.hsCtx,
+			cryptoParams:                 state.cryptoParams,
+			handshakeHash:                state.handshakeHash,
+			Config:                       state.Config,
+			serverCertificateRequest:     state.serverCertificateRequest,
+			masterSecret:                 state.masterSecret,
+			clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
+			serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+			peerPublicKey:                serverPublicKey,
+		}
+		return nextState, nil, AlertNoAlert
+	}
+
 	serverPublicKey := state.serverCertificate.CertificateList[0].CertData.PublicKey
+
+	// If the server sent a delegated credential, it signs with that instead
+	// of the key of its certificate
+	var delegatedCredential *DelegatedCredential
+	dc := DelegatedCredentialExtension{HandshakeType: HandshakeTypeCertificate}
+	gotDC, err := state.serverCertificate.CertificateList[0].Extensions.Find(&dc)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitCV] Error decoding delegated_credential extension: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+	if gotDC {
+		if !state.Config.AcceptDelegatedCredentials {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Unsolicited delegated credential")
+			return nil, nil, AlertUnsupportedExtension
+		}
+
+		leaf := state.serverCertificate.CertificateList[0].CertData
+		serverPublicKey, err = dc.Credential.verify(leaf, state.Config.time(), state.Config.SignatureSchemes)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitCV] Invalid delegated credential: %v", err)
+			return nil, nil, AlertIllegalParameter
+		}
+		if certVerify.Algorithm != dc.Credential.CertVerifyAlgorithm {
+			logf(logTypeHandshake, "[ClientStateWaitCV] CertificateVerify algorithm does not match delegated credential")
+			return nil, nil, AlertIllegalParameter
+		}
+		delegatedCredential = &dc.Credential
+	}
+
 	if err := certVerify.Verify(serverPublicKey, hcv); err != nil {
 		logf(logTypeHandshake, "[ClientStateWaitCV] Server signature failed to verify")
 		return nil, nil, AlertHandshakeFailure
 	}
 
 	certs := make([]*x509.Certificate, len(state.serverCertificate.CertificateList))
-	rawCerts := make([][]byte, len(state.serverCertificate.CertificateList))
 	for i, certEntry := range state.serverCertificate.CertificateList {
 		certs[i] = certEntry.CertData
-		rawCerts[i] = certEntry.CertData.Raw
+	}
+
+	ocspStatus := StatusRequestExtension{HandshakeType: HandshakeTypeCertificate}
+	_, err = state.serverCertificate.CertificateList[0].Extensions.Find(&ocspStatus)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitCV] Error decoding status_request extension: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	scts := SCTExtension{HandshakeType: HandshakeTypeCertificate}
+	_, err = state.serverCertificate.CertificateList[0].Extensions.Find(&scts)
+	if err != nil {
+		logf(logTypeHandshake, "[ClientStateWaitCV] Error decoding signed_certificate_timestamp extension: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	verifiedChains, alert := verifyServerCertificates(state.Config, state.Params.ServerName, certs, ocspStatus.OCSPResponse, scts.SCTs)
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+
+	state.handshakeHash.Write(hm.Marshal())
+
+	logf(logTypeHandshake, "[ClientStateWaitCV] -> [ClientStateWaitFinished]")
+	nextState := clientStateWaitFinished{
+		Params:                       state.Params,
+		hsCtx:                        state.hsCtx,
+		cryptoParams:                 state.cryptoParams,
+		handshakeHash:                state.handshakeHash,
+		Config:                       state.Config,
+		serverCertificateRequest:     state.serverCertificateRequest,
+		masterSecret:                 state.masterSecret,
+		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
+		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
+		peerCertificates:             certs,
+		verifiedChains:               verifiedChains,
+		ocspResponse:                 ocspStatus.OCSPResponse,
+		signedCertificateTimestamps:  scts.SCTs,
+		delegatedCredential:          delegatedCredential,
+	}
+	return nextState, nil, AlertNoAlert
+}
+
+// Verifies the server's certificate chain, along with the OCSP response and
+// SCTs that came with it, as the Config requires
+func verifyServerCertificates(config *Config, serverName string, certs []*x509.Certificate, ocspResponse []byte, scts [][]byte) ([][]*x509.Certificate, Alert) {
+	rawCerts := make([][]byte, len(certs))
+	for i, cert := range certs {
+		rawCerts[i] = cert.Raw
 	}
 
 	var verifiedChains [][]*x509.Certificate
-	if !state.Config.InsecureSkipVerify {
+	if !config.InsecureSkipVerify {
 		opts := x509.VerifyOptions{
-			Roots:         state.Config.RootCAs,
-			CurrentTime:   state.Config.time(),
-			DNSName:       state.Config.ServerName,
+			Roots:         config.RootCAs,
+			CurrentTime:   config.time(),
+			DNSName:       serverName,
 			Intermediates: x509.NewCertPool(),
 		}
 
@@ -849,47 +1342,50 @@ func (state clientStateWaitCV) Next(hr handshakeMessageReader) (HandshakeState,
 		var err error
 		verifiedChains, err = certs[0].Verify(opts)
 		if err != nil {
-			logf(logTypeHandshake, "[ClientStateWaitCV] Certificate verification failed: %s", err)
-			return nil, nil, AlertBadCertificate
+			logf(logTypeHandshake, "Certificate verification failed: %s", err)
+			return nil, AlertBadCertificate
 		}
 	}
 
-	if state.Config.VerifyPeerCertificate != nil {
-		if err := state.Config.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
-			logf(logTypeHandshake, "[ClientStateWaitCV] Application rejected server certificate: %s", err)
-			return nil, nil, AlertBadCertificate
+	if config.VerifyPeerCertificate != nil {
+		if err := config.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+			logf(logTypeHandshake, "Application rejected server certificate: %s", err)
+			return nil, AlertBadCertificate
 		}
 	}
 
-	state.handshakeHash.Write(hm.Marshal())
+	if config.VerifyOCSPResponse != nil {
+		if err := config.VerifyOCSPResponse(ocspResponse, certs); err != nil {
+			logf(logTypeHandshake, "Application rejected OCSP response: %s", err)
+			return nil, AlertBadCertificateStatsResponse
+		}
+	}
 
-	logf(logTypeHandshake, "[ClientStateWaitCV] -> [ClientStateWaitFinished]")
-	nextState := clientStateWaitFinished{
-		Params:                       state.Params,
-		hsCtx:                        state.hsCtx,
-		cryptoParams:                 state.cryptoParams,
-		handshakeHash:                state.handshakeHash,
-		certificates:                 state.Config.Certificates,
-		serverCertificateRequest:     state.serverCertificateRequest,
-		masterSecret:                 state.masterSecret,
-		clientHandshakeTrafficSecret: state.clientHandshakeTrafficSecret,
-		serverHandshakeTrafficSecret: state.serverHandshakeTrafficSecret,
-		peerCertificates:             certs,
-		verifiedChains:               verifiedChains,
+	if config.MinValidSCTs > 0 {
+		err := verifySCTs(scts, certs[0], config.CTLogKeys, config.MinValidSCTs)
+		if err != nil {
+			logf(logTypeHandshake, "Insufficient SCTs: %v", err)
+			return nil, AlertBadCertificate
+		}
 	}
-	return nextState, nil, AlertNoAlert
+
+	return verifiedChains, AlertNoAlert
 }
 
 type clientStateWaitFinished struct {
+	Config        *Config
 	Params        ConnectionParameters
 	hsCtx         *HandshakeContext
 	cryptoParams  CipherSuiteParams
 	handshakeHash hash.Hash
 
-	certificates             []*Certificate
-	serverCertificateRequest *CertificateRequestBody
-	peerCertificates         []*x509.Certificate
-	verifiedChains           [][]*x509.Certificate
+	serverCertificateRequest    *CertificateRequestBody
+	peerCertificates            []*x509.Certificate
+	verifiedChains              [][]*x509.Certificate
+	ocspResponse                []byte
+	signedCertificateTimestamps [][]byte
+	peerPublicKey               crypto.PublicKey
+	delegatedCredential         *DelegatedCredential
 
 	masterSecret                 []byte
 	clientHandshakeTrafficSecret []byte
@@ -983,13 +1479,68 @@ func (state clientStateWaitFinished) Next(hr handshakeMessageReader) (HandshakeS
 			return nil, nil, AlertIllegalParameter
 		}
 
-		// Select a certificate
-		cert, certScheme, err := CertificateSelection(nil, schemes.Algorithms, state.certificates)
+		oidFilters := OIDFiltersExtension{}
+		_, err = state.serverCertificateRequest.Extensions.Find(&oidFilters)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitFinished] WARNING invalid oid_filters extension [%v]", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		authorities := CertificateAuthoritiesExtension{}
+		gotAuthorities, err := state.serverCertificateRequest.Extensions.Find(&authorities)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitFinished] WARNING invalid certificate_authorities extension [%v]", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		certSchemes := SignatureAlgorithmsCertExtension{}
+		_, err = state.serverCertificateRequest.Extensions.Find(&certSchemes)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitFinished] WARNING invalid signature_algorithms_cert extension [%v]", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		compression := CompressCertificateExtension{}
+		_, err = state.serverCertificateRequest.Extensions.Find(&compression)
+		if err != nil {
+			logf(logTypeHandshake, "[ClientStateWaitFinished] WARNING invalid compress_certificate extension [%v]", err)
+			return nil, nil, AlertDecodeError
+		}
+
+		// Select a certificate, only offering ones the server will accept
+		candidates := certificatesOfType(state.Config.Certificates, state.Params.ClientCertificateType)
+		if gotAuthorities {
+			candidates = certificatesForAuthorities(candidates, authorities.Authorities)
+		}
+		if state.Params.RejectedECH {
+			// A server that rejected ECH doesn't get to see our certificate
+			candidates = nil
+		} else if state.Config.GetClientCertificate != nil {
+			info := &CertificateRequestInfo{
+				SignatureSchemes: schemes.Algorithms,
+				OIDFilters:       oidFilters.Filters,
+				AcceptableCAs:    authorities.Authorities,
+
+				CertificateSignatureSchemes: certSchemes.Algorithms,
+			}
+			cert, err := state.Config.GetClientCertificate(info)
+			if err != nil {
+				logf(logTypeHandshake, "[ClientStateWaitFinished] Error getting client certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+
+			candidates = nil
+			if cert != nil {
+				candidates = certificatesOfType([]*Certificate{cert}, state.Params.ClientCertificateType)
+			}
+		}
+
+		cert, certScheme, err := certificateSelection(nil, schemes.Algorithms, certSchemes.Algorithms, candidates)
 		if err != nil {
 			// XXX: Signal this to the application layer?
 			logf(logTypeHandshake, "[ClientStateWaitFinished] WARNING no appropriate certificate found [%v]", err)
 
-			certificate := &CertificateBody{}
+			certificate := &CertificateBody{CertificateType: state.Params.ClientCertificateType}
 			certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificate)
 			if err != nil {
 				logf(logTypeHandshake, "[ClientStateWaitFinished] Error marshaling Certificate [%v]", err)
@@ -1001,12 +1552,32 @@ func (state clientStateWaitFinished) Next(hr handshakeMessageReader) (HandshakeS
 		} else {
 			// Create and send Certificate, CertificateVerify
 			certificate := &CertificateBody{
+				CertificateType: state.Params.ClientCertificateType,
 				CertificateList: make([]CertificateEntry, len(cert.Chain)),
 			}
 			for i, entry := range cert.Chain {
 				certificate.CertificateList[i] = CertificateEntry{CertData: entry}
 			}
-			certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificate)
+			if cert.isRawPublicKey() {
+				rawPublicKey, err := cert.rawPublicKey()
+				if err != nil {
+					logf(logTypeHandshake, "[ClientStateWaitFinished] Error encoding raw public key [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+				certificate.CertificateList = []CertificateEntry{{RawPublicKey: rawPublicKey}}
+			}
+
+			// Compress the Certificate if the server supports one of our algorithms
+			var certificateBody HandshakeMessageBody = certificate
+			if compressor := selectCertificateCompressor(state.Config.CertificateCompressors, compression.Algorithms); compressor != nil {
+				certificateBody, err = compressCertificate(compressor, certificate)
+				if err != nil {
+					logf(logTypeHandshake, "[ClientStateWaitFinished] Error compressing Certificate [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+			}
+
+			certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificateBody)
 			if err != nil {
 				logf(logTypeHandshake, "[ClientStateWaitFinished] Error marshaling Certificate [%v]", err)
 				return nil, nil, AlertInternalError
@@ -1082,6 +1653,11 @@ func (state clientStateWaitFinished) Next(hr handshakeMessageReader) (HandshakeS
 		exporterSecret:      exporterSecret,
 		peerCertificates:    state.peerCertificates,
 		verifiedChains:      state.verifiedChains,
+		ocspResponse:        state.ocspResponse,
+		peerPublicKey:       state.peerPublicKey,
+		delegatedCredential: state.delegatedCredential,
+
+		signedCertificateTimestamps: state.signedCertificateTimestamps,
 	}
 	return nextState, toSend, AlertNoAlert
 }
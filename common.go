@@ -12,6 +12,13 @@ const (
 	dtls12WireVersion uint16 = 0xfefd
 )
 
+// Protocol versions that can be set as Config.MinVersion and
+// Config.MaxVersion
+const (
+	VersionTLS12 = tls12Version
+	VersionTLS13 = tls13Version
+)
+
 var (
 	// Flags for some minor compat issues
 	allowWrongVersionNumber = true
@@ -22,10 +29,11 @@ var (
 type RecordType byte
 
 const (
-	RecordTypeAlert           RecordType = 21
-	RecordTypeHandshake       RecordType = 22
-	RecordTypeApplicationData RecordType = 23
-	RecordTypeAck             RecordType = 25
+	RecordTypeChangeCipherSpec RecordType = 20
+	RecordTypeAlert            RecordType = 21
+	RecordTypeHandshake        RecordType = 22
+	RecordTypeApplicationData  RecordType = 23
+	RecordTypeAck              RecordType = 25
 )
 
 // enum {...} HandshakeType;
@@ -33,19 +41,25 @@ type HandshakeType byte
 
 const (
 	// Omitted: *_RESERVED
-	HandshakeTypeClientHello         HandshakeType = 1
-	HandshakeTypeServerHello         HandshakeType = 2
-	HandshakeTypeNewSessionTicket    HandshakeType = 4
-	HandshakeTypeEndOfEarlyData      HandshakeType = 5
-	HandshakeTypeHelloRetryRequest   HandshakeType = 6
-	HandshakeTypeEncryptedExtensions HandshakeType = 8
-	HandshakeTypeCertificate         HandshakeType = 11
-	HandshakeTypeCertificateRequest  HandshakeType = 13
-	HandshakeTypeCertificateVerify   HandshakeType = 15
-	HandshakeTypeServerConfiguration HandshakeType = 17
-	HandshakeTypeFinished            HandshakeType = 20
-	HandshakeTypeKeyUpdate           HandshakeType = 24
-	HandshakeTypeMessageHash         HandshakeType = 254
+	HandshakeTypeHelloRequest          HandshakeType = 0
+	HandshakeTypeClientHello           HandshakeType = 1
+	HandshakeTypeServerHello           HandshakeType = 2
+	HandshakeTypeNewSessionTicket      HandshakeType = 4
+	HandshakeTypeEndOfEarlyData        HandshakeType = 5
+	HandshakeTypeHelloRetryRequest     HandshakeType = 6
+	HandshakeTypeEncryptedExtensions   HandshakeType = 8
+	HandshakeTypeCertificate           HandshakeType = 11
+	HandshakeTypeServerKeyExchange     HandshakeType = 12
+	HandshakeTypeCertificateRequest    HandshakeType = 13
+	HandshakeTypeServerHelloDone       HandshakeType = 14
+	HandshakeTypeCertificateVerify     HandshakeType = 15
+	HandshakeTypeClientKeyExchange     HandshakeType = 16
+	HandshakeTypeServerConfiguration   HandshakeType = 17
+	HandshakeTypeFinished              HandshakeType = 20
+	HandshakeTypeCertificateStatus     HandshakeType = 22
+	HandshakeTypeKeyUpdate             HandshakeType = 24
+	HandshakeTypeCompressedCertificate HandshakeType = 25
+	HandshakeTypeMessageHash           HandshakeType = 254
 )
 
 var hrrRandomSentinel = [32]byte{
@@ -55,6 +69,12 @@ var hrrRandomSentinel = [32]byte{
 	0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
 }
 
+// The last eight bytes of ServerHello.Random when a server that supports
+// TLS 1.3 negotiates TLS 1.2 (RFC 8446, Section 4.1.3)
+var downgradeSentinelTLS12 = [8]byte{
+	0x44, 0x4f, 0x57, 0x4e, 0x47, 0x52, 0x44, 0x01,
+}
+
 // uint8 CipherSuite[2];
 type CipherSuite uint16
 
@@ -67,6 +87,12 @@ const (
 	TLS_CHACHA20_POLY1305_SHA256 CipherSuite = 0x1303
 	TLS_AES_128_CCM_SHA256       CipherSuite = 0x1304
 	TLS_AES_256_CCM_8_SHA256     CipherSuite = 0x1305
+
+	// TLS 1.2 suites, ECDHE with AEAD ciphers only
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 CipherSuite = 0xc02b
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 CipherSuite = 0xc02c
+	TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256   CipherSuite = 0xc02f
+	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384   CipherSuite = 0xc030
 )
 
 func (c CipherSuite) String() string {
@@ -83,6 +109,14 @@ func (c CipherSuite) String() string {
 		return "TLS_AES_128_CCM_SHA256"
 	case TLS_AES_256_CCM_8_SHA256:
 		return "TLS_AES_256_CCM_8_SHA256"
+	case TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256:
+		return "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"
+	case TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	case TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:
+		return "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	case TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		return "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"
 	}
 	// cannot use %x here, since it calls String(), leading to infinite recursion
 	return fmt.Sprintf("invalid CipherSuite value: 0x%s", strconv.FormatUint(uint64(c), 16))
@@ -114,17 +148,30 @@ const (
 type ExtensionType uint16
 
 const (
-	ExtensionTypeServerName          ExtensionType = 0
-	ExtensionTypeSupportedGroups     ExtensionType = 10
-	ExtensionTypeSignatureAlgorithms ExtensionType = 13
-	ExtensionTypeALPN                ExtensionType = 16
-	ExtensionTypeKeyShare            ExtensionType = 51
-	ExtensionTypePreSharedKey        ExtensionType = 41
-	ExtensionTypeEarlyData           ExtensionType = 42
-	ExtensionTypeSupportedVersions   ExtensionType = 43
-	ExtensionTypeCookie              ExtensionType = 44
-	ExtensionTypePSKKeyExchangeModes ExtensionType = 45
-	ExtensionTypeTicketEarlyDataInfo ExtensionType = 46
+	ExtensionTypeServerName           ExtensionType = 0
+	ExtensionTypeStatusRequest        ExtensionType = 5
+	ExtensionTypeSupportedGroups      ExtensionType = 10
+	ExtensionTypeECPointFormats       ExtensionType = 11
+	ExtensionTypeSignatureAlgorithms  ExtensionType = 13
+	ExtensionTypeALPN                 ExtensionType = 16
+	ExtensionTypeSCT                  ExtensionType = 18
+	ExtensionTypeClientCertType       ExtensionType = 19
+	ExtensionTypeServerCertType       ExtensionType = 20
+	ExtensionTypeExtendedMasterSecret ExtensionType = 23
+	ExtensionTypeCompressCertificate  ExtensionType = 27
+	ExtensionTypeDelegatedCredential  ExtensionType = 34
+	ExtensionTypeKeyShare             ExtensionType = 51
+	ExtensionTypePreSharedKey         ExtensionType = 41
+	ExtensionTypeEarlyData            ExtensionType = 42
+	ExtensionTypeSupportedVersions    ExtensionType = 43
+	ExtensionTypeCookie               ExtensionType = 44
+	ExtensionTypePSKKeyExchangeModes  ExtensionType = 45
+	ExtensionTypeTicketEarlyDataInfo  ExtensionType = 46
+	ExtensionTypeCertAuthorities      ExtensionType = 47
+	ExtensionTypeOIDFilters           ExtensionType = 48
+	ExtensionTypeSignatureAlgsCert    ExtensionType = 50
+	ExtensionTypeECH                  ExtensionType = 0xfe0d
+	ExtensionTypeRenegotiationInfo    ExtensionType = 0xff01
 )
 
 // enum {...} NamedGroup
@@ -154,6 +201,30 @@ const (
 	PSKModeDHEKE PSKKeyExchangeMode = 1
 )
 
+// enum { ocsp(1), (255) } CertificateStatusType;
+type CertificateStatusType uint8
+
+const (
+	CertificateStatusTypeOCSP CertificateStatusType = 1
+)
+
+// enum { zlib(1), brotli(2), zstd(3), (65535) } CertificateCompressionAlgorithm;
+type CertificateCompressionAlgorithm uint16
+
+const (
+	CertificateCompressionZlib   CertificateCompressionAlgorithm = 1
+	CertificateCompressionBrotli CertificateCompressionAlgorithm = 2
+	CertificateCompressionZstd   CertificateCompressionAlgorithm = 3
+)
+
+// enum { X509(0), RawPublicKey(2), (255) } CertificateType;
+type CertificateType uint8
+
+const (
+	CertificateTypeX509         CertificateType = 0
+	CertificateTypeRawPublicKey CertificateType = 2
+)
+
 // enum {
 //     update_not_requested(0), update_requested(1), (255)
 // } KeyUpdateRequest;
@@ -177,6 +248,8 @@ const (
 	StateClientWaitCV
 	StateClientWaitFinished
 	StateClientWaitCertCR
+	StateClientWaitSKE
+	StateClientWaitSHD
 	StateClientConnected
 	// states valid for the server
 	StateServerStart State = iota
@@ -187,6 +260,7 @@ const (
 	StateServerWaitFlight2
 	StateServerWaitCert
 	StateServerWaitCV
+	StateServerWaitCKE
 	StateServerWaitFinished
 	StateServerConnected
 )
@@ -207,6 +281,10 @@ func (s State) String() string {
 		return "Client WAIT_FINISHED"
 	case StateClientWaitCertCR:
 		return "Client WAIT_CERT_CR"
+	case StateClientWaitSKE:
+		return "Client WAIT_SKE"
+	case StateClientWaitSHD:
+		return "Client WAIT_SHD"
 	case StateClientConnected:
 		return "Client CONNECTED"
 	case StateServerStart:
@@ -225,6 +303,8 @@ func (s State) String() string {
 		return "Server WAIT_CERT"
 	case StateServerWaitCV:
 		return "Server WAIT_CV"
+	case StateServerWaitCKE:
+		return "Server WAIT_CKE"
 	case StateServerWaitFinished:
 		return "Server WAIT_FINISHED"
 	case StateServerConnected:
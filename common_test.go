@@ -2,12 +2,18 @@ package mint
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
 	"fmt"
+	"math/big"
+	"net"
 	"reflect"
 	"runtime"
 	"sort"
 	"testing"
+	"time"
 )
 
 func unhex(h string) []byte {
@@ -142,3 +148,65 @@ func runParametrizedTest(t *testing.T, inparams map[string][]string, f parametri
 
 	runParametrizedInner(t, "", make(map[string]string), inparams, il, f)
 }
+
+// testCertOptions describes a certificate made by newTestCertificate.  The
+// zero value gives a self-signed ECDSA P-256 certificate valid for an hour.
+type testCertOptions struct {
+	Alg        SignatureScheme // The type of key, as a scheme it signs with
+	CommonName string          // "test" if empty
+	DNSNames   []string
+	IPs        []net.IP
+	IsCA       bool
+	Issuer     *Certificate // Signs the certificate, and ends its chain
+	KeyUsage   x509.KeyUsage
+	Extensions []pkix.Extension
+	Lifetime   time.Duration // An hour if zero
+}
+
+func newTestCertificate(t *testing.T, opts testCertOptions) *Certificate {
+	t.Helper()
+	alg := opts.Alg
+	if alg == 0 {
+		alg = ECDSA_P256_SHA256
+	}
+	priv, err := newSigningKey(alg)
+	assertNotError(t, err, "Failed to generate key")
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assertNotError(t, err, "Failed to generate serial number")
+	commonName := opts.CommonName
+	if commonName == "" {
+		commonName = "test"
+	}
+	lifetime := opts.Lifetime
+	if lifetime == 0 {
+		lifetime = time.Hour
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(lifetime),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              opts.DNSNames,
+		IPAddresses:           opts.IPs,
+		IsCA:                  opts.IsCA,
+		BasicConstraintsValid: opts.IsCA,
+		KeyUsage:              opts.KeyUsage,
+		ExtraExtensions:       opts.Extensions,
+	}
+
+	parent, signer := template, priv
+	var issuerChain []*x509.Certificate
+	if opts.Issuer != nil {
+		parent, signer = opts.Issuer.Chain[0], opts.Issuer.PrivateKey
+		issuerChain = opts.Issuer.Chain
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, priv.Public(), signer)
+	assertNotError(t, err, "Failed to create certificate")
+	cert, err := x509.ParseCertificate(der)
+	assertNotError(t, err, "Failed to parse certificate")
+
+	chain := append([]*x509.Certificate{cert}, issuerChain...)
+	return &Certificate{Chain: chain, PrivateKey: priv}
+}
@@ -13,20 +13,89 @@ import (
 	"time"
 )
 
+// A Certificate with an empty Chain holds only a key, and is used to
+// authenticate with a raw public key (RFC 7250) when the peer accepts one.
 type Certificate struct {
 	Chain      []*x509.Certificate
 	PrivateKey crypto.Signer
+
+	// OCSPStaple is an OCSP response for the leaf certificate, which is sent
+	// to clients that request it.
+	OCSPStaple []byte
+	// GetOCSPStaple, if not nil, is called to obtain a fresh OCSP response
+	// each time one is to be sent, and takes precedence over OCSPStaple.  If
+	// it returns an error, no response is stapled.
+	GetOCSPStaple func() ([]byte, error)
+	// SignedCertificateTimestamps is a list of serialized SCTs for the leaf
+	// certificate, which is sent to clients that request it.
+	SignedCertificateTimestamps [][]byte
+	// DelegatedCredential, if not nil, is a delegated credential (RFC 9345)
+	// for the leaf certificate.  PrivateKey then holds the credential's key
+	// rather than the key of the leaf certificate, so the Certificate can
+	// only be used with clients that accept delegated credentials.  See
+	// NewDelegatedCredential.
+	DelegatedCredential *DelegatedCredential
+}
+
+func (c *Certificate) ocspStaple() []byte {
+	if c.GetOCSPStaple == nil {
+		return c.OCSPStaple
+	}
+
+	staple, err := c.GetOCSPStaple()
+	if err != nil {
+		logf(logTypeHandshake, "Error refreshing OCSP staple [%v]", err)
+		return nil
+	}
+	return staple
+}
+
+func (c *Certificate) isRawPublicKey() bool {
+	return len(c.Chain) == 0
+}
+
+// Returns the DER-encoded SubjectPublicKeyInfo sent for a raw public key
+func (c *Certificate) rawPublicKey() ([]byte, error) {
+	return x509.MarshalPKIXPublicKey(c.PrivateKey.Public())
 }
 
 type PreSharedKey struct {
 	CipherSuite  CipherSuite
 	IsResumption bool
+	IsImported   bool // Derived by a PSKImporter
 	Identity     []byte
 	Key          []byte
 	NextProto    string
 	ReceivedAt   time.Time
 	ExpiresAt    time.Time
 	TicketAgeAdd uint32
+	// MaxEarlyDataSize is the most 0-RTT data the server allows with the
+	// PSK, or zero if it does not allow early data.  It comes from the ticket
+	// for a resumption PSK, and has to be set for an external one.
+	MaxEarlyDataSize uint32
+
+	// For a resumption PSK, how the peer authenticated in the handshake that
+	// issued the ticket.  These are restored into the ConnectionState of a
+	// connection that resumes with it.
+	PeerCertificates []*x509.Certificate
+	VerifiedChains   [][]*x509.Certificate
+	PeerPublicKey    crypto.PublicKey
+}
+
+// The label of the binder key depends on where the PSK came from
+func (psk PreSharedKey) binderLabel() string {
+	switch {
+	case psk.IsResumption:
+		return labelResumptionBinder
+	case psk.IsImported:
+		return labelImportedBinder
+	}
+	return labelExternalBinder
+}
+
+// Whether the PSK has expired.  PSKs without an expiry time never do.
+func (psk PreSharedKey) expired(now time.Time) bool {
+	return !psk.ExpiresAt.IsZero() && !now.Before(psk.ExpiresAt)
 }
 
 type PreSharedKeyCache interface {
@@ -35,6 +104,13 @@ type PreSharedKeyCache interface {
 	Size() int
 }
 
+// A PreSharedKeyCache can also implement PreSharedKeyLister if it holds
+// several PSKs under one key, such as several tickets from one server.  A
+// client then offers all of the PSKs stored under the server name.
+type PreSharedKeyLister interface {
+	GetAll(string) []PreSharedKey
+}
+
 // A CookieHandler can be used to give the application more fine-grained control over Cookies.
 // Generate receives the Conn as an argument, so the CookieHandler can decide when to send the cookie based on that, and offload state to the client by encoding that into the Cookie.
 // When the client echoes the Cookie, Validate is called. The application can then recover the state from the cookie.
@@ -62,19 +138,137 @@ func (cache PSKMapCache) Size() int {
 	return len(cache)
 }
 
+// ClientHelloInfo contains information from a ClientHello message, so that
+// the application can make per-connection decisions in callbacks such as
+// GetCertificate.
+type ClientHelloInfo struct {
+	CipherSuites     []CipherSuite     // Offered cipher suites
+	ServerName       string            // server_name, if sent
+	SupportedGroups  []NamedGroup      // supported_groups, if sent
+	SignatureSchemes []SignatureScheme // signature_algorithms, if sent
+	SupportedProtos  []string          // ALPN protocols, if sent
+	RemoteAddr       net.Addr          // Address of the client
+
+	// Distinguished names from certificate_authorities, if sent
+	CertificateAuthorities [][]byte
+	// signature_algorithms_cert, if sent
+	CertificateSignatureSchemes []SignatureScheme
+}
+
+// CertificateRequestInfo contains information from a server's
+// CertificateRequest message, so that a client can choose a certificate with
+// GetClientCertificate.
+type CertificateRequestInfo struct {
+	SignatureSchemes []SignatureScheme // signature_algorithms from the server
+	OIDFilters       []OIDFilter       // oid_filters, if sent
+
+	// Distinguished names from certificate_authorities, if sent
+	AcceptableCAs [][]byte
+	// signature_algorithms_cert, if sent
+	CertificateSignatureSchemes []SignatureScheme
+}
+
+// EarlyDataInfo describes a ClientHello that offers early data, so that a
+// server can decide whether to accept 0-RTT on that connection.
+type EarlyDataInfo struct {
+	ServerName  string        // server_name sent by the client
+	NextProto   string        // ALPN protocol that will be selected
+	PSKIdentity []byte        // Identity of the PSK being used
+	TicketAge   time.Duration // Client's view of the ticket age (resumption only)
+}
+
+// ClientAuthType declares the policy the server will follow for TLS client
+// authentication.
+type ClientAuthType int
+
+const (
+	// NoClientCert indicates that no client certificate should be requested.
+	NoClientCert ClientAuthType = iota
+	// RequestClientCert indicates that a client certificate should be
+	// requested, but the client is not required to send one, and any
+	// certificate it sends is not verified.
+	RequestClientCert
+	// RequireAnyClientCert indicates that the client must send a
+	// certificate, but that it is not verified.
+	RequireAnyClientCert
+	// VerifyClientCertIfGiven indicates that a client certificate should be
+	// requested, and that if the client sends one, it must be valid.
+	VerifyClientCertIfGiven
+	// RequireAndVerifyClientCert indicates that the client must send a valid
+	// certificate.
+	RequireAndVerifyClientCert
+)
+
 // Config is the struct used to pass configuration settings to a TLS client or
 // server instance.  The settings for client and server are pretty different,
 // but we just throw them all in here.
 type Config struct {
 	// Client fields
 	ServerName string
+	// If ResendRejectedEarlyData is set, early data that the server rejects is
+	// retained and sent again as ordinary application data once the handshake
+	// completes.
+	ResendRejectedEarlyData bool
+	// GetClientCertificate, if not nil, is called when a server requests a
+	// certificate from the client, and is used instead of selecting from
+	// Certificates.  If it returns a nil Certificate and no error, an empty
+	// Certificate message is sent.  If it returns an error, the handshake is
+	// aborted.
+	GetClientCertificate func(*CertificateRequestInfo) (*Certificate, error)
+	// If SendCertificateAuthorities is set, the client lists the subjects of
+	// RootCAs in a certificate_authorities extension, so that a server with
+	// several certificates can choose one the client will accept.
+	SendCertificateAuthorities bool
+	// VerifyOCSPResponse, if not nil, is called by a client after the server's
+	// certificate has been verified.  It receives the OCSP response stapled
+	// by the server, which is nil if none was sent, along with the server's
+	// certificate chain.  If it returns an error, the handshake is aborted
+	// with a bad_certificate_status_response alert.
+	VerifyOCSPResponse func(ocspResponse []byte, peerCertificates []*x509.Certificate) error
+	// CTLogKeys are the public keys of the Certificate Transparency logs that
+	// the client trusts.  If MinValidSCTs is positive, the server must
+	// provide at least that many SCTs for its certificate, with valid
+	// signatures from distinct logs in CTLogKeys, or the handshake is aborted.
+	CTLogKeys    []crypto.PublicKey
+	MinValidSCTs int
+	// If AcceptDelegatedCredentials is set, the client allows the server to
+	// authenticate with a delegated credential (RFC 9345) for any of
+	// SignatureSchemes.
+	AcceptDelegatedCredentials bool
+	// ECHConfigs, if not empty, is an encoded ECHConfigList for the server.
+	// The client encrypts its ClientHello to the first usable config, sending
+	// only the config's public name in the clear.  If the server rejects ECH,
+	// the handshake fails with an ech_required alert, and any retry configs
+	// the server sent are available in ConnectionState.ECHRetryConfigs.
+	ECHConfigs []byte
+	// ClientSessionCache stores the session tickets the client receives, under
+	// a key made from ServerName, the server's address, NextProtos and the
+	// client's certificate.  If nil, an in-memory cache is used.
+	ClientSessionCache ClientSessionCache
 
 	// Server fields
+	// GetConfigForClient, if not nil, is called after a ClientHello is
+	// received.  If it returns a non-nil Config, that Config is used for the
+	// rest of the connection, including negotiation, session tickets and
+	// cookies.  Its NonBlocking and UseDTLS settings must match this Config.
+	GetConfigForClient func(*ClientHelloInfo) (*Config, error)
 	SendSessionTickets bool
-	TicketLifetime     uint32
-	TicketLen          int
-	EarlyDataLifetime  uint32
-	AllowEarlyData     bool
+	// TicketCount is the number of tickets sent when the handshake completes,
+	// if SendSessionTickets is set.  If zero, one ticket is sent.
+	TicketCount int
+	// TicketLifetime is the lifetime in seconds of the tickets sent with the
+	// handshake.  If zero, it is one day, since a ticket with a zero lifetime
+	// would be discarded by the client straight away.
+	TicketLifetime    uint32
+	TicketLen         int
+	EarlyDataLifetime uint32
+	// AllowEarlyData lets a client send, and a server accept, 0-RTT data
+	// under a PSK whose MaxEarlyDataSize is not zero.
+	AllowEarlyData bool
+	// AcceptEarlyData, if not nil, is called when a client offers 0-RTT data
+	// that AllowEarlyData would otherwise permit.  It decides whether early
+	// data is accepted on this particular connection.
+	AcceptEarlyData func(*EarlyDataInfo) bool
 	// Require the client to echo a cookie.
 	RequireCookie bool
 	// A CookieHandler can be used to set and validate a cookie.
@@ -88,8 +282,33 @@ type Config struct {
 	// In blocking mode, a default cookie protector is used, if this is unused.
 	CookieProtector CookieProtector
 	// The ExtensionHandler is used to add custom extensions.
-	ExtensionHandler  AppExtensionHandler
+	ExtensionHandler AppExtensionHandler
+	// ClientAuth determines the server's policy for client authentication.
+	ClientAuth ClientAuthType
+	// RequireClientAuth is equivalent to setting ClientAuth to
+	// RequestClientCert, and is ignored if ClientAuth is set.
 	RequireClientAuth bool
+	// ClientCAs defines the set of root certificate authorities that servers
+	// use to verify client certificates, if required by ClientAuth.  Their
+	// subjects are sent to the client in a certificate_authorities extension.
+	ClientCAs *x509.CertPool
+	// DefaultCertificate is used when the client does not send server_name,
+	// or when no certificate in Certificates matches it.
+	DefaultCertificate *Certificate
+	// If RejectUnrecognizedName is set, a server_name that matches no
+	// certificate in Certificates causes the handshake to be aborted with an
+	// unrecognized_name alert, rather than falling back to DefaultCertificate.
+	RejectUnrecognizedName bool
+	// ECHKeys are the keys with which the server decrypts Encrypted Client
+	// Hello.  If a client's ClientHelloInner can't be decrypted, the handshake
+	// continues with its ClientHelloOuter, and the configs of all these keys
+	// are sent to the client to retry with.
+	ECHKeys []*ECHKey
+	// GetPSK, if not nil, is called to look up each PSK identity the client
+	// offers, before PSKs is consulted.  If it returns a nil PreSharedKey and
+	// no error, the identity is looked up in PSKs.  If it returns an error,
+	// the handshake is aborted.
+	GetPSK func(identity []byte, info *ClientHelloInfo) (*PreSharedKey, error)
 
 	// Time returns the current time as the number of seconds since the epoch.
 	// If Time is nil, TLS uses time.Now.
@@ -108,6 +327,11 @@ type Config struct {
 
 	// Shared fields
 	Certificates []*Certificate
+	// GetCertificate, if not nil, is called by a server to select a
+	// certificate for a connection.  If it returns a nil Certificate and no
+	// error, the server falls back to selecting from Certificates.  If it
+	// returns an error, the handshake is aborted.
+	GetCertificate func(*ClientHelloInfo) (*Certificate, error)
 	// VerifyPeerCertificate, if not nil, is called after normal
 	// certificate verification by either a TLS client or server. It
 	// receives the raw ASN.1 certificates provided by the peer and also
@@ -117,7 +341,8 @@ type Config struct {
 	// If normal verification fails then the handshake will abort before
 	// considering this callback. If normal verification is disabled by
 	// setting InsecureSkipVerify then this callback will be considered but
-	// the verifiedChains argument will always be nil.
+	// the verifiedChains argument will always be nil.  Likewise, on a server
+	// verifiedChains is nil unless ClientAuth requires verification.
 	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
 
 	CipherSuites     []CipherSuite
@@ -129,6 +354,38 @@ type Config struct {
 	NonBlocking      bool
 	UseDTLS          bool
 
+	// MinVersion and MaxVersion bound the protocol versions that can be
+	// negotiated, VersionTLS12 or VersionTLS13.  If MaxVersion is zero, it is
+	// VersionTLS13; if MinVersion is zero, it is VersionTLS13, or MaxVersion
+	// if that is lower.  TLS 1.2 uses only the ECDHE suites in CipherSuites,
+	// which include the TLS 1.2 defaults if CipherSuites is empty, and is
+	// never used with DTLS.
+	MinVersion uint16
+	MaxVersion uint16
+
+	// CertificateSignatureSchemes, if not empty, lists the signature schemes
+	// that the peer should use in its certificate chain, as opposed to in its
+	// CertificateVerify.  It is sent in signature_algorithms_cert.
+	CertificateSignatureSchemes []SignatureScheme
+
+	// PeerPublicKeys, if not empty, lists the raw public keys (RFC 7250) that
+	// are accepted from the peer.  A client offers to accept a raw public key
+	// from the server, and a server offers to accept one from the client when
+	// requesting client authentication.  A raw public key is authenticated
+	// only by matching one of these keys; no chain is built.
+	PeerPublicKeys []crypto.PublicKey
+
+	// CertificateCompressors lists the certificate compression algorithms
+	// (RFC 8879) to offer, in preference order.  A certificate is sent
+	// compressed with the first of these that the peer also offers.
+	CertificateCompressors []CertificateCompressor
+
+	// If GREASE is set, a client adds reserved values (RFC 8701) to the lists
+	// in its ClientHello, along with an empty extension of a reserved type,
+	// and a server adds such an extension to its CertificateRequest.  This
+	// checks that peers ignore values they don't know.
+	GREASE bool
+
 	RecordLayer RecordLayerFactory
 
 	// The same config object can be shared among different connections, so it
@@ -143,23 +400,42 @@ func (c *Config) Clone() *Config {
 	defer c.mutex.Unlock()
 
 	return &Config{
-		ServerName: c.ServerName,
-
-		SendSessionTickets: c.SendSessionTickets,
-		TicketLifetime:     c.TicketLifetime,
-		TicketLen:          c.TicketLen,
-		EarlyDataLifetime:  c.EarlyDataLifetime,
-		AllowEarlyData:     c.AllowEarlyData,
-		RequireCookie:      c.RequireCookie,
-		CookieHandler:      c.CookieHandler,
-		CookieProtector:    c.CookieProtector,
-		ExtensionHandler:   c.ExtensionHandler,
-		RequireClientAuth:  c.RequireClientAuth,
-		Time:               c.Time,
-		RootCAs:            c.RootCAs,
-		InsecureSkipVerify: c.InsecureSkipVerify,
+		ServerName:                 c.ServerName,
+		ResendRejectedEarlyData:    c.ResendRejectedEarlyData,
+		GetClientCertificate:       c.GetClientCertificate,
+		SendCertificateAuthorities: c.SendCertificateAuthorities,
+		VerifyOCSPResponse:         c.VerifyOCSPResponse,
+		CTLogKeys:                  c.CTLogKeys,
+		MinValidSCTs:               c.MinValidSCTs,
+		AcceptDelegatedCredentials: c.AcceptDelegatedCredentials,
+		ECHConfigs:                 c.ECHConfigs,
+
+		GetConfigForClient:     c.GetConfigForClient,
+		SendSessionTickets:     c.SendSessionTickets,
+		TicketCount:            c.TicketCount,
+		TicketLifetime:         c.TicketLifetime,
+		TicketLen:              c.TicketLen,
+		EarlyDataLifetime:      c.EarlyDataLifetime,
+		AllowEarlyData:         c.AllowEarlyData,
+		AcceptEarlyData:        c.AcceptEarlyData,
+		RequireCookie:          c.RequireCookie,
+		CookieHandler:          c.CookieHandler,
+		CookieProtector:        c.CookieProtector,
+		ExtensionHandler:       c.ExtensionHandler,
+		ClientAuth:             c.ClientAuth,
+		RequireClientAuth:      c.RequireClientAuth,
+		ClientCAs:              c.ClientCAs,
+		DefaultCertificate:     c.DefaultCertificate,
+		RejectUnrecognizedName: c.RejectUnrecognizedName,
+		ECHKeys:                c.ECHKeys,
+		GetPSK:                 c.GetPSK,
+		ClientSessionCache:     c.ClientSessionCache,
+		Time:                   c.Time,
+		RootCAs:                c.RootCAs,
+		InsecureSkipVerify:     c.InsecureSkipVerify,
 
 		Certificates:          c.Certificates,
+		GetCertificate:        c.GetCertificate,
 		VerifyPeerCertificate: c.VerifyPeerCertificate,
 		CipherSuites:          c.CipherSuites,
 		Groups:                c.Groups,
@@ -169,6 +445,14 @@ func (c *Config) Clone() *Config {
 		PSKModes:              c.PSKModes,
 		NonBlocking:           c.NonBlocking,
 		UseDTLS:               c.UseDTLS,
+		MinVersion:            c.MinVersion,
+		MaxVersion:            c.MaxVersion,
+
+		CertificateSignatureSchemes: c.CertificateSignatureSchemes,
+
+		PeerPublicKeys:         c.PeerPublicKeys,
+		CertificateCompressors: c.CertificateCompressors,
+		GREASE:                 c.GREASE,
 	}
 }
 
@@ -177,8 +461,23 @@ func (c *Config) Init(isClient bool) error {
 	defer c.mutex.Unlock()
 
 	// Set defaults
+	if c.MaxVersion == 0 {
+		c.MaxVersion = tls13Version
+	}
+	if c.MinVersion == 0 {
+		c.MinVersion = tls13Version
+		if c.MaxVersion < c.MinVersion {
+			c.MinVersion = c.MaxVersion
+		}
+	}
+	if len(c.supportedVersions()) == 0 {
+		return fmt.Errorf("tls.config: No supported versions in [%04x, %04x]", c.MinVersion, c.MaxVersion)
+	}
 	if len(c.CipherSuites) == 0 {
 		c.CipherSuites = defaultSupportedCipherSuites
+		if c.MinVersion <= tls12Version {
+			c.CipherSuites = append(append([]CipherSuite{}, defaultSupportedCipherSuites...), defaultTLS12CipherSuites...)
+		}
 	}
 	if len(c.Groups) == 0 {
 		c.Groups = defaultSupportedGroups
@@ -189,9 +488,18 @@ func (c *Config) Init(isClient bool) error {
 	if c.TicketLen == 0 {
 		c.TicketLen = defaultTicketLen
 	}
+	if c.TicketCount == 0 {
+		c.TicketCount = defaultTicketCount
+	}
+	if c.TicketLifetime == 0 {
+		c.TicketLifetime = defaultTicketLifetime
+	}
 	if !reflect.ValueOf(c.PSKs).IsValid() {
 		c.PSKs = &PSKMapCache{}
 	}
+	if isClient && c.ClientSessionCache == nil {
+		c.ClientSessionCache = NewClientSessionMapCache(0)
+	}
 	if len(c.PSKModes) == 0 {
 		c.PSKModes = defaultPSKModes
 	}
@@ -199,9 +507,9 @@ func (c *Config) Init(isClient bool) error {
 }
 
 func (c *Config) ValidForServer() bool {
-	return (reflect.ValueOf(c.PSKs).IsValid() && c.PSKs.Size() > 0) ||
+	return (reflect.ValueOf(c.PSKs).IsValid() && c.PSKs.Size() > 0) || c.GetPSK != nil ||
+		c.GetCertificate != nil || c.GetConfigForClient != nil || c.DefaultCertificate != nil ||
 		(len(c.Certificates) > 0 &&
-			len(c.Certificates[0].Chain) > 0 &&
 			c.Certificates[0].PrivateKey != nil)
 }
 
@@ -209,6 +517,72 @@ func (c *Config) ValidForClient() bool {
 	return len(c.ServerName) > 0
 }
 
+func (c *Config) clientAuth() ClientAuthType {
+	if c.ClientAuth == NoClientCert && c.RequireClientAuth {
+		return RequestClientCert
+	}
+	return c.ClientAuth
+}
+
+// The certificate types a client accepts from the server, or nil if only
+// X.509 is supported and the server_certificate_type extension is not needed
+func (c *Config) serverCertTypes() []CertificateType {
+	if len(c.PeerPublicKeys) == 0 {
+		return nil
+	}
+	return []CertificateType{CertificateTypeRawPublicKey, CertificateTypeX509}
+}
+
+// The certificate types a client can send to the server, or nil if only X.509
+// is supported
+func (c *Config) clientCertTypes() []CertificateType {
+	if len(certificatesOfType(c.Certificates, CertificateTypeRawPublicKey)) == 0 {
+		return nil
+	}
+	return []CertificateType{CertificateTypeRawPublicKey, CertificateTypeX509}
+}
+
+// The versions that can be negotiated, highest first.  This applies the
+// defaults itself, since not every Config has been through Init.
+func (c *Config) supportedVersions() []uint16 {
+	minVersion, maxVersion := c.MinVersion, c.MaxVersion
+	if maxVersion == 0 {
+		maxVersion = tls13Version
+	}
+	if minVersion == 0 {
+		minVersion = tls13Version
+		if maxVersion < minVersion {
+			minVersion = maxVersion
+		}
+	}
+
+	versions := []uint16{}
+	for _, v := range []uint16{tls13Version, tls12Version} {
+		if v < minVersion || v > maxVersion || (v == tls12Version && c.UseDTLS) {
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+// The configured cipher suites that can be used with any of the given
+// versions.  Suites that aren't known for TLS 1.2 are treated as TLS 1.3
+// suites, so that they are offered and negotiated as before.
+func (c *Config) cipherSuitesFor(versions ...uint16) []CipherSuite {
+	suites := []CipherSuite{}
+	for _, suite := range c.CipherSuites {
+		_, tls12 := tls12CipherSuiteMap[suite]
+		for _, v := range versions {
+			if (v == tls12Version) == tls12 {
+				suites = append(suites, suite)
+				break
+			}
+		}
+	}
+	return suites
+}
+
 func (c *Config) time() time.Time {
 	t := c.Time
 	if t == nil {
@@ -223,6 +597,13 @@ var (
 		TLS_AES_256_GCM_SHA384,
 	}
 
+	defaultTLS12CipherSuites = []CipherSuite{
+		TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	}
+
 	defaultSupportedGroups = []NamedGroup{
 		P256,
 		P384,
@@ -239,7 +620,9 @@ var (
 		ECDSA_P521_SHA512,
 	}
 
-	defaultTicketLen = 16
+	defaultTicketLen             = 16
+	defaultTicketCount           = 1
+	defaultTicketLifetime uint32 = 24 * 60 * 60
 
 	defaultPSKModes = []PSKKeyExchangeMode{
 		PSKModeKE,
@@ -248,13 +631,21 @@ var (
 )
 
 type ConnectionState struct {
-	HandshakeState   State
-	CipherSuite      CipherSuiteParams     // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
-	PeerCertificates []*x509.Certificate   // certificate chain presented by remote peer
-	VerifiedChains   [][]*x509.Certificate // verified chains built from PeerCertificates
-	NextProto        string                // Selected ALPN proto
-	UsingPSK         bool                  // Are we using PSK.
-	UsingEarlyData   bool                  // Did we negotiate 0-RTT.
+	HandshakeState              State
+	Version                     uint16                // negotiated protocol version (VersionTLS12, ...)
+	CipherSuite                 CipherSuiteParams     // cipher suite in use (TLS_RSA_WITH_RC4_128_SHA, ...)
+	PeerCertificates            []*x509.Certificate   // certificate chain presented by remote peer
+	VerifiedChains              [][]*x509.Certificate // verified chains built from PeerCertificates
+	NextProto                   string                // Selected ALPN proto
+	UsingPSK                    bool                  // Are we using PSK.
+	UsingEarlyData              bool                  // Did we negotiate 0-RTT.
+	RejectedEarlyData           bool                  // Was 0-RTT offered but not accepted.
+	OCSPResponse                []byte                // OCSP response stapled by the server
+	SignedCertificateTimestamps [][]byte              // SCTs provided by the server
+	PeerPublicKey               crypto.PublicKey      // raw public key presented by remote peer
+	DelegatedCredential         *DelegatedCredential  // delegated credential used by the server
+	UsingECH                    bool                  // Was the ClientHello encrypted.
+	ECHRetryConfigs             []byte                // ECHConfigList sent by a server that rejected ECH
 }
 
 // Conn implements the net.Conn interface, as with "crypto/tls"
@@ -274,6 +665,10 @@ type Conn struct {
 	readBuffer []byte
 	in, out    RecordLayer
 	hsCtx      *HandshakeContext
+
+	// Client early data, retained for resending if the server rejects it
+	earlyDataSent   bool
+	earlyDataBuffer []byte
 }
 
 func NewConn(conn net.Conn, config *Config, isClient bool) *Conn {
@@ -391,6 +786,11 @@ func (c *Conn) consumeRecord() error {
 		}
 		return c.hsCtx.processAck(pt.fragment)
 
+	case RecordTypeChangeCipherSpec:
+		logf(logTypeHandshake, "Received ChangeCipherSpec after the handshake")
+		c.sendAlert(AlertUnexpectedMessage)
+		return io.EOF
+
 	case RecordTypeApplicationData:
 		c.readBuffer = append(c.readBuffer, pt.fragment...)
 		logf(logTypeIO, "extended buffer: [%d] %x", len(c.readBuffer), c.readBuffer)
@@ -410,25 +810,11 @@ func readPartial(in *[]byte, buffer []byte) int {
 }
 
 // Read application data up to the size of buffer.  Handshake and alert records
-// are consumed by the Conn object directly.
+// are consumed by the Conn object directly.  Read only returns data sent after
+// the handshake; a server gets 0-RTT data from EarlyData instead.
 func (c *Conn) Read(buffer []byte) (int, error) {
 	if _, connected := c.hState.(stateConnected); !connected {
-		// Clients can't call Read prior to handshake completion.
-		if c.isClient {
-			return 0, errors.New("Read called before the handshake completed")
-		}
-
-		// Neither can servers that don't allow early data.
-		if !c.config.AllowEarlyData {
-			return 0, errors.New("Read called before the handshake completed")
-		}
-
-		// If there's no early data, then return WouldBlock
-		if len(c.hsCtx.earlyData) == 0 {
-			return 0, AlertWouldBlock
-		}
-
-		return readPartial(&c.hsCtx.earlyData, buffer), nil
+		return 0, errors.New("Read called before the handshake completed")
 	}
 
 	// The handshake is now connected.
@@ -467,6 +853,34 @@ func (c *Conn) Read(buffer []byte) (int, error) {
 	return readPartial(&c.readBuffer, buffer), nil
 }
 
+// EarlyData returns a reader for the 0-RTT data sent by the client.  Early
+// data can be replayed by an attacker, so it is only returned by this reader,
+// never by Read.  The reader can be used from another goroutine while the
+// handshake runs, and returns io.EOF when the handshake is complete and all
+// early data has been read.
+func (c *Conn) EarlyData() io.Reader {
+	return earlyDataReader{c}
+}
+
+type earlyDataReader struct {
+	c *Conn
+}
+
+func (r earlyDataReader) Read(buffer []byte) (int, error) {
+	// The handshake appends to the early data under the same lock
+	r.c.in.Lock()
+	defer r.c.in.Unlock()
+
+	if len(r.c.hsCtx.earlyData) == 0 {
+		if r.c.handshakeComplete {
+			return 0, io.EOF
+		}
+		return 0, AlertWouldBlock
+	}
+
+	return readPartial(&r.c.hsCtx.earlyData, buffer), nil
+}
+
 // Write application data
 func (c *Conn) Write(buffer []byte) (int, error) {
 	// Lock the output channel
@@ -477,6 +891,53 @@ func (c *Conn) Write(buffer []byte) (int, error) {
 		return 0, errors.New("Write called before the handshake completed (and early data not in use)")
 	}
 
+	if c.isClient && c.out.Epoch() == EpochEarlyData {
+		return c.writeEarlyData(buffer)
+	}
+
+	return c.writeRecords(buffer)
+}
+
+// WriteEarlyData sends application data as 0-RTT data.  If the handshake has
+// not yet started, the ClientHello is sent first.  Whether the data was
+// accepted is known only once the handshake completes; see EarlyDataAccepted.
+func (c *Conn) WriteEarlyData(buffer []byte) (int, error) {
+	if !c.isClient {
+		return 0, errors.New("WriteEarlyData called on a server")
+	}
+
+	if c.hState == nil {
+		if alert := c.HandshakeSetup(); alert != AlertNoAlert {
+			return 0, alert
+		}
+	}
+
+	// Lock the output channel
+	c.out.Lock()
+	defer c.out.Unlock()
+
+	if c.out.Epoch() != EpochEarlyData {
+		return 0, errors.New("WriteEarlyData called when early data not in use")
+	}
+
+	return c.writeEarlyData(buffer)
+}
+
+// writeEarlyData sends 0-RTT data, retaining a copy if it might need to be
+// resent.
+// c.out.Mutex <= L.
+func (c *Conn) writeEarlyData(buffer []byte) (int, error) {
+	c.earlyDataSent = true
+	sent, err := c.writeRecords(buffer)
+	if c.config.ResendRejectedEarlyData {
+		c.earlyDataBuffer = append(c.earlyDataBuffer, buffer[:sent]...)
+	}
+	return sent, err
+}
+
+// writeRecords fragments application data into records at the current epoch.
+// c.out.Mutex <= L.
+func (c *Conn) writeRecords(buffer []byte) (int, error) {
 	// Send full-size fragments
 	var start int
 	sent := 0
@@ -598,6 +1059,14 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 				c.hsCtx.handshakeRetransmit,
 				c.hsCtx.timeoutMS)
 		}
+	case SendChangeCipherSpec:
+		logf(logTypeHandshake, "%s sending ChangeCipherSpec", label)
+		err := c.out.WriteRecord(&TLSPlaintext{contentType: RecordTypeChangeCipherSpec, fragment: []byte{1}})
+		if err != nil {
+			logf(logTypeHandshake, "%s Error writing ChangeCipherSpec: %v", label, err)
+			return AlertInternalError
+		}
+
 	case RekeyIn:
 		logf(logTypeHandshake, "%s Rekeying in to %s: %+v", label, action.epoch.label(), action.KeySet)
 		// Check that we don't have an input data in the handshake frame parser.
@@ -626,8 +1095,8 @@ func (c *Conn) takeAction(actionGeneric HandshakeAction) Alert {
 	case StorePSK:
 		logf(logTypeHandshake, "%s Storing new session ticket with identity [%x]", label, action.PSK.Identity)
 		if c.isClient {
-			// Clients look up PSKs based on server name
-			c.config.PSKs.Put(c.config.ServerName, action.PSK)
+			// Clients look up tickets based on the server's identity
+			c.config.ClientSessionCache.Put(c.sessionCacheKey(), action.PSK)
 		} else {
 			// Servers look them up based on the identity in the extension
 			c.config.PSKs.Put(hex.EncodeToString(action.PSK.Identity), action.PSK)
@@ -656,6 +1125,9 @@ func (c *Conn) HandshakeSetup() Alert {
 		ServerName: c.config.ServerName,
 		NextProtos: c.config.NextProtos,
 	}
+	if c.isClient {
+		opts.SessionCacheKey = c.sessionCacheKey()
+	}
 
 	if c.isClient {
 		state, actions, alert = clientStateStart{Config: c.config, Opts: opts, hsCtx: c.hsCtx}.Next(nil)
@@ -672,18 +1144,8 @@ func (c *Conn) HandshakeSetup() Alert {
 			}
 		}
 	} else {
-		if c.config.RequireCookie && c.config.CookieProtector == nil {
-			logf(logTypeHandshake, "RequireCookie set, but no CookieProtector provided. Using default cookie protector. Stateless Retry not possible.")
-			if c.config.NonBlocking {
-				logf(logTypeHandshake, "Not possible in non-blocking mode.")
-				return AlertInternalError
-			}
-			var err error
-			c.config.CookieProtector, err = NewDefaultCookieProtector()
-			if err != nil {
-				logf(logTypeHandshake, "Error initializing cookie source: %v", alert)
-				return AlertInternalError
-			}
+		if alert := setDefaultCookieProtector(c.config); alert != AlertNoAlert {
+			return alert
 		}
 		state = serverStateStart{Config: c.config, conn: c, hsCtx: c.hsCtx}
 	}
@@ -692,6 +1154,27 @@ func (c *Conn) HandshakeSetup() Alert {
 	return AlertNoAlert
 }
 
+// setDefaultCookieProtector installs a default CookieProtector on a server
+// config that requires cookies but doesn't provide one.
+func setDefaultCookieProtector(config *Config) Alert {
+	if !config.RequireCookie || config.CookieProtector != nil {
+		return AlertNoAlert
+	}
+
+	logf(logTypeHandshake, "RequireCookie set, but no CookieProtector provided. Using default cookie protector. Stateless Retry not possible.")
+	if config.NonBlocking {
+		logf(logTypeHandshake, "Not possible in non-blocking mode.")
+		return AlertInternalError
+	}
+	var err error
+	config.CookieProtector, err = NewDefaultCookieProtector()
+	if err != nil {
+		logf(logTypeHandshake, "Error initializing cookie source: %v", err)
+		return AlertInternalError
+	}
+	return AlertNoAlert
+}
+
 type handshakeMessageReader interface {
 	ReadMessage() (*HandshakeMessage, Alert)
 }
@@ -794,18 +1277,23 @@ func (c *Conn) Handshake() Alert {
 		_, connected = state.(stateConnected)
 		if connected {
 			c.state = state.(stateConnected)
+
+			// A server that rejected ECH has only authenticated as the public
+			// name, so the connection can't be used
+			if c.isClient && c.state.Params.RejectedECH {
+				logf(logTypeHandshake, "%s Server rejected ECH", label)
+				c.sendAlert(AlertECHRequired)
+				c.handshakeAlert = AlertECHRequired
+				return AlertECHRequired
+			}
+
 			c.handshakeComplete = true
 
 			if !c.isClient {
-				// Send NewSessionTicket if configured to
-				if c.config.SendSessionTickets {
-					actions, alert := c.state.NewSessionTicket(
-						c.config.TicketLen,
-						c.config.TicketLifetime,
-						c.config.EarlyDataLifetime)
-
-					for _, action := range actions {
-						alert = c.takeAction(action)
+				// Send NewSessionTickets if configured to
+				if c.config.SendSessionTickets && c.state.Params.Version != tls12Version {
+					for i := 0; i < c.config.TicketCount; i++ {
+						alert := c.sendSessionTicket(c.defaultTicketOptions())
 						if alert != AlertNoAlert {
 							logf(logTypeHandshake, "Error during handshake actions: %v", alert)
 							c.sendAlert(alert)
@@ -814,14 +1302,14 @@ func (c *Conn) Handshake() Alert {
 					}
 				}
 
-				// If there is early data, move it into the main buffer
-				if c.hsCtx.earlyData != nil {
-					c.readBuffer = c.hsCtx.earlyData
-					c.hsCtx.earlyData = nil
-				}
-
 			} else {
 				assert(c.hsCtx.earlyData == nil)
+
+				// If the server rejected our early data, send it again now
+				if alert := c.resendEarlyData(); alert != AlertNoAlert {
+					c.sendAlert(alert)
+					return alert
+				}
 			}
 		}
 
@@ -836,10 +1324,49 @@ func (c *Conn) Handshake() Alert {
 	return AlertNoAlert
 }
 
+// resendEarlyData writes any rejected 0-RTT data again as 1-RTT data, if the
+// client was configured to do so.
+func (c *Conn) resendEarlyData() Alert {
+	buffer := c.earlyDataBuffer
+	c.earlyDataBuffer = nil
+	if !c.earlyDataRejected() || len(buffer) == 0 {
+		return AlertNoAlert
+	}
+
+	logf(logTypeHandshake, "Resending %d bytes of rejected early data", len(buffer))
+	if _, err := c.Write(buffer); err != nil {
+		logf(logTypeHandshake, "Error resending early data: %v", err)
+		return AlertInternalError
+	}
+	return AlertNoAlert
+}
+
+// earlyDataRejected reports whether 0-RTT was attempted but not accepted.  A
+// client that wrote early data before a HelloRetryRequest counts as rejected
+// even though the second ClientHello did not offer early data.
+func (c *Conn) earlyDataRejected() bool {
+	if !c.handshakeComplete {
+		return false
+	}
+	if c.isClient && c.earlyDataSent && !c.state.Params.UsingEarlyData {
+		return true
+	}
+	return c.state.Params.RejectedEarlyData
+}
+
+// EarlyDataAccepted returns true if 0-RTT data was negotiated.  It can only
+// return true once the handshake has completed.
+func (c *Conn) EarlyDataAccepted() bool {
+	return c.handshakeComplete && c.state.Params.UsingEarlyData
+}
+
 func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 	if !c.handshakeComplete {
 		return fmt.Errorf("Cannot update keys until after handshake")
 	}
+	if c.state.Params.Version == tls12Version {
+		return fmt.Errorf("Cannot update keys in TLS 1.2")
+	}
 
 	request := KeyUpdateNotRequested
 	if requestUpdate {
@@ -865,6 +1392,66 @@ func (c *Conn) SendKeyUpdate(requestUpdate bool) error {
 	return nil
 }
 
+// SessionTicketOptions describes a ticket sent by SendSessionTicket.
+type SessionTicketOptions struct {
+	// Lifetime is how long the client may use the ticket, in seconds
+	Lifetime uint32
+	// MaxEarlyDataSize, if not zero, allows the client to send that much
+	// 0-RTT data when resuming with the ticket
+	MaxEarlyDataSize uint32
+	// Extensions are added to the NewSessionTicket message
+	Extensions []ExtensionBody
+}
+
+// The most a ticket's lifetime can be, seven days
+const maxTicketLifetime = 7 * 24 * 60 * 60
+
+func (c *Conn) defaultTicketOptions() SessionTicketOptions {
+	return SessionTicketOptions{
+		Lifetime:         c.config.TicketLifetime,
+		MaxEarlyDataSize: c.config.EarlyDataLifetime,
+	}
+}
+
+// SendSessionTicket sends the client a new session ticket, which the server
+// also stores in its PSKs cache.  It can be called any time after the
+// handshake has completed, as many times as needed.
+func (c *Conn) SendSessionTicket(opts SessionTicketOptions) error {
+	if c.isClient {
+		return fmt.Errorf("Only a server can send session tickets")
+	}
+	if !c.handshakeComplete {
+		return fmt.Errorf("Cannot send session tickets until after handshake")
+	}
+	if c.state.Params.Version == tls12Version {
+		return fmt.Errorf("Cannot send session tickets in TLS 1.2")
+	}
+	if opts.Lifetime > maxTicketLifetime {
+		return fmt.Errorf("Ticket lifetime too long: %d", opts.Lifetime)
+	}
+
+	if alert := c.sendSessionTicket(opts); alert != AlertNoAlert {
+		c.sendAlert(alert)
+		return fmt.Errorf("Alert while sending session ticket: %v", alert)
+	}
+	return nil
+}
+
+func (c *Conn) sendSessionTicket(opts SessionTicketOptions) Alert {
+	actions, alert := c.state.NewSessionTicket(c.config.TicketLen, opts)
+	if alert != AlertNoAlert {
+		return alert
+	}
+
+	for _, action := range actions {
+		alert = c.takeAction(action)
+		if alert != AlertNoAlert {
+			return alert
+		}
+	}
+	return AlertNoAlert
+}
+
 func (c *Conn) GetHsState() State {
 	if c.hState == nil {
 		return StateInit
@@ -878,6 +1465,10 @@ func (c *Conn) ComputeExporter(label string, context []byte, keyLength int) ([]b
 		return nil, fmt.Errorf("Cannot compute exporter when state is not connected")
 	}
 
+	if c.state.Params.Version == tls12Version {
+		return c.state.exportKeyingMaterialTLS12(label, context, keyLength)
+	}
+
 	if c.state.exporterSecret == nil {
 		return nil, fmt.Errorf("Internal error: no exporter secret")
 	}
@@ -895,14 +1486,28 @@ func (c *Conn) ConnectionState() ConnectionState {
 	}
 
 	if c.handshakeComplete {
+		state.Version = c.state.Params.Version
 		state.CipherSuite = cipherSuiteMap[c.state.Params.CipherSuite]
+		if c.state.Params.Version == tls12Version {
+			state.CipherSuite = tls12CipherSuiteMap[c.state.Params.CipherSuite].params
+		}
 		state.NextProto = c.state.Params.NextProto
 		state.VerifiedChains = c.state.verifiedChains
 		state.PeerCertificates = c.state.peerCertificates
 		state.UsingPSK = c.state.Params.UsingPSK
 		state.UsingEarlyData = c.state.Params.UsingEarlyData
+		state.RejectedEarlyData = c.earlyDataRejected()
+		state.OCSPResponse = c.state.ocspResponse
+		state.SignedCertificateTimestamps = c.state.signedCertificateTimestamps
+		state.PeerPublicKey = c.state.peerPublicKey
+		state.DelegatedCredential = c.state.delegatedCredential
+		state.UsingECH = c.state.Params.UsingECH
 	}
 
+	// A client whose ECH was rejected never completes the handshake, but may
+	// retry with these
+	state.ECHRetryConfigs = c.state.Params.ECHRetryConfigs
+
 	return state
 }
 
@@ -198,10 +198,11 @@ func init() {
 	}
 
 	psk = PreSharedKey{
-		CipherSuite:  TLS_AES_128_GCM_SHA256,
-		IsResumption: false,
-		Identity:     []byte{0, 1, 2, 3},
-		Key:          []byte{4, 5, 6, 7},
+		CipherSuite:      TLS_AES_128_GCM_SHA256,
+		IsResumption:     false,
+		Identity:         []byte{0, 1, 2, 3},
+		Key:              []byte{4, 5, 6, 7},
+		MaxEarlyDataSize: 1 << 14,
 	}
 	certificates = []*Certificate{
 		{
@@ -634,6 +635,388 @@ func TestCertChain(t *testing.T) {
 
 // TODO(#90): Add a test with mismatching server name
 
+// Creates a CA and a certificate for name issued by it
+func newCAIssuedCertificate(t *testing.T, caName, name string) (*Certificate, *x509.Certificate) {
+	t.Helper()
+	ca := newTestCertificate(t, testCertOptions{CommonName: caName, IsCA: true})
+	cert := newTestCertificate(t, testCertOptions{CommonName: name, DNSNames: []string{name}, Issuer: ca})
+	return cert, ca.Chain[0]
+}
+
+func TestDefaultCertificate(t *testing.T) {
+	defaultCert, _ := newCAIssuedCertificate(t, "Test Default CA", "default.example")
+
+	for _, reject := range []bool{false, true} {
+		serverConfig := &Config{
+			Certificates:           certificates,
+			DefaultCertificate:     defaultCert,
+			RejectUnrecognizedName: reject,
+		}
+		clientConfig := &Config{
+			ServerName:         "unknown.example",
+			InsecureSkipVerify: true,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			client.Handshake()
+			done <- true
+		}()
+
+		alert := server.Handshake()
+		if reject {
+			assertEquals(t, alert, AlertUnrecognizedName)
+			cConn.Close()
+			<-done
+			continue
+		}
+
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+		assertTrue(t, client.ConnectionState().PeerCertificates[0].Equal(defaultCert.Chain[0]), "Wrong server certificate")
+	}
+}
+
+func TestRawPublicKeys(t *testing.T) {
+	serverKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate server key")
+	clientKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate client key")
+
+	serverConfig := &Config{
+		ClientAuth:     RequireAnyClientCert,
+		Certificates:   []*Certificate{{PrivateKey: serverKey}},
+		PeerPublicKeys: []crypto.PublicKey{clientKey.Public()},
+	}
+	clientConfig := &Config{
+		ServerName:     serverName,
+		Certificates:   []*Certificate{{PrivateKey: clientKey}},
+		PeerPublicKeys: []crypto.PublicKey{serverKey.Public()},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assertEquals(t, client.ConnectionState().PeerPublicKey, serverKey.Public())
+	assertEquals(t, len(client.ConnectionState().PeerCertificates), 0)
+	assertEquals(t, server.ConnectionState().PeerPublicKey, clientKey.Public())
+	assertEquals(t, len(server.ConnectionState().PeerCertificates), 0)
+}
+
+func TestRawPublicKeyNotPinned(t *testing.T) {
+	serverKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate server key")
+	otherKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate other key")
+
+	serverConfig := &Config{
+		Certificates: []*Certificate{{PrivateKey: serverKey}},
+	}
+	clientConfig := &Config{
+		ServerName:     serverName,
+		PeerPublicKeys: []crypto.PublicKey{otherKey.Public()},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		server.Handshake()
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertBadCertificate)
+	sConn.Close()
+	<-done
+}
+
+func TestRawPublicKeyNotOffered(t *testing.T) {
+	serverKey, err := newSigningKey(ECDSA_P256_SHA256)
+	assertNotError(t, err, "Failed to generate server key")
+
+	// A client that doesn't send server_certificate_type only accepts X.509,
+	// even if the application picks a raw public key
+	for _, useGetCertificate := range []bool{false, true} {
+		serverConfig := &Config{DefaultCertificate: &Certificate{PrivateKey: serverKey}}
+		if useGetCertificate {
+			serverConfig = &Config{
+				Certificates: certificates,
+				GetCertificate: func(*ClientHelloInfo) (*Certificate, error) {
+					return &Certificate{PrivateKey: serverKey}, nil
+				},
+			}
+		}
+		clientConfig := &Config{ServerName: serverName, InsecureSkipVerify: true}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan Alert)
+		go func() {
+			alert := server.Handshake()
+			cConn.Close()
+			done <- alert
+		}()
+
+		client.Handshake()
+		sConn.Close()
+		assertEquals(t, <-done, AlertUnsupportedCertificate)
+	}
+}
+
+func TestSignatureAlgorithmsCert(t *testing.T) {
+	// The client's certificate is ECDSA-signed, but the server only accepts
+	// RSA-signed chains, so the client has nothing to send
+	issued, _ := newCAIssuedCertificate(t, "Test Client CA", "other.example.org")
+
+	var peerCerts int
+	var info *CertificateRequestInfo
+	serverConfig := &Config{
+		RequireClientAuth:           true,
+		Certificates:                certificates,
+		CertificateSignatureSchemes: []SignatureScheme{RSA_PKCS1_SHA256, RSA_PSS_SHA256},
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(i *CertificateRequestInfo) (*Certificate, error) {
+			info = i
+			return issued, nil
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		peerCerts = len(server.ConnectionState().PeerCertificates)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assertDeepEquals(t, info.CertificateSignatureSchemes, serverConfig.CertificateSignatureSchemes)
+	assertEquals(t, peerCerts, 0)
+}
+
+func TestServerCertificateAuthorities(t *testing.T) {
+	issued, cacert := newCAIssuedCertificate(t, "Test Server CA", serverName)
+
+	// The self-signed certificate comes first, so the server would choose it
+	// without the client's certificate_authorities
+	serverConfig := &Config{
+		Certificates: []*Certificate{certificates[0], issued},
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cacert)
+	clientConfig := &Config{
+		ServerName:                 serverName,
+		RootCAs:                    pool,
+		SendCertificateAuthorities: true,
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assertTrue(t, client.ConnectionState().PeerCertificates[0].Equal(issued.Chain[0]), "Wrong server certificate")
+}
+
+func TestClientCertificateAuthorities(t *testing.T) {
+	issued, _ := newCAIssuedCertificate(t, "Test Client CA", "other.example.org")
+
+	var peerCert *x509.Certificate
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	serverConfig := &Config{
+		RequireClientAuth: true,
+		ClientCAs:         clientCAs,
+		Certificates:      certificates,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			var err error
+			peerCert, err = x509.ParseCertificate(rawCerts[0])
+			return err
+		},
+	}
+
+	var acceptableCAs [][]byte
+	for _, getCert := range []bool{false, true} {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			Certificates:       []*Certificate{issued, clientCertificates[0]},
+			InsecureSkipVerify: true,
+		}
+		if getCert {
+			clientConfig.GetClientCertificate = func(info *CertificateRequestInfo) (*Certificate, error) {
+				acceptableCAs = info.AcceptableCAs
+				return clientCertificates[0], nil
+			}
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		assertNotNil(t, peerCert, "Server did not receive a client certificate")
+		assertTrue(t, peerCert.Equal(clientCert), "Wrong client certificate")
+	}
+
+	assertDeepEquals(t, acceptableCAs, [][]byte{clientCert.RawSubject})
+}
+
+func TestGetCertificate(t *testing.T) {
+	var info *ClientHelloInfo
+	serverConfig := &Config{
+		NextProtos: []string{"h2"},
+		GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+			info = chi
+			return certificates[0], nil
+		},
+	}
+	clientConfig := &Config{
+		ServerName:         serverName,
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+	}
+	assertTrue(t, serverConfig.ValidForServer(), "GetCertificate config not valid for server")
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		serverAlert := server.Handshake()
+		assertEquals(t, serverAlert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	clientAlert := client.Handshake()
+	assertEquals(t, clientAlert, AlertNoAlert)
+	<-done
+
+	checkConsistency(t, client, server)
+	assertNotNil(t, info, "GetCertificate was not called")
+	assertEquals(t, info.ServerName, serverName)
+	assertDeepEquals(t, info.CipherSuites, defaultSupportedCipherSuites)
+	assertDeepEquals(t, info.SupportedGroups, defaultSupportedGroups)
+	assertDeepEquals(t, info.SignatureSchemes, defaultSignatureSchemes)
+	assertDeepEquals(t, info.SupportedProtos, []string{"h2"})
+	assertTrue(t, client.ConnectionState().PeerCertificates[0].Equal(serverCert), "Wrong server certificate")
+}
+
+func TestGetCertificateError(t *testing.T) {
+	serverConfig := &Config{
+		GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+			return nil, errors.New("no certificate")
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, basicConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		client.Handshake()
+		done <- true
+	}()
+
+	serverAlert := server.Handshake()
+	assertEquals(t, serverAlert, AlertInternalError)
+
+	cConn.Close()
+	<-done
+}
+
+func TestGetConfigForClient(t *testing.T) {
+	tenantConfig := &Config{
+		Certificates:       certificates,
+		NextProtos:         []string{"h2"},
+		SendSessionTickets: true,
+		RequireCookie:      true,
+	}
+	serverConfig := &Config{
+		GetConfigForClient: func(chi *ClientHelloInfo) (*Config, error) {
+			if chi.ServerName != serverName {
+				return nil, errors.New("unknown tenant")
+			}
+			return tenantConfig, nil
+		},
+	}
+	assertTrue(t, serverConfig.ValidForServer(), "GetConfigForClient config not valid for server")
+
+	cConn, sConn := pipe()
+	client := Client(cConn, alpnConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		serverAlert := server.Handshake()
+		assertEquals(t, serverAlert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	clientAlert := client.Handshake()
+	assertEquals(t, clientAlert, AlertNoAlert)
+	<-done
+
+	checkConsistency(t, client, server)
+	assertEquals(t, client.ConnectionState().NextProto, "h2")
+	assertNotNil(t, tenantConfig.CookieProtector, "Tenant config did not get a cookie protector")
+	assertEquals(t, tenantConfig.PSKs.Size(), 1)
+	assertEquals(t, serverConfig.PSKs.Size(), 0)
+}
+
 func TestClientAuth(t *testing.T) {
 	configServer := &Config{
 		RequireClientAuth: true,
@@ -732,38 +1115,722 @@ func TestClientAuthVerifyPeerRejected(t *testing.T) {
 		done <- true
 	}()
 
-	serverAlert := server.Handshake()
-	assertEquals(t, serverAlert, AlertBadCertificate)
-	assertEquals(t, verifyCalled, true)
+	serverAlert := server.Handshake()
+	assertEquals(t, serverAlert, AlertBadCertificate)
+	assertEquals(t, verifyCalled, true)
+
+	cConn.Close()
+	<-done
+}
+
+func TestDelegatedCredentials(t *testing.T) {
+	cert := newTestCertificate(t, delegationCertOptions(true))
+	delegated, err := NewDelegatedCredential(cert, ECDSA_P256_SHA256, time.Hour)
+	assertNotError(t, err, "Failed to create delegated credential")
+
+	// The server only holds the delegated credential, so it can't serve
+	// clients that don't accept one
+	for _, accept := range []bool{true, false} {
+		serverConfig := &Config{
+			Certificates: []*Certificate{delegated},
+		}
+		clientConfig := &Config{
+			ServerName:                 serverName,
+			InsecureSkipVerify:         true,
+			AcceptDelegatedCredentials: accept,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			client.Handshake()
+			done <- true
+		}()
+
+		alert := server.Handshake()
+		if !accept {
+			assertEquals(t, alert, AlertAccessDenied)
+			cConn.Close()
+			<-done
+			continue
+		}
+
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+		assertDeepEquals(t, client.ConnectionState().DelegatedCredential, delegated.DelegatedCredential)
+		assertTrue(t, client.ConnectionState().PeerCertificates[0].Equal(cert.Chain[0]), "Wrong server certificate")
+	}
+}
+
+type countingCompressor struct {
+	ZlibCertificateCompressor
+	compressed, decompressed int
+}
+
+func (c *countingCompressor) Compress(data []byte) ([]byte, error) {
+	c.compressed++
+	return c.ZlibCertificateCompressor.Compress(data)
+}
+
+func (c *countingCompressor) Decompress(data []byte, uncompressedLength int) ([]byte, error) {
+	c.decompressed++
+	return c.ZlibCertificateCompressor.Decompress(data, uncompressedLength)
+}
+
+func TestCertificateCompression(t *testing.T) {
+	for _, clientCompresses := range []bool{true, false} {
+		serverCompressor := &countingCompressor{}
+		clientCompressor := &countingCompressor{}
+
+		serverConfig := &Config{
+			RequireClientAuth:      true,
+			Certificates:           certificates,
+			CertificateCompressors: []CertificateCompressor{serverCompressor},
+		}
+		clientConfig := &Config{
+			ServerName:         serverName,
+			Certificates:       clientCertificates,
+			InsecureSkipVerify: true,
+		}
+		if clientCompresses {
+			clientConfig.CertificateCompressors = []CertificateCompressor{clientCompressor}
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		checkConsistency(t, client, server)
+		assertEquals(t, len(server.ConnectionState().PeerCertificates), 1)
+
+		// Each certificate is compressed exactly when both sides support it
+		expected := 0
+		if clientCompresses {
+			expected = 1
+		}
+		assertEquals(t, serverCompressor.compressed, expected)
+		assertEquals(t, clientCompressor.decompressed, expected)
+		assertEquals(t, clientCompressor.compressed, expected)
+		assertEquals(t, serverCompressor.decompressed, expected)
+	}
+}
+
+func TestECH(t *testing.T) {
+	publicName := "public.example.com"
+	privateCert, privateCA := newCAIssuedCertificate(t, "Test Private CA", serverName)
+	publicCert, publicCA := newCAIssuedCertificate(t, "Test Public CA", publicName)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(privateCA)
+	rootCAs.AddCert(publicCA)
+
+	key, err := NewECHKey(1, publicName)
+	assertNotError(t, err, "Failed to generate ECH key")
+	configs, err := MarshalECHConfigList([]ECHConfig{key.Config})
+	assertNotError(t, err, "Failed to marshal ECHConfigList")
+
+	// A key with the same ID that can't decrypt what the client sends
+	staleKey, err := NewECHKey(1, publicName)
+	assertNotError(t, err, "Failed to generate ECH key")
+	retryConfigs, err := MarshalECHConfigList([]ECHConfig{staleKey.Config})
+	assertNotError(t, err, "Failed to marshal ECHConfigList")
+
+	for _, accept := range []bool{true, false} {
+		for _, requireCookie := range []bool{false, true} {
+			var clientHelloName string
+			serverConfig := &Config{
+				Certificates:  []*Certificate{privateCert, publicCert},
+				ECHKeys:       []*ECHKey{key},
+				RequireCookie: requireCookie,
+				GetCertificate: func(chi *ClientHelloInfo) (*Certificate, error) {
+					clientHelloName = chi.ServerName
+					return nil, nil
+				},
+			}
+			if !accept {
+				serverConfig.ECHKeys = []*ECHKey{staleKey}
+			}
+			clientConfig := &Config{
+				ServerName: serverName,
+				RootCAs:    rootCAs,
+				ECHConfigs: configs,
+			}
+
+			cConn, sConn := pipe()
+			client := Client(cConn, clientConfig)
+			server := Server(sConn, serverConfig)
+
+			done := make(chan Alert)
+			go func() {
+				done <- server.Handshake()
+			}()
+
+			alert := client.Handshake()
+			if !accept {
+				// The server authenticated as the public name, and offered the
+				// client another config.  It only learns of the failure after
+				// its handshake completes.
+				assertEquals(t, alert, AlertECHRequired)
+				assertEquals(t, <-done, AlertNoAlert)
+				assertEquals(t, clientHelloName, publicName)
+				assertByteEquals(t, client.ConnectionState().ECHRetryConfigs, retryConfigs)
+				continue
+			}
+
+			assertEquals(t, alert, AlertNoAlert)
+			assertEquals(t, <-done, AlertNoAlert)
+			checkConsistency(t, client, server)
+			assertEquals(t, clientHelloName, serverName)
+			assertTrue(t, client.ConnectionState().UsingECH, "Client didn't use ECH")
+			assertTrue(t, server.ConnectionState().UsingECH, "Server didn't use ECH")
+			assertTrue(t, client.ConnectionState().PeerCertificates[0].Equal(privateCert.Chain[0]), "Wrong server certificate")
+		}
+	}
+
+	// A server without ECH keys follows the ClientHelloOuter, and sends no
+	// retry configs
+	serverConfig := &Config{Certificates: []*Certificate{privateCert, publicCert}}
+	clientConfig := &Config{ServerName: serverName, RootCAs: rootCAs, ECHConfigs: configs}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	go server.Handshake()
+	assertEquals(t, client.Handshake(), AlertECHRequired)
+	assertEquals(t, len(client.ConnectionState().ECHRetryConfigs), 0)
+}
+
+func TestClientAuthModes(t *testing.T) {
+	issued, cacert := newCAIssuedCertificate(t, "Test Client CA", clientName)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cacert)
+
+	// The client always sends clientCert, so that its choice isn't affected by
+	// the certificate_authorities extension
+	cases := []struct {
+		clientAuth ClientAuthType
+		clientCert *Certificate
+		alert      Alert
+		verified   bool
+	}{
+		{RequestClientCert, nil, AlertNoAlert, false},
+		{RequestClientCert, clientCertificates[0], AlertNoAlert, false},
+		{RequireAnyClientCert, nil, AlertCertificateRequired, false},
+		{RequireAnyClientCert, clientCertificates[0], AlertNoAlert, false},
+		{VerifyClientCertIfGiven, nil, AlertNoAlert, false},
+		{VerifyClientCertIfGiven, clientCertificates[0], AlertBadCertificate, false},
+		{VerifyClientCertIfGiven, issued, AlertNoAlert, true},
+		{RequireAndVerifyClientCert, nil, AlertCertificateRequired, false},
+		{RequireAndVerifyClientCert, clientCertificates[0], AlertBadCertificate, false},
+		{RequireAndVerifyClientCert, issued, AlertNoAlert, true},
+	}
+
+	for _, c := range cases {
+		serverConfig := &Config{
+			ClientAuth:   c.clientAuth,
+			ClientCAs:    clientCAs,
+			Certificates: certificates,
+		}
+		clientCert := c.clientCert
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			GetClientCertificate: func(*CertificateRequestInfo) (*Certificate, error) {
+				return clientCert, nil
+			},
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			client.Handshake()
+			done <- true
+		}()
+
+		alert := server.Handshake()
+		assertEquals(t, alert, c.alert)
+		<-done
+
+		if c.alert != AlertNoAlert {
+			continue
+		}
+
+		serverCS := server.ConnectionState()
+		if c.clientCert != nil {
+			assertDeepEquals(t, serverCS.PeerCertificates, c.clientCert.Chain)
+		} else {
+			assertEquals(t, len(serverCS.PeerCertificates), 0)
+		}
+		if c.verified {
+			assertDeepEquals(t, serverCS.VerifiedChains, [][]*x509.Certificate{issued.Chain})
+		} else {
+			assertEquals(t, len(serverCS.VerifiedChains), 0)
+		}
+	}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	staple := []byte{0x30, 0x03, 0x0a, 0x01, 0x00}
+	refreshed := []byte{0x30, 0x03, 0x0a, 0x01, 0x01}
+
+	fixed := *certificates[0]
+	fixed.OCSPStaple = staple
+	refreshing := *certificates[0]
+	refreshing.OCSPStaple = staple
+	refreshing.GetOCSPStaple = func() ([]byte, error) {
+		return refreshed, nil
+	}
+	failing := *certificates[0]
+	failing.GetOCSPStaple = func() ([]byte, error) {
+		return nil, errors.New("OCSP responder unavailable")
+	}
+
+	cases := []struct {
+		cert     *Certificate
+		response []byte
+	}{
+		{certificates[0], nil},
+		{&fixed, staple},
+		{&refreshing, refreshed},
+		{&failing, nil},
+	}
+
+	for _, c := range cases {
+		var verifyResponse []byte
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			VerifyOCSPResponse: func(ocspResponse []byte, peerCertificates []*x509.Certificate) error {
+				verifyResponse = ocspResponse
+				assertEquals(t, len(peerCertificates), 1)
+				return nil
+			},
+		}
+		serverConfig := &Config{
+			Certificates: []*Certificate{c.cert},
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			alert := server.Handshake()
+			assertEquals(t, alert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		alert := client.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+
+		assertByteEquals(t, verifyResponse, c.response)
+		assertByteEquals(t, client.ConnectionState().OCSPResponse, c.response)
+	}
+}
+
+func TestOCSPResponseRejected(t *testing.T) {
+	cert := *certificates[0]
+	cert.OCSPStaple = []byte{0x30, 0x03, 0x0a, 0x01, 0x00}
+
+	clientConfig := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		VerifyOCSPResponse: func(ocspResponse []byte, peerCertificates []*x509.Certificate) error {
+			return errors.New("revoked")
+		},
+	}
+	serverConfig := &Config{
+		Certificates: []*Certificate{&cert},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	done := make(chan bool)
+	go func() {
+		server.Handshake()
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertBadCertificateStatsResponse)
+
+	sConn.Close()
+	<-done
+}
+
+func TestSignedCertificateTimestamps(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNotError(t, err, "Failed to generate log key")
+
+	cert := *certificates[0]
+	cert.SignedCertificateTimestamps = [][]byte{newTestSCT(t, logKey, serverCert, 1)}
+	serverConfig := &Config{
+		Certificates: []*Certificate{&cert},
+	}
+
+	for _, minValidSCTs := range []int{0, 1, 2} {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			InsecureSkipVerify: true,
+			CTLogKeys:          []crypto.PublicKey{logKey.Public()},
+			MinValidSCTs:       minValidSCTs,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func() {
+			server.Handshake()
+			done <- true
+		}()
+
+		alert := client.Handshake()
+		if minValidSCTs > len(cert.SignedCertificateTimestamps) {
+			assertEquals(t, alert, AlertBadCertificate)
+			sConn.Close()
+			<-done
+			continue
+		}
+
+		assertEquals(t, alert, AlertNoAlert)
+		<-done
+		assertDeepEquals(t, client.ConnectionState().SignedCertificateTimestamps, cert.SignedCertificateTimestamps)
+	}
+}
+
+func TestGetClientCertificate(t *testing.T) {
+	var verifyCalled bool
+	configServer := &Config{
+		RequireClientAuth: true,
+		Certificates:      certificates,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			verifyCalled = true
+			assertEquals(t, len(rawCerts), 1)
+			return nil
+		},
+	}
+
+	var gotInfo *CertificateRequestInfo
+	configClient := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(info *CertificateRequestInfo) (*Certificate, error) {
+			gotInfo = info
+			return clientCertificates[0], nil
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, configClient)
+	server := Server(sConn, configServer)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	assertNotNil(t, gotInfo, "GetClientCertificate was not called")
+	assertDeepEquals(t, gotInfo.SignatureSchemes, server.config.SignatureSchemes)
+	assertEquals(t, verifyCalled, true)
+}
+
+func TestGetClientCertificateNone(t *testing.T) {
+	var verifyCalled bool
+	configServer := &Config{
+		RequireClientAuth: true,
+		Certificates:      certificates,
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			verifyCalled = true
+			return nil
+		},
+	}
+	configClient := &Config{
+		ServerName:         serverName,
+		Certificates:       clientCertificates,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(info *CertificateRequestInfo) (*Certificate, error) {
+			return nil, nil
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, configClient)
+	server := Server(sConn, configServer)
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		alert := server.Handshake()
+		assertEquals(t, alert, AlertNoAlert)
+		done <- true
+	}(t)
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertNoAlert)
+	<-done
+
+	// An empty Certificate was sent, so the server had nothing to verify
+	assertEquals(t, verifyCalled, false)
+}
+
+func TestGetClientCertificateError(t *testing.T) {
+	configServer := &Config{
+		RequireClientAuth: true,
+		Certificates:      certificates,
+	}
+	configClient := &Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+		GetClientCertificate: func(info *CertificateRequestInfo) (*Certificate, error) {
+			return nil, errors.New("no certificate for you")
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, configClient)
+	server := Server(sConn, configServer)
+
+	done := make(chan bool)
+	go func() {
+		server.Handshake()
+		done <- true
+	}()
+
+	alert := client.Handshake()
+	assertEquals(t, alert, AlertInternalError)
+
+	sConn.Close()
+	<-done
+}
+
+func TestPSKFlows(t *testing.T) {
+	for _, conf := range []*Config{pskConfig, pskECDHEConfig, pskDHEConfig} {
+		cConn, sConn := pipe()
+
+		client := Client(cConn, conf)
+		server := Server(sConn, conf)
+
+		var clientAlert, serverAlert Alert
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			serverAlert = server.Handshake()
+			assertEquals(t, serverAlert, AlertNoAlert)
+			done <- true
+		}(t)
+
+		clientAlert = client.Handshake()
+		assertEquals(t, clientAlert, AlertNoAlert)
+
+		<-done
+
+		checkConsistency(t, client, server)
+
+		assertTrue(t, client.state.Params.UsingPSK, "Session did not use the provided PSK")
+	}
+}
+
+func TestImportedPSK(t *testing.T) {
+	imp := PSKImporter{
+		Identity: []byte("client-17"),
+		Key:      bytes.Repeat([]byte{0xa5}, 32),
+	}
+	suites := []CipherSuite{TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256}
+	imported, err := imp.ImportAll(suites)
+	assertNotError(t, err, "Failed to import PSKs")
+
+	// The client offers the PSK imported for SHA-384; the server finds it
+	// with GetPSK rather than in its PSKs
+	clientConfig := &Config{
+		ServerName:         serverName,
+		CipherSuites:       suites,
+		PSKs:               &PSKMapCache{serverName: imported[0]},
+		InsecureSkipVerify: true,
+	}
+
+	var lookups int
+	var lookupErr error
+	serverConfig := &Config{
+		CipherSuites: suites,
+		GetPSK: func(identity []byte, info *ClientHelloInfo) (*PreSharedKey, error) {
+			lookups++
+			assertEquals(t, info.ServerName, serverName)
+			if lookupErr != nil {
+				return nil, lookupErr
+			}
+			for _, psk := range imported {
+				if bytes.Equal(psk.Identity, identity) {
+					return &psk, nil
+				}
+			}
+			return nil, nil
+		},
+	}
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	var serverAlert Alert
+	done := make(chan bool)
+	go func() {
+		serverAlert = server.Handshake()
+		done <- true
+	}()
+
+	clientAlert := client.Handshake()
+	<-done
+	assertEquals(t, clientAlert, AlertNoAlert)
+	assertEquals(t, serverAlert, AlertNoAlert)
+
+	checkConsistency(t, client, server)
+	assertEquals(t, lookups, 1)
+	assertTrue(t, server.state.Params.UsingPSK, "Session did not use the imported PSK")
+	assertEquals(t, server.state.Params.CipherSuite, TLS_AES_256_GCM_SHA384)
+
+	// An error from GetPSK aborts the handshake
+	lookupErr = errors.New("database unavailable")
+	cConn, sConn = pipe()
+	client = Client(cConn, clientConfig)
+	server = Server(sConn, serverConfig)
+
+	go func() {
+		client.Handshake()
+		done <- true
+	}()
+
+	serverAlert = server.Handshake()
+	assertEquals(t, serverAlert, AlertInternalError)
 
 	cConn.Close()
 	<-done
 }
 
-func TestPSKFlows(t *testing.T) {
-	for _, conf := range []*Config{pskConfig, pskECDHEConfig, pskDHEConfig} {
-		cConn, sConn := pipe()
+// A PreSharedKeyCache that holds several PSKs per key
+type pskListCache map[string][]PreSharedKey
 
-		client := Client(cConn, conf)
-		server := Server(sConn, conf)
+func (cache pskListCache) Get(key string) (PreSharedKey, bool) {
+	if len(cache[key]) == 0 {
+		return PreSharedKey{}, false
+	}
+	return cache[key][0], true
+}
 
-		var clientAlert, serverAlert Alert
+func (cache pskListCache) Put(key string, psk PreSharedKey) {
+	cache[key] = append(cache[key], psk)
+}
+
+func (cache pskListCache) Size() int {
+	return len(cache)
+}
+
+func (cache pskListCache) GetAll(key string) []PreSharedKey {
+	return cache[key]
+}
+
+func TestClientPSKCandidates(t *testing.T) {
+	now := time.Now()
+	external := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, Identity: []byte{1}}
+	older := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, IsResumption: true, Identity: []byte{2}, ReceivedAt: now.Add(-time.Hour)}
+	newer := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, IsResumption: true, Identity: []byte{3}, ReceivedAt: now}
+	sha384 := PreSharedKey{CipherSuite: TLS_AES_256_GCM_SHA384, IsResumption: true, Identity: []byte{4}, ReceivedAt: now}
+	expired := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, Identity: []byte{5}, ExpiresAt: now.Add(-time.Second)}
+
+	// Tickets come from the ClientSessionCache, external PSKs from PSKs
+	opts := ConnectionOptions{ServerName: serverName, SessionCacheKey: "key"}
+	sessions := NewClientSessionMapCache(0)
+	for _, ticket := range []PreSharedKey{older, sha384, newer} {
+		sessions.Put(opts.SessionCacheKey, ticket)
+	}
+	config := &Config{
+		PSKs:               pskListCache{serverName: {expired, external}},
+		ClientSessionCache: sessions,
+	}
+	candidates := clientPSKCandidates(config, opts, []CipherSuite{TLS_AES_128_GCM_SHA256})
+	assertDeepEquals(t, candidates, []PreSharedKey{newer, older, external})
+
+	// A PSK cache without GetAll offers just the one PSK
+	config = &Config{PSKs: &PSKMapCache{serverName: external}}
+	candidates = clientPSKCandidates(config, opts, []CipherSuite{TLS_AES_128_GCM_SHA256})
+	assertDeepEquals(t, candidates, []PreSharedKey{external})
+}
+
+func TestMultiplePSKs(t *testing.T) {
+	unknown := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, Identity: []byte{9, 9, 9, 9}, Key: []byte{1, 2, 3, 4}}
+	sha256 := PreSharedKey{CipherSuite: TLS_AES_128_GCM_SHA256, Identity: []byte{0, 1, 2, 3}, Key: []byte{4, 5, 6, 7}}
+	sha384 := PreSharedKey{CipherSuite: TLS_AES_256_GCM_SHA384, Identity: []byte{4, 5, 6, 7}, Key: []byte{8, 9, 10, 11}}
+
+	cases := []struct {
+		serverSuites []CipherSuite
+		selected     PreSharedKey
+	}{
+		{[]CipherSuite{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384}, sha256},
+		{[]CipherSuite{TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256}, sha384},
+	}
+	for _, c := range cases {
+		clientConfig := &Config{
+			ServerName:         serverName,
+			CipherSuites:       []CipherSuite{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384},
+			PSKs:               pskListCache{serverName: {unknown, sha256, sha384}},
+			AllowEarlyData:     true,
+			InsecureSkipVerify: true,
+		}
+		serverConfig := &Config{
+			CipherSuites:   c.serverSuites,
+			PSKs:           &PSKMapCache{"00010203": sha256, "04050607": sha384},
+			AllowEarlyData: true,
+		}
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
 
+		var serverAlert Alert
 		done := make(chan bool)
-		go func(t *testing.T) {
+		go func() {
 			serverAlert = server.Handshake()
-			assertEquals(t, serverAlert, AlertNoAlert)
 			done <- true
-		}(t)
-
-		clientAlert = client.Handshake()
-		assertEquals(t, clientAlert, AlertNoAlert)
+		}()
 
+		clientAlert := client.Handshake()
 		<-done
+		assertEquals(t, clientAlert, AlertNoAlert)
+		assertEquals(t, serverAlert, AlertNoAlert)
 
 		checkConsistency(t, client, server)
+		assertTrue(t, client.state.Params.UsingPSK, "Session did not use a PSK")
+		assertEquals(t, client.state.Params.CipherSuite, c.selected.CipherSuite)
 
-		assertTrue(t, client.state.Params.UsingPSK, "Session did not use the provided PSK")
+		// Early data is only accepted under the first PSK offered
+		assertTrue(t, !server.state.Params.UsingEarlyData, "Accepted early data under a later PSK")
 	}
 }
 
@@ -802,20 +1869,17 @@ func TestResumption(t *testing.T) {
 	<-done
 
 	checkConsistency(t, client1, server1)
-	assertEquals(t, clientConfig.PSKs.Size(), 1)
 	assertEquals(t, serverConfig.PSKs.Size(), 1)
 
-	clientCache := clientConfig.PSKs.(*PSKMapCache)
+	clientTickets := clientConfig.ClientSessionCache.Get(client1.sessionCacheKey())
+	assertEquals(t, len(clientTickets), 1)
 	serverCache := serverConfig.PSKs.(*PSKMapCache)
 
 	var serverPSK PreSharedKey
 	for _, key := range *serverCache {
 		serverPSK = key
 	}
-	var clientPSK PreSharedKey
-	for _, key := range *clientCache {
-		clientPSK = key
-	}
+	clientPSK := clientTickets[0]
 
 	// Ensure that the PSKs are the same, except with regard to the
 	// receivedAt/expiresAt times, which might differ by a little.
@@ -852,6 +1916,165 @@ func TestResumption(t *testing.T) {
 	assertTrue(t, client2.state.Params.UsingPSK, "Session did not use the provided PSK")
 }
 
+func TestResumptionPeerAuth(t *testing.T) {
+	serverConfig := resumptionConfig.Clone()
+	serverConfig.RequireClientAuth = true
+	clientConfig := resumptionConfig.Clone()
+	clientConfig.Certificates = clientCertificates
+
+	handshake := func() (*Conn, *Conn) {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			serverAlert := server.Handshake()
+			assertEquals(t, serverAlert, AlertNoAlert)
+			server.Write([]byte{'a'})
+			done <- true
+		}(t)
+
+		clientAlert := client.Handshake()
+		assertEquals(t, clientAlert, AlertNoAlert)
+
+		// Read the ticket along with the byte the server sent
+		_, err := client.Read(make([]byte, 1))
+		assertNotError(t, err, "Couldn't read one byte")
+		<-done
+		return client, server
+	}
+
+	client1, server1 := handshake()
+	assertTrue(t, !client1.state.Params.UsingPSK, "First session used a PSK")
+	assertTrue(t, server1.state.Params.UsingClientAuth, "First session did not use client auth")
+
+	// The resumed session reports the peers from the first session
+	client2, server2 := handshake()
+	assertTrue(t, client2.state.Params.UsingPSK, "Session did not resume")
+	assertTrue(t, !server2.state.Params.UsingClientAuth, "Resumed session used client auth")
+
+	serverState := server2.ConnectionState()
+	assertEquals(t, len(serverState.PeerCertificates), 1)
+	assertTrue(t, serverState.PeerCertificates[0].Equal(clientCert), "Wrong client certificate")
+	assertDeepEquals(t, serverState.VerifiedChains, server1.ConnectionState().VerifiedChains)
+
+	clientState := client2.ConnectionState()
+	assertEquals(t, len(clientState.PeerCertificates), 1)
+	assertTrue(t, clientState.PeerCertificates[0].Equal(serverCert), "Wrong server certificate")
+
+	// The ticket used to resume is gone, and the one issued on the resumed
+	// session carries the same peers
+	tickets := clientConfig.ClientSessionCache.Get(client2.sessionCacheKey())
+	assertEquals(t, len(tickets), 1)
+	assertTrue(t, tickets[0].PeerCertificates[0].Equal(serverCert), "Ticket lost the server certificate")
+}
+
+func TestResumptionExpiredOnServer(t *testing.T) {
+	serverConfig := resumptionConfig.Clone()
+	clientConfig := resumptionConfig.Clone()
+
+	handshake := func() *Conn {
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			serverAlert := server.Handshake()
+			assertEquals(t, serverAlert, AlertNoAlert)
+			server.Write([]byte{'a'})
+			done <- true
+		}(t)
+
+		clientAlert := client.Handshake()
+		assertEquals(t, clientAlert, AlertNoAlert)
+		_, err := client.Read(make([]byte, 1))
+		assertNotError(t, err, "Couldn't read one byte")
+		<-done
+		return client
+	}
+
+	client := handshake()
+	assertTrue(t, !client.state.Params.UsingPSK, "First session used a PSK")
+
+	// The server's copy of the ticket expires, though the client's hasn't
+	serverCache := serverConfig.PSKs.(*PSKMapCache)
+	for key, ticket := range *serverCache {
+		ticket.ExpiresAt = time.Now().Add(-time.Second)
+		(*serverCache)[key] = ticket
+	}
+
+	client = handshake()
+	assertTrue(t, !client.state.Params.UsingPSK, "Resumed with an expired ticket")
+}
+
+func TestSendSessionTicket(t *testing.T) {
+	serverConfig := resumptionConfig.Clone()
+	serverConfig.TicketCount = 3
+	serverConfig.TicketLifetime = 3600
+	clientConfig := resumptionConfig.Clone()
+
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	// Tickets can't be sent before the handshake, or by a client
+	err := server.SendSessionTicket(SessionTicketOptions{Lifetime: 60})
+	assertError(t, err, "Sent a ticket before the handshake")
+
+	done := make(chan bool)
+	go func(t *testing.T) {
+		serverAlert := server.Handshake()
+		assertEquals(t, serverAlert, AlertNoAlert)
+		server.Write([]byte{'a'})
+		done <- true
+	}(t)
+
+	clientAlert := client.Handshake()
+	assertEquals(t, clientAlert, AlertNoAlert)
+	_, err = client.Read(make([]byte, 1))
+	assertNotError(t, err, "Couldn't read one byte")
+	<-done
+
+	err = client.SendSessionTicket(SessionTicketOptions{Lifetime: 60})
+	assertError(t, err, "Client sent a ticket")
+
+	// TicketCount tickets are sent with the handshake
+	key := client.sessionCacheKey()
+	tickets := clientConfig.ClientSessionCache.Get(key)
+	assertEquals(t, len(tickets), 3)
+	assertEquals(t, serverConfig.PSKs.Size(), 3)
+	for _, ticket := range tickets {
+		lifetime := ticket.ExpiresAt.Sub(ticket.ReceivedAt).Round(time.Second)
+		assertEquals(t, lifetime, 3600*time.Second)
+	}
+
+	// More can be sent later, each with its own options
+	go func(t *testing.T) {
+		err := server.SendSessionTicket(SessionTicketOptions{
+			Lifetime:         60,
+			MaxEarlyDataSize: 1024,
+			Extensions:       []ExtensionBody{&testExtensionBody{t: HandshakeTypeNewSessionTicket}},
+		})
+		assertNotError(t, err, "Couldn't send session ticket")
+		server.Write([]byte{'b'})
+		done <- true
+	}(t)
+
+	_, err = client.Read(make([]byte, 1))
+	assertNotError(t, err, "Couldn't read one byte")
+	<-done
+
+	tickets = clientConfig.ClientSessionCache.Get(key)
+	assertEquals(t, len(tickets), 4)
+	assertEquals(t, serverConfig.PSKs.Size(), 4)
+	assertEquals(t, tickets[3].ExpiresAt.Sub(tickets[3].ReceivedAt).Round(time.Second), 60*time.Second)
+
+	err = server.SendSessionTicket(SessionTicketOptions{Lifetime: maxTicketLifetime + 1})
+	assertError(t, err, "Sent a ticket with too long a lifetime")
+}
+
 func test0xRTT(t *testing.T, name string, p testInstanceState) {
 	conf := *pskConfig
 	conf.NonBlocking = true
@@ -876,13 +2099,19 @@ func test0xRTT(t *testing.T, name string, p testInstanceState) {
 	assertEquals(t, n, len(zdata))
 	hsUntilBlocked(t, server, sbConn) // Read CH and early data.
 	tmp := make([]byte, 10)
-	n, err = server.Read(tmp)
+
+	// Early data is only returned by the early data reader, not Read
+	_, err = server.Read(tmp)
+	assertError(t, err, "Read returned before the handshake completed")
+	n, err = server.EarlyData().Read(tmp)
 	assertNotError(t, err, "Error reading early data")
 	tmp = tmp[:n]
 	assertByteEquals(t, zdata, tmp)
 	hsRunHandshakeOneThread(t, client, server)
 
 	assertTrue(t, client.state.Params.UsingEarlyData, "Session did not negotiate early data")
+	assertTrue(t, client.EarlyDataAccepted(), "Client did not report early data accepted")
+	assertTrue(t, !client.ConnectionState().RejectedEarlyData, "Client reported early data rejected")
 	n, err = server.Read(tmp)
 	assertEquals(t, AlertWouldBlock, err)
 	assertEquals(t, 0, n)
@@ -929,6 +2158,166 @@ func Test0xRTTFailure(t *testing.T) {
 	<-done
 }
 
+func TestEarlyDataRejectedResend(t *testing.T) {
+	cconf := pskConfig.Clone()
+	cconf.NonBlocking = true
+	cconf.ResendRejectedEarlyData = true
+	sconf := pskConfig.Clone()
+	sconf.NonBlocking = true
+	sconf.AllowEarlyData = false
+
+	cConn, sConn := pipe()
+	cbConn := newBufferedConn(cConn)
+	cbConn.SetAutoflush()
+	sbConn := newBufferedConn(sConn)
+	sbConn.SetAutoflush()
+
+	client := Client(cbConn, cconf)
+	server := Server(sbConn, sconf)
+
+	// WriteEarlyData sends the ClientHello itself
+	zdata := []byte("ABC")
+	n, err := client.WriteEarlyData(zdata)
+	assertNotError(t, err, "Client was not able to write early data")
+	assertEquals(t, n, len(zdata))
+
+	hsRunHandshakeOneThread(t, client, server)
+	assertTrue(t, !client.EarlyDataAccepted(), "Client reported early data accepted")
+	assertTrue(t, client.ConnectionState().RejectedEarlyData, "Client did not report early data rejected")
+	assertTrue(t, server.ConnectionState().RejectedEarlyData, "Server did not report early data rejected")
+
+	// The rejected data arrives as 1-RTT data
+	tmp := make([]byte, 10)
+	n, err = server.Read(tmp)
+	assertNotError(t, err, "Error reading resent early data")
+	assertByteEquals(t, zdata, tmp[:n])
+}
+
+func TestEarlyDataLimit(t *testing.T) {
+	// Returns a nonblocking config with a copy of psk that allows limit bytes
+	// of early data
+	configWithLimit := func(limit uint32) *Config {
+		key := psk
+		key.MaxEarlyDataSize = limit
+		conf := pskConfig.Clone()
+		conf.NonBlocking = true
+		conf.PSKs = &PSKMapCache{serverName: key, "00010203": key}
+		return conf
+	}
+
+	newPair := func(cconf, sconf *Config) (*Conn, *Conn) {
+		cConn, sConn := pipe()
+		cbConn := newBufferedConn(cConn)
+		cbConn.SetAutoflush()
+		sbConn := newBufferedConn(sConn)
+		sbConn.SetAutoflush()
+		return Client(cbConn, cconf), Server(sbConn, sconf)
+	}
+
+	// A client doesn't offer early data under a PSK that doesn't allow it
+	client, server := newPair(configWithLimit(0), configWithLimit(16))
+	_, err := client.WriteEarlyData([]byte("ABC"))
+	assertError(t, err, "Wrote early data under a PSK that doesn't allow it")
+	hsRunHandshakeOneThread(t, client, server)
+	assertTrue(t, !client.state.Params.ClientSendingEarlyData, "Client offered early data")
+
+	// A server doesn't accept early data under a PSK that doesn't allow it
+	client, server = newPair(configWithLimit(16), configWithLimit(0))
+	_, err = client.WriteEarlyData([]byte("ABC"))
+	assertNotError(t, err, "Client was not able to write early data")
+	hsRunHandshakeOneThread(t, client, server)
+	assertTrue(t, server.ConnectionState().RejectedEarlyData, "Server accepted early data")
+
+	// A server fails the handshake if it gets more early data than allowed
+	client, server = newPair(configWithLimit(16), configWithLimit(2))
+	_, err = client.WriteEarlyData([]byte("ABC"))
+	assertNotError(t, err, "Client was not able to write early data")
+	client.Handshake()
+	alert := AlertNoAlert
+	for i := 0; i < 10 && (alert == AlertNoAlert || alert == AlertWouldBlock); i++ {
+		alert = server.Handshake()
+	}
+	assertEquals(t, alert, AlertUnexpectedMessage)
+}
+
+func TestWriteEarlyDataWithoutPSK(t *testing.T) {
+	conf := nbConfig.Clone()
+	cConn, _ := pipe()
+	client := Client(cConn, conf)
+
+	n, err := client.WriteEarlyData([]byte{1, 2, 3})
+	assertError(t, err, "WriteEarlyData succeeded without a PSK")
+	assertEquals(t, n, 0)
+}
+
+func testAcceptEarlyData(t *testing.T, name string, p testInstanceState) {
+	accept := p["accept"] == "true"
+
+	// External PSKs are bound to an ALPN value
+	h2PSK := psk
+	h2PSK.NextProto = "h2"
+	h2PSKs := &PSKMapCache{
+		serverName: h2PSK,
+		"00010203": h2PSK,
+	}
+
+	var info *EarlyDataInfo
+	cconf := pskConfig.Clone()
+	cconf.NonBlocking = true
+	cconf.NextProtos = []string{"h2"}
+	cconf.PSKs = h2PSKs
+	sconf := pskConfig.Clone()
+	sconf.NonBlocking = true
+	sconf.NextProtos = []string{"h2"}
+	sconf.PSKs = h2PSKs
+	sconf.AcceptEarlyData = func(i *EarlyDataInfo) bool {
+		info = i
+		return accept
+	}
+
+	cConn, sConn := pipe()
+	cbConn := newBufferedConn(cConn)
+	cbConn.SetAutoflush()
+	sbConn := newBufferedConn(sConn)
+	sbConn.SetAutoflush()
+
+	client := Client(cbConn, cconf)
+	server := Server(sbConn, sconf)
+
+	zdata := []byte("ABC")
+	_, err := client.WriteEarlyData(zdata)
+	assertNotError(t, err, "Client was not able to write early data")
+
+	hsRunHandshakeOneThread(t, client, server)
+	assertNotNil(t, info, "AcceptEarlyData was not called")
+	assertEquals(t, info.ServerName, serverName)
+	assertEquals(t, info.NextProto, "h2")
+	assertByteEquals(t, info.PSKIdentity, psk.Identity)
+	assertEquals(t, client.EarlyDataAccepted(), accept)
+	assertEquals(t, server.EarlyDataAccepted(), accept)
+
+	// Early data is only available from the early data reader
+	tmp := make([]byte, 10)
+	n, err := server.Read(tmp)
+	assertEquals(t, err, AlertWouldBlock)
+	assertEquals(t, n, 0)
+
+	n, err = server.EarlyData().Read(tmp)
+	if accept {
+		assertNotError(t, err, "Error reading early data")
+		assertByteEquals(t, zdata, tmp[:n])
+		_, err = server.EarlyData().Read(tmp)
+	}
+	assertEquals(t, err, io.EOF)
+}
+
+func TestAcceptEarlyData(t *testing.T) {
+	params := map[string][]string{
+		"accept": {"true", "false"},
+	}
+	runParametrizedTest(t, params, testAcceptEarlyData)
+}
+
 func TestKeyUpdate(t *testing.T) {
 	cConn, sConn := pipe()
 
@@ -1833,3 +3222,285 @@ func TestHandshakeMessageAcrossBoundary(t *testing.T) {
 	err = client.Handshake()
 	assertEquals(t, AlertDecodeError, err)
 }
+
+func testTLS12Handshake(t *testing.T, clientConfig, serverConfig *Config) (*Conn, *Conn) {
+	t.Helper()
+	cConn, sConn := pipe()
+	client := Client(cConn, clientConfig)
+	server := Server(sConn, serverConfig)
+
+	var serverAlert Alert
+	done := make(chan bool)
+	go func() {
+		serverAlert = server.Handshake()
+		done <- true
+	}()
+
+	clientAlert := client.Handshake()
+	assertEquals(t, clientAlert, AlertNoAlert)
+	<-done
+	assertEquals(t, serverAlert, AlertNoAlert)
+	return client, server
+}
+
+func TestTLS12(t *testing.T) {
+	rsaKey, rsaCert, err := MakeNewSelfSignedCert(serverName, RSA_PKCS1_SHA256)
+	assertNotError(t, err, "Failed to make RSA certificate")
+	rsaCertificates := []*Certificate{{Chain: []*x509.Certificate{rsaCert}, PrivateKey: rsaKey}}
+
+	cases := map[string]struct {
+		client, server *Config
+		suite          CipherSuite
+	}{
+		"server max": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, MinVersion: VersionTLS12, NextProtos: []string{"h2", "http/1.1"}},
+			server: &Config{Certificates: certificates, MaxVersion: VersionTLS12, NextProtos: []string{"http/1.1"}},
+			suite:  TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		"client max": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, MaxVersion: VersionTLS12, NextProtos: []string{"http/1.1"}},
+			server: &Config{Certificates: certificates, MinVersion: VersionTLS12, NextProtos: []string{"http/1.1"}},
+			suite:  TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		"RSA": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, MaxVersion: VersionTLS12, NextProtos: []string{"http/1.1"}},
+			server: &Config{Certificates: rsaCertificates, MinVersion: VersionTLS12, NextProtos: []string{"http/1.1"}},
+			suite:  TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		},
+		"client auth": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, MaxVersion: VersionTLS12, Certificates: clientCertificates, NextProtos: []string{"http/1.1"}},
+			server: &Config{Certificates: certificates, MinVersion: VersionTLS12, RequireClientAuth: true, NextProtos: []string{"http/1.1"}},
+			suite:  TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			client, server := testTLS12Handshake(t, c.client, c.server)
+
+			clientCS := client.ConnectionState()
+			serverCS := server.ConnectionState()
+			assertEquals(t, clientCS.Version, uint16(VersionTLS12))
+			assertEquals(t, serverCS.Version, uint16(VersionTLS12))
+			assertEquals(t, clientCS.CipherSuite.Suite, c.suite)
+			assertEquals(t, serverCS.CipherSuite.Suite, c.suite)
+			assertEquals(t, clientCS.NextProto, "http/1.1")
+			assertEquals(t, serverCS.NextProto, "http/1.1")
+			if c.server.RequireClientAuth {
+				assertDeepEquals(t, serverCS.PeerCertificates, []*x509.Certificate{clientCert})
+			}
+
+			emptyContext := []byte{}
+			assertByteEquals(t, computeExporter(t, client, "E", emptyContext, 20), computeExporter(t, server, "E", emptyContext, 20))
+			assertNotByteEquals(t, computeExporter(t, client, "E", emptyContext, 20), computeExporter(t, server, "F", emptyContext, 20))
+
+			// Application data flows in both directions
+			buf := make([]byte, 5)
+			_, err := client.Write([]byte("hello"))
+			assertNotError(t, err, "Client write failed")
+			_, err = server.Read(buf)
+			assertNotError(t, err, "Server read failed")
+			assertByteEquals(t, buf, []byte("hello"))
+			_, err = server.Write([]byte("world"))
+			assertNotError(t, err, "Server write failed")
+			_, err = client.Read(buf)
+			assertNotError(t, err, "Client read failed")
+			assertByteEquals(t, buf, []byte("world"))
+		})
+	}
+}
+
+func TestTLS12NotChosen(t *testing.T) {
+	// TLS 1.3 is still chosen when both sides support it
+	clientConfig := &Config{ServerName: serverName, InsecureSkipVerify: true, MinVersion: VersionTLS12}
+	serverConfig := &Config{Certificates: certificates, MinVersion: VersionTLS12}
+	client, server := testTLS12Handshake(t, clientConfig, serverConfig)
+	assertEquals(t, client.ConnectionState().Version, uint16(VersionTLS13))
+	assertEquals(t, server.ConnectionState().Version, uint16(VersionTLS13))
+
+	// A TLS 1.2 server doesn't accept a TLS 1.3-only client
+	cConn, sConn := pipe()
+	client = Client(cConn, &Config{ServerName: serverName, InsecureSkipVerify: true})
+	server = Server(sConn, &Config{Certificates: certificates, MaxVersion: VersionTLS12})
+
+	var serverAlert Alert
+	done := make(chan bool)
+	go func() {
+		serverAlert = server.Handshake()
+		// The server doesn't send an alert, so stop the client reading
+		cConn.Close()
+		done <- true
+	}()
+
+	clientAlert := client.Handshake()
+	assertTrue(t, clientAlert != AlertNoAlert, "Handshake succeeded without a common version")
+	<-done
+	assertEquals(t, serverAlert, AlertProtocolVersion)
+}
+
+type recordingConn struct {
+	*pipeConn
+	written []byte
+}
+
+func (r *recordingConn) Write(data []byte) (int, error) {
+	r.written = append(r.written, data...)
+	return r.pipeConn.Write(data)
+}
+
+// The records in a TLS stream
+func splitRecords(t *testing.T, data []byte) ([]RecordType, [][]byte) {
+	types := []RecordType{}
+	fragments := [][]byte{}
+	for len(data) > 0 {
+		assertTrue(t, len(data) >= recordHeaderLenTLS, "Truncated record header")
+		size := int(data[3])<<8 + int(data[4])
+		assertTrue(t, len(data) >= recordHeaderLenTLS+size, "Truncated record")
+		types = append(types, RecordType(data[0]))
+		fragments = append(fragments, data[recordHeaderLenTLS:recordHeaderLenTLS+size])
+		data = data[recordHeaderLenTLS+size:]
+	}
+	return types, fragments
+}
+
+func TestMiddleboxCompatibility(t *testing.T) {
+	cases := map[string]struct {
+		config                   *Config
+		clientTypes, serverTypes []RecordType
+	}{
+		"basic": {
+			config:      basicConfig,
+			clientTypes: []RecordType{RecordTypeHandshake, RecordTypeChangeCipherSpec, RecordTypeApplicationData},
+			serverTypes: []RecordType{RecordTypeHandshake, RecordTypeChangeCipherSpec, RecordTypeApplicationData},
+		},
+		"HRR": {
+			config:      hrrConfig,
+			clientTypes: []RecordType{RecordTypeHandshake, RecordTypeChangeCipherSpec, RecordTypeHandshake, RecordTypeApplicationData},
+			serverTypes: []RecordType{RecordTypeHandshake, RecordTypeChangeCipherSpec, RecordTypeHandshake, RecordTypeApplicationData},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			conf := c.config.Clone()
+			cConn, sConn := pipe()
+			cRec := &recordingConn{pipeConn: cConn}
+			sRec := &recordingConn{pipeConn: sConn}
+			client := Client(cRec, conf)
+			server := Server(sRec, conf)
+
+			done := make(chan bool)
+			go func(t *testing.T) {
+				serverAlert := server.Handshake()
+				assertEquals(t, serverAlert, AlertNoAlert)
+				done <- true
+			}(t)
+
+			clientAlert := client.Handshake()
+			assertEquals(t, clientAlert, AlertNoAlert)
+			<-done
+
+			// Each side sends one ChangeCipherSpec before it encrypts anything
+			clientTypes, clientRecords := splitRecords(t, cRec.written)
+			serverTypes, serverRecords := splitRecords(t, sRec.written)
+			assertDeepEquals(t, clientTypes[:len(c.clientTypes)], c.clientTypes)
+			assertDeepEquals(t, serverTypes[:len(c.serverTypes)], c.serverTypes)
+			for _, typ := range append(clientTypes[len(c.clientTypes):], serverTypes[len(c.serverTypes):]...) {
+				assertEquals(t, typ, RecordTypeApplicationData)
+			}
+
+			// The client sends a session ID, which the server echoes
+			ch := &ClientHelloBody{}
+			assertNotError(t, safeUnmarshal(ch, clientRecords[0][handshakeHeaderLenTLS:]), "Failed to decode ClientHello")
+			sh := &ServerHelloBody{}
+			assertNotError(t, safeUnmarshal(sh, serverRecords[0][handshakeHeaderLenTLS:]), "Failed to decode ServerHello")
+			assertEquals(t, len(ch.LegacySessionID), 32)
+			assertByteEquals(t, sh.LegacySessionID, ch.LegacySessionID)
+		})
+	}
+}
+
+func TestChangeCipherSpecBeforeClientHello(t *testing.T) {
+	cConn, sConn := pipe()
+	_, err := cConn.Write([]byte{byte(RecordTypeChangeCipherSpec), 0x03, 0x01, 0x00, 0x01, 0x01})
+	assertNotError(t, err, "Failed to write ChangeCipherSpec")
+
+	client := Client(cConn, nbConfig)
+	clientAlert := client.Handshake()
+	assertEquals(t, clientAlert, AlertNoAlert)
+
+	server := Server(sConn, basicConfig)
+	serverAlert := server.Handshake()
+	assertEquals(t, serverAlert, AlertUnexpectedMessage)
+}
+
+func TestGREASE(t *testing.T) {
+	cases := map[string]struct {
+		client, server *Config
+	}{
+		"TLS 1.3": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, Certificates: clientCertificates, NextProtos: []string{"h2"}, GREASE: true},
+			server: &Config{Certificates: certificates, RequireClientAuth: true, NextProtos: []string{"h2"}, GREASE: true},
+		},
+		"HRR": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, NextProtos: []string{"h2"}, GREASE: true},
+			server: &Config{Certificates: certificates, RequireCookie: true, NextProtos: []string{"h2"}},
+		},
+		"TLS 1.2": {
+			client: &Config{ServerName: serverName, InsecureSkipVerify: true, MinVersion: VersionTLS12, NextProtos: []string{"h2"}, GREASE: true},
+			server: &Config{Certificates: certificates, MaxVersion: VersionTLS12, NextProtos: []string{"h2"}},
+		},
+	}
+
+	for name, c := range cases {
+		t.Run(name, func(t *testing.T) {
+			cConn, sConn := pipe()
+			cRec := &recordingConn{pipeConn: cConn}
+			client := Client(cRec, c.client)
+			server := Server(sConn, c.server)
+
+			done := make(chan bool)
+			go func(t *testing.T) {
+				serverAlert := server.Handshake()
+				assertEquals(t, serverAlert, AlertNoAlert)
+				done <- true
+			}(t)
+
+			clientAlert := client.Handshake()
+			assertEquals(t, clientAlert, AlertNoAlert)
+			<-done
+
+			// The server ignored the GREASE values
+			assertEquals(t, client.ConnectionState().NextProto, "h2")
+			assertEquals(t, server.ConnectionState().NextProto, "h2")
+			if c.server.RequireClientAuth {
+				assertTrue(t, client.state.Params.UsingClientAuth, "Session did not negotiate client auth")
+			}
+
+			// The ClientHello starts each list with a GREASE value
+			_, records := splitRecords(t, cRec.written)
+			ch := &ClientHelloBody{}
+			assertNotError(t, safeUnmarshal(ch, records[0][handshakeHeaderLenTLS:]), "Failed to decode ClientHello")
+			assertEquals(t, ch.CipherSuites[0]&0x0f0f, CipherSuite(0x0a0a))
+			assertEquals(t, ch.Extensions[0].ExtensionType&0x0f0f, ExtensionType(0x0a0a))
+			assertEquals(t, len(ch.Extensions[0].ExtensionData), 0)
+			sg := &SupportedGroupsExtension{}
+			sa := &SignatureAlgorithmsExtension{}
+			alpn := &ALPNExtension{}
+			found, err := ch.Extensions.Parse([]ExtensionBody{sg, sa, alpn})
+			assertNotError(t, err, "Failed to parse ClientHello extensions")
+			assertEquals(t, len(found), 3)
+			assertEquals(t, sg.Groups[0]&0x0f0f, NamedGroup(0x0a0a))
+			assertEquals(t, sa.Algorithms[0]&0x0f0f, SignatureScheme(0x0a0a))
+			assertEquals(t, alpn.Protocols[0][0]&0x0f, byte(0x0a))
+
+			// A second ClientHello repeats the values
+			if c.server.RequireCookie {
+				ch2 := &ClientHelloBody{}
+				assertNotError(t, safeUnmarshal(ch2, records[2][handshakeHeaderLenTLS:]), "Failed to decode second ClientHello")
+				assertEquals(t, ch2.CipherSuites[0], ch.CipherSuites[0])
+				assertEquals(t, ch2.Extensions[0].ExtensionType, ch.Extensions[0].ExtensionType)
+			}
+		})
+	}
+}
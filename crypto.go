@@ -601,9 +601,18 @@ func computeFinishedData(params CipherSuiteParams, baseKey []byte, input []byte)
 	return mac.Sum(nil)
 }
 
+// The early secret for a PSK, under the hash of the negotiated ciphersuite
+func pskEarlySecret(params CipherSuiteParams, psk PreSharedKey) []byte {
+	zero := bytes.Repeat([]byte{0}, params.Hash.Size())
+	return HkdfExtract(params.Hash, zero, psk.Key)
+}
+
 type KeySet struct {
 	Cipher AEADFactory
 	Keys   map[string][]byte
+
+	// TLS12 selects the TLS 1.2 record format for these keys
+	TLS12 bool
 }
 
 func makeTrafficKeys(params CipherSuiteParams, secret []byte) KeySet {
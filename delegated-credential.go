@@ -0,0 +1,209 @@
+package mint
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Delegated credentials (RFC 9345) let a server authenticate with a
+// short-lived key, signed by the key of its end-entity certificate, so that
+// the certificate's key need not be present on the server.
+const (
+	maxDelegatedCredentialValidity = 7 * 24 * time.Hour
+	delegatedCredentialContext     = "TLS, server delegated credentials"
+)
+
+// id-pe-delegationUsage
+var oidDelegationUsage = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44363, 44}
+
+//	struct {
+//	    uint32 valid_time;
+//	    SignatureScheme dc_cert_verify_algorithm;
+//	    opaque ASN1_subjectPublicKeyInfo<1..2^24-1>;
+//	} Credential;
+//
+//	struct {
+//	    Credential cred;
+//	    SignatureScheme algorithm;
+//	    opaque signature<1..2^16-1>;
+//	} DelegatedCredential;
+//
+// ValidTime is the number of seconds after the notBefore time of the
+// end-entity certificate at which the credential expires.
+type DelegatedCredential struct {
+	ValidTime           uint32
+	CertVerifyAlgorithm SignatureScheme
+	PublicKey           []byte `tls:"head=3,min=1"`
+	Algorithm           SignatureScheme
+	Signature           []byte `tls:"head=2,min=1"`
+}
+
+type credentialInner struct {
+	ValidTime           uint32
+	CertVerifyAlgorithm SignatureScheme
+	PublicKey           []byte `tls:"head=3,min=1"`
+}
+
+func (dc DelegatedCredential) Marshal() ([]byte, error) {
+	return syntax.Marshal(dc)
+}
+
+func (dc *DelegatedCredential) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, dc)
+}
+
+// The signature covers the end-entity certificate, the credential and the
+// signature algorithm
+func (dc DelegatedCredential) signatureInput(leaf *x509.Certificate) ([]byte, error) {
+	cred, err := syntax.Marshal(credentialInner{dc.ValidTime, dc.CertVerifyAlgorithm, dc.PublicKey})
+	if err != nil {
+		return nil, err
+	}
+
+	sigInput := bytes.Repeat([]byte{0x20}, 64)
+	sigInput = append(sigInput, []byte(delegatedCredentialContext)...)
+	sigInput = append(sigInput, 0)
+	sigInput = append(sigInput, leaf.Raw...)
+	sigInput = append(sigInput, cred...)
+	sigInput = append(sigInput, byte(dc.Algorithm>>8), byte(dc.Algorithm))
+	return sigInput, nil
+}
+
+func (dc DelegatedCredential) expiry(leaf *x509.Certificate) time.Time {
+	return leaf.NotBefore.Add(time.Duration(dc.ValidTime) * time.Second)
+}
+
+// Checks that the credential is valid at the given time, and not valid for
+// longer than the maximum validity period
+func (dc DelegatedCredential) validAt(leaf *x509.Certificate, now time.Time) bool {
+	expiry := dc.expiry(leaf)
+	return now.Before(expiry) && expiry.Sub(now) <= maxDelegatedCredentialValidity
+}
+
+// Verifies a delegated credential presented with the given end-entity
+// certificate, and returns the credential's public key
+func (dc DelegatedCredential) verify(leaf *x509.Certificate, now time.Time, schemes []SignatureScheme) (crypto.PublicKey, error) {
+	if !dc.validAt(leaf, now) {
+		return nil, fmt.Errorf("tls.dc: Credential is expired or valid for too long")
+	}
+
+	if !schemeListContains(schemes, dc.CertVerifyAlgorithm) || !schemeListContains(schemes, dc.Algorithm) {
+		return nil, fmt.Errorf("tls.dc: Unsupported signature algorithm")
+	}
+
+	if !canDelegate(leaf) {
+		return nil, fmt.Errorf("tls.dc: Certificate does not permit delegation")
+	}
+
+	sigInput, err := dc.signatureInput(leaf)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(dc.Algorithm, leaf.PublicKey, sigInput, dc.Signature); err != nil {
+		return nil, err
+	}
+
+	return x509.ParsePKIXPublicKey(dc.PublicKey)
+}
+
+// A certificate can be used to delegate credentials only if it has the
+// DelegationUsage extension and the digitalSignature key usage
+func canDelegate(leaf *x509.Certificate) bool {
+	if leaf.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return false
+	}
+
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidDelegationUsage) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the scheme used to sign delegated credentials with a given key
+func delegationScheme(key crypto.Signer) (SignatureScheme, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return RSA_PSS_SHA256, nil
+	case *ecdsa.PublicKey:
+		switch namedGroupFromECDSAKey(pub) {
+		case P256:
+			return ECDSA_P256_SHA256, nil
+		case P384:
+			return ECDSA_P384_SHA384, nil
+		case P521:
+			return ECDSA_P521_SHA512, nil
+		}
+	}
+	return 0, fmt.Errorf("tls.dc: Unsupported key type for delegation")
+}
+
+// NewDelegatedCredential generates a new key for the given scheme and
+// delegates to it from cert, for the given validity period starting now.  The
+// returned Certificate holds the certificate chain, the delegated credential
+// and the new key, but not the private key of cert.
+func NewDelegatedCredential(cert *Certificate, scheme SignatureScheme, validity time.Duration) (*Certificate, error) {
+	if cert.isRawPublicKey() || cert.PrivateKey == nil {
+		return nil, fmt.Errorf("tls.dc: A certificate and private key are required")
+	}
+
+	leaf := cert.Chain[0]
+	if !canDelegate(leaf) {
+		return nil, fmt.Errorf("tls.dc: Certificate does not permit delegation")
+	}
+
+	if validity <= 0 || validity > maxDelegatedCredentialValidity {
+		return nil, fmt.Errorf("tls.dc: Invalid validity period [%v]", validity)
+	}
+
+	expiry := time.Now().Add(validity)
+	if expiry.After(leaf.NotAfter) {
+		expiry = leaf.NotAfter
+	}
+
+	priv, err := newSigningKey(scheme)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(priv.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	alg, err := delegationScheme(cert.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := &DelegatedCredential{
+		ValidTime:           uint32(expiry.Sub(leaf.NotBefore) / time.Second),
+		CertVerifyAlgorithm: scheme,
+		PublicKey:           pub,
+		Algorithm:           alg,
+	}
+
+	sigInput, err := dc.signatureInput(leaf)
+	if err != nil {
+		return nil, err
+	}
+	dc.Signature, err = sign(alg, cert.PrivateKey, sigInput)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Certificate{
+		Chain:               cert.Chain,
+		PrivateKey:          priv,
+		DelegatedCredential: dc,
+	}, nil
+}
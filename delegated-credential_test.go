@@ -0,0 +1,84 @@
+package mint
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+// Describes a certificate for serverName, which can issue delegated
+// credentials if delegationUsage is set
+func delegationCertOptions(delegationUsage bool) testCertOptions {
+	opts := testCertOptions{
+		CommonName: serverName,
+		DNSNames:   []string{serverName},
+		KeyUsage:   x509.KeyUsageDigitalSignature,
+		Lifetime:   30 * 24 * time.Hour,
+	}
+	if delegationUsage {
+		opts.Extensions = []pkix.Extension{
+			{Id: oidDelegationUsage, Value: []byte{0x05, 0x00}},
+		}
+	}
+	return opts
+}
+
+func TestNewDelegatedCredential(t *testing.T) {
+	cert := newTestCertificate(t, delegationCertOptions(true))
+	leaf := cert.Chain[0]
+	schemes := []SignatureScheme{ECDSA_P256_SHA256, RSA_PSS_SHA256}
+	now := time.Now()
+
+	delegated, err := NewDelegatedCredential(cert, RSA_PSS_SHA256, 24*time.Hour)
+	assertNotError(t, err, "Failed to create delegated credential")
+	assertEquals(t, delegated.Chain[0], leaf)
+	assertTrue(t, delegated.PrivateKey != cert.PrivateKey, "Delegated certificate holds the certificate's key")
+
+	dc := *delegated.DelegatedCredential
+	assertEquals(t, dc.CertVerifyAlgorithm, RSA_PSS_SHA256)
+	assertEquals(t, dc.Algorithm, ECDSA_P256_SHA256)
+
+	// The credential verifies, and yields its own key
+	pub, err := dc.verify(leaf, now, schemes)
+	assertNotError(t, err, "Failed to verify delegated credential")
+	assertDeepEquals(t, pub, delegated.PrivateKey.Public())
+
+	// It survives a round trip through the wire encoding
+	data, err := dc.Marshal()
+	assertNotError(t, err, "Failed to marshal delegated credential")
+	var decoded DelegatedCredential
+	read, err := decoded.Unmarshal(data)
+	assertNotError(t, err, "Failed to unmarshal delegated credential")
+	assertEquals(t, read, len(data))
+	assertDeepEquals(t, decoded, dc)
+
+	// Expired credentials are rejected
+	_, err = dc.verify(leaf, now.Add(25*time.Hour), schemes)
+	assertError(t, err, "Verified an expired delegated credential")
+
+	// ... as are credentials that are valid for too long
+	_, err = dc.verify(leaf, now.Add(-7*24*time.Hour), schemes)
+	assertError(t, err, "Verified a delegated credential valid for too long")
+
+	// ... and ones using schemes the client doesn't support
+	_, err = dc.verify(leaf, now, []SignatureScheme{ECDSA_P256_SHA256})
+	assertError(t, err, "Verified a delegated credential with an unsupported scheme")
+
+	// ... and ones whose signature does not match
+	tampered := dc
+	tampered.ValidTime++
+	_, err = tampered.verify(leaf, now, schemes)
+	assertError(t, err, "Verified a tampered delegated credential")
+
+	// ... and ones signed by a certificate without DelegationUsage
+	other := newTestCertificate(t, delegationCertOptions(false))
+	_, err = dc.verify(other.Chain[0], now, schemes)
+	assertError(t, err, "Verified a delegated credential for a certificate without DelegationUsage")
+
+	// Credentials can't be minted for such a certificate, or for too long
+	_, err = NewDelegatedCredential(other, ECDSA_P256_SHA256, time.Hour)
+	assertError(t, err, "Delegated from a certificate without DelegationUsage")
+	_, err = NewDelegatedCredential(cert, ECDSA_P256_SHA256, 8*24*time.Hour)
+	assertError(t, err, "Delegated for longer than the maximum validity period")
+}
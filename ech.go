@@ -0,0 +1,543 @@
+package mint
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/bifurcation/mint/hpke"
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Encrypted Client Hello (draft-ietf-tls-esni) lets a client encrypt its real
+// ClientHello (the ClientHelloInner) to a key published by the server, and
+// send it inside a ClientHelloOuter that names only a public name shared by
+// many servers.
+//
+// A server that accepts ECH and sends a HelloRetryRequest confirms that in an
+// encrypted_client_hello extension in the HelloRetryRequest.  The client then
+// encrypts its second ClientHelloInner under the same HPKE context, with an
+// empty enc, and the server decrypts it with the context it kept.
+const (
+	echVersion                    uint16 = 0xfe0d
+	echInfoLabel                         = "tls ech"
+	echAcceptConfirmationLabel           = "ech accept confirmation"
+	echHRRAcceptConfirmationLabel        = "hrr ech accept confirmation"
+	echAcceptConfirmationLen             = 8
+)
+
+type ECHClientHelloType uint8
+
+const (
+	ECHClientHelloOuter ECHClientHelloType = 0
+	ECHClientHelloInner ECHClientHelloType = 1
+)
+
+//	struct {
+//	    HpkeKdfId kdf_id;
+//	    HpkeAeadId aead_id;
+//	} HpkeSymmetricCipherSuite;
+type HPKESymmetricCipherSuite struct {
+	KDFID  hpke.KDFID
+	AEADID hpke.AEADID
+}
+
+//	struct {
+//	    uint8 config_id;
+//	    HpkeKemId kem_id;
+//	    HpkePublicKey public_key;
+//	    HpkeSymmetricCipherSuite cipher_suites<4..2^16-4>;
+//	} HpkeKeyConfig;
+//
+//	struct {
+//	    HpkeKeyConfig key_config;
+//	    uint8 maximum_name_length;
+//	    opaque public_name<1..255>;
+//	    Extension extensions<0..2^16-1>;
+//	} ECHConfigContents;
+//
+//	struct {
+//	    uint16 version;
+//	    uint16 length;
+//	    select (ECHConfig.version) {
+//	      case 0xfe0d: ECHConfigContents contents;
+//	    }
+//	} ECHConfig;
+//
+// ECHConfig echconfigs<4..2^16-1> ECHConfigList;
+type ECHConfig struct {
+	ConfigID          uint8
+	KEMID             hpke.KEMID
+	PublicKey         []byte
+	CipherSuites      []HPKESymmetricCipherSuite
+	MaximumNameLength uint8
+	PublicName        string
+	Extensions        []Extension
+}
+
+type echConfigContents struct {
+	ConfigID          uint8
+	KEMID             hpke.KEMID
+	PublicKey         []byte                     `tls:"head=2,min=1"`
+	CipherSuites      []HPKESymmetricCipherSuite `tls:"head=2,min=4"`
+	MaximumNameLength uint8
+	PublicName        []byte      `tls:"head=1,min=1"`
+	Extensions        []Extension `tls:"head=2"`
+}
+
+type echConfigEntry struct {
+	Version  uint16
+	Contents []byte `tls:"head=2"`
+}
+
+type echConfigList struct {
+	Configs []echConfigEntry `tls:"head=2,min=4"`
+}
+
+func (c ECHConfig) contents() ([]byte, error) {
+	return syntax.Marshal(echConfigContents{
+		ConfigID:          c.ConfigID,
+		KEMID:             c.KEMID,
+		PublicKey:         c.PublicKey,
+		CipherSuites:      c.CipherSuites,
+		MaximumNameLength: c.MaximumNameLength,
+		PublicName:        []byte(c.PublicName),
+		Extensions:        c.Extensions,
+	})
+}
+
+func (c ECHConfig) Marshal() ([]byte, error) {
+	contents, err := c.contents()
+	if err != nil {
+		return nil, err
+	}
+	return syntax.Marshal(echConfigEntry{Version: echVersion, Contents: contents})
+}
+
+// MarshalECHConfigList encodes an ECHConfigList, as published by a server.
+func MarshalECHConfigList(configs []ECHConfig) ([]byte, error) {
+	list := echConfigList{Configs: make([]echConfigEntry, len(configs))}
+	for i, config := range configs {
+		contents, err := config.contents()
+		if err != nil {
+			return nil, err
+		}
+		list.Configs[i] = echConfigEntry{Version: echVersion, Contents: contents}
+	}
+	return syntax.Marshal(list)
+}
+
+// UnmarshalECHConfigList decodes an ECHConfigList, skipping configs of
+// versions other than the one we support.
+func UnmarshalECHConfigList(data []byte) ([]ECHConfig, error) {
+	var list echConfigList
+	read, err := syntax.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	if read != len(data) {
+		return nil, fmt.Errorf("tls.ech: Extra data after ECHConfigList")
+	}
+
+	configs := []ECHConfig{}
+	for _, entry := range list.Configs {
+		if entry.Version != echVersion {
+			continue
+		}
+
+		var contents echConfigContents
+		read, err := syntax.Unmarshal(entry.Contents, &contents)
+		if err != nil {
+			return nil, err
+		}
+		if read != len(entry.Contents) {
+			return nil, fmt.Errorf("tls.ech: Extra data after ECHConfigContents")
+		}
+
+		configs = append(configs, ECHConfig{
+			ConfigID:          contents.ConfigID,
+			KEMID:             contents.KEMID,
+			PublicKey:         contents.PublicKey,
+			CipherSuites:      contents.CipherSuites,
+			MaximumNameLength: contents.MaximumNameLength,
+			PublicName:        string(contents.PublicName),
+			Extensions:        contents.Extensions,
+		})
+	}
+	return configs, nil
+}
+
+// Returns the first cipher suite in the config that we support, if the config
+// is usable at all
+func (c ECHConfig) cipherSuite() (HPKESymmetricCipherSuite, bool) {
+	// Mandatory extensions are the ones with the high bit set, and we don't
+	// know any
+	for _, ext := range c.Extensions {
+		if ext.ExtensionType&0x8000 != 0 {
+			return HPKESymmetricCipherSuite{}, false
+		}
+	}
+
+	for _, suite := range c.CipherSuites {
+		if s := c.hpkeSuite(suite); s.Supported() && s.AEAD != hpke.EXPORT_ONLY {
+			return suite, true
+		}
+	}
+	return HPKESymmetricCipherSuite{}, false
+}
+
+func (c ECHConfig) hpkeSuite(suite HPKESymmetricCipherSuite) hpke.Suite {
+	return hpke.Suite{KEM: c.KEMID, KDF: suite.KDFID, AEAD: suite.AEADID}
+}
+
+// The HPKE info string binds the encryption to the whole ECHConfig
+func (c ECHConfig) hpkeInfo() ([]byte, error) {
+	config, err := c.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	info := append([]byte(echInfoLabel), 0)
+	return append(info, config...), nil
+}
+
+// An ECHKey is a server's ECHConfig together with the corresponding HPKE
+// private key.
+type ECHKey struct {
+	Config     ECHConfig
+	PrivateKey []byte
+}
+
+// NewECHKey generates an X25519 key pair and an ECHConfig for it, which
+// directs clients to use publicName in the ClientHelloOuter.
+func NewECHKey(configID uint8, publicName string) (*ECHKey, error) {
+	priv, err := hpke.Suite{KEM: hpke.DHKEM_X25519}.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ECHKey{
+		Config: ECHConfig{
+			ConfigID:  configID,
+			KEMID:     hpke.DHKEM_X25519,
+			PublicKey: priv.PublicKey().Bytes(),
+			CipherSuites: []HPKESymmetricCipherSuite{
+				{KDFID: hpke.HKDF_SHA256, AEADID: hpke.AES_128_GCM},
+				{KDFID: hpke.HKDF_SHA256, AEADID: hpke.AES_256_GCM},
+			},
+			PublicName: publicName,
+			Extensions: []Extension{},
+		},
+		PrivateKey: priv.Bytes(),
+	}, nil
+}
+
+// What a client remembers about the ECH it offered: the HPKE context, which
+// also encrypts the second ClientHelloInner after a HelloRetryRequest, and
+// what it needs to follow the inner transcript if the server accepts
+type echOffer struct {
+	config  *ECHConfig
+	suite   HPKESymmetricCipherSuite
+	enc     []byte
+	context *hpke.SenderContext
+
+	innerRandom      []byte
+	innerClientHello *HandshakeMessage
+
+	// Set after a HelloRetryRequest, which tells us whether the server
+	// accepted ECH
+	retried     bool
+	hrrAccepted bool
+}
+
+// Sets up the HPKE context for offering ECH with the given config
+func newECHOffer(config *ECHConfig, suite HPKESymmetricCipherSuite) (*echOffer, error) {
+	info, err := config.hpkeInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	hpkeSuite := config.hpkeSuite(suite)
+	pkR, err := hpkeSuite.UnmarshalPublicKey(config.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, ctx, err := hpkeSuite.SetupBaseS(pkR, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &echOffer{config: config, suite: suite, enc: enc, context: ctx}, nil
+}
+
+// What a server remembers about the ECH in a ClientHello it answered with a
+// HelloRetryRequest, to handle the second ClientHello the same way
+type echRetry struct {
+	accepted     bool
+	configID     uint8
+	suite        HPKESymmetricCipherSuite
+	context      *hpke.ReceiverContext
+	confirmation []byte
+}
+
+// The retry configs a server sends when it rejects ECH
+func echRetryConfigs(keys []*ECHKey) ([]byte, error) {
+	configs := make([]ECHConfig, len(keys))
+	for i, key := range keys {
+		configs[i] = key.Config
+	}
+	return MarshalECHConfigList(configs)
+}
+
+// Returns the first usable config in an ECHConfigList, or nil
+func selectECHConfig(data []byte) (*ECHConfig, HPKESymmetricCipherSuite) {
+	configs, err := UnmarshalECHConfigList(data)
+	if err != nil {
+		logf(logTypeHandshake, "Error decoding ECHConfigList: %v", err)
+		return nil, HPKESymmetricCipherSuite{}
+	}
+
+	for i := range configs {
+		if suite, ok := configs[i].cipherSuite(); ok {
+			return &configs[i], suite
+		}
+	}
+	return nil, HPKESymmetricCipherSuite{}
+}
+
+// The ClientHelloInner is padded so that its length reveals as little as
+// possible about the server name
+func echPaddingLen(encodedLen int, serverName string, maxNameLen uint8) int {
+	padding := 0
+	if len(serverName) > 0 {
+		if len(serverName) < int(maxNameLen) {
+			padding = int(maxNameLen) - len(serverName)
+		}
+	} else {
+		padding = int(maxNameLen) + 9
+	}
+
+	return padding + 31 - ((encodedLen + padding - 1) % 32)
+}
+
+// Builds a ClientHelloOuter carrying the given ClientHelloInner, encrypted to
+// the server's ECHConfig.  After a HelloRetryRequest, the enc is left empty,
+// since the server already has the HPKE context.  The outer hello carries the inner one's
+// extensions, except that it names the public name and offers no PSK.  It
+// keeps early_data, so that a server that rejects ECH knows to skip the early
+// data that follows.
+func sealClientHelloOuter(inner *ClientHelloBody, serverName string, offer *echOffer) (*ClientHelloBody, error) {
+	config := offer.config
+	encoded, err := inner.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	padding := echPaddingLen(len(encoded), serverName, config.MaximumNameLength)
+	encoded = append(encoded, make([]byte, padding)...)
+
+	enc := offer.enc
+	if offer.retried {
+		enc = []byte{}
+	}
+
+	outer := &ClientHelloBody{
+		LegacyVersion:   inner.LegacyVersion,
+		LegacySessionID: inner.LegacySessionID,
+		CipherSuites:    inner.CipherSuites,
+	}
+	if _, err := prng.Read(outer.Random[:]); err != nil {
+		return nil, err
+	}
+
+	for _, ext := range inner.Extensions {
+		switch ext.ExtensionType {
+		case ExtensionTypeECH, ExtensionTypePreSharedKey:
+			continue
+		}
+		outer.Extensions = append(outer.Extensions, ext)
+	}
+
+	sni := ServerNameExtension(config.PublicName)
+	if err := outer.Extensions.Add(&sni); err != nil {
+		return nil, err
+	}
+
+	// The ClientHelloOuterAAD is the outer hello with a zero payload
+	ech := &ECHExtension{
+		HandshakeType:   HandshakeTypeClientHello,
+		ClientHelloType: ECHClientHelloOuter,
+		CipherSuite:     offer.suite,
+		ConfigID:        config.ConfigID,
+		Enc:             enc,
+		Payload:         make([]byte, len(encoded)+offer.context.Overhead()),
+	}
+	if err := outer.Extensions.Add(ech); err != nil {
+		return nil, err
+	}
+
+	aad, err := outer.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	ech.Payload, err = offer.context.Seal(aad, encoded)
+	if err != nil {
+		return nil, err
+	}
+	if err := outer.Extensions.Add(ech); err != nil {
+		return nil, err
+	}
+	return outer, nil
+}
+
+// Sets up the HPKE context to decrypt a ClientHelloInner with, or returns nil
+// with no alert if we don't have the key for it
+func echReceiverContext(ech *ECHExtension, keys []*ECHKey) (*hpke.ReceiverContext, Alert) {
+	var key *ECHKey
+	for _, k := range keys {
+		if k.Config.ConfigID == ech.ConfigID {
+			key = k
+			break
+		}
+	}
+	if key == nil {
+		logf(logTypeHandshake, "[ECH] Unknown config ID [%d]", ech.ConfigID)
+		return nil, AlertNoAlert
+	}
+
+	info, err := key.Config.hpkeInfo()
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error marshaling ECHConfig [%v]", err)
+		return nil, AlertInternalError
+	}
+
+	hpkeSuite := key.Config.hpkeSuite(ech.CipherSuite)
+	skR, err := hpkeSuite.UnmarshalPrivateKey(key.PrivateKey)
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error unmarshaling private key [%v]", err)
+		return nil, AlertNoAlert
+	}
+
+	ctx, err := hpkeSuite.SetupBaseR(ech.Enc, skR, info)
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error setting up HPKE context [%v]", err)
+		return nil, AlertNoAlert
+	}
+	return ctx, AlertNoAlert
+}
+
+// Decrypts the ClientHelloInner from a ClientHelloOuter, returning it along
+// with its encoding and the HPKE context.  If the payload can't be decrypted,
+// ECH is rejected and nil is returned with no alert.
+//
+// After a HelloRetryRequest in which we accepted ECH, the second
+// ClientHelloInner has to be encrypted under the same context, so anything
+// else is an error.
+func openClientHelloInner(outer *ClientHelloBody, ech *ECHExtension, keys []*ECHKey, retry *echRetry) (*ClientHelloBody, []byte, *hpke.ReceiverContext, Alert) {
+	var ctx *hpke.ReceiverContext
+	if retry != nil {
+		if ech.ConfigID != retry.configID || ech.CipherSuite != retry.suite || len(ech.Enc) != 0 {
+			logf(logTypeHandshake, "[ECH] encrypted_client_hello changed after HelloRetryRequest")
+			return nil, nil, nil, AlertIllegalParameter
+		}
+		ctx = retry.context
+	} else {
+		var alert Alert
+		ctx, alert = echReceiverContext(ech, keys)
+		if ctx == nil {
+			return nil, nil, nil, alert
+		}
+	}
+
+	// Reconstruct the ClientHelloOuterAAD, without disturbing the outer hello
+	aadCH := *outer
+	aadCH.Extensions = append(ExtensionList{}, outer.Extensions...)
+	zeroed := *ech
+	zeroed.Payload = make([]byte, len(ech.Payload))
+	if err := aadCH.Extensions.Add(&zeroed); err != nil {
+		logf(logTypeHandshake, "[ECH] Error marshaling ECH extension [%v]", err)
+		return nil, nil, nil, AlertInternalError
+	}
+	aad, err := aadCH.Marshal()
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error marshaling ClientHelloOuterAAD [%v]", err)
+		return nil, nil, nil, AlertInternalError
+	}
+
+	encoded, err := ctx.Open(aad, ech.Payload)
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error decrypting ClientHelloInner [%v]", err)
+		if retry != nil {
+			return nil, nil, nil, AlertDecryptError
+		}
+		return nil, nil, nil, AlertNoAlert
+	}
+
+	// Once decrypted, the inner hello has to be well-formed
+	inner := &ClientHelloBody{LegacyVersion: outer.LegacyVersion}
+	read, err := inner.Unmarshal(encoded)
+	if err != nil {
+		logf(logTypeHandshake, "[ECH] Error decoding ClientHelloInner [%v]", err)
+		return nil, nil, nil, AlertIllegalParameter
+	}
+	if !bytes.Equal(encoded[read:], make([]byte, len(encoded)-read)) {
+		logf(logTypeHandshake, "[ECH] Non-zero padding in ClientHelloInner")
+		return nil, nil, nil, AlertIllegalParameter
+	}
+
+	innerECH := &ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	found, err := inner.Extensions.Find(innerECH)
+	if err != nil || !found || innerECH.ClientHelloType != ECHClientHelloInner {
+		logf(logTypeHandshake, "[ECH] ClientHelloInner lacks an inner ECH extension")
+		return nil, nil, nil, AlertIllegalParameter
+	}
+
+	return inner, encoded[:read], ctx, AlertNoAlert
+}
+
+// The server signals that it accepted ECH in the last bytes of
+// ServerHello.random, or in the encrypted_client_hello extension of a
+// HelloRetryRequest, computed over the transcript with the confirmation zeroed
+func echAcceptConfirmation(params CipherSuiteParams, label string, innerRandom []byte, transcript ...*HandshakeMessage) []byte {
+	h := params.Hash.New()
+	for _, hm := range transcript {
+		h.Write(hm.Marshal())
+	}
+
+	prk := HkdfExtract(params.Hash, nil, innerRandom)
+	return HkdfExpandLabel(params.Hash, prk, label, h.Sum(nil), echAcceptConfirmationLen)
+}
+
+// Returns a copy of a ServerHello message with the confirmation zeroed
+func zeroECHAcceptConfirmation(serverHello *HandshakeMessage) *HandshakeMessage {
+	// The random follows the two-byte legacy_version
+	end := 2 + 32
+	zeroed := *serverHello
+	zeroed.body = append([]byte{}, serverHello.body...)
+	copy(zeroed.body[end-echAcceptConfirmationLen:end], make([]byte, echAcceptConfirmationLen))
+	return &zeroed
+}
+
+// Returns a copy of a HelloRetryRequest message with the confirmation in its
+// encrypted_client_hello extension zeroed
+func zeroECHHRRConfirmation(helloRetryRequest *HandshakeMessage, hrr *ServerHelloBody) (*HandshakeMessage, error) {
+	zeroedBody := *hrr
+	zeroedBody.Extensions = append(ExtensionList{}, hrr.Extensions...)
+	err := zeroedBody.Extensions.Add(&ECHExtension{
+		HandshakeType: HandshakeTypeHelloRetryRequest,
+		Confirmation:  make([]byte, echAcceptConfirmationLen),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := zeroedBody.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	zeroed := *helloRetryRequest
+	zeroed.body = body
+	zeroed.length = uint32(len(body))
+	return &zeroed, nil
+}
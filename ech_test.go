@@ -0,0 +1,196 @@
+package mint
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bifurcation/mint/hpke"
+)
+
+func TestECHConfigList(t *testing.T) {
+	key, err := NewECHKey(3, "public.example.com")
+	assertNotError(t, err, "Failed to generate ECH key")
+
+	data, err := MarshalECHConfigList([]ECHConfig{key.Config})
+	assertNotError(t, err, "Failed to marshal ECHConfigList")
+	configs, err := UnmarshalECHConfigList(data)
+	assertNotError(t, err, "Failed to unmarshal ECHConfigList")
+	assertEquals(t, len(configs), 1)
+	assertDeepEquals(t, configs[0], key.Config)
+
+	// Configs of other versions are skipped
+	unknown := append([]byte{0x00, 0x00, 0xfe, 0x0c, 0x00, 0x01, 0x00}, data[2:]...)
+	unknown[0] = byte((len(unknown) - 2) >> 8)
+	unknown[1] = byte(len(unknown) - 2)
+	configs, err = UnmarshalECHConfigList(unknown)
+	assertNotError(t, err, "Failed to unmarshal ECHConfigList with an unknown version")
+	assertEquals(t, len(configs), 1)
+	assertDeepEquals(t, configs[0], key.Config)
+
+	// Trailing data is rejected
+	_, err = UnmarshalECHConfigList(append(data, 0x00))
+	assertError(t, err, "Unmarshaled ECHConfigList with trailing data")
+
+	// Configs with an unsupported KEM, no usable cipher suite or a
+	// mandatory extension are not used
+	unsupportedKEM := key.Config
+	unsupportedKEM.KEMID = 0x0021
+	unsupportedSuite := key.Config
+	unsupportedSuite.CipherSuites = []HPKESymmetricCipherSuite{{KDFID: hpke.HKDF_SHA256, AEADID: hpke.EXPORT_ONLY}, {KDFID: hpke.HKDF_SHA256, AEADID: 0x0004}}
+	mandatory := key.Config
+	mandatory.Extensions = []Extension{{ExtensionType: 0xfa00}}
+	for _, config := range []ECHConfig{unsupportedKEM, unsupportedSuite, mandatory} {
+		data, err := MarshalECHConfigList([]ECHConfig{config})
+		assertNotError(t, err, "Failed to marshal ECHConfigList")
+		selected, _ := selectECHConfig(data)
+		assertTrue(t, selected == nil, "Selected an unusable ECHConfig")
+	}
+
+	data, err = MarshalECHConfigList([]ECHConfig{unsupportedKEM, key.Config})
+	assertNotError(t, err, "Failed to marshal ECHConfigList")
+	selected, suite := selectECHConfig(data)
+	assertDeepEquals(t, selected, &key.Config)
+	assertEquals(t, suite, key.Config.CipherSuites[0])
+}
+
+func TestECHPadding(t *testing.T) {
+	// The padded length is a multiple of 32, and doesn't depend on names up
+	// to the maximum length
+	for _, baseLen := range []int{100, 128, 200} {
+		expected := -1
+		for _, name := range []string{"a.example", "longer.name.example", "the.maximum.length.name.example"} {
+			encodedLen := baseLen + len(name)
+			padded := encodedLen + echPaddingLen(encodedLen, name, 31)
+			assertEquals(t, padded%32, 0)
+			if expected < 0 {
+				expected = padded
+			}
+			assertEquals(t, padded, expected)
+		}
+
+		padded := baseLen + echPaddingLen(baseLen, "", 31)
+		assertEquals(t, padded%32, 0)
+	}
+}
+
+func TestSealOpenClientHelloInner(t *testing.T) {
+	key, err := NewECHKey(3, "public.example.com")
+	assertNotError(t, err, "Failed to generate ECH key")
+	suite, _ := key.Config.cipherSuite()
+
+	inner := &ClientHelloBody{
+		LegacyVersion:   tls12Version,
+		LegacySessionID: []byte{},
+		CipherSuites:    []CipherSuite{TLS_AES_128_GCM_SHA256},
+	}
+	sni := ServerNameExtension("example.com")
+	assertNotError(t, inner.Extensions.Add(&sni), "Failed to add server_name")
+	assertNotError(t, inner.Extensions.Add(&ECHExtension{HandshakeType: HandshakeTypeClientHello, ClientHelloType: ECHClientHelloInner}),
+		"Failed to add encrypted_client_hello")
+	assertNotError(t, inner.Extensions.Add(&EarlyDataExtension{}), "Failed to add early_data")
+	encoded, err := inner.Marshal()
+	assertNotError(t, err, "Failed to marshal ClientHelloInner")
+
+	offer, err := newECHOffer(&key.Config, suite)
+	assertNotError(t, err, "Failed to set up ECH")
+	outer, err := sealClientHelloOuter(inner, "example.com", offer)
+	assertNotError(t, err, "Failed to seal ClientHelloOuter")
+
+	// The outer hello names the public name, and still signals early data
+	outerSNI := new(ServerNameExtension)
+	found, err := outer.Extensions.Find(outerSNI)
+	assertTrue(t, found && err == nil, "ClientHelloOuter lacks server_name")
+	assertEquals(t, string(*outerSNI), "public.example.com")
+	found, _ = outer.Extensions.Find(&EarlyDataExtension{})
+	assertTrue(t, found, "ClientHelloOuter doesn't signal early data")
+	assertTrue(t, !bytes.Equal(outer.Random[:], inner.Random[:]), "ClientHelloOuter reuses the inner random")
+
+	ech := &ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	found, err = outer.Extensions.Find(ech)
+	assertTrue(t, found && err == nil, "ClientHelloOuter lacks encrypted_client_hello")
+	assertEquals(t, ech.ClientHelloType, ECHClientHelloOuter)
+
+	opened, openedData, ctx, alert := openClientHelloInner(outer, ech, []*ECHKey{key}, nil)
+	assertEquals(t, alert, AlertNoAlert)
+	assertDeepEquals(t, opened, inner)
+	assertByteEquals(t, openedData, encoded)
+	assertNotNil(t, ctx, "No HPKE context for the opened ClientHelloOuter")
+
+	// Tampering with the outer hello or using the wrong key leads to rejection
+	tampered := *outer
+	tampered.CipherSuites = []CipherSuite{TLS_AES_256_GCM_SHA384}
+	opened, _, _, alert = openClientHelloInner(&tampered, ech, []*ECHKey{key}, nil)
+	assertEquals(t, alert, AlertNoAlert)
+	assertTrue(t, opened == nil, "Opened a tampered ClientHelloOuter")
+
+	otherKey, err := NewECHKey(3, "public.example.com")
+	assertNotError(t, err, "Failed to generate ECH key")
+	opened, _, _, alert = openClientHelloInner(outer, ech, []*ECHKey{otherKey}, nil)
+	assertEquals(t, alert, AlertNoAlert)
+	assertTrue(t, opened == nil, "Opened a ClientHelloOuter with the wrong key")
+
+	// A ClientHelloInner that isn't marked as such is a protocol error
+	unmarked := *inner
+	unmarked.Extensions = ExtensionList{inner.Extensions[0]}
+	offer, err = newECHOffer(&key.Config, suite)
+	assertNotError(t, err, "Failed to set up ECH")
+	outer, err = sealClientHelloOuter(&unmarked, "example.com", offer)
+	assertNotError(t, err, "Failed to seal ClientHelloOuter")
+	_, err = outer.Extensions.Find(ech)
+	assertNotError(t, err, "Failed to find encrypted_client_hello")
+	_, _, _, alert = openClientHelloInner(outer, ech, []*ECHKey{key}, nil)
+	assertEquals(t, alert, AlertIllegalParameter)
+}
+
+func TestSealOpenClientHelloInnerAfterHRR(t *testing.T) {
+	key, err := NewECHKey(3, "public.example.com")
+	assertNotError(t, err, "Failed to generate ECH key")
+	suite, _ := key.Config.cipherSuite()
+
+	inner := &ClientHelloBody{
+		LegacyVersion:   tls12Version,
+		LegacySessionID: []byte{},
+		CipherSuites:    []CipherSuite{TLS_AES_128_GCM_SHA256},
+	}
+	assertNotError(t, inner.Extensions.Add(&ECHExtension{HandshakeType: HandshakeTypeClientHello, ClientHelloType: ECHClientHelloInner}),
+		"Failed to add encrypted_client_hello")
+
+	offer, err := newECHOffer(&key.Config, suite)
+	assertNotError(t, err, "Failed to set up ECH")
+	outer1, err := sealClientHelloOuter(inner, "example.com", offer)
+	assertNotError(t, err, "Failed to seal first ClientHelloOuter")
+	ech1 := &ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	_, err = outer1.Extensions.Find(ech1)
+	assertNotError(t, err, "Failed to find encrypted_client_hello")
+	_, _, ctx, alert := openClientHelloInner(outer1, ech1, []*ECHKey{key}, nil)
+	assertEquals(t, alert, AlertNoAlert)
+
+	// The second ClientHelloInner goes under the same context, with no enc
+	offer.retried = true
+	outer2, err := sealClientHelloOuter(inner, "example.com", offer)
+	assertNotError(t, err, "Failed to seal second ClientHelloOuter")
+	ech2 := &ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	_, err = outer2.Extensions.Find(ech2)
+	assertNotError(t, err, "Failed to find encrypted_client_hello")
+	assertEquals(t, len(ech2.Enc), 0)
+
+	// A fresh context can't decrypt it, but the one from the first ClientHello
+	// can
+	opened, _, _, alert := openClientHelloInner(outer2, ech2, []*ECHKey{key}, nil)
+	assertEquals(t, alert, AlertNoAlert)
+	assertTrue(t, opened == nil, "Opened a second ClientHelloOuter without the first context")
+
+	retry := &echRetry{accepted: true, configID: ech1.ConfigID, suite: ech1.CipherSuite, context: ctx}
+	changed := *ech2
+	changed.ConfigID++
+	_, _, _, alert = openClientHelloInner(outer2, &changed, []*ECHKey{key}, retry)
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	opened, _, _, alert = openClientHelloInner(outer2, ech2, []*ECHKey{key}, retry)
+	assertEquals(t, alert, AlertNoAlert)
+	assertDeepEquals(t, opened, inner)
+
+	// Once the context has moved on, a replay doesn't decrypt
+	_, _, _, alert = openClientHelloInner(outer2, ech2, []*ECHKey{key}, retry)
+	assertEquals(t, alert, AlertDecryptError)
+}
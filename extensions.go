@@ -341,6 +341,25 @@ func (sa *SignatureAlgorithmsExtension) Unmarshal(data []byte) (int, error) {
 	return syntax.Unmarshal(data, sa)
 }
 
+// The signature_algorithms_cert extension has the same format as
+// signature_algorithms, but lists the algorithms that are acceptable in
+// certificates rather than in CertificateVerify.
+type SignatureAlgorithmsCertExtension struct {
+	Algorithms []SignatureScheme `tls:"head=2,min=2"`
+}
+
+func (sac SignatureAlgorithmsCertExtension) Type() ExtensionType {
+	return ExtensionTypeSignatureAlgsCert
+}
+
+func (sac SignatureAlgorithmsCertExtension) Marshal() ([]byte, error) {
+	return syntax.Marshal(sac)
+}
+
+func (sac *SignatureAlgorithmsCertExtension) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, sac)
+}
+
 // struct {
 //     opaque identity<1..2^16-1>;
 //     uint32 obfuscated_ticket_age;
@@ -624,3 +643,608 @@ func (c CookieExtension) Marshal() ([]byte, error) {
 func (c *CookieExtension) Unmarshal(data []byte) (int, error) {
 	return syntax.Unmarshal(data, c)
 }
+
+// opaque ResponderID<1..2^16-1>;
+// opaque Extensions<0..2^16-1>;
+//
+// struct {
+//     ResponderID responder_id_list<0..2^16-1>;
+//     Extensions  request_extensions;
+// } OCSPStatusRequest;
+//
+// struct {
+//     CertificateStatusType status_type;
+//     select (status_type) {
+//         case ocsp: OCSPStatusRequest;
+//     } request;
+// } CertificateStatusRequest;
+//
+// struct {
+//     CertificateStatusType status_type;
+//     select (status_type) {
+//         case ocsp: OCSPResponse;
+//     } response;
+// } CertificateStatus;
+//
+// opaque OCSPResponse<1..2^24-1>;
+//
+// The ClientHello carries a CertificateStatusRequest, and a CertificateEntry
+// carries a CertificateStatus.  Only OCSP is supported, and responder IDs and
+// request extensions are neither sent nor interpreted.  Unmarshal records the
+// status type it finds in StatusType; a type other than OCSP is skipped rather
+// than rejected, and means that no staple is requested or sent.
+type StatusRequestExtension struct {
+	HandshakeType HandshakeType
+	StatusType    CertificateStatusType
+	OCSPResponse  []byte
+}
+
+type statusRequestClientHelloInner struct {
+	StatusType        CertificateStatusType
+	ResponderIDList   []byte `tls:"head=2"`
+	RequestExtensions []byte `tls:"head=2"`
+}
+
+type statusRequestCertificateInner struct {
+	StatusType   CertificateStatusType
+	OCSPResponse []byte `tls:"head=3,min=1"`
+}
+
+func (sr StatusRequestExtension) Type() ExtensionType {
+	return ExtensionTypeStatusRequest
+}
+
+func (sr StatusRequestExtension) Marshal() ([]byte, error) {
+	switch sr.HandshakeType {
+	case HandshakeTypeClientHello:
+		return syntax.Marshal(statusRequestClientHelloInner{StatusType: CertificateStatusTypeOCSP})
+
+	case HandshakeTypeCertificate:
+		return syntax.Marshal(statusRequestCertificateInner{CertificateStatusTypeOCSP, sr.OCSPResponse})
+
+	case HandshakeTypeServerHello:
+		// In TLS 1.2, the response follows in a CertificateStatus message
+		return []byte{}, nil
+
+	default:
+		return nil, fmt.Errorf("tls.status_request: Handshake type not allowed")
+	}
+}
+
+func (sr *StatusRequestExtension) Unmarshal(data []byte) (int, error) {
+	switch sr.HandshakeType {
+	case HandshakeTypeClientHello, HandshakeTypeCertificate:
+		if len(data) == 0 {
+			return 0, fmt.Errorf("tls.status_request: Missing status type")
+		}
+
+		// We can't parse the body of a status type we don't know, so the rest
+		// of the extension is skipped
+		sr.StatusType = CertificateStatusType(data[0])
+		sr.OCSPResponse = nil
+		if sr.StatusType != CertificateStatusTypeOCSP {
+			return len(data), nil
+		}
+
+		if sr.HandshakeType == HandshakeTypeClientHello {
+			var inner statusRequestClientHelloInner
+			return syntax.Unmarshal(data, &inner)
+		}
+
+		var inner statusRequestCertificateInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+
+		sr.OCSPResponse = inner.OCSPResponse
+		return read, nil
+
+	case HandshakeTypeServerHello:
+		return 0, nil
+
+	default:
+		return 0, fmt.Errorf("tls.status_request: Handshake type not allowed")
+	}
+}
+
+// opaque SerializedSCT<1..2^16-1>;
+//
+// struct {
+//     SerializedSCT sct_list <1..2^16-1>;
+// } SignedCertificateTimestampList;
+//
+// The ClientHello carries an empty extension, and a CertificateEntry carries
+// a SignedCertificateTimestampList.
+type SCTExtension struct {
+	HandshakeType HandshakeType
+	SCTs          [][]byte
+}
+
+type serializedSCTInner struct {
+	SCT []byte `tls:"head=2,min=1"`
+}
+
+type sctListInner struct {
+	SCTs []serializedSCTInner `tls:"head=2,min=1"`
+}
+
+func (sct SCTExtension) Type() ExtensionType {
+	return ExtensionTypeSCT
+}
+
+func (sct SCTExtension) Marshal() ([]byte, error) {
+	switch sct.HandshakeType {
+	case HandshakeTypeClientHello:
+		return []byte{}, nil
+
+	case HandshakeTypeCertificate:
+		scts := make([]serializedSCTInner, len(sct.SCTs))
+		for i, entry := range sct.SCTs {
+			scts[i] = serializedSCTInner{entry}
+		}
+		return syntax.Marshal(sctListInner{scts})
+
+	default:
+		return nil, fmt.Errorf("tls.sct: Handshake type not allowed")
+	}
+}
+
+func (sct *SCTExtension) Unmarshal(data []byte) (int, error) {
+	switch sct.HandshakeType {
+	case HandshakeTypeClientHello:
+		return 0, nil
+
+	case HandshakeTypeCertificate:
+		var inner sctListInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+
+		sct.SCTs = make([][]byte, len(inner.SCTs))
+		for i, entry := range inner.SCTs {
+			sct.SCTs[i] = entry.SCT
+		}
+		return read, nil
+
+	default:
+		return 0, fmt.Errorf("tls.sct: Handshake type not allowed")
+	}
+}
+
+// opaque DistinguishedName<1..2^16-1>;
+//
+// struct {
+//     DistinguishedName authorities<3..2^16-1>;
+// } CertificateAuthoritiesExtension;
+type CertificateAuthoritiesExtension struct {
+	Authorities [][]byte
+}
+
+type distinguishedNameInner struct {
+	Name []byte `tls:"head=2,min=1"`
+}
+
+type certificateAuthoritiesInner struct {
+	Authorities []distinguishedNameInner `tls:"head=2,min=3"`
+}
+
+func (ca CertificateAuthoritiesExtension) Type() ExtensionType {
+	return ExtensionTypeCertAuthorities
+}
+
+func (ca CertificateAuthoritiesExtension) Marshal() ([]byte, error) {
+	authorities := make([]distinguishedNameInner, len(ca.Authorities))
+	for i, name := range ca.Authorities {
+		authorities[i] = distinguishedNameInner{name}
+	}
+	return syntax.Marshal(certificateAuthoritiesInner{authorities})
+}
+
+func (ca *CertificateAuthoritiesExtension) Unmarshal(data []byte) (int, error) {
+	var inner certificateAuthoritiesInner
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	ca.Authorities = make([][]byte, len(inner.Authorities))
+	for i, name := range inner.Authorities {
+		ca.Authorities[i] = name.Name
+	}
+	return read, nil
+}
+
+// struct {
+//     opaque certificate_extension_oid<1..2^8-1>;
+//     opaque certificate_extension_values<0..2^16-1>;
+// } OIDFilter;
+//
+// struct {
+//     OIDFilter filters<0..2^16-1>;
+// } OIDFilterExtension;
+type OIDFilter struct {
+	CertificateExtensionOID    []byte `tls:"head=1,min=1"`
+	CertificateExtensionValues []byte `tls:"head=2"`
+}
+
+type OIDFiltersExtension struct {
+	Filters []OIDFilter `tls:"head=2"`
+}
+
+func (of OIDFiltersExtension) Type() ExtensionType {
+	return ExtensionTypeOIDFilters
+}
+
+func (of OIDFiltersExtension) Marshal() ([]byte, error) {
+	return syntax.Marshal(of)
+}
+
+func (of *OIDFiltersExtension) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, of)
+}
+
+// struct {
+//     select(ClientOrServerExtension) {
+//         case client:
+//             CertificateType client_certificate_types<1..2^8-1>;
+//         case server:
+//             CertificateType client_certificate_type;
+//     }
+// } ClientCertTypeExtension;
+//
+// The server_certificate_type extension has the same structure.  The
+// ClientHello carries the types the client supports, in preference order, and
+// EncryptedExtensions carries the type selected by the server.
+type ClientCertTypeExtension struct {
+	HandshakeType    HandshakeType
+	CertificateTypes []CertificateType
+}
+
+type ServerCertTypeExtension struct {
+	HandshakeType    HandshakeType
+	CertificateTypes []CertificateType
+}
+
+type certTypeClientHelloInner struct {
+	CertificateTypes []CertificateType `tls:"head=1,min=1"`
+}
+
+type certTypeEncryptedExtensionsInner struct {
+	CertificateType CertificateType
+}
+
+func marshalCertTypes(handshakeType HandshakeType, certTypes []CertificateType) ([]byte, error) {
+	switch handshakeType {
+	case HandshakeTypeClientHello:
+		return syntax.Marshal(certTypeClientHelloInner{certTypes})
+
+	case HandshakeTypeEncryptedExtensions:
+		if len(certTypes) != 1 {
+			return nil, fmt.Errorf("tls.cert_type: Exactly one type must be selected")
+		}
+		return syntax.Marshal(certTypeEncryptedExtensionsInner{certTypes[0]})
+
+	default:
+		return nil, fmt.Errorf("tls.cert_type: Handshake type not allowed")
+	}
+}
+
+func unmarshalCertTypes(handshakeType HandshakeType, data []byte) ([]CertificateType, int, error) {
+	switch handshakeType {
+	case HandshakeTypeClientHello:
+		var inner certTypeClientHelloInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return nil, 0, err
+		}
+		return inner.CertificateTypes, read, nil
+
+	case HandshakeTypeEncryptedExtensions:
+		var inner certTypeEncryptedExtensionsInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return nil, 0, err
+		}
+		return []CertificateType{inner.CertificateType}, read, nil
+
+	default:
+		return nil, 0, fmt.Errorf("tls.cert_type: Handshake type not allowed")
+	}
+}
+
+func (ct ClientCertTypeExtension) Type() ExtensionType {
+	return ExtensionTypeClientCertType
+}
+
+func (ct ClientCertTypeExtension) Marshal() ([]byte, error) {
+	return marshalCertTypes(ct.HandshakeType, ct.CertificateTypes)
+}
+
+func (ct *ClientCertTypeExtension) Unmarshal(data []byte) (int, error) {
+	certTypes, read, err := unmarshalCertTypes(ct.HandshakeType, data)
+	if err != nil {
+		return 0, err
+	}
+	ct.CertificateTypes = certTypes
+	return read, nil
+}
+
+func (ct ServerCertTypeExtension) Type() ExtensionType {
+	return ExtensionTypeServerCertType
+}
+
+func (ct ServerCertTypeExtension) Marshal() ([]byte, error) {
+	return marshalCertTypes(ct.HandshakeType, ct.CertificateTypes)
+}
+
+func (ct *ServerCertTypeExtension) Unmarshal(data []byte) (int, error) {
+	certTypes, read, err := unmarshalCertTypes(ct.HandshakeType, data)
+	if err != nil {
+		return 0, err
+	}
+	ct.CertificateTypes = certTypes
+	return read, nil
+}
+
+// struct {
+//     CertificateCompressionAlgorithm algorithms<2..2^8-2>;
+// } CertificateCompressionAlgorithms;
+type CompressCertificateExtension struct {
+	Algorithms []CertificateCompressionAlgorithm `tls:"head=1,min=2,max=254"`
+}
+
+func (cc CompressCertificateExtension) Type() ExtensionType {
+	return ExtensionTypeCompressCertificate
+}
+
+func (cc CompressCertificateExtension) Marshal() ([]byte, error) {
+	return syntax.Marshal(cc)
+}
+
+func (cc *CompressCertificateExtension) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, cc)
+}
+
+// struct {
+//     SignatureScheme supported_signature_algorithm<2..2^16-2>;
+// } SignatureSchemeList;
+//
+// The ClientHello carries a SignatureSchemeList of the schemes the client
+// accepts in a CertificateVerify signed with a delegated credential, and the
+// end-entity CertificateEntry carries a DelegatedCredential.
+type DelegatedCredentialExtension struct {
+	HandshakeType HandshakeType
+	Algorithms    []SignatureScheme
+	Credential    DelegatedCredential
+}
+
+type delegatedCredentialClientHelloInner struct {
+	Algorithms []SignatureScheme `tls:"head=2,min=2"`
+}
+
+func (dc DelegatedCredentialExtension) Type() ExtensionType {
+	return ExtensionTypeDelegatedCredential
+}
+
+func (dc DelegatedCredentialExtension) Marshal() ([]byte, error) {
+	switch dc.HandshakeType {
+	case HandshakeTypeClientHello:
+		return syntax.Marshal(delegatedCredentialClientHelloInner{dc.Algorithms})
+
+	case HandshakeTypeCertificate:
+		return dc.Credential.Marshal()
+
+	default:
+		return nil, fmt.Errorf("tls.delegated_credential: Handshake type not allowed")
+	}
+}
+
+func (dc *DelegatedCredentialExtension) Unmarshal(data []byte) (int, error) {
+	switch dc.HandshakeType {
+	case HandshakeTypeClientHello:
+		var inner delegatedCredentialClientHelloInner
+		read, err := syntax.Unmarshal(data, &inner)
+		if err != nil {
+			return 0, err
+		}
+		dc.Algorithms = inner.Algorithms
+		return read, nil
+
+	case HandshakeTypeCertificate:
+		return dc.Credential.Unmarshal(data)
+
+	default:
+		return 0, fmt.Errorf("tls.delegated_credential: Handshake type not allowed")
+	}
+}
+
+// enum { outer(0), inner(1) } ECHClientHelloType;
+//
+// struct {
+//     ECHClientHelloType type;
+//     select (ECHClientHello.type) {
+//         case outer:
+//             HpkeSymmetricCipherSuite cipher_suite;
+//             uint8 config_id;
+//             opaque enc<0..2^16-1>;
+//             opaque payload<1..2^16-1>;
+//         case inner:
+//             Empty;
+//     };
+// } ECHClientHello;
+//
+// struct {
+//     ECHConfigList retry_configs;
+// } ECHEncryptedExtensions;
+//
+// struct {
+//     opaque confirmation[8];
+// } ECHHelloRetryRequest;
+//
+// RetryConfigs holds the encoded ECHConfigList.
+type ECHExtension struct {
+	HandshakeType   HandshakeType
+	ClientHelloType ECHClientHelloType
+	CipherSuite     HPKESymmetricCipherSuite
+	ConfigID        uint8
+	Enc             []byte
+	Payload         []byte
+	RetryConfigs    []byte
+	Confirmation    []byte
+}
+
+type echClientHelloOuterInner struct {
+	CipherSuite HPKESymmetricCipherSuite
+	ConfigID    uint8
+	Enc         []byte `tls:"head=2"`
+	Payload     []byte `tls:"head=2,min=1"`
+}
+
+func (ech ECHExtension) Type() ExtensionType {
+	return ExtensionTypeECH
+}
+
+func (ech ECHExtension) Marshal() ([]byte, error) {
+	switch ech.HandshakeType {
+	case HandshakeTypeClientHello:
+		data := []byte{byte(ech.ClientHelloType)}
+		switch ech.ClientHelloType {
+		case ECHClientHelloOuter:
+			outer, err := syntax.Marshal(echClientHelloOuterInner{ech.CipherSuite, ech.ConfigID, ech.Enc, ech.Payload})
+			if err != nil {
+				return nil, err
+			}
+			return append(data, outer...), nil
+
+		case ECHClientHelloInner:
+			return data, nil
+
+		default:
+			return nil, fmt.Errorf("tls.ech: Unknown ClientHello type [%d]", ech.ClientHelloType)
+		}
+
+	case HandshakeTypeEncryptedExtensions:
+		if _, err := UnmarshalECHConfigList(ech.RetryConfigs); err != nil {
+			return nil, err
+		}
+		return ech.RetryConfigs, nil
+
+	case HandshakeTypeHelloRetryRequest:
+		if len(ech.Confirmation) != echAcceptConfirmationLen {
+			return nil, fmt.Errorf("tls.ech: Wrong confirmation length")
+		}
+		return ech.Confirmation, nil
+
+	default:
+		return nil, fmt.Errorf("tls.ech: Handshake type not allowed")
+	}
+}
+
+func (ech *ECHExtension) Unmarshal(data []byte) (int, error) {
+	switch ech.HandshakeType {
+	case HandshakeTypeClientHello:
+		if len(data) < 1 {
+			return 0, fmt.Errorf("tls.ech: Too short")
+		}
+
+		ech.ClientHelloType = ECHClientHelloType(data[0])
+		switch ech.ClientHelloType {
+		case ECHClientHelloOuter:
+			var outer echClientHelloOuterInner
+			read, err := syntax.Unmarshal(data[1:], &outer)
+			if err != nil {
+				return 0, err
+			}
+			ech.CipherSuite = outer.CipherSuite
+			ech.ConfigID = outer.ConfigID
+			ech.Enc = outer.Enc
+			ech.Payload = outer.Payload
+			return 1 + read, nil
+
+		case ECHClientHelloInner:
+			return 1, nil
+
+		default:
+			return 0, fmt.Errorf("tls.ech: Unknown ClientHello type [%d]", ech.ClientHelloType)
+		}
+
+	case HandshakeTypeEncryptedExtensions:
+		var list echConfigList
+		read, err := syntax.Unmarshal(data, &list)
+		if err != nil {
+			return 0, err
+		}
+		ech.RetryConfigs = data[:read]
+		return read, nil
+
+	case HandshakeTypeHelloRetryRequest:
+		if len(data) < echAcceptConfirmationLen {
+			return 0, fmt.Errorf("tls.ech: Too short")
+		}
+		ech.Confirmation = data[:echAcceptConfirmationLen]
+		return echAcceptConfirmationLen, nil
+
+	default:
+		return 0, fmt.Errorf("tls.ech: Handshake type not allowed")
+	}
+}
+
+// The extended_master_secret extension (RFC 7627) is empty, and is sent in
+// both hellos when the TLS 1.2 master secret covers the handshake transcript
+type ExtendedMasterSecretExtension struct{}
+
+func (ems ExtendedMasterSecretExtension) Type() ExtensionType {
+	return ExtensionTypeExtendedMasterSecret
+}
+
+func (ems ExtendedMasterSecretExtension) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (ems *ExtendedMasterSecretExtension) Unmarshal(data []byte) (int, error) {
+	return 0, nil
+}
+
+// struct {
+//     opaque renegotiated_connection<0..255>;
+// } RenegotiationInfo;
+//
+// Renegotiation is never done, so renegotiated_connection is always empty.
+type RenegotiationInfoExtension struct {
+	RenegotiatedConnection []byte `tls:"head=1"`
+}
+
+func (ri RenegotiationInfoExtension) Type() ExtensionType {
+	return ExtensionTypeRenegotiationInfo
+}
+
+func (ri RenegotiationInfoExtension) Marshal() ([]byte, error) {
+	return syntax.Marshal(ri)
+}
+
+func (ri *RenegotiationInfoExtension) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, ri)
+}
+
+// enum { uncompressed (0), (255) } ECPointFormat;
+//
+// struct {
+//     ECPointFormat ec_point_format_list<1..2^8-1>
+// } ECPointFormatList;
+type ECPointFormatsExtension struct {
+	Formats []uint8 `tls:"head=1,min=1"`
+}
+
+func (pf ECPointFormatsExtension) Type() ExtensionType {
+	return ExtensionTypeECPointFormats
+}
+
+func (pf ECPointFormatsExtension) Marshal() ([]byte, error) {
+	return syntax.Marshal(pf)
+}
+
+func (pf *ECPointFormatsExtension) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, pf)
+}
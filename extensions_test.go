@@ -175,6 +175,18 @@ var validExtensionTestCases = map[ExtensionType]struct {
 		marshaledHex: "000408040403",
 	},
 
+	// SignatureAlgorithmsCert
+	ExtensionTypeSignatureAlgsCert: {
+		blank: &SignatureAlgorithmsCertExtension{},
+		unmarshaled: &SignatureAlgorithmsCertExtension{
+			Algorithms: []SignatureScheme{
+				RSA_PKCS1_SHA256,
+				ECDSA_P256_SHA256,
+			},
+		},
+		marshaledHex: "000404010403",
+	},
+
 	// ALPN
 	ExtensionTypeALPN: {
 		blank: &ALPNExtension{},
@@ -184,6 +196,18 @@ var validExtensionTestCases = map[ExtensionType]struct {
 		marshaledHex: "000c08687474702f312e31026832",
 	},
 
+	// CompressCertificate
+	ExtensionTypeCompressCertificate: {
+		blank: &CompressCertificateExtension{},
+		unmarshaled: &CompressCertificateExtension{
+			Algorithms: []CertificateCompressionAlgorithm{
+				CertificateCompressionZlib,
+				CertificateCompressionBrotli,
+			},
+		},
+		marshaledHex: "0400010002",
+	},
+
 	// Omitted: KeyShare (depends on HandshakeType)
 	// Omitted: PreSharedKey (depends on HandshakeType)
 	// Omitted: SupportedVersions (depends on HandshakeType)
@@ -223,6 +247,32 @@ var validExtensionTestCases = map[ExtensionType]struct {
 		},
 		marshaledHex: "01020304",
 	},
+
+	// CertificateAuthorities
+	ExtensionTypeCertAuthorities: {
+		blank: &CertificateAuthoritiesExtension{},
+		unmarshaled: &CertificateAuthoritiesExtension{
+			Authorities: [][]byte{
+				{0x30, 0x01, 0x02},
+				{0x30, 0x03},
+			},
+		},
+		marshaledHex: "0009" + "0003300102" + "00023003",
+	},
+
+	// OIDFilters
+	ExtensionTypeOIDFilters: {
+		blank: &OIDFiltersExtension{},
+		unmarshaled: &OIDFiltersExtension{
+			Filters: []OIDFilter{
+				{
+					CertificateExtensionOID:    []byte{0x55, 0x1d, 0x25},
+					CertificateExtensionValues: []byte{0x30, 0x0a},
+				},
+			},
+		},
+		marshaledHex: "000803551d250002300a",
+	},
 }
 
 func TestExtensionBodyMarshalUnmarshal(t *testing.T) {
@@ -397,6 +447,19 @@ func TestExtensionParse(t *testing.T) {
 	assertTrue(t, found[ExtensionTypeKeyShare], "Failed to find key share")
 	assertTrue(t, found[ExtensionTypeSupportedVersions], "Failed to find supported versions")
 
+	// Unknown (GREASE) extensions are ignored, whatever they contain
+	greaseExtensions := ExtensionList{
+		Extension{ExtensionType: 0x0a0a, ExtensionData: []byte{}},
+		validExtensions[0],
+		Extension{ExtensionType: 0x5a5a, ExtensionData: []byte{0x00}},
+		validExtensions[1],
+	}
+	found, err = greaseExtensions.Parse(extensionsIn)
+	assertNotError(t, err, "Failed to parse extensions with GREASE")
+	assertEquals(t, len(found), 2)
+	assertTrue(t, found[ExtensionTypeKeyShare], "Failed to find key share")
+	assertTrue(t, found[ExtensionTypeSupportedVersions], "Failed to find supported versions")
+
 	// Now a version with an error
 	sv.HandshakeType = HandshakeTypeServerHello
 	found, err = validExtensions.Parse(extensionsIn)
@@ -480,6 +543,258 @@ func TestSupportedVersionsMarshalUnmarshal(t *testing.T) {
 	assertError(t, err, "Unmarshaled a SupportedVersions that's too short")
 }
 
+func TestStatusRequestMarshalUnmarshal(t *testing.T) {
+	statusRequestClient := unhex("0100000000")
+	statusRequestCertificate := unhex("01000004a0a1a2a3")
+	ocspResponse := []byte{0xa0, 0xa1, 0xa2, 0xa3}
+
+	// Test extension type
+	assertEquals(t, StatusRequestExtension{}.Type(), ExtensionTypeStatusRequest)
+
+	// Test successful marshal
+	out, err := StatusRequestExtension{HandshakeType: HandshakeTypeClientHello}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid StatusRequest (client)")
+	assertByteEquals(t, out, statusRequestClient)
+
+	out, err = StatusRequestExtension{HandshakeType: HandshakeTypeCertificate, OCSPResponse: ocspResponse}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid StatusRequest (certificate)")
+	assertByteEquals(t, out, statusRequestCertificate)
+
+	// A TLS 1.2 ServerHello just signals that a CertificateStatus follows
+	out, err = StatusRequestExtension{HandshakeType: HandshakeTypeServerHello}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid StatusRequest (server hello)")
+	assertEquals(t, len(out), 0)
+
+	// Test marshal failure on an unsupported handshake type
+	_, err = StatusRequestExtension{HandshakeType: HandshakeTypeEncryptedExtensions}.Marshal()
+	assertError(t, err, "Marshaled StatusRequest for an unsupported handshake type")
+
+	// Test successful unmarshal
+	sr := StatusRequestExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err := sr.Unmarshal(statusRequestClient)
+	assertNotError(t, err, "Failed to unmarshal valid StatusRequest (client)")
+	assertEquals(t, read, len(statusRequestClient))
+
+	sr = StatusRequestExtension{HandshakeType: HandshakeTypeCertificate}
+	read, err = sr.Unmarshal(statusRequestCertificate)
+	assertNotError(t, err, "Failed to unmarshal valid StatusRequest (certificate)")
+	assertByteEquals(t, sr.OCSPResponse, ocspResponse)
+	assertEquals(t, read, len(statusRequestCertificate))
+
+	// An unknown status type is skipped, and carries no response
+	statusRequestCertificate[0] = 0x02
+	read, err = sr.Unmarshal(statusRequestCertificate)
+	assertNotError(t, err, "Failed to unmarshal StatusRequest with an unknown status type (certificate)")
+	assertEquals(t, read, len(statusRequestCertificate))
+	assertEquals(t, sr.StatusType, CertificateStatusType(0x02))
+	assertEquals(t, len(sr.OCSPResponse), 0)
+
+	sr = StatusRequestExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err = sr.Unmarshal(unhex("02a0a1"))
+	assertNotError(t, err, "Failed to unmarshal StatusRequest with an unknown status type (client)")
+	assertEquals(t, read, 3)
+	assertEquals(t, sr.StatusType, CertificateStatusType(0x02))
+
+	// Test unmarshal failure on an empty extension
+	_, err = sr.Unmarshal([]byte{})
+	assertError(t, err, "Unmarshaled an empty StatusRequest")
+
+	// Test unmarshal failure on an unsupported handshake type
+	sr = StatusRequestExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
+	_, err = sr.Unmarshal(statusRequestClient)
+	assertError(t, err, "Unmarshaled StatusRequest for an unsupported handshake type")
+}
+
+func TestCertTypeMarshalUnmarshal(t *testing.T) {
+	certTypesClient := unhex("020200")
+	certTypesEE := unhex("02")
+	offered := []CertificateType{CertificateTypeRawPublicKey, CertificateTypeX509}
+	selected := []CertificateType{CertificateTypeRawPublicKey}
+
+	// Test extension types
+	assertEquals(t, ClientCertTypeExtension{}.Type(), ExtensionTypeClientCertType)
+	assertEquals(t, ServerCertTypeExtension{}.Type(), ExtensionTypeServerCertType)
+
+	// Test successful marshal
+	out, err := ClientCertTypeExtension{HandshakeType: HandshakeTypeClientHello, CertificateTypes: offered}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ClientCertType (client)")
+	assertByteEquals(t, out, certTypesClient)
+
+	out, err = ServerCertTypeExtension{HandshakeType: HandshakeTypeEncryptedExtensions, CertificateTypes: selected}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ServerCertType (server)")
+	assertByteEquals(t, out, certTypesEE)
+
+	// Test marshal failure on more than one selected type
+	_, err = ServerCertTypeExtension{HandshakeType: HandshakeTypeEncryptedExtensions, CertificateTypes: offered}.Marshal()
+	assertError(t, err, "Marshaled ServerCertType with more than one selected type")
+
+	// Test marshal failure on an unsupported handshake type
+	_, err = ClientCertTypeExtension{HandshakeType: HandshakeTypeServerHello, CertificateTypes: offered}.Marshal()
+	assertError(t, err, "Marshaled ClientCertType for an unsupported handshake type")
+
+	// Test successful unmarshal
+	ct := ClientCertTypeExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err := ct.Unmarshal(certTypesClient)
+	assertNotError(t, err, "Failed to unmarshal valid ClientCertType (client)")
+	assertDeepEquals(t, ct.CertificateTypes, offered)
+	assertEquals(t, read, len(certTypesClient))
+
+	st := ServerCertTypeExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
+	read, err = st.Unmarshal(certTypesEE)
+	assertNotError(t, err, "Failed to unmarshal valid ServerCertType (server)")
+	assertDeepEquals(t, st.CertificateTypes, selected)
+	assertEquals(t, read, len(certTypesEE))
+
+	// Test unmarshal failure on an empty list
+	ct = ClientCertTypeExtension{HandshakeType: HandshakeTypeClientHello}
+	_, err = ct.Unmarshal(unhex("00"))
+	assertError(t, err, "Unmarshaled ClientCertType with an empty list")
+
+	// Test unmarshal failure on an unsupported handshake type
+	st = ServerCertTypeExtension{HandshakeType: HandshakeTypeServerHello}
+	_, err = st.Unmarshal(certTypesEE)
+	assertError(t, err, "Unmarshaled ServerCertType for an unsupported handshake type")
+}
+
+func TestDelegatedCredentialMarshalUnmarshal(t *testing.T) {
+	delegatedCredentialClient := unhex("000404030804")
+	delegatedCredentialCertificate := unhex("00000e10040300000103040300020a0b")
+	schemes := []SignatureScheme{ECDSA_P256_SHA256, RSA_PSS_SHA256}
+	credential := DelegatedCredential{
+		ValidTime:           3600,
+		CertVerifyAlgorithm: ECDSA_P256_SHA256,
+		PublicKey:           []byte{0x03},
+		Algorithm:           ECDSA_P256_SHA256,
+		Signature:           []byte{0x0a, 0x0b},
+	}
+
+	// Test extension type
+	assertEquals(t, DelegatedCredentialExtension{}.Type(), ExtensionTypeDelegatedCredential)
+
+	// Test successful marshal
+	out, err := DelegatedCredentialExtension{HandshakeType: HandshakeTypeClientHello, Algorithms: schemes}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid DelegatedCredential (client)")
+	assertByteEquals(t, out, delegatedCredentialClient)
+
+	out, err = DelegatedCredentialExtension{HandshakeType: HandshakeTypeCertificate, Credential: credential}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid DelegatedCredential (certificate)")
+	assertByteEquals(t, out, delegatedCredentialCertificate)
+
+	// Test marshal failure on an unsupported handshake type
+	_, err = DelegatedCredentialExtension{HandshakeType: HandshakeTypeServerHello}.Marshal()
+	assertError(t, err, "Marshaled DelegatedCredential for an unsupported handshake type")
+
+	// Test successful unmarshal
+	dc := DelegatedCredentialExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err := dc.Unmarshal(delegatedCredentialClient)
+	assertNotError(t, err, "Failed to unmarshal valid DelegatedCredential (client)")
+	assertDeepEquals(t, dc.Algorithms, schemes)
+	assertEquals(t, read, len(delegatedCredentialClient))
+
+	dc = DelegatedCredentialExtension{HandshakeType: HandshakeTypeCertificate}
+	read, err = dc.Unmarshal(delegatedCredentialCertificate)
+	assertNotError(t, err, "Failed to unmarshal valid DelegatedCredential (certificate)")
+	assertDeepEquals(t, dc.Credential, credential)
+	assertEquals(t, read, len(delegatedCredentialCertificate))
+
+	// Test unmarshal failure on an unsupported handshake type
+	dc = DelegatedCredentialExtension{HandshakeType: HandshakeTypeServerHello}
+	_, err = dc.Unmarshal(delegatedCredentialClient)
+	assertError(t, err, "Unmarshaled DelegatedCredential for an unsupported handshake type")
+}
+
+func TestECHMarshalUnmarshal(t *testing.T) {
+	echOuter := unhex("0000010001070002aabb0003010203")
+	echInner := unhex("01")
+	outer := ECHExtension{
+		HandshakeType:   HandshakeTypeClientHello,
+		ClientHelloType: ECHClientHelloOuter,
+		CipherSuite:     HPKESymmetricCipherSuite{KDFID: 0x0001, AEADID: 0x0001},
+		ConfigID:        7,
+		Enc:             []byte{0xaa, 0xbb},
+		Payload:         []byte{0x01, 0x02, 0x03},
+	}
+	retryConfigs, err := MarshalECHConfigList([]ECHConfig{{
+		ConfigID:     7,
+		KEMID:        0x0020,
+		PublicKey:    []byte{0x01},
+		CipherSuites: []HPKESymmetricCipherSuite{{KDFID: 0x0001, AEADID: 0x0001}},
+		PublicName:   "example.com",
+	}})
+	assertNotError(t, err, "Failed to marshal ECHConfigList")
+
+	// Test extension type
+	assertEquals(t, ECHExtension{}.Type(), ExtensionTypeECH)
+
+	// Test successful marshal
+	out, err := outer.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ECH (outer)")
+	assertByteEquals(t, out, echOuter)
+
+	out, err = ECHExtension{HandshakeType: HandshakeTypeClientHello, ClientHelloType: ECHClientHelloInner}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ECH (inner)")
+	assertByteEquals(t, out, echInner)
+
+	out, err = ECHExtension{HandshakeType: HandshakeTypeEncryptedExtensions, RetryConfigs: retryConfigs}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ECH (retry configs)")
+	assertByteEquals(t, out, retryConfigs)
+
+	confirmation := unhex("0102030405060708")
+	out, err = ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest, Confirmation: confirmation}.Marshal()
+	assertNotError(t, err, "Failed to marshal valid ECH (confirmation)")
+	assertByteEquals(t, out, confirmation)
+
+	// Test marshal failure on an unknown ClientHello type, invalid retry
+	// configs, a short confirmation or an unsupported handshake type
+	_, err = ECHExtension{HandshakeType: HandshakeTypeClientHello, ClientHelloType: 2}.Marshal()
+	assertError(t, err, "Marshaled ECH with an unknown ClientHello type")
+	_, err = ECHExtension{HandshakeType: HandshakeTypeEncryptedExtensions, RetryConfigs: []byte{0x00}}.Marshal()
+	assertError(t, err, "Marshaled ECH with invalid retry configs")
+	_, err = ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest, Confirmation: confirmation[:7]}.Marshal()
+	assertError(t, err, "Marshaled ECH with a short confirmation")
+	_, err = ECHExtension{HandshakeType: HandshakeTypeServerHello}.Marshal()
+	assertError(t, err, "Marshaled ECH for an unsupported handshake type")
+
+	// Test successful unmarshal
+	ech := ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err := ech.Unmarshal(echOuter)
+	assertNotError(t, err, "Failed to unmarshal valid ECH (outer)")
+	assertDeepEquals(t, ech, outer)
+	assertEquals(t, read, len(echOuter))
+
+	ech = ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	read, err = ech.Unmarshal(echInner)
+	assertNotError(t, err, "Failed to unmarshal valid ECH (inner)")
+	assertEquals(t, ech.ClientHelloType, ECHClientHelloInner)
+	assertEquals(t, read, len(echInner))
+
+	ech = ECHExtension{HandshakeType: HandshakeTypeEncryptedExtensions}
+	read, err = ech.Unmarshal(retryConfigs)
+	assertNotError(t, err, "Failed to unmarshal valid ECH (retry configs)")
+	assertByteEquals(t, ech.RetryConfigs, retryConfigs)
+	assertEquals(t, read, len(retryConfigs))
+
+	ech = ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+	read, err = ech.Unmarshal(confirmation)
+	assertNotError(t, err, "Failed to unmarshal valid ECH (confirmation)")
+	assertByteEquals(t, ech.Confirmation, confirmation)
+	assertEquals(t, read, len(confirmation))
+
+	// Test unmarshal failure on truncated data, an unknown ClientHello type,
+	// or an unsupported handshake type
+	ech = ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	_, err = ech.Unmarshal(echOuter[:5])
+	assertError(t, err, "Unmarshaled a truncated ECH")
+	_, err = ech.Unmarshal(unhex("02"))
+	assertError(t, err, "Unmarshaled ECH with an unknown ClientHello type")
+	ech = ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest}
+	_, err = ech.Unmarshal(confirmation[:7])
+	assertError(t, err, "Unmarshaled a truncated ECH confirmation")
+	ech = ECHExtension{HandshakeType: HandshakeTypeServerHello}
+	_, err = ech.Unmarshal(echInner)
+	assertError(t, err, "Unmarshaled ECH for an unsupported handshake type")
+}
+
 func TestKeyShareMarshalUnmarshal(t *testing.T) {
 	keyShareClient := unhex(keyShareClientHex)
 	keyShareHelloRetry := unhex(keyShareHelloRetryHex)
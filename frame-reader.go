@@ -52,6 +52,11 @@ func (f *frameReader) needed() int {
 	return tmp
 }
 
+// Whether any part of a frame has been read but not yet returned
+func (f *frameReader) buffered() bool {
+	return f.state != kFrameReaderHdr || f.writeOffset > 0 || len(f.remainder) > 0
+}
+
 func (f *frameReader) addChunk(in []byte) {
 	// Append to the buffer.
 	logf(logTypeFrameReader, "Appending %v", len(in))
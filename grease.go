@@ -0,0 +1,63 @@
+package mint
+
+import (
+	"fmt"
+)
+
+// GREASE (RFC 8701) reserves values of the form 0x?A?A in each of the TLS
+// registries.  A client that sends them at random checks that servers ignore
+// values they don't know, so that new ones can be deployed.
+
+// The GREASE values in a ClientHello.  A second ClientHello, after a
+// HelloRetryRequest, repeats them.
+type greaseValues struct {
+	cipherSuite     CipherSuite
+	group           NamedGroup
+	signatureScheme SignatureScheme
+	version         uint16
+	extension       ExtensionType
+	alpn            string
+}
+
+func greaseValue(seed byte) uint16 {
+	b := uint16(seed&0xf0 | 0x0a)
+	return b<<8 | b
+}
+
+func newGREASEValues() (*greaseValues, error) {
+	seed := make([]byte, 6)
+	if _, err := prng.Read(seed); err != nil {
+		return nil, err
+	}
+
+	// The reserved ALPN identifiers are the same two bytes, 0x?A
+	alpn := seed[5]&0xf0 | 0x0a
+	return &greaseValues{
+		cipherSuite:     CipherSuite(greaseValue(seed[0])),
+		group:           NamedGroup(greaseValue(seed[1])),
+		signatureScheme: SignatureScheme(greaseValue(seed[2])),
+		version:         greaseValue(seed[3]),
+		extension:       ExtensionType(greaseValue(seed[4])),
+		alpn:            string([]byte{alpn, alpn}),
+	}, nil
+}
+
+// An empty extension of a reserved type
+type greaseExtension struct {
+	extensionType ExtensionType
+}
+
+func (ge greaseExtension) Type() ExtensionType {
+	return ge.extensionType
+}
+
+func (ge greaseExtension) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (ge *greaseExtension) Unmarshal(data []byte) (int, error) {
+	if len(data) != 0 {
+		return 0, fmt.Errorf("tls.grease: Non-empty GREASE extension")
+	}
+	return 0, nil
+}
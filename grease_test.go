@@ -0,0 +1,38 @@
+package mint
+
+import (
+	"testing"
+)
+
+func TestGREASEValues(t *testing.T) {
+	isGREASE := func(v uint16) bool {
+		return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+	}
+
+	for i := 0; i < 16; i++ {
+		g, err := newGREASEValues()
+		assertNotError(t, err, "Failed to create GREASE values")
+		assertTrue(t, isGREASE(uint16(g.cipherSuite)), "Cipher suite is not GREASE")
+		assertTrue(t, isGREASE(uint16(g.group)), "Group is not GREASE")
+		assertTrue(t, isGREASE(uint16(g.signatureScheme)), "Signature scheme is not GREASE")
+		assertTrue(t, isGREASE(g.version), "Version is not GREASE")
+		assertTrue(t, isGREASE(uint16(g.extension)), "Extension is not GREASE")
+		assertEquals(t, len(g.alpn), 2)
+		assertTrue(t, isGREASE(uint16(g.alpn[0])<<8|uint16(g.alpn[1])), "ALPN is not GREASE")
+	}
+}
+
+func TestGREASEExtensionMarshalUnmarshal(t *testing.T) {
+	ext := &greaseExtension{0x0a0a}
+	assertEquals(t, ext.Type(), ExtensionType(0x0a0a))
+
+	out, err := ext.Marshal()
+	assertNotError(t, err, "Failed to marshal GREASE extension")
+	assertEquals(t, len(out), 0)
+
+	err = safeUnmarshal(ext, []byte{})
+	assertNotError(t, err, "Failed to unmarshal empty GREASE extension")
+
+	err = safeUnmarshal(ext, []byte{0x00})
+	assertError(t, err, "Unmarshaled a non-empty GREASE extension")
+}
@@ -80,6 +80,8 @@ func (hm HandshakeMessage) ToBody() (HandshakeMessageBody, error) {
 		body = new(EncryptedExtensionsBody)
 	case HandshakeTypeCertificate:
 		body = new(CertificateBody)
+	case HandshakeTypeCompressedCertificate:
+		body = new(CompressedCertificateBody)
 	case HandshakeTypeCertificateRequest:
 		body = new(CertificateRequestBody)
 	case HandshakeTypeCertificateVerify:
@@ -92,6 +94,14 @@ func (hm HandshakeMessage) ToBody() (HandshakeMessageBody, error) {
 		body = new(KeyUpdateBody)
 	case HandshakeTypeEndOfEarlyData:
 		body = new(EndOfEarlyDataBody)
+	case HandshakeTypeServerKeyExchange:
+		body = new(ServerKeyExchangeBody)
+	case HandshakeTypeServerHelloDone:
+		body = new(ServerHelloDoneBody)
+	case HandshakeTypeClientKeyExchange:
+		body = new(ClientKeyExchangeBody)
+	case HandshakeTypeCertificateStatus:
+		body = new(CertificateStatusBody)
 	default:
 		return body, fmt.Errorf("tls.handshakemessage: Unsupported body type")
 	}
@@ -127,6 +137,7 @@ type HandshakeLayer struct {
 	queued         []*HandshakeMessage // In/out queue
 	sent           []*HandshakeMessage // Sent messages for DTLS
 	recvdRecords   []uint64            // Records we have received.
+	receivedCCS    bool                // Have we seen a ChangeCipherSpec
 	maxFragmentLen int
 }
 
@@ -188,11 +199,19 @@ func (h *HandshakeLayer) readRecord() error {
 	}
 
 	switch pt.contentType {
-	case RecordTypeHandshake, RecordTypeAlert, RecordTypeAck:
+	case RecordTypeHandshake, RecordTypeAlert, RecordTypeAck, RecordTypeChangeCipherSpec:
 	default:
 		return fmt.Errorf("tls.handshakelayer: Unexpected record type %d", pt.contentType)
 	}
 
+	// A ChangeCipherSpec carries nothing for the handshake, so read on
+	if pt.contentType == RecordTypeChangeCipherSpec {
+		if err := h.readChangeCipherSpec(pt.fragment); err != nil {
+			return err
+		}
+		return h.readRecord()
+	}
+
 	if pt.contentType == RecordTypeAck {
 		if !h.datagram {
 			return fmt.Errorf("tls.handshakelayer: can't have ACK with TLS")
@@ -346,6 +365,33 @@ func (h *HandshakeLayer) checkMessageAvailable() (*HandshakeMessage, error) {
 	return nil, nil
 }
 
+// Read a ChangeCipherSpec record that is next in the input, for the states
+// that read records themselves rather than through ReadMessage.
+func (h *HandshakeLayer) readChangeCipherSpecRecord() error {
+	pt, err := h.conn.ReadRecord()
+	if err != nil {
+		return err
+	}
+	return h.readChangeCipherSpec(pt.fragment)
+}
+
+// A ChangeCipherSpec can only come between handshake messages, and only once.
+// The handshake state machines check that it came where it was supposed to.
+func (h *HandshakeLayer) readChangeCipherSpec(fragment []byte) error {
+	logf(logTypeIO, "read ChangeCipherSpec")
+	if len(fragment) != 1 || fragment[0] != 1 {
+		return fmt.Errorf("tls.handshakelayer: Malformed ChangeCipherSpec")
+	}
+	if h.frame.buffered() {
+		return fmt.Errorf("tls.handshakelayer: ChangeCipherSpec inside a handshake message")
+	}
+	if h.receivedCCS {
+		return fmt.Errorf("tls.handshakelayer: Duplicate ChangeCipherSpec")
+	}
+	h.receivedCCS = true
+	return nil
+}
+
 func (h *HandshakeLayer) ReadMessage() (*HandshakeMessage, error) {
 	var hdr, body []byte
 	var err error
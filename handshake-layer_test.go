@@ -223,6 +223,34 @@ func TestReadHandshakeMessage(t *testing.T) {
 	assertError(t, err, "Read handshake message from a non-handshake record")
 }
 
+func TestReadChangeCipherSpec(t *testing.T) {
+	ccsHex := "1403010001" + "01"
+	short := unhex(ccsHex + shortHex)
+
+	// Test that a single ChangeCipherSpec is skipped, and remembered
+	h := newHandshakeLayerFromBytes(short)
+	hm, err := h.ReadMessage()
+	assertNotError(t, err, "Failed to read past a ChangeCipherSpec")
+	assertDeepEquals(t, hm, shortMessageIn)
+	assertTrue(t, h.receivedCCS, "ChangeCipherSpec not recorded")
+
+	// Test read failure on a second ChangeCipherSpec
+	h = newHandshakeLayerFromBytes(unhex(ccsHex + ccsHex + shortHex))
+	_, err = h.ReadMessage()
+	assertError(t, err, "Read past two ChangeCipherSpecs")
+
+	// Test read failure on a malformed ChangeCipherSpec
+	h = newHandshakeLayerFromBytes(unhex("1403010001" + "02" + shortHex))
+	_, err = h.ReadMessage()
+	assertError(t, err, "Read past a malformed ChangeCipherSpec")
+
+	// Test read failure on a ChangeCipherSpec inside a handshake message
+	h = newHandshakeLayerFromBytes(unhex(recordHeaderHex(longFragment1) + hex.EncodeToString(longFragment1) +
+		ccsHex + recordHeaderHex(longFragment2) + hex.EncodeToString(longFragment2)))
+	_, err = h.ReadMessage()
+	assertError(t, err, "Read a handshake message split by a ChangeCipherSpec")
+}
+
 func testWriteHandshakeMessage(h *HandshakeLayer, hm *HandshakeMessage) error {
 	hm.cipher = h.conn.(*DefaultRecordLayer).cipher
 	_, err := h.WriteMessage(hm)
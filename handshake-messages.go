@@ -60,7 +60,7 @@ func (ch ClientHelloBody) Marshal() ([]byte, error) {
 		return syntax.Marshal(clientHelloBodyInnerTLS{
 			LegacyVersion:            ch.LegacyVersion,
 			Random:                   ch.Random,
-			LegacySessionID:          []byte{},
+			LegacySessionID:          ch.LegacySessionID,
 			CipherSuites:             ch.CipherSuites,
 			LegacyCompressionMethods: []byte{0},
 			Extensions:               ch.Extensions,
@@ -69,7 +69,7 @@ func (ch ClientHelloBody) Marshal() ([]byte, error) {
 		return syntax.Marshal(clientHelloBodyInnerDTLS{
 			LegacyVersion:            ch.LegacyVersion,
 			Random:                   ch.Random,
-			LegacySessionID:          []byte{},
+			LegacySessionID:          ch.LegacySessionID,
 			CipherSuites:             ch.CipherSuites,
 			LegacyCompressionMethods: []byte{0},
 			Extensions:               ch.Extensions,
@@ -190,8 +190,35 @@ func (sh ServerHelloBody) Marshal() ([]byte, error) {
 	return syntax.Marshal(sh)
 }
 
+// A TLS 1.2 ServerHello without extensions can end after the compression
+// method
+type serverHelloBodyNoExtensions struct {
+	Version                 uint16
+	Random                  [32]byte
+	LegacySessionID         []byte `tls:"head=1,max=32"`
+	CipherSuite             CipherSuite
+	LegacyCompressionMethod uint8
+}
+
 func (sh *ServerHelloBody) Unmarshal(data []byte) (int, error) {
-	return syntax.Unmarshal(data, sh)
+	var inner serverHelloBodyNoExtensions
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	if read < len(data) {
+		return syntax.Unmarshal(data, sh)
+	}
+
+	*sh = ServerHelloBody{
+		Version:                 inner.Version,
+		Random:                  inner.Random,
+		LegacySessionID:         inner.LegacySessionID,
+		CipherSuite:             inner.CipherSuite,
+		LegacyCompressionMethod: inner.LegacyCompressionMethod,
+	}
+	return read, nil
 }
 
 // struct {
@@ -260,7 +287,12 @@ func (ee *EncryptedExtensionsBody) Unmarshal(data []byte) (int, error) {
 // opaque ASN1Cert<1..2^24-1>;
 //
 // struct {
-//     ASN1Cert cert_data;
+//     select (certificate_type) {
+//         case RawPublicKey:
+//             opaque ASN1_subjectPublicKeyInfo<1..2^24-1>;
+//         case X509:
+//             ASN1Cert cert_data;
+//     };
 //     Extension extensions<0..2^16-1>
 // } CertificateEntry;
 //
@@ -268,12 +300,19 @@ func (ee *EncryptedExtensionsBody) Unmarshal(data []byte) (int, error) {
 //     opaque certificate_request_context<0..2^8-1>;
 //     CertificateEntry certificate_list<0..2^24-1>;
 // } Certificate;
+//
+// The certificate type is negotiated through the client_certificate_type and
+// server_certificate_type extensions, so it is not carried on the wire.  For
+// raw public keys, RawPublicKey holds a DER-encoded SubjectPublicKeyInfo and
+// CertData is nil.
 type CertificateEntry struct {
-	CertData   *x509.Certificate
-	Extensions ExtensionList
+	CertData     *x509.Certificate
+	RawPublicKey []byte
+	Extensions   ExtensionList
 }
 
 type CertificateBody struct {
+	CertificateType           CertificateType
 	CertificateRequestContext []byte
 	CertificateList           []CertificateEntry
 }
@@ -299,8 +338,13 @@ func (c CertificateBody) Marshal() ([]byte, error) {
 	}
 
 	for i, entry := range c.CertificateList {
+		certData := entry.RawPublicKey
+		if c.CertificateType == CertificateTypeX509 {
+			certData = entry.CertData.Raw
+		}
+
 		inner.CertificateList[i] = certificateEntryInner{
-			CertData:   entry.CertData.Raw,
+			CertData:   certData,
 			Extensions: entry.Extensions,
 		}
 	}
@@ -319,9 +363,22 @@ func (c *CertificateBody) Unmarshal(data []byte) (int, error) {
 	c.CertificateList = make([]CertificateEntry, len(inner.CertificateList))
 
 	for i, entry := range inner.CertificateList {
-		c.CertificateList[i].CertData, err = x509.ParseCertificate(entry.CertData)
-		if err != nil {
-			return 0, fmt.Errorf("tls:certificate: Certificate failed to parse: %v", err)
+		switch c.CertificateType {
+		case CertificateTypeX509:
+			c.CertificateList[i].CertData, err = x509.ParseCertificate(entry.CertData)
+			if err != nil {
+				return 0, fmt.Errorf("tls:certificate: Certificate failed to parse: %v", err)
+			}
+
+		case CertificateTypeRawPublicKey:
+			_, err = x509.ParsePKIXPublicKey(entry.CertData)
+			if err != nil {
+				return 0, fmt.Errorf("tls:certificate: Public key failed to parse: %v", err)
+			}
+			c.CertificateList[i].RawPublicKey = entry.CertData
+
+		default:
+			return 0, fmt.Errorf("tls:certificate: Unsupported certificate type [%d]", c.CertificateType)
 		}
 
 		c.CertificateList[i].Extensions = entry.Extensions
@@ -479,3 +536,54 @@ func (eoed EndOfEarlyDataBody) Marshal() ([]byte, error) {
 func (eoed *EndOfEarlyDataBody) Unmarshal(data []byte) (int, error) {
 	return 0, nil
 }
+
+// struct {
+//     CertificateCompressionAlgorithm algorithm;
+//     uint24 uncompressed_length;
+//     opaque compressed_certificate_message<1..2^24-1>;
+// } CompressedCertificate;
+type CompressedCertificateBody struct {
+	Algorithm                    CertificateCompressionAlgorithm
+	UncompressedLength           int
+	CompressedCertificateMessage []byte
+}
+
+type compressedCertificateInner struct {
+	Algorithm                    CertificateCompressionAlgorithm
+	UncompressedLength           [3]byte
+	CompressedCertificateMessage []byte `tls:"head=3,min=1"`
+}
+
+func (cc CompressedCertificateBody) Type() HandshakeType {
+	return HandshakeTypeCompressedCertificate
+}
+
+func (cc CompressedCertificateBody) Marshal() ([]byte, error) {
+	if cc.UncompressedLength < 0 || cc.UncompressedLength >= 1<<24 {
+		return nil, fmt.Errorf("tls:compressedcertificate: Uncompressed length out of range")
+	}
+
+	inner := compressedCertificateInner{
+		Algorithm:                    cc.Algorithm,
+		CompressedCertificateMessage: cc.CompressedCertificateMessage,
+	}
+	inner.UncompressedLength[0] = byte(cc.UncompressedLength >> 16)
+	inner.UncompressedLength[1] = byte(cc.UncompressedLength >> 8)
+	inner.UncompressedLength[2] = byte(cc.UncompressedLength)
+	return syntax.Marshal(inner)
+}
+
+func (cc *CompressedCertificateBody) Unmarshal(data []byte) (int, error) {
+	inner := compressedCertificateInner{}
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return read, err
+	}
+
+	cc.Algorithm = inner.Algorithm
+	cc.UncompressedLength = int(inner.UncompressedLength[0])<<16 |
+		int(inner.UncompressedLength[1])<<8 |
+		int(inner.UncompressedLength[2])
+	cc.CompressedCertificateMessage = inner.CompressedCertificateMessage
+	return read, nil
+}
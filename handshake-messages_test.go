@@ -229,6 +229,14 @@ var (
 	// EndOfEarlyData test cases
 	endOfEarlyDataValidHex = ""
 	endOfEarlyDataValidIn  = EndOfEarlyDataBody{}
+
+	// CompressedCertificate test cases
+	compressedCertificateValidHex = "0001000400000003a0a1a2"
+	compressedCertificateValidIn  = CompressedCertificateBody{
+		Algorithm:                    CertificateCompressionZlib,
+		UncompressedLength:           0x0400,
+		CompressedCertificateMessage: []byte{0xa0, 0xa1, 0xa2},
+	}
 )
 
 func TestHandshakeMessageTypes(t *testing.T) {
@@ -274,6 +282,16 @@ func TestClientHelloMarshalUnmarshal(t *testing.T) {
 	assertError(t, err, "Marshaled a ClientHello with bad extensions")
 	chValidIn.Extensions = extListValidIn
 
+	// Test successful marshal of a session ID
+	chValidIn.LegacySessionID = bytes.Repeat([]byte{0x5a}, 32)
+	out, err = chValidIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a ClientHello with a session ID")
+	var chSession ClientHelloBody
+	err = safeUnmarshal(&chSession, out)
+	assertNotError(t, err, "Failed to unmarshal a ClientHello with a session ID")
+	assertByteEquals(t, chSession.LegacySessionID, chValidIn.LegacySessionID)
+	chValidIn.LegacySessionID = []byte{}
+
 	// Test successful unmarshal
 	var ch ClientHelloBody
 	read, err := ch.Unmarshal(chValid)
@@ -380,6 +398,15 @@ func TestServerHelloMarshalUnmarshal(t *testing.T) {
 	assertEquals(t, sh.CipherSuite, shEmptyIn.CipherSuite)
 	assertEquals(t, len(sh.Extensions), 0)
 
+	// Test successful unmarshal of a TLS 1.2 ServerHello with no extensions
+	// block at all
+	shNoExtensions := shEmpty[:len(shEmpty)-2]
+	read, err = sh.Unmarshal(shNoExtensions)
+	assertNotError(t, err, "Failed to unmarshal a ServerHello without extensions")
+	assertEquals(t, read, len(shNoExtensions))
+	assertEquals(t, sh.CipherSuite, shEmptyIn.CipherSuite)
+	assertEquals(t, len(sh.Extensions), 0)
+
 	// Test unmarshal failure on too-short ServerHello
 	_, err = sh.Unmarshal(shValid[:fixedServerHelloBodyLen-1])
 	assertError(t, err, "Unmarshaled a too-short ServerHello")
@@ -666,6 +693,35 @@ func TestEndOfEarlyDataMarshalUnmarshal(t *testing.T) {
 	assertDeepEquals(t, eoed, endOfEarlyDataValidIn)
 }
 
+func TestCompressedCertificateMarshalUnmarshal(t *testing.T) {
+	compressedCertificateValid := unhex(compressedCertificateValidHex)
+
+	// Test correctness of handshake type
+	assertEquals(t, (CompressedCertificateBody{}).Type(), HandshakeTypeCompressedCertificate)
+
+	// Test successful marshal
+	out, err := compressedCertificateValidIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid CompressedCertificate")
+	assertByteEquals(t, out, compressedCertificateValid)
+
+	// Test marshal failure on an uncompressed length too large for uint24
+	tooLong := compressedCertificateValidIn
+	tooLong.UncompressedLength = 1 << 24
+	_, err = tooLong.Marshal()
+	assertError(t, err, "Marshaled a CompressedCertificate with an overlong length")
+
+	// Test successful unmarshal
+	var cc CompressedCertificateBody
+	read, err := cc.Unmarshal(compressedCertificateValid)
+	assertNotError(t, err, "Failed to unmarshal a valid CompressedCertificate")
+	assertEquals(t, read, len(compressedCertificateValid))
+	assertDeepEquals(t, cc, compressedCertificateValidIn)
+
+	// Test unmarshal failure on an empty compressed message
+	_, err = cc.Unmarshal(unhex("0001000400000000"))
+	assertError(t, err, "Unmarshaled a CompressedCertificate with no data")
+}
+
 func TestsafeUnmarshal(t *testing.T) {
 	chValid := unhex(chValidHex)
 	tooLong := append(chValid, 0)
@@ -0,0 +1,502 @@
+// Package hpke implements Hybrid Public Key Encryption (RFC 9180) in the base,
+// PSK, auth and auth_psk modes, over the Diffie-Hellman KEMs for X25519 and
+// the NIST curves.
+package hpke
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+type Mode uint8
+
+const (
+	ModeBase    Mode = 0x00
+	ModePSK     Mode = 0x01
+	ModeAuth    Mode = 0x02
+	ModeAuthPSK Mode = 0x03
+)
+
+type KEMID uint16
+
+const (
+	DHKEM_P256   KEMID = 0x0010
+	DHKEM_P384   KEMID = 0x0011
+	DHKEM_P521   KEMID = 0x0012
+	DHKEM_X25519 KEMID = 0x0020
+)
+
+type KDFID uint16
+
+const (
+	HKDF_SHA256 KDFID = 0x0001
+	HKDF_SHA384 KDFID = 0x0002
+	HKDF_SHA512 KDFID = 0x0003
+)
+
+type AEADID uint16
+
+const (
+	AES_128_GCM       AEADID = 0x0001
+	AES_256_GCM       AEADID = 0x0002
+	CHACHA20_POLY1305 AEADID = 0x0003
+	EXPORT_ONLY       AEADID = 0xffff
+)
+
+const versionLabel = "HPKE-v1"
+
+type kdf struct {
+	hash crypto.Hash
+}
+
+var kdfs = map[KDFID]kdf{
+	HKDF_SHA256: {crypto.SHA256},
+	HKDF_SHA384: {crypto.SHA384},
+	HKDF_SHA512: {crypto.SHA512},
+}
+
+func (k kdf) labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte(versionLabel), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(k.hash.New, labeledIKM, salt)
+}
+
+func (k kdf) labeledExpand(suiteID, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := []byte{byte(length >> 8), byte(length)}
+	labeledInfo = append(labeledInfo, versionLabel...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+
+	out := make([]byte, length)
+	if _, err := hkdf.Expand(k.hash.New, prk, labeledInfo).Read(out); err != nil {
+		// Only possible if the length exceeds 255*Nh, which callers check
+		panic(err)
+	}
+	return out
+}
+
+type aeadScheme struct {
+	keySize int
+	new     func(key []byte) (cipher.AEAD, error)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+var aeads = map[AEADID]aeadScheme{
+	AES_128_GCM:       {16, newAESGCM},
+	AES_256_GCM:       {32, newAESGCM},
+	CHACHA20_POLY1305: {32, chacha20poly1305.New},
+	EXPORT_ONLY:       {0, nil},
+}
+
+const nonceSize = 12
+
+// A Suite is a combination of a KEM, a KDF and an AEAD
+type Suite struct {
+	KEM  KEMID
+	KDF  KDFID
+	AEAD AEADID
+}
+
+// Supported reports whether this package implements all three algorithms
+func (s Suite) Supported() bool {
+	_, kemOK := kems[s.KEM]
+	_, kdfOK := kdfs[s.KDF]
+	_, aeadOK := aeads[s.AEAD]
+	return kemOK && kdfOK && aeadOK
+}
+
+func (s Suite) String() string {
+	return fmt.Sprintf("[%04x, %04x, %04x]", uint16(s.KEM), uint16(s.KDF), uint16(s.AEAD))
+}
+
+func (s Suite) suiteID() []byte {
+	return []byte{'H', 'P', 'K', 'E',
+		byte(s.KEM >> 8), byte(s.KEM),
+		byte(s.KDF >> 8), byte(s.KDF),
+		byte(s.AEAD >> 8), byte(s.AEAD)}
+}
+
+// Key generation and parsing only depend on the KEM
+func (s Suite) kem() (*dhkem, error) {
+	kem, ok := kems[s.KEM]
+	if !ok {
+		return nil, fmt.Errorf("hpke: Unsupported KEM %04x", uint16(s.KEM))
+	}
+	return kem, nil
+}
+
+// GenerateKeyPair generates a fresh key pair for the suite's KEM
+func (s Suite) GenerateKeyPair() (*PrivateKey, error) {
+	kem, err := s.kem()
+	if err != nil {
+		return nil, err
+	}
+	return kem.generateKeyPair()
+}
+
+// DeriveKeyPair deterministically derives a key pair from the input keying
+// material, which should have at least as much entropy as the private key
+func (s Suite) DeriveKeyPair(ikm []byte) (*PrivateKey, error) {
+	kem, err := s.kem()
+	if err != nil {
+		return nil, err
+	}
+	return kem.deriveKeyPair(ikm)
+}
+
+// UnmarshalPublicKey parses a serialized public key (DeserializePublicKey)
+func (s Suite) UnmarshalPublicKey(data []byte) (*PublicKey, error) {
+	kem, err := s.kem()
+	if err != nil {
+		return nil, err
+	}
+	return kem.newPublicKey(data)
+}
+
+// UnmarshalPrivateKey parses a serialized private key (DeserializePrivateKey)
+func (s Suite) UnmarshalPrivateKey(data []byte) (*PrivateKey, error) {
+	kem, err := s.kem()
+	if err != nil {
+		return nil, err
+	}
+	return kem.newPrivateKey(data)
+}
+
+// KeySchedule, RFC 9180, Section 5.1
+func (s Suite) keySchedule(mode Mode, sharedSecret, info, psk, pskID []byte) (*context, error) {
+	hasPSK := len(psk) > 0
+	hasPSKID := len(pskID) > 0
+	switch {
+	case hasPSK != hasPSKID:
+		return nil, fmt.Errorf("hpke: Inconsistent PSK inputs")
+	case hasPSK && (mode == ModeBase || mode == ModeAuth):
+		return nil, fmt.Errorf("hpke: PSK input provided when not needed")
+	case !hasPSK && (mode == ModePSK || mode == ModeAuthPSK):
+		return nil, fmt.Errorf("hpke: Missing required PSK input")
+	}
+
+	kdf := kdfs[s.KDF]
+	suiteID := s.suiteID()
+
+	pskIDHash := kdf.labeledExtract(suiteID, nil, "psk_id_hash", pskID)
+	infoHash := kdf.labeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{byte(mode)}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+
+	secret := kdf.labeledExtract(suiteID, sharedSecret, "secret", psk)
+
+	ctx := &context{
+		suiteID:        suiteID,
+		kdf:            kdf,
+		exporterSecret: kdf.labeledExpand(suiteID, secret, "exp", keyScheduleContext, kdf.hash.Size()),
+	}
+
+	scheme := aeads[s.AEAD]
+	if scheme.new == nil {
+		return ctx, nil
+	}
+
+	key := kdf.labeledExpand(suiteID, secret, "key", keyScheduleContext, scheme.keySize)
+	aead, err := scheme.new(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx.aead = aead
+	ctx.baseNonce = kdf.labeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, nonceSize)
+	return ctx, nil
+}
+
+func (s Suite) setupS(mode Mode, skE *PrivateKey, pkR *PublicKey, info, psk, pskID []byte, skS *PrivateKey) ([]byte, *SenderContext, error) {
+	if !s.Supported() {
+		return nil, nil, fmt.Errorf("hpke: Unsupported cipher suite %v", s)
+	}
+
+	kem, err := s.kem()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if skE == nil {
+		skE, err = kem.generateKeyPair()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sharedSecret, enc, err := kem.encap(skE, pkR, skS)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, err := s.keySchedule(mode, sharedSecret, info, psk, pskID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, &SenderContext{*ctx}, nil
+}
+
+func (s Suite) setupR(mode Mode, enc []byte, skR *PrivateKey, info, psk, pskID []byte, pkS *PublicKey) (*ReceiverContext, error) {
+	if !s.Supported() {
+		return nil, fmt.Errorf("hpke: Unsupported cipher suite %v", s)
+	}
+
+	kem, err := s.kem()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := kem.decap(enc, skR, pkS)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := s.keySchedule(mode, sharedSecret, info, psk, pskID)
+	if err != nil {
+		return nil, err
+	}
+	return &ReceiverContext{*ctx}, nil
+}
+
+// SetupBaseS sets up a sender context for the recipient's public key, and
+// returns the encapsulated key to send to the recipient
+func (s Suite) SetupBaseS(pkR *PublicKey, info []byte) ([]byte, *SenderContext, error) {
+	return s.setupS(ModeBase, nil, pkR, info, nil, nil, nil)
+}
+
+// SetupBaseR sets up a recipient context from an encapsulated key
+func (s Suite) SetupBaseR(enc []byte, skR *PrivateKey, info []byte) (*ReceiverContext, error) {
+	return s.setupR(ModeBase, enc, skR, info, nil, nil, nil)
+}
+
+// SetupPSKS is SetupBaseS, additionally binding a pre-shared key
+func (s Suite) SetupPSKS(pkR *PublicKey, info, psk, pskID []byte) ([]byte, *SenderContext, error) {
+	return s.setupS(ModePSK, nil, pkR, info, psk, pskID, nil)
+}
+
+// SetupPSKR is SetupBaseR, additionally binding a pre-shared key
+func (s Suite) SetupPSKR(enc []byte, skR *PrivateKey, info, psk, pskID []byte) (*ReceiverContext, error) {
+	return s.setupR(ModePSK, enc, skR, info, psk, pskID, nil)
+}
+
+// SetupAuthS is SetupBaseS, additionally authenticating the sender's key
+func (s Suite) SetupAuthS(pkR *PublicKey, info []byte, skS *PrivateKey) ([]byte, *SenderContext, error) {
+	if skS == nil {
+		return nil, nil, fmt.Errorf("hpke: Missing sender key")
+	}
+	return s.setupS(ModeAuth, nil, pkR, info, nil, nil, skS)
+}
+
+// SetupAuthR is SetupBaseR, additionally authenticating the sender's key
+func (s Suite) SetupAuthR(enc []byte, skR *PrivateKey, info []byte, pkS *PublicKey) (*ReceiverContext, error) {
+	if pkS == nil {
+		return nil, fmt.Errorf("hpke: Missing sender key")
+	}
+	return s.setupR(ModeAuth, enc, skR, info, nil, nil, pkS)
+}
+
+// SetupAuthPSKS combines SetupPSKS and SetupAuthS
+func (s Suite) SetupAuthPSKS(pkR *PublicKey, info, psk, pskID []byte, skS *PrivateKey) ([]byte, *SenderContext, error) {
+	if skS == nil {
+		return nil, nil, fmt.Errorf("hpke: Missing sender key")
+	}
+	return s.setupS(ModeAuthPSK, nil, pkR, info, psk, pskID, skS)
+}
+
+// SetupAuthPSKR combines SetupPSKR and SetupAuthR
+func (s Suite) SetupAuthPSKR(enc []byte, skR *PrivateKey, info, psk, pskID []byte, pkS *PublicKey) (*ReceiverContext, error) {
+	if pkS == nil {
+		return nil, fmt.Errorf("hpke: Missing sender key")
+	}
+	return s.setupR(ModeAuthPSK, enc, skR, info, psk, pskID, pkS)
+}
+
+// Seal encrypts a single message to the recipient in the base mode,
+// returning the encapsulated key and the ciphertext
+func (s Suite) Seal(pkR *PublicKey, info, aad, pt []byte) ([]byte, []byte, error) {
+	enc, ctx, err := s.SetupBaseS(pkR, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := ctx.Seal(aad, pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ct, nil
+}
+
+// Open decrypts a single message sealed with Seal
+func (s Suite) Open(enc []byte, skR *PrivateKey, info, aad, ct []byte) ([]byte, error) {
+	ctx, err := s.SetupBaseR(enc, skR, info)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Open(aad, ct)
+}
+
+// SealPSK is Seal in the PSK mode
+func (s Suite) SealPSK(pkR *PublicKey, info, aad, pt, psk, pskID []byte) ([]byte, []byte, error) {
+	enc, ctx, err := s.SetupPSKS(pkR, info, psk, pskID)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := ctx.Seal(aad, pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ct, nil
+}
+
+// OpenPSK is Open in the PSK mode
+func (s Suite) OpenPSK(enc []byte, skR *PrivateKey, info, aad, ct, psk, pskID []byte) ([]byte, error) {
+	ctx, err := s.SetupPSKR(enc, skR, info, psk, pskID)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Open(aad, ct)
+}
+
+// SealAuth is Seal in the auth mode
+func (s Suite) SealAuth(pkR *PublicKey, info, aad, pt []byte, skS *PrivateKey) ([]byte, []byte, error) {
+	enc, ctx, err := s.SetupAuthS(pkR, info, skS)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := ctx.Seal(aad, pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ct, nil
+}
+
+// OpenAuth is Open in the auth mode
+func (s Suite) OpenAuth(enc []byte, skR *PrivateKey, info, aad, ct []byte, pkS *PublicKey) ([]byte, error) {
+	ctx, err := s.SetupAuthR(enc, skR, info, pkS)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Open(aad, ct)
+}
+
+// SealAuthPSK is Seal in the auth_psk mode
+func (s Suite) SealAuthPSK(pkR *PublicKey, info, aad, pt, psk, pskID []byte, skS *PrivateKey) ([]byte, []byte, error) {
+	enc, ctx, err := s.SetupAuthPSKS(pkR, info, psk, pskID, skS)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := ctx.Seal(aad, pt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ct, nil
+}
+
+// OpenAuthPSK is Open in the auth_psk mode
+func (s Suite) OpenAuthPSK(enc []byte, skR *PrivateKey, info, aad, ct, psk, pskID []byte, pkS *PublicKey) ([]byte, error) {
+	ctx, err := s.SetupAuthPSKR(enc, skR, info, psk, pskID, pkS)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Open(aad, ct)
+}
+
+// The state shared by sender and recipient contexts.  The AEAD is nil for
+// the export-only AEAD.
+type context struct {
+	suiteID        []byte
+	kdf            kdf
+	aead           cipher.AEAD
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+}
+
+func (ctx *context) nonce() ([]byte, error) {
+	if ctx.aead == nil {
+		return nil, fmt.Errorf("hpke: Export-only context cannot encrypt")
+	}
+	if ctx.seq == math.MaxUint64 {
+		return nil, fmt.Errorf("hpke: Message limit reached")
+	}
+
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce[nonceSize-8:], ctx.seq)
+	for i := range nonce {
+		nonce[i] ^= ctx.baseNonce[i]
+	}
+	return nonce, nil
+}
+
+// Overhead returns the difference between the length of a ciphertext and
+// that of its plaintext
+func (ctx *context) Overhead() int {
+	if ctx.aead == nil {
+		return 0
+	}
+	return ctx.aead.Overhead()
+}
+
+// Export derives a secret of the given length from the context, RFC 9180,
+// Section 5.3
+func (ctx *context) Export(exporterContext []byte, length int) ([]byte, error) {
+	if length < 0 || length > 255*ctx.kdf.hash.Size() || length > 0xffff {
+		return nil, fmt.Errorf("hpke: Invalid export length %d", length)
+	}
+	return ctx.kdf.labeledExpand(ctx.suiteID, ctx.exporterSecret, "sec", exporterContext, length), nil
+}
+
+// A SenderContext encrypts a sequence of messages to the recipient
+type SenderContext struct {
+	context
+}
+
+// Seal encrypts the next message in the sequence
+func (ctx *SenderContext) Seal(aad, pt []byte) ([]byte, error) {
+	nonce, err := ctx.nonce()
+	if err != nil {
+		return nil, err
+	}
+
+	ct := ctx.aead.Seal(nil, nonce, pt, aad)
+	ctx.seq++
+	return ct, nil
+}
+
+// A ReceiverContext decrypts a sequence of messages from the sender, which
+// must be opened in the order they were sealed
+type ReceiverContext struct {
+	context
+}
+
+// Open decrypts the next message in the sequence
+func (ctx *ReceiverContext) Open(aad, ct []byte) ([]byte, error) {
+	nonce, err := ctx.nonce()
+	if err != nil {
+		return nil, err
+	}
+
+	pt, err := ctx.aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, err
+	}
+	ctx.seq++
+	return pt, nil
+}
@@ -0,0 +1,417 @@
+package hpke
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"golang.org/x/crypto/sha3"
+)
+
+func unhex(h string) []byte {
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+var (
+	testInfo  = []byte("Ode on a Grecian Urn")
+	testAAD   = []byte("Count-0")
+	testPT    = []byte("Beauty is truth, truth beauty")
+	testPSK   = unhex("0247fd33b913760fa1fa51e1892d9f307fbe65eb171e8132c2af18555a738b82")
+	testPSKID = []byte("Ennyn Durin aran Moria")
+
+	testKEMs = []KEMID{DHKEM_P256, DHKEM_P384, DHKEM_P521, DHKEM_X25519}
+)
+
+func TestRFC9180BaseVector(t *testing.T) {
+	// RFC 9180, Appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256,
+	// AES-128-GCM, base mode
+	suite := Suite{DHKEM_X25519, HKDF_SHA256, AES_128_GCM}
+	skRm := unhex("4612c550263fc8ad58375df3f557aac531d26850903e55a9f23f21d8534e8ac8")
+	enc := unhex("37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431")
+	baseNonce := unhex("56d890e5accaaf011cff4b7d")
+	ct := unhex("f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a")
+
+	skR, err := suite.UnmarshalPrivateKey(skRm)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal private key: %v", err)
+	}
+
+	ctx, err := suite.SetupBaseR(enc, skR, testInfo)
+	if err != nil {
+		t.Fatalf("Failed to set up recipient: %v", err)
+	}
+	if !bytes.Equal(ctx.baseNonce, baseNonce) {
+		t.Fatalf("Incorrect base nonce: %x != %x", ctx.baseNonce, baseNonce)
+	}
+
+	pt, err := ctx.Open(testAAD, ct)
+	if err != nil || !bytes.Equal(pt, testPT) {
+		t.Fatalf("Failed to open test vector: %v", err)
+	}
+}
+
+func drawRandomInput(t *testing.T, r io.Reader) []byte {
+	l := make([]byte, 1)
+	if _, err := r.Read(l); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, int(l[0]))
+	if _, err := r.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// The RFC 9180 base mode vectors, with the encryptions and exports of each
+// vector replaced by a SHAKE128 accumulation over 1000 pseudorandom inputs,
+// as in the Go standard library's crypto/hpke tests.
+func TestRFC9180Vectors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/rfc9180.json")
+	if err != nil {
+		t.Fatalf("Failed to read test vectors: %v", err)
+	}
+
+	var vectors []struct {
+		Mode           Mode   `json:"mode"`
+		KEM            KEMID  `json:"kem_id"`
+		KDF            KDFID  `json:"kdf_id"`
+		AEAD           AEADID `json:"aead_id"`
+		Info           string `json:"info"`
+		IkmE           string `json:"ikmE"`
+		IkmR           string `json:"ikmR"`
+		SkRm           string `json:"skRm"`
+		PkRm           string `json:"pkRm"`
+		Enc            string `json:"enc"`
+		AccEncryptions string `json:"encryptions_accumulated"`
+		AccExports     string `json:"exports_accumulated"`
+	}
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Failed to parse test vectors: %v", err)
+	}
+
+	for _, v := range vectors {
+		suite := Suite{v.KEM, v.KDF, v.AEAD}
+		t.Run(fmt.Sprintf("%d%v", v.Mode, suite), func(t *testing.T) {
+			skR, err := suite.DeriveKeyPair(unhex(v.IkmR))
+			if err != nil {
+				t.Fatalf("Failed to derive recipient key: %v", err)
+			}
+			if !bytes.Equal(skR.Bytes(), unhex(v.SkRm)) || !bytes.Equal(skR.PublicKey().Bytes(), unhex(v.PkRm)) {
+				t.Fatalf("Incorrect recipient key")
+			}
+
+			skE, err := suite.DeriveKeyPair(unhex(v.IkmE))
+			if err != nil {
+				t.Fatalf("Failed to derive ephemeral key: %v", err)
+			}
+
+			pkR, err := suite.UnmarshalPublicKey(unhex(v.PkRm))
+			if err != nil {
+				t.Fatalf("Failed to unmarshal public key: %v", err)
+			}
+
+			info := unhex(v.Info)
+			enc, sender, err := suite.setupS(v.Mode, skE, pkR, info, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to set up sender: %v", err)
+			}
+			if !bytes.Equal(enc, unhex(v.Enc)) {
+				t.Fatalf("Incorrect enc: %x != %s", enc, v.Enc)
+			}
+
+			recipient, err := suite.setupR(v.Mode, enc, skR, info, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("Failed to set up recipient: %v", err)
+			}
+
+			if v.AEAD == EXPORT_ONLY {
+				if _, err := sender.Seal(nil, nil); err == nil {
+					t.Fatalf("Sealed with an export-only context")
+				}
+				if _, err := recipient.Open(nil, nil); err == nil {
+					t.Fatalf("Opened with an export-only context")
+				}
+			} else {
+				source, sink := sha3.NewShake128(), sha3.NewShake128()
+				for i := 0; i < 1000; i++ {
+					aad, pt := drawRandomInput(t, source), drawRandomInput(t, source)
+					ct, err := sender.Seal(aad, pt)
+					if err != nil {
+						t.Fatalf("Failed to seal: %v", err)
+					}
+					sink.Write(ct)
+
+					opened, err := recipient.Open(aad, ct)
+					if err != nil || !bytes.Equal(opened, pt) {
+						t.Fatalf("Failed to open: %v", err)
+					}
+				}
+
+				acc := make([]byte, 16)
+				sink.Read(acc)
+				if !bytes.Equal(acc, unhex(v.AccEncryptions)) {
+					t.Fatalf("Incorrect encryptions: %x != %s", acc, v.AccEncryptions)
+				}
+			}
+
+			source, sink := sha3.NewShake128(), sha3.NewShake128()
+			for l := 0; l < 1000; l++ {
+				exporterContext := drawRandomInput(t, source)
+				value, err := sender.Export(exporterContext, l)
+				if err != nil {
+					t.Fatalf("Failed to export: %v", err)
+				}
+				sink.Write(value)
+
+				other, err := recipient.Export(exporterContext, l)
+				if err != nil || !bytes.Equal(other, value) {
+					t.Fatalf("Recipient export mismatch: %v", err)
+				}
+			}
+
+			acc := make([]byte, 16)
+			sink.Read(acc)
+			if !bytes.Equal(acc, unhex(v.AccExports)) {
+				t.Fatalf("Incorrect exports: %x != %s", acc, v.AccExports)
+			}
+		})
+	}
+}
+
+func TestModes(t *testing.T) {
+	for _, kem := range testKEMs {
+		for _, aead := range []AEADID{AES_128_GCM, AES_256_GCM, CHACHA20_POLY1305} {
+			suite := Suite{kem, HKDF_SHA384, aead}
+
+			skR, err := suite.GenerateKeyPair()
+			if err != nil {
+				t.Fatalf("Failed to generate recipient key: %v", err)
+			}
+			skS, err := suite.GenerateKeyPair()
+			if err != nil {
+				t.Fatalf("Failed to generate sender key: %v", err)
+			}
+			skX, err := suite.GenerateKeyPair()
+			if err != nil {
+				t.Fatalf("Failed to generate other key: %v", err)
+			}
+			pkR, pkS, pkX := skR.PublicKey(), skS.PublicKey(), skX.PublicKey()
+
+			// Each mode round-trips a sequence of messages, and fails with
+			// the wrong PSK or sender key
+			type setup struct {
+				name   string
+				sender func() ([]byte, *SenderContext, error)
+				good   func(enc []byte) (*ReceiverContext, error)
+				bad    func(enc []byte) (*ReceiverContext, error)
+			}
+			setups := []setup{
+				{
+					name:   "base",
+					sender: func() ([]byte, *SenderContext, error) { return suite.SetupBaseS(pkR, testInfo) },
+					good:   func(enc []byte) (*ReceiverContext, error) { return suite.SetupBaseR(enc, skR, testInfo) },
+					bad:    func(enc []byte) (*ReceiverContext, error) { return suite.SetupBaseR(enc, skX, testInfo) },
+				},
+				{
+					name:   "psk",
+					sender: func() ([]byte, *SenderContext, error) { return suite.SetupPSKS(pkR, testInfo, testPSK, testPSKID) },
+					good: func(enc []byte) (*ReceiverContext, error) {
+						return suite.SetupPSKR(enc, skR, testInfo, testPSK, testPSKID)
+					},
+					bad: func(enc []byte) (*ReceiverContext, error) {
+						return suite.SetupPSKR(enc, skR, testInfo, testPSK[1:], testPSKID)
+					},
+				},
+				{
+					name:   "auth",
+					sender: func() ([]byte, *SenderContext, error) { return suite.SetupAuthS(pkR, testInfo, skS) },
+					good:   func(enc []byte) (*ReceiverContext, error) { return suite.SetupAuthR(enc, skR, testInfo, pkS) },
+					bad:    func(enc []byte) (*ReceiverContext, error) { return suite.SetupAuthR(enc, skR, testInfo, pkX) },
+				},
+				{
+					name: "auth_psk",
+					sender: func() ([]byte, *SenderContext, error) {
+						return suite.SetupAuthPSKS(pkR, testInfo, testPSK, testPSKID, skS)
+					},
+					good: func(enc []byte) (*ReceiverContext, error) {
+						return suite.SetupAuthPSKR(enc, skR, testInfo, testPSK, testPSKID, pkS)
+					},
+					bad: func(enc []byte) (*ReceiverContext, error) {
+						return suite.SetupAuthPSKR(enc, skR, testInfo, testPSK, testPSKID, pkX)
+					},
+				},
+			}
+
+			for _, s := range setups {
+				enc, sender, err := s.sender()
+				if err != nil {
+					t.Fatalf("%v %s: Failed to set up sender: %v", suite, s.name, err)
+				}
+				recipient, err := s.good(enc)
+				if err != nil {
+					t.Fatalf("%v %s: Failed to set up recipient: %v", suite, s.name, err)
+				}
+
+				for i := 0; i < 3; i++ {
+					ct, err := sender.Seal(testAAD, testPT)
+					if err != nil || len(ct) != len(testPT)+sender.Overhead() {
+						t.Fatalf("%v %s: Failed to seal: %v", suite, s.name, err)
+					}
+					pt, err := recipient.Open(testAAD, ct)
+					if err != nil || !bytes.Equal(pt, testPT) {
+						t.Fatalf("%v %s: Failed to open: %v", suite, s.name, err)
+					}
+				}
+
+				// The wrong AAD or an out-of-order message fails to open
+				ct, _ := sender.Seal(testAAD, testPT)
+				if _, err := recipient.Open(testInfo, ct); err == nil {
+					t.Fatalf("%v %s: Opened with the wrong AAD", suite, s.name)
+				}
+				sender.Seal(testAAD, testPT)
+				ct, _ = sender.Seal(testAAD, testPT)
+				if _, err := recipient.Open(testAAD, ct); err == nil {
+					t.Fatalf("%v %s: Opened an out-of-order message", suite, s.name)
+				}
+
+				senderExport, _ := sender.Export(testInfo, 32)
+				recipientExport, _ := recipient.Export(testInfo, 32)
+				if !bytes.Equal(senderExport, recipientExport) {
+					t.Fatalf("%v %s: Exported secrets differ", suite, s.name)
+				}
+
+				enc, sender, _ = s.sender()
+				ct, _ = sender.Seal(testAAD, testPT)
+				wrong, err := s.bad(enc)
+				if err == nil {
+					_, err = wrong.Open(testAAD, ct)
+				}
+				if err == nil {
+					t.Fatalf("%v %s: Opened with the wrong keys", suite, s.name)
+				}
+			}
+
+			_, _, err = suite.SetupAuthS(pkR, testInfo, nil)
+			if err == nil {
+				t.Fatalf("Set up an auth sender without a sender key")
+			}
+		}
+	}
+}
+
+func TestPSKInputs(t *testing.T) {
+	suite := Suite{DHKEM_X25519, HKDF_SHA256, AES_128_GCM}
+	skR, _ := suite.GenerateKeyPair()
+	pkR := skR.PublicKey()
+
+	cases := map[string]struct {
+		mode       Mode
+		psk, pskID []byte
+	}{
+		"psk-without-id":  {ModePSK, testPSK, nil},
+		"id-without-psk":  {ModePSK, nil, testPSKID},
+		"psk-mode-no-psk": {ModePSK, nil, nil},
+		"base-with-psk":   {ModeBase, testPSK, testPSKID},
+		"auth-with-psk":   {ModeAuth, testPSK, testPSKID},
+	}
+	for name, c := range cases {
+		if _, _, err := suite.setupS(c.mode, nil, pkR, testInfo, c.psk, c.pskID, nil); err == nil {
+			t.Fatalf("%s: Set up a sender with invalid PSK inputs", name)
+		}
+	}
+}
+
+func TestSingleShot(t *testing.T) {
+	for _, kem := range testKEMs {
+		suite := Suite{kem, HKDF_SHA256, AES_256_GCM}
+		skR, _ := suite.GenerateKeyPair()
+		skS, _ := suite.GenerateKeyPair()
+		pkR, pkS := skR.PublicKey(), skS.PublicKey()
+
+		enc, ct, err := suite.Seal(pkR, testInfo, testAAD, testPT)
+		if err != nil {
+			t.Fatalf("Failed to seal: %v", err)
+		}
+		pt, err := suite.Open(enc, skR, testInfo, testAAD, ct)
+		if err != nil || !bytes.Equal(pt, testPT) {
+			t.Fatalf("Failed to open: %v", err)
+		}
+
+		enc, ct, err = suite.SealPSK(pkR, testInfo, testAAD, testPT, testPSK, testPSKID)
+		if err != nil {
+			t.Fatalf("Failed to seal in PSK mode: %v", err)
+		}
+		pt, err = suite.OpenPSK(enc, skR, testInfo, testAAD, ct, testPSK, testPSKID)
+		if err != nil || !bytes.Equal(pt, testPT) {
+			t.Fatalf("Failed to open in PSK mode: %v", err)
+		}
+
+		enc, ct, err = suite.SealAuth(pkR, testInfo, testAAD, testPT, skS)
+		if err != nil {
+			t.Fatalf("Failed to seal in auth mode: %v", err)
+		}
+		pt, err = suite.OpenAuth(enc, skR, testInfo, testAAD, ct, pkS)
+		if err != nil || !bytes.Equal(pt, testPT) {
+			t.Fatalf("Failed to open in auth mode: %v", err)
+		}
+
+		enc, ct, err = suite.SealAuthPSK(pkR, testInfo, testAAD, testPT, testPSK, testPSKID, skS)
+		if err != nil {
+			t.Fatalf("Failed to seal in auth_psk mode: %v", err)
+		}
+		pt, err = suite.OpenAuthPSK(enc, skR, testInfo, testAAD, ct, testPSK, testPSKID, pkS)
+		if err != nil || !bytes.Equal(pt, testPT) {
+			t.Fatalf("Failed to open in auth_psk mode: %v", err)
+		}
+
+		// The ciphertext is bound to the mode
+		if _, err := suite.Open(enc, skR, testInfo, testAAD, ct); err == nil {
+			t.Fatalf("Opened an auth_psk ciphertext in base mode")
+		}
+	}
+}
+
+func TestUnsupported(t *testing.T) {
+	x25519, _ := Suite{KEM: DHKEM_X25519}.GenerateKeyPair()
+	p256, _ := Suite{KEM: DHKEM_P256}.GenerateKeyPair()
+
+	unsupported := []Suite{
+		{0x0021, HKDF_SHA256, AES_128_GCM},
+		{DHKEM_X25519, 0x0004, AES_128_GCM},
+		{DHKEM_X25519, HKDF_SHA256, 0x0004},
+	}
+	for _, suite := range unsupported {
+		if suite.Supported() {
+			t.Fatalf("Unsupported suite reported as supported: %v", suite)
+		}
+		if _, _, err := suite.SetupBaseS(x25519.PublicKey(), testInfo); err == nil {
+			t.Fatalf("Set up a sender with an unsupported suite: %v", suite)
+		}
+		if _, err := suite.SetupBaseR(x25519.PublicKey().Bytes(), x25519, testInfo); err == nil {
+			t.Fatalf("Set up a recipient with an unsupported suite: %v", suite)
+		}
+	}
+
+	// Keys must match the KEM
+	suite := Suite{DHKEM_X25519, HKDF_SHA256, AES_128_GCM}
+	if _, _, err := suite.SetupBaseS(p256.PublicKey(), testInfo); err == nil {
+		t.Fatalf("Set up a sender with a key for the wrong KEM")
+	}
+	if _, err := suite.UnmarshalPublicKey(p256.PublicKey().Bytes()); err == nil {
+		t.Fatalf("Unmarshaled a public key for the wrong KEM")
+	}
+
+	// Export lengths are limited to 255*Nh
+	_, ctx, _ := suite.SetupBaseS(x25519.PublicKey(), testInfo)
+	if _, err := ctx.Export(nil, 255*32+1); err == nil {
+		t.Fatalf("Exported more than 255*Nh bytes")
+	}
+}
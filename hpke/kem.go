@@ -0,0 +1,233 @@
+package hpke
+
+import (
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// A dhkem is one of the Diffie-Hellman based KEMs of RFC 9180, Section 4.1.
+// The curve is nil for X25519.
+type dhkem struct {
+	id        KEMID
+	curve     elliptic.Curve
+	kdf       KDFID
+	nSecret   int
+	nSK       int
+	bitmask   byte
+	clampable bool
+}
+
+var kems = map[KEMID]*dhkem{
+	DHKEM_P256:   {id: DHKEM_P256, curve: elliptic.P256(), kdf: HKDF_SHA256, nSecret: 32, nSK: 32, bitmask: 0xff},
+	DHKEM_P384:   {id: DHKEM_P384, curve: elliptic.P384(), kdf: HKDF_SHA384, nSecret: 48, nSK: 48, bitmask: 0xff},
+	DHKEM_P521:   {id: DHKEM_P521, curve: elliptic.P521(), kdf: HKDF_SHA512, nSecret: 64, nSK: 66, bitmask: 0x01},
+	DHKEM_X25519: {id: DHKEM_X25519, kdf: HKDF_SHA256, nSecret: 32, nSK: 32, clampable: true},
+}
+
+// A PublicKey is a public key for one of the KEMs, kept in its serialized
+// form
+type PublicKey struct {
+	kem  *dhkem
+	data []byte
+}
+
+// Bytes returns the serialized public key (SerializePublicKey)
+func (pk *PublicKey) Bytes() []byte {
+	return append([]byte{}, pk.data...)
+}
+
+// A PrivateKey is a private key for one of the KEMs
+type PrivateKey struct {
+	kem    *dhkem
+	scalar []byte
+	public *PublicKey
+}
+
+// Bytes returns the serialized private key (SerializePrivateKey)
+func (sk *PrivateKey) Bytes() []byte {
+	return append([]byte{}, sk.scalar...)
+}
+
+// PublicKey returns the public key that corresponds to sk
+func (sk *PrivateKey) PublicKey() *PublicKey {
+	return sk.public
+}
+
+func (k *dhkem) suiteID() []byte {
+	return []byte{'K', 'E', 'M', byte(k.id >> 8), byte(k.id)}
+}
+
+func (k *dhkem) newPrivateKey(scalar []byte) (*PrivateKey, error) {
+	if len(scalar) != k.nSK {
+		return nil, fmt.Errorf("hpke: Wrong private key size")
+	}
+
+	var pub []byte
+	if k.curve == nil {
+		var private, public [32]byte
+		copy(private[:], scalar)
+		curve25519.ScalarBaseMult(&public, &private)
+		pub = public[:]
+	} else {
+		s := new(big.Int).SetBytes(scalar)
+		if s.Sign() == 0 || s.Cmp(k.curve.Params().N) >= 0 {
+			return nil, fmt.Errorf("hpke: Invalid private key")
+		}
+		x, y := k.curve.ScalarBaseMult(scalar)
+		pub = elliptic.Marshal(k.curve, x, y)
+	}
+
+	return &PrivateKey{
+		kem:    k,
+		scalar: append([]byte{}, scalar...),
+		public: &PublicKey{kem: k, data: pub},
+	}, nil
+}
+
+func (k *dhkem) newPublicKey(data []byte) (*PublicKey, error) {
+	if k.curve == nil {
+		if len(data) != 32 {
+			return nil, fmt.Errorf("hpke: Wrong public key size")
+		}
+	} else {
+		byteLen := (k.curve.Params().BitSize + 7) / 8
+		if len(data) != 1+2*byteLen {
+			return nil, fmt.Errorf("hpke: Wrong public key size")
+		}
+		// Unmarshal rejects points that are not on the curve
+		if x, _ := elliptic.Unmarshal(k.curve, data); x == nil {
+			return nil, fmt.Errorf("hpke: Invalid public key")
+		}
+	}
+	return &PublicKey{kem: k, data: append([]byte{}, data...)}, nil
+}
+
+func (k *dhkem) generateKeyPair() (*PrivateKey, error) {
+	if k.curve == nil {
+		scalar := make([]byte, k.nSK)
+		if _, err := rand.Read(scalar); err != nil {
+			return nil, err
+		}
+		return k.newPrivateKey(scalar)
+	}
+
+	scalar, _, _, err := elliptic.GenerateKey(k.curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return k.newPrivateKey(scalar)
+}
+
+// DeriveKeyPair, RFC 9180, Section 7.1.3
+func (k *dhkem) deriveKeyPair(ikm []byte) (*PrivateKey, error) {
+	kdf := kdfs[k.kdf]
+	dkpPRK := kdf.labeledExtract(k.suiteID(), nil, "dkp_prk", ikm)
+
+	if k.clampable {
+		sk := kdf.labeledExpand(k.suiteID(), dkpPRK, "sk", nil, k.nSK)
+		return k.newPrivateKey(sk)
+	}
+
+	for counter := 0; counter < 256; counter++ {
+		bytes := kdf.labeledExpand(k.suiteID(), dkpPRK, "candidate", []byte{byte(counter)}, k.nSK)
+		bytes[0] &= k.bitmask
+
+		// newPrivateKey rejects zero and values not less than the order
+		if sk, err := k.newPrivateKey(bytes); err == nil {
+			return sk, nil
+		}
+	}
+	return nil, fmt.Errorf("hpke: Unable to derive key pair")
+}
+
+// The Diffie-Hellman shared secret, which for the NIST curves is the
+// x-coordinate of the shared point
+func (k *dhkem) dh(sk *PrivateKey, pk *PublicKey) ([]byte, error) {
+	if sk.kem != k || pk.kem != k {
+		return nil, fmt.Errorf("hpke: Key does not match KEM")
+	}
+
+	if k.curve == nil {
+		var private, public, shared [32]byte
+		copy(private[:], sk.scalar)
+		copy(public[:], pk.data)
+		curve25519.ScalarMult(&shared, &private, &public)
+
+		// A low-order public key gives an all-zero secret, which RFC 9180
+		// requires us to reject
+		if subtle.ConstantTimeCompare(shared[:], make([]byte, 32)) == 1 {
+			return nil, fmt.Errorf("hpke: Invalid public key")
+		}
+		return shared[:], nil
+	}
+
+	x, y := elliptic.Unmarshal(k.curve, pk.data)
+	zx, _ := k.curve.ScalarMult(x, y, sk.scalar)
+	zxBytes := zx.Bytes()
+
+	byteLen := (k.curve.Params().BitSize + 7) / 8
+	shared := make([]byte, byteLen)
+	copy(shared[byteLen-len(zxBytes):], zxBytes)
+	return shared, nil
+}
+
+func (k *dhkem) extractAndExpand(dh, kemContext []byte) []byte {
+	kdf := kdfs[k.kdf]
+	eaePRK := kdf.labeledExtract(k.suiteID(), nil, "eae_prk", dh)
+	return kdf.labeledExpand(k.suiteID(), eaePRK, "shared_secret", kemContext, k.nSecret)
+}
+
+// Encap and AuthEncap, with the ephemeral key supplied by the caller.  If skS
+// is nil, the encapsulation is not authenticated.
+func (k *dhkem) encap(skE *PrivateKey, pkR *PublicKey, skS *PrivateKey) ([]byte, []byte, error) {
+	dh, err := k.dh(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := skE.PublicKey().Bytes()
+	kemContext := append(append([]byte{}, enc...), pkR.data...)
+
+	if skS != nil {
+		dhS, err := k.dh(skS, pkR)
+		if err != nil {
+			return nil, nil, err
+		}
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, skS.PublicKey().data...)
+	}
+
+	return k.extractAndExpand(dh, kemContext), enc, nil
+}
+
+// Decap and AuthDecap.  If pkS is nil, the encapsulation is not
+// authenticated.
+func (k *dhkem) decap(enc []byte, skR *PrivateKey, pkS *PublicKey) ([]byte, error) {
+	pkE, err := k.newPublicKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := k.dh(skR, pkE)
+	if err != nil {
+		return nil, err
+	}
+
+	kemContext := append(append([]byte{}, enc...), skR.PublicKey().data...)
+
+	if pkS != nil {
+		dhS, err := k.dh(skR, pkS)
+		if err != nil {
+			return nil, err
+		}
+		dh = append(dh, dhS...)
+		kemContext = append(kemContext, pkS.data...)
+	}
+
+	return k.extractAndExpand(dh, kemContext), nil
+}
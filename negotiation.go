@@ -2,19 +2,24 @@ package mint
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
 	"encoding/hex"
 	"fmt"
+	"net"
+	"strings"
 	"time"
 )
 
+// VersionNegotiation selects the first of the supported versions, which are
+// listed highest first, that the client offered.
 func VersionNegotiation(offered, supported []uint16) (bool, uint16) {
-	for _, offeredVersion := range offered {
-		for _, tls13Version := range supported {
-			logf(logTypeHandshake, "[server] version offered by client [%04x] <> [%04x]", offeredVersion, tls13Version)
-			if offeredVersion == tls13Version {
-				// XXX: Should probably be highest supported version, but for now, we
-				// only support one version, so it doesn't really matter.
-				return true, offeredVersion
+	for _, supportedVersion := range supported {
+		for _, offeredVersion := range offered {
+			logf(logTypeHandshake, "[server] version offered by client [%04x] <> [%04x]", offeredVersion, supportedVersion)
+			if offeredVersion == supportedVersion {
+				return true, supportedVersion
 			}
 		}
 	}
@@ -22,6 +27,15 @@ func VersionNegotiation(offered, supported []uint16) (bool, uint16) {
 	return false, 0
 }
 
+func versionListContains(versions []uint16, version uint16) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
 func DHNegotiation(keyShares []KeyShareEntry, groups []NamedGroup) (bool, NamedGroup, []byte, []byte) {
 	for _, share := range keyShares {
 		for _, group := range groups {
@@ -54,19 +68,74 @@ const (
 
 func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context []byte, psks PreSharedKeyCache) (bool, int, *PreSharedKey, CipherSuiteParams, error) {
 	logf(logTypeNegotiation, "Negotiating PSK offered=[%d] supported=[%d]", len(identities), psks.Size())
+	return pskNegotiation(identities, binders, context, pskCacheLookup(psks), time.Now(), nil, nil)
+}
+
+// Servers store PSKs by hex-encoded identity
+func pskCacheLookup(psks PreSharedKeyCache) func([]byte) (*PreSharedKey, error) {
+	return func(identity []byte) (*PreSharedKey, error) {
+		if psk, ok := psks.Get(hex.EncodeToString(identity)); ok {
+			return &psk, nil
+		}
+		return nil, nil
+	}
+}
+
+// pskNegotiation is PSKNegotiation with an arbitrary lookup function, which
+// returns nil if it has no PSK for an identity.  Of the identities that are
+// known, unexpired at now, current and usable with a cipher suite both sides
+// support, the server selects the one whose cipher suite it prefers most, and
+// after that the one the client listed first.  Only the selected identity's
+// binder is checked.  If offered and supported are nil, any cipher suite is
+// usable.
+func pskNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context []byte, lookup func([]byte) (*PreSharedKey, error), now time.Time, offered, supported []CipherSuite) (bool, int, *PreSharedKey, CipherSuiteParams, error) {
+	if len(binders) != len(identities) {
+		return false, 0, nil, CipherSuiteParams{}, fmt.Errorf("tls.presharedkey: Mismatched identities and binders")
+	}
+
+	suiteRank := func(suite CipherSuite) (int, bool) {
+		if supported == nil {
+			return 0, true
+		}
+		if _, ok := cipherSuiteMap[suite]; !ok {
+			return 0, false
+		}
+
+		offeredByClient := false
+		for _, o := range offered {
+			offeredByClient = offeredByClient || (o == suite)
+		}
+		for rank, s := range supported {
+			if offeredByClient && s == suite {
+				return rank, true
+			}
+		}
+		return 0, false
+	}
+
+	selected := -1
+	var selectedPSK PreSharedKey
+	var selectedRank int
 	for i, id := range identities {
-		identityHex := hex.EncodeToString(id.Identity)
+		found, err := lookup(id.Identity)
+		if err != nil {
+			return false, 0, nil, CipherSuiteParams{}, err
+		}
+		if found == nil {
+			logf(logTypeNegotiation, "No PSK for identity %x", id.Identity)
+			continue
+		}
+		psk := *found
 
-		psk, ok := psks.Get(identityHex)
-		if !ok {
-			logf(logTypeNegotiation, "No PSK for identity %x", identityHex)
+		if psk.expired(now) {
+			logf(logTypeNegotiation, "PSK for identity %x expired at %v", id.Identity, psk.ExpiresAt)
 			continue
 		}
 
 		// For resumption, make sure the ticket age is correct
 		if psk.IsResumption {
 			extTicketAge := id.ObfuscatedTicketAge - psk.TicketAgeAdd
-			knownTicketAge := uint32(time.Since(psk.ReceivedAt) / time.Millisecond)
+			knownTicketAge := uint32(now.Sub(psk.ReceivedAt) / time.Millisecond)
 			ticketAgeDelta := knownTicketAge - extTicketAge
 			if knownTicketAge < extTicketAge {
 				ticketAgeDelta = extTicketAge - knownTicketAge
@@ -75,44 +144,51 @@ func PSKNegotiation(identities []PSKIdentity, binders []PSKBinderEntry, context
 				logf(logTypeNegotiation, "WARNING potential replay [%x]", psk.Identity)
 				logf(logTypeNegotiation, "Ticket age exceeds tolerance |%d - %d| = [%d] > [%d]",
 					extTicketAge, knownTicketAge, ticketAgeDelta, ticketAgeTolerance)
-				return false, 0, nil, CipherSuiteParams{}, fmt.Errorf("WARNING Potential replay for identity %x", psk.Identity)
+				continue
 			}
 		}
 
-		params, ok := cipherSuiteMap[psk.CipherSuite]
+		rank, ok := suiteRank(psk.CipherSuite)
 		if !ok {
-			err := fmt.Errorf("tls.cryptoinit: Unsupported ciphersuite from PSK [%04x]", psk.CipherSuite)
-			return false, 0, nil, CipherSuiteParams{}, err
+			logf(logTypeNegotiation, "Unusable ciphersuite [%04x] for identity %x", uint16(psk.CipherSuite), psk.Identity)
+			continue
 		}
 
-		// Compute binder
-		binderLabel := labelExternalBinder
-		if psk.IsResumption {
-			binderLabel = labelResumptionBinder
+		if selected < 0 || rank < selectedRank {
+			selected, selectedPSK, selectedRank = i, psk, rank
 		}
+	}
 
-		h0 := params.Hash.New().Sum(nil)
-		zero := bytes.Repeat([]byte{0}, params.Hash.Size())
-		earlySecret := HkdfExtract(params.Hash, zero, psk.Key)
-		binderKey := deriveSecret(params, earlySecret, binderLabel, h0)
+	if selected < 0 {
+		logf(logTypeNegotiation, "Failed to find a usable PSK")
+		return false, 0, nil, CipherSuiteParams{}, nil
+	}
 
-		// context = ClientHello[truncated]
-		// context = ClientHello1 + HelloRetryRequest + ClientHello2[truncated]
-		ctxHash := params.Hash.New()
-		ctxHash.Write(context)
+	psk := selectedPSK
+	params, ok := cipherSuiteMap[psk.CipherSuite]
+	if !ok {
+		err := fmt.Errorf("tls.cryptoinit: Unsupported ciphersuite from PSK [%04x]", uint16(psk.CipherSuite))
+		return false, 0, nil, CipherSuiteParams{}, err
+	}
 
-		binder := computeFinishedData(params, binderKey, ctxHash.Sum(nil))
-		if !bytes.Equal(binder, binders[i].Binder) {
-			logf(logTypeNegotiation, "Binder check failed for identity %x; [%x] != [%x]", psk.Identity, binder, binders[i].Binder)
-			return false, 0, nil, CipherSuiteParams{}, fmt.Errorf("Binder check failed identity %x", psk.Identity)
-		}
+	// Compute binder
+	h0 := params.Hash.New().Sum(nil)
+	earlySecret := pskEarlySecret(params, psk)
+	binderKey := deriveSecret(params, earlySecret, psk.binderLabel(), h0)
 
-		logf(logTypeNegotiation, "Using PSK with identity %x", psk.Identity)
-		return true, i, &psk, params, nil
+	// context = ClientHello[truncated]
+	// context = ClientHello1 + HelloRetryRequest + ClientHello2[truncated]
+	ctxHash := params.Hash.New()
+	ctxHash.Write(context)
+
+	binder := computeFinishedData(params, binderKey, ctxHash.Sum(nil))
+	if !bytes.Equal(binder, binders[selected].Binder) {
+		logf(logTypeNegotiation, "Binder check failed for identity %x; [%x] != [%x]", psk.Identity, binder, binders[selected].Binder)
+		return false, 0, nil, CipherSuiteParams{}, fmt.Errorf("Binder check failed identity %x", psk.Identity)
 	}
 
-	logf(logTypeNegotiation, "Failed to find a usable PSK")
-	return false, 0, nil, CipherSuiteParams{}, nil
+	logf(logTypeNegotiation, "Using PSK with identity %x", psk.Identity)
+	return true, selected, &psk, params, nil
 }
 
 func PSKModeNegotiation(canDoDH, canDoPSK bool, modes []PSKKeyExchangeMode) (bool, bool) {
@@ -135,37 +211,251 @@ func PSKModeNegotiation(canDoDH, canDoPSK bool, modes []PSKKeyExchangeMode) (boo
 }
 
 func CertificateSelection(serverName *string, signatureSchemes []SignatureScheme, certs []*Certificate) (*Certificate, SignatureScheme, error) {
-	// Select for server name if provided
-	candidates := certs
+	return certificateSelection(serverName, signatureSchemes, nil, certs)
+}
+
+// certificateSelection is CertificateSelection, also limited to certificates
+// whose chains are signed with certSignatureSchemes, if that is not nil.
+func certificateSelection(serverName *string, signatureSchemes, certSignatureSchemes []SignatureScheme, certs []*Certificate) (*Certificate, SignatureScheme, error) {
+	// Select for server name if provided.  Certificates that match the name
+	// exactly are tried before wildcard ones.
+	groups := [][]*Certificate{certs}
 	if serverName != nil {
-		candidatesByName := []*Certificate{}
-		for _, cert := range certs {
-			for _, name := range cert.Chain[0].DNSNames {
-				if len(*serverName) > 0 && name == *serverName {
-					candidatesByName = append(candidatesByName, cert)
-				}
-			}
+		exact, wildcard := certificateNameMatches(certs, *serverName)
+		if len(exact)+len(wildcard) == 0 {
+			return nil, 0, fmt.Errorf("No certificates available for server name: %s", *serverName)
 		}
+		groups = [][]*Certificate{exact, wildcard}
+	}
 
-		if len(candidatesByName) == 0 {
-			return nil, 0, fmt.Errorf("No certificates available for server name: %s", *serverName)
+	// Select for the algorithms used to sign the chain, if the peer said which
+	// ones it accepts
+	if certSignatureSchemes != nil {
+		found := false
+		for i := range groups {
+			groups[i] = certificatesForChainSchemes(groups[i], certSignatureSchemes)
+			found = found || len(groups[i]) > 0
+		}
+		if !found {
+			return nil, 0, fmt.Errorf("No certificates signed with acceptable signature schemes")
 		}
+	}
 
-		candidates = candidatesByName
+	for _, candidates := range groups {
+		if cert, scheme, ok := certificateForSchemes(signatureSchemes, candidates); ok {
+			return cert, scheme, nil
+		}
 	}
 
-	// Select for signature scheme
-	for _, cert := range candidates {
-		for _, scheme := range signatureSchemes {
+	return nil, 0, fmt.Errorf("No certificates compatible with signature schemes")
+}
+
+// Selects for signature scheme, following the client's preference order.
+// The certificate chosen is the one that can use the earliest scheme in the
+// client's list, so an ECDSA certificate wins over an RSA one only if the
+// client lists an ECDSA scheme first.  Ties go to the certificate configured
+// first.
+func certificateForSchemes(signatureSchemes []SignatureScheme, candidates []*Certificate) (*Certificate, SignatureScheme, bool) {
+	for _, scheme := range signatureSchemes {
+		for _, cert := range candidates {
 			if !schemeValidForKey(scheme, cert.PrivateKey) {
 				continue
 			}
 
-			return cert, scheme, nil
+			// A delegated credential fixes the scheme for CertificateVerify
+			if cert.DelegatedCredential != nil && cert.DelegatedCredential.CertVerifyAlgorithm != scheme {
+				continue
+			}
+
+			return cert, scheme, true
 		}
 	}
 
-	return nil, 0, fmt.Errorf("No certificates compatible with signature schemes")
+	return nil, 0, false
+}
+
+// Returns the certificates whose chains are signed only with the given
+// schemes.  Self-signed certificates are not checked, since their signatures
+// carry no weight.
+func certificatesForChainSchemes(certs []*Certificate, schemes []SignatureScheme) []*Certificate {
+	matching := []*Certificate{}
+	for _, cert := range certs {
+		acceptable := true
+		for _, entry := range cert.Chain {
+			if bytes.Equal(entry.RawIssuer, entry.RawSubject) {
+				continue
+			}
+
+			scheme, ok := x509SignatureScheme(entry.SignatureAlgorithm)
+			acceptable = acceptable && ok && schemeListContains(schemes, scheme)
+		}
+
+		if acceptable {
+			matching = append(matching, cert)
+		}
+	}
+	return matching
+}
+
+func x509SignatureScheme(alg x509.SignatureAlgorithm) (SignatureScheme, bool) {
+	switch alg {
+	case x509.SHA1WithRSA:
+		return RSA_PKCS1_SHA1, true
+	case x509.SHA256WithRSA:
+		return RSA_PKCS1_SHA256, true
+	case x509.SHA384WithRSA:
+		return RSA_PKCS1_SHA384, true
+	case x509.SHA512WithRSA:
+		return RSA_PKCS1_SHA512, true
+	case x509.ECDSAWithSHA256:
+		return ECDSA_P256_SHA256, true
+	case x509.ECDSAWithSHA384:
+		return ECDSA_P384_SHA384, true
+	case x509.ECDSAWithSHA512:
+		return ECDSA_P521_SHA512, true
+	case x509.SHA256WithRSAPSS:
+		return RSA_PSS_SHA256, true
+	case x509.SHA384WithRSAPSS:
+		return RSA_PSS_SHA384, true
+	case x509.SHA512WithRSAPSS:
+		return RSA_PSS_SHA512, true
+	case x509.PureEd25519:
+		return Ed25519, true
+	}
+	return 0, false
+}
+
+func schemeListContains(schemes []SignatureScheme, scheme SignatureScheme) bool {
+	for _, s := range schemes {
+		if s == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func isECDSAKey(key crypto.Signer) bool {
+	if key == nil {
+		return false
+	}
+	_, ok := key.Public().(*ecdsa.PublicKey)
+	return ok
+}
+
+// Returns the certificates valid for the given DNS name or IP address, with
+// exact matches ahead of wildcard matches
+func certificatesForName(certs []*Certificate, serverName string) []*Certificate {
+	exact, wildcard := certificateNameMatches(certs, serverName)
+	return append(exact, wildcard...)
+}
+
+// Returns the certificates that match the given DNS name or IP address
+// exactly, and those that only match it with a wildcard
+func certificateNameMatches(certs []*Certificate, serverName string) ([]*Certificate, []*Certificate) {
+	if len(serverName) == 0 {
+		return nil, nil
+	}
+
+	exact := []*Certificate{}
+	wildcard := []*Certificate{}
+	for _, cert := range certs {
+		if cert.isRawPublicKey() {
+			continue
+		}
+
+		leaf := cert.Chain[0]
+		if leaf.VerifyHostname(serverName) != nil {
+			continue
+		}
+
+		isExact := net.ParseIP(serverName) != nil
+		for _, name := range leaf.DNSNames {
+			isExact = isExact || strings.EqualFold(name, serverName)
+		}
+
+		if isExact {
+			exact = append(exact, cert)
+		} else {
+			wildcard = append(wildcard, cert)
+		}
+	}
+
+	return exact, wildcard
+}
+
+// Returns the certificates whose chain contains a certificate issued by or
+// identifying one of the given distinguished names
+func certificatesForAuthorities(certs []*Certificate, authorities [][]byte) []*Certificate {
+	matching := []*Certificate{}
+	for _, cert := range certs {
+		if certificateMatchesAuthorities(cert, authorities) {
+			matching = append(matching, cert)
+		}
+	}
+	return matching
+}
+
+func certificateMatchesAuthorities(cert *Certificate, authorities [][]byte) bool {
+	for _, entry := range cert.Chain {
+		for _, name := range authorities {
+			if bytes.Equal(entry.RawIssuer, name) || bytes.Equal(entry.RawSubject, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the certificates that can be used with a client, leaving out those
+// with delegated credentials unless the client accepts them
+func certificatesForDelegation(certs []*Certificate, dcSchemes, signatureSchemes []SignatureScheme, now time.Time) []*Certificate {
+	usable := []*Certificate{}
+	for _, cert := range certs {
+		dc := cert.DelegatedCredential
+		if dc != nil && (!schemeListContains(dcSchemes, dc.CertVerifyAlgorithm) ||
+			!schemeListContains(signatureSchemes, dc.Algorithm) ||
+			!dc.validAt(cert.Chain[0], now)) {
+			continue
+		}
+		usable = append(usable, cert)
+	}
+	return usable
+}
+
+// Returns the certificates that can be sent with the given certificate type
+func certificatesOfType(certs []*Certificate, certType CertificateType) []*Certificate {
+	matching := []*Certificate{}
+	for _, cert := range certs {
+		if cert.isRawPublicKey() == (certType == CertificateTypeRawPublicKey) {
+			matching = append(matching, cert)
+		}
+	}
+	return matching
+}
+
+func certTypeListContains(certTypes []CertificateType, certType CertificateType) bool {
+	for _, t := range certTypes {
+		if t == certType {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that a raw public key matches one of the pinned keys, by comparing
+// their encoded SubjectPublicKeyInfo
+func verifyPinnedPublicKey(rawPublicKey []byte, pinned []crypto.PublicKey) (crypto.PublicKey, error) {
+	for _, key := range pinned {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if bytes.Equal(der, rawPublicKey) {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("tls.rpk: Public key is not pinned")
 }
 
 func EarlyDataNegotiation(usingPSK, gotEarlyData, allowEarlyData bool) (using bool, rejected bool) {
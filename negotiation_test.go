@@ -2,7 +2,10 @@ package mint
 
 import (
 	"bytes"
+	"encoding/hex"
+	"net"
 	"testing"
+	"time"
 )
 
 func TestVersionNegotiation(t *testing.T) {
@@ -11,6 +14,20 @@ func TestVersionNegotiation(t *testing.T) {
 	assertEquals(t, ok, true)
 	assertEquals(t, negotiated, uint16(0x7f12))
 
+	// Test that the highest supported version wins, whatever the client's order
+	ok, negotiated = VersionNegotiation([]uint16{tls12Version, tls13Version}, []uint16{tls13Version, tls12Version})
+	assertEquals(t, ok, true)
+	assertEquals(t, negotiated, tls13Version)
+
+	ok, negotiated = VersionNegotiation([]uint16{tls12Version}, []uint16{tls13Version, tls12Version})
+	assertEquals(t, ok, true)
+	assertEquals(t, negotiated, tls12Version)
+
+	// Test that unknown (GREASE) versions are ignored
+	ok, negotiated = VersionNegotiation([]uint16{0x7a7a, tls13Version, 0xfafa}, []uint16{tls13Version})
+	assertEquals(t, ok, true)
+	assertEquals(t, negotiated, tls13Version)
+
 	// Test failed negotiation
 	ok, negotiated = VersionNegotiation([]uint16{0x0300}, []uint16{0x0400})
 	assertEquals(t, ok, false)
@@ -49,6 +66,12 @@ func TestDHNegotiation(t *testing.T) {
 	assertNotNil(t, pub, "Nil public key")
 	assertNotNil(t, secret, "Nil DH secret")
 
+	// Test that a key share for an unknown (GREASE) group is ignored
+	greaseKeyShares := append([]KeyShareEntry{{Group: 0x2a2a, KeyExchange: []byte{0}}}, keyShares...)
+	ok, group, _, _ = DHNegotiation(greaseKeyShares, []NamedGroup{X25519})
+	assertEquals(t, ok, true)
+	assertEquals(t, group, X25519)
+
 	// Test failure
 	ok, _, _, _ = DHNegotiation(keyShares, []NamedGroup{P521})
 	assertEquals(t, ok, false)
@@ -97,6 +120,74 @@ func TestPSKNegotiation(t *testing.T) {
 	assertNotError(t, err, "Errored on PSK negotiation failure")
 }
 
+func TestPSKNegotiationPreference(t *testing.T) {
+	chTrunc := unhex("0001020304050607")
+	psks := &PSKMapCache{
+		"00010203": {CipherSuite: TLS_AES_128_GCM_SHA256, Identity: []byte{0, 1, 2, 3}, Key: []byte{0, 1, 2, 3}},
+		"04050607": {CipherSuite: TLS_AES_256_GCM_SHA384, Identity: []byte{4, 5, 6, 7}, Key: []byte{4, 5, 6, 7}},
+	}
+	identities := []PSKIdentity{
+		{Identity: []byte{8, 9, 10, 11}},
+		{Identity: []byte{0, 1, 2, 3}},
+		{Identity: []byte{4, 5, 6, 7}},
+	}
+
+	// Only the selected identity needs a valid binder
+	binderFor := func(index int) []PSKBinderEntry {
+		psk, _ := psks.Get(hex.EncodeToString(identities[index].Identity))
+		params := cipherSuiteMap[psk.CipherSuite]
+		binderKey := deriveSecret(params, pskEarlySecret(params, psk), labelExternalBinder, params.Hash.New().Sum(nil))
+		h := params.Hash.New()
+		h.Write(chTrunc)
+
+		binders := make([]PSKBinderEntry, len(identities))
+		binders[index].Binder = computeFinishedData(params, binderKey, h.Sum(nil))
+		return binders
+	}
+
+	offered := []CipherSuite{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384}
+
+	// The server's ciphersuite preference beats the client's order
+	ok, selected, psk, _, err := pskNegotiation(identities, binderFor(2), chTrunc, pskCacheLookup(psks), time.Now(),
+		offered, []CipherSuite{TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256})
+	assertNotError(t, err, "Failed to negotiate PSK")
+	assertTrue(t, ok, "Failed to select a PSK")
+	assertEquals(t, selected, 2)
+	assertEquals(t, psk.CipherSuite, TLS_AES_256_GCM_SHA384)
+
+	// With equal preference, the client's order wins
+	ok, selected, _, _, err = pskNegotiation(identities, binderFor(1), chTrunc, pskCacheLookup(psks), time.Now(), nil, nil)
+	assertNotError(t, err, "Failed to negotiate PSK")
+	assertTrue(t, ok, "Failed to select a PSK")
+	assertEquals(t, selected, 1)
+
+	// PSKs for ciphersuites that either side doesn't support are skipped
+	ok, selected, _, _, err = pskNegotiation(identities, binderFor(1), chTrunc, pskCacheLookup(psks), time.Now(),
+		[]CipherSuite{TLS_AES_128_GCM_SHA256}, []CipherSuite{TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256})
+	assertNotError(t, err, "Failed to negotiate PSK")
+	assertTrue(t, ok, "Failed to select a PSK")
+	assertEquals(t, selected, 1)
+
+	// Expired PSKs are skipped
+	expired := PSKMapCache{}
+	for key, psk := range *psks {
+		psk.ExpiresAt = time.Now().Add(-time.Second)
+		expired[key] = psk
+	}
+	ok, _, _, _, err = pskNegotiation(identities, binderFor(1), chTrunc, pskCacheLookup(&expired), time.Now(), nil, nil)
+	assertNotError(t, err, "Errored on expired PSKs")
+	assertTrue(t, !ok, "Selected an expired PSK")
+
+	// A bad binder on the selected identity is fatal
+	_, _, _, _, err = pskNegotiation(identities, binderFor(1), chTrunc, pskCacheLookup(psks), time.Now(),
+		offered, []CipherSuite{TLS_AES_256_GCM_SHA384})
+	assertError(t, err, "Accepted a bad binder")
+
+	// The binders must match the identities
+	_, _, _, _, err = pskNegotiation(identities, binderFor(1)[:2], chTrunc, pskCacheLookup(psks), time.Now(), nil, nil)
+	assertError(t, err, "Accepted mismatched binders")
+}
+
 func TestPSKModeNegotiation(t *testing.T) {
 	// Test that everything that's allowed gets used
 	usingDH, usingPSK := PSKModeNegotiation(true, true, []PSKKeyExchangeMode{PSKModeKE, PSKModeDHEKE})
@@ -136,11 +227,133 @@ func TestCertificateSelection(t *testing.T) {
 	_, _, err = CertificateSelection(&badName, rsa, certificates)
 	assertError(t, err, "Found a certificate for an incorrect host name")
 
+	// Test that unknown (GREASE) schemes are ignored
+	cert, scheme, err = certificateSelection(&goodName, []SignatureScheme{0x0a0a, ECDSA_P256_SHA256}, []SignatureScheme{0x1a1a, ECDSA_P256_SHA256}, certificates)
+	assertNotError(t, err, "Failed to find certificate with GREASE schemes")
+	assertNotNil(t, cert, "Failed to set certificate")
+	assertEquals(t, scheme, ECDSA_P256_SHA256)
+
 	// Test failure on no certs matching signature scheme
 	_, _, err = CertificateSelection(&goodName, eddsa, certificates)
 	assertError(t, err, "Found a certificate for an incorrect signature scheme")
 }
 
+func TestCertificateSelectionNames(t *testing.T) {
+	wildcard := newTestCertificate(t, testCertOptions{DNSNames: []string{"*.example.com"}})
+	exact := newTestCertificate(t, testCertOptions{DNSNames: []string{"www.example.com"}})
+	ip := newTestCertificate(t, testCertOptions{IPs: []net.IP{net.ParseIP("192.0.2.1")}})
+	schemes := []SignatureScheme{ECDSA_P256_SHA256}
+	certs := []*Certificate{wildcard, exact, ip}
+
+	cases := []struct {
+		name string
+		cert *Certificate
+	}{
+		{"www.example.com", exact},
+		{"WWW.Example.com", exact},
+		{"mail.example.com", wildcard},
+		{"192.0.2.1", ip},
+		{"example.com", nil},
+		{"a.b.example.com", nil},
+		{"192.0.2.2", nil},
+		{"", nil},
+	}
+
+	for _, c := range cases {
+		name := c.name
+		cert, _, err := CertificateSelection(&name, schemes, certs)
+		if c.cert == nil {
+			assertError(t, err, "Found a certificate for an unknown name")
+			continue
+		}
+		assertNotError(t, err, "Failed to find a certificate")
+		assertEquals(t, cert, c.cert)
+	}
+}
+
+func TestCertificateSelectionPreference(t *testing.T) {
+	rsaCert := newTestCertificate(t, testCertOptions{Alg: RSA_PSS_SHA256, DNSNames: []string{"example.com"}})
+	ecdsaCert := newTestCertificate(t, testCertOptions{Alg: ECDSA_P256_SHA256, DNSNames: []string{"example.com"}})
+	certs := []*Certificate{rsaCert, ecdsaCert}
+	name := "example.com"
+
+	// ECDSA is preferred if the client lists it first, whatever the order of
+	// the certificates
+	cert, scheme, err := CertificateSelection(&name, []SignatureScheme{ECDSA_P256_SHA256, RSA_PSS_SHA256}, certs)
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, ecdsaCert)
+	assertEquals(t, scheme, ECDSA_P256_SHA256)
+
+	// RSA is preferred if the client lists it first
+	cert, scheme, err = CertificateSelection(&name, []SignatureScheme{RSA_PSS_SHA256, ECDSA_P256_SHA256}, []*Certificate{ecdsaCert, rsaCert})
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, rsaCert)
+	assertEquals(t, scheme, RSA_PSS_SHA256)
+
+	// A scheme neither certificate can use doesn't change the ranking
+	cert, scheme, err = CertificateSelection(&name, []SignatureScheme{Ed25519, ECDSA_P256_SHA256, RSA_PSS_SHA256}, certs)
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, ecdsaCert)
+	assertEquals(t, scheme, ECDSA_P256_SHA256)
+
+	// RSA is used if the client does not support ECDSA
+	cert, scheme, err = CertificateSelection(&name, []SignatureScheme{RSA_PSS_SHA384, RSA_PSS_SHA256}, certs)
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, rsaCert)
+	assertEquals(t, scheme, RSA_PSS_SHA384)
+}
+
+func TestCertificateSelectionExactBeforeWildcard(t *testing.T) {
+	exact := newTestCertificate(t, testCertOptions{Alg: RSA_PSS_SHA256, DNSNames: []string{"www.example.com"}})
+	wildcard := newTestCertificate(t, testCertOptions{Alg: ECDSA_P256_SHA256, DNSNames: []string{"*.example.com"}})
+	certs := []*Certificate{wildcard, exact}
+	name := "www.example.com"
+
+	// An exact match wins, even if the client prefers the wildcard's scheme
+	cert, scheme, err := CertificateSelection(&name, []SignatureScheme{ECDSA_P256_SHA256, RSA_PSS_SHA256}, certs)
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, exact)
+	assertEquals(t, scheme, RSA_PSS_SHA256)
+
+	// A wildcard match is used if no exact match has a usable scheme
+	cert, scheme, err = CertificateSelection(&name, []SignatureScheme{ECDSA_P256_SHA256}, certs)
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, wildcard)
+	assertEquals(t, scheme, ECDSA_P256_SHA256)
+}
+
+func TestCertificateSelectionChainSchemes(t *testing.T) {
+	rsaCA := newTestCertificate(t, testCertOptions{Alg: RSA_PSS_SHA256, CommonName: "Test CA", IsCA: true})
+	ecdsaCA := newTestCertificate(t, testCertOptions{Alg: ECDSA_P256_SHA256, CommonName: "Test CA", IsCA: true})
+	rsaSigned := newTestCertificate(t, testCertOptions{DNSNames: []string{"example.com"}, Issuer: rsaCA})
+	ecdsaSigned := newTestCertificate(t, testCertOptions{DNSNames: []string{"example.com"}, Issuer: ecdsaCA})
+	selfSigned := newTestCertificate(t, testCertOptions{DNSNames: []string{"example.com"}})
+	schemes := []SignatureScheme{ECDSA_P256_SHA256}
+	name := "example.com"
+
+	// Without signature_algorithms_cert, any chain is acceptable
+	cert, _, err := CertificateSelection(&name, schemes, []*Certificate{rsaSigned, ecdsaSigned})
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, rsaSigned)
+
+	// With it, chains are filtered by their signature algorithms
+	cert, _, err = certificateSelection(&name, schemes, []SignatureScheme{ECDSA_P256_SHA256}, []*Certificate{rsaSigned, ecdsaSigned})
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, ecdsaSigned)
+
+	cert, _, err = certificateSelection(&name, schemes, []SignatureScheme{RSA_PKCS1_SHA256}, []*Certificate{rsaSigned, ecdsaSigned})
+	assertNotError(t, err, "Failed to find a certificate")
+	assertEquals(t, cert, rsaSigned)
+
+	_, _, err = certificateSelection(&name, schemes, []SignatureScheme{Ed25519}, []*Certificate{rsaSigned, ecdsaSigned})
+	assertError(t, err, "Found a certificate with an unacceptable chain")
+
+	// Self-signed certificates are not checked
+	cert, _, err = certificateSelection(&name, schemes, []SignatureScheme{Ed25519}, []*Certificate{selfSigned})
+	assertNotError(t, err, "Failed to find a self-signed certificate")
+	assertEquals(t, cert, selfSigned)
+}
+
 func TestEarlyDataNegotiation(t *testing.T) {
 	useEarlyData, rejected := EarlyDataNegotiation(true, true, true)
 	assertTrue(t, useEarlyData, "Did not use early data when allowed")
@@ -174,6 +387,11 @@ func TestCipherSuiteNegotiation(t *testing.T) {
 	assertNotError(t, err, "CipherSuite negotiation without PSK failed")
 	assertEquals(t, suite, TLS_AES_256_GCM_SHA384)
 
+	// Test that unknown (GREASE) suites are ignored
+	suite, err = CipherSuiteNegotiation(nil, append([]CipherSuite{0x3a3a}, offered...), supported)
+	assertNotError(t, err, "CipherSuite negotiation with GREASE failed")
+	assertEquals(t, suite, TLS_AES_256_GCM_SHA384)
+
 	// Test failure
 	_, err = CipherSuiteNegotiation(nil, []CipherSuite{TLS_AES_128_GCM_SHA256}, supported)
 	assertError(t, err, "CipherSuite negotiation succeeded with no overlap")
@@ -194,6 +412,11 @@ func TestALPNNegotiation(t *testing.T) {
 	assertNotError(t, err, "ALPN negotiation without PSK failed")
 	assertEquals(t, proto, "h2")
 
+	// Test that unknown (GREASE) protocols are ignored
+	proto, err = ALPNNegotiation(nil, append([]string{"\x4a\x4a"}, offered...), supported)
+	assertNotError(t, err, "ALPN negotiation with GREASE failed")
+	assertEquals(t, proto, "h2")
+
 	// Test failure on resumption and mismatch
 	proto, err = ALPNNegotiation(psk, []string{"http/1.1"}, []string{})
 	assertError(t, err, "Resumption allowed without offer having previous ALPN")
@@ -0,0 +1,329 @@
+package mint
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// The first byte of a PSK file says whether the rest is encrypted
+const (
+	pskFileFormatPlain  uint8 = 0
+	pskFileFormatAESGCM uint8 = 1
+)
+
+type pskFileState struct {
+	Data []byte `tls:"head=3"`
+}
+
+type pskFileEntry struct {
+	Key  []byte         `tls:"head=2"`
+	PSKs []pskFileState `tls:"head=4"`
+}
+
+type pskFileContents struct {
+	Entries []pskFileEntry `tls:"head=4"`
+}
+
+// pskFile holds PSKs in memory and writes all of them to a file whenever they
+// change.  The file is replaced atomically, so a reader never sees a partial
+// write.  If a key is given, the file is encrypted with AES-GCM.
+type pskFile struct {
+	mutex   sync.Mutex
+	path    string
+	aead    cipher.AEAD
+	entries map[string][]PreSharedKey
+	err     error
+}
+
+func openPSKFile(path string, key []byte) (*pskFile, error) {
+	f := &pskFile{
+		path:    path,
+		entries: map[string][]PreSharedKey{},
+	}
+
+	if key != nil {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("tls.psk: Invalid file encryption key [%v]", err)
+		}
+		f.aead, err = cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := f.decode(data); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *pskFile) decode(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("tls.psk: Empty PSK file")
+	}
+
+	format, data := data[0], data[1:]
+	switch {
+	case format == pskFileFormatPlain && f.aead == nil:
+	case format == pskFileFormatAESGCM && f.aead != nil:
+		nonceSize := f.aead.NonceSize()
+		if len(data) < nonceSize {
+			return fmt.Errorf("tls.psk: PSK file too short")
+		}
+
+		var err error
+		data, err = f.aead.Open(nil, data[:nonceSize], data[nonceSize:], []byte{format})
+		if err != nil {
+			return fmt.Errorf("tls.psk: Error decrypting PSK file [%v]", err)
+		}
+	case format == pskFileFormatAESGCM:
+		return fmt.Errorf("tls.psk: PSK file is encrypted, but no key was given")
+	case format == pskFileFormatPlain:
+		return fmt.Errorf("tls.psk: PSK file is not encrypted")
+	default:
+		return fmt.Errorf("tls.psk: Unknown PSK file format [%d]", format)
+	}
+
+	var contents pskFileContents
+	read, err := syntax.Unmarshal(data, &contents)
+	if err != nil {
+		return fmt.Errorf("tls.psk: Error decoding PSK file [%v]", err)
+	}
+	if read != len(data) {
+		return fmt.Errorf("tls.psk: Extra data in PSK file")
+	}
+
+	for _, entry := range contents.Entries {
+		psks := make([]PreSharedKey, len(entry.PSKs))
+		for i, state := range entry.PSKs {
+			if err := psks[i].UnmarshalBinary(state.Data); err != nil {
+				return err
+			}
+		}
+		f.entries[string(entry.Key)] = psks
+	}
+	return nil
+}
+
+func (f *pskFile) encode() ([]byte, error) {
+	keys := make([]string, 0, len(f.entries))
+	for key := range f.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var contents pskFileContents
+	for _, key := range keys {
+		entry := pskFileEntry{Key: []byte(key)}
+		for _, psk := range f.entries[key] {
+			data, err := psk.MarshalBinary()
+			if err != nil {
+				return nil, err
+			}
+			entry.PSKs = append(entry.PSKs, pskFileState{Data: data})
+		}
+		contents.Entries = append(contents.Entries, entry)
+	}
+
+	data, err := syntax.Marshal(contents)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.aead == nil {
+		return append([]byte{pskFileFormatPlain}, data...), nil
+	}
+
+	header := []byte{pskFileFormatAESGCM}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := prng.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(header, nonce...)
+	return f.aead.Seal(out, nonce, data, header), nil
+}
+
+// save writes the PSKs to a temporary file next to the real one, then renames
+// it into place.
+func (f *pskFile) save() error {
+	data, err := f.encode()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(f.path), filepath.Base(f.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
+
+// prune drops the PSKs that have expired, and the keys left with none
+func (f *pskFile) prune(now time.Time) {
+	for key, psks := range f.entries {
+		live := []PreSharedKey{}
+		for _, psk := range psks {
+			if !psk.expired(now) {
+				live = append(live, psk)
+			}
+		}
+
+		if len(live) == 0 {
+			delete(f.entries, key)
+		} else {
+			f.entries[key] = live
+		}
+	}
+}
+
+// update changes the PSKs stored under a key, drops expired ones and saves
+// the file.  The cache interfaces can't return errors, so an error writing
+// the file is logged and kept for err() to report.
+func (f *pskFile) update(key string, change func([]PreSharedKey) []PreSharedKey) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.entries[key] = change(f.entries[key])
+	f.prune(time.Now())
+	f.err = f.save()
+	if f.err != nil {
+		logf(logTypeIO, "Error saving PSK file %s: %v", f.path, f.err)
+	}
+}
+
+func (f *pskFile) lastError() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.err
+}
+
+func (f *pskFile) get(key string) []PreSharedKey {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]PreSharedKey{}, f.entries[key]...)
+}
+
+// PSKFileCache is a PreSharedKeyCache that persists its PSKs in a file, so
+// that they survive between runs of a program.  Every Put rewrites and syncs
+// the whole file while holding a lock, so it is meant for clients and other
+// low-volume uses, not for a busy server.
+type PSKFileCache struct {
+	file *pskFile
+}
+
+// NewPSKFileCache loads the PSKs stored in the file at path, if it exists.
+// If key is not nil, it is an AES key used to encrypt the file.
+func NewPSKFileCache(path string, key []byte) (*PSKFileCache, error) {
+	file, err := openPSKFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+	return &PSKFileCache{file: file}, nil
+}
+
+func (cache *PSKFileCache) Get(key string) (PreSharedKey, bool) {
+	psks := cache.file.get(key)
+	if len(psks) == 0 {
+		return PreSharedKey{}, false
+	}
+	return psks[0], true
+}
+
+func (cache *PSKFileCache) Put(key string, psk PreSharedKey) {
+	cache.file.update(key, func(_ []PreSharedKey) []PreSharedKey {
+		return []PreSharedKey{psk}
+	})
+}
+
+func (cache *PSKFileCache) Size() int {
+	cache.file.mutex.Lock()
+	defer cache.file.mutex.Unlock()
+	return len(cache.file.entries)
+}
+
+// Err returns the error from the last attempt to write the file, or nil if it
+// succeeded.
+func (cache *PSKFileCache) Err() error {
+	return cache.file.lastError()
+}
+
+// ClientSessionFileCache is a ClientSessionCache that persists session
+// tickets in a file, so that a client can resume across runs.  Like
+// PSKFileCache, it rewrites the whole file on every Put.
+type ClientSessionFileCache struct {
+	file          *pskFile
+	ticketsPerKey int
+}
+
+// NewClientSessionFileCache loads the tickets stored in the file at path, if
+// it exists.  If key is not nil, it is an AES key used to encrypt the file.
+// At most ticketsPerKey tickets are kept for each key, or a default number if
+// ticketsPerKey is not positive.
+func NewClientSessionFileCache(path string, key []byte, ticketsPerKey int) (*ClientSessionFileCache, error) {
+	if ticketsPerKey <= 0 {
+		ticketsPerKey = defaultTicketsPerSession
+	}
+
+	file, err := openPSKFile(path, key)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientSessionFileCache{file: file, ticketsPerKey: ticketsPerKey}, nil
+}
+
+func (cache *ClientSessionFileCache) Get(key string) []PreSharedKey {
+	return cache.file.get(key)
+}
+
+func (cache *ClientSessionFileCache) Remove(key string, identity []byte) {
+	cache.file.update(key, func(tickets []PreSharedKey) []PreSharedKey {
+		return removeTicket(tickets, identity)
+	})
+}
+
+func (cache *ClientSessionFileCache) Put(key string, psk PreSharedKey) {
+	cache.file.update(key, func(tickets []PreSharedKey) []PreSharedKey {
+		tickets = append(tickets, psk)
+		if len(tickets) > cache.ticketsPerKey {
+			tickets = tickets[len(tickets)-cache.ticketsPerKey:]
+		}
+		return tickets
+	})
+}
+
+// Err returns the error from the last attempt to write the file, or nil if it
+// succeeded.
+func (cache *ClientSessionFileCache) Err() error {
+	return cache.file.lastError()
+}
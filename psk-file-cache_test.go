@@ -0,0 +1,187 @@
+package mint
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPSKFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "psks")
+
+	cache, err := NewPSKFileCache(path, nil)
+	assertNotError(t, err, "Failed to create PSK file cache")
+	assertEquals(t, cache.Size(), 0)
+
+	cache.Put("a", psk)
+	other := psk
+	other.Identity = []byte{0x09}
+	cache.Put("b", other)
+	cache.Put("b", psk)
+	assertEquals(t, cache.Size(), 2)
+
+	// The PSKs are there when the file is opened again
+	cache, err = NewPSKFileCache(path, nil)
+	assertNotError(t, err, "Failed to reopen PSK file cache")
+	assertEquals(t, cache.Size(), 2)
+	stored, ok := cache.Get("b")
+	assertTrue(t, ok, "PSK not found after reopening")
+	assertDeepEquals(t, stored, psk)
+	_, ok = cache.Get("c")
+	assertTrue(t, !ok, "Found a PSK that was never stored")
+
+	// Only the file itself is left in the directory
+	files, err := ioutil.ReadDir(dir)
+	assertNotError(t, err, "Failed to read directory")
+	assertEquals(t, len(files), 1)
+
+	// The file is encrypted only if a key is given
+	_, err = NewPSKFileCache(path, bytes.Repeat([]byte{0x01}, 16))
+	assertError(t, err, "Opened a plaintext file with a key")
+}
+
+func TestPSKFileCacheEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "psks")
+	key := bytes.Repeat([]byte{0x01}, 32)
+
+	cache, err := NewPSKFileCache(path, key)
+	assertNotError(t, err, "Failed to create encrypted PSK file cache")
+	cache.Put("a", psk)
+
+	data, err := ioutil.ReadFile(path)
+	assertNotError(t, err, "Failed to read PSK file")
+	assertTrue(t, !bytes.Contains(data, psk.Identity), "Identity stored in the clear")
+
+	cache, err = NewPSKFileCache(path, key)
+	assertNotError(t, err, "Failed to reopen encrypted PSK file cache")
+	stored, ok := cache.Get("a")
+	assertTrue(t, ok, "PSK not found after reopening")
+	assertDeepEquals(t, stored, psk)
+
+	_, err = NewPSKFileCache(path, nil)
+	assertError(t, err, "Opened an encrypted file without a key")
+	_, err = NewPSKFileCache(path, bytes.Repeat([]byte{0x02}, 32))
+	assertError(t, err, "Opened an encrypted file with the wrong key")
+	_, err = NewPSKFileCache(path, []byte{0x01})
+	assertError(t, err, "Accepted an invalid key")
+
+	data[len(data)-1] ^= 0xff
+	err = ioutil.WriteFile(path, data, 0600)
+	assertNotError(t, err, "Failed to write PSK file")
+	_, err = NewPSKFileCache(path, key)
+	assertError(t, err, "Opened a corrupted file")
+}
+
+func TestClientSessionFileCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions")
+	key := bytes.Repeat([]byte{0x01}, 16)
+
+	cache, err := NewClientSessionFileCache(path, key, 2)
+	assertNotError(t, err, "Failed to create session file cache")
+
+	tickets := []PreSharedKey{psk, psk, psk}
+	for i := range tickets {
+		tickets[i].IsResumption = true
+		tickets[i].Identity = []byte{byte(i + 1)}
+		cache.Put("a", tickets[i])
+	}
+	assertDeepEquals(t, cache.Get("a"), tickets[1:])
+
+	// Resuming in a new process finds the same tickets
+	cache, err = NewClientSessionFileCache(path, key, 2)
+	assertNotError(t, err, "Failed to reopen session file cache")
+	assertDeepEquals(t, cache.Get("a"), tickets[1:])
+	assertEquals(t, len(cache.Get("b")), 0)
+	assertNotError(t, cache.Err(), "Error saving session file")
+
+	// Expired tickets are dropped when the file is saved
+	expired := tickets[0]
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	cache.Put("b", expired)
+	assertEquals(t, len(cache.Get("b")), 0)
+	cache, err = NewClientSessionFileCache(path, key, 2)
+	assertNotError(t, err, "Failed to reopen session file cache")
+	assertEquals(t, len(cache.Get("b")), 0)
+	assertDeepEquals(t, cache.Get("a"), tickets[1:])
+
+	// A used ticket is removed from the file
+	cache.Remove("a", tickets[1].Identity)
+	cache, err = NewClientSessionFileCache(path, key, 2)
+	assertNotError(t, err, "Failed to reopen session file cache")
+	assertDeepEquals(t, cache.Get("a"), tickets[2:])
+}
+
+func TestPSKFileCacheWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing", "psks")
+
+	// A file that can't be written keeps the PSKs in memory, and reports the
+	// error
+	cache, err := NewPSKFileCache(path, nil)
+	assertNotError(t, err, "Failed to create PSK file cache")
+	cache.Put("a", psk)
+	assertError(t, cache.Err(), "No error saving to a missing directory")
+	_, ok := cache.Get("a")
+	assertTrue(t, ok, "PSK not kept after failing to save it")
+
+	err = os.Mkdir(filepath.Dir(path), 0700)
+	assertNotError(t, err, "Failed to create directory")
+	cache.Put("b", psk)
+	assertNotError(t, cache.Err(), "Error saving PSK file")
+}
+
+func TestClientSessionFileCacheResumption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mint")
+	assertNotError(t, err, "Failed to create temporary directory")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sessions")
+	serverConfig := resumptionConfig.Clone()
+
+	handshake := func() *Conn {
+		sessions, err := NewClientSessionFileCache(path, nil, 0)
+		assertNotError(t, err, "Failed to open session file cache")
+		clientConfig := resumptionConfig.Clone()
+		clientConfig.ClientSessionCache = sessions
+
+		cConn, sConn := pipe()
+		client := Client(cConn, clientConfig)
+		server := Server(sConn, serverConfig)
+
+		done := make(chan bool)
+		go func(t *testing.T) {
+			serverAlert := server.Handshake()
+			assertEquals(t, serverAlert, AlertNoAlert)
+			server.Write([]byte{'a'})
+			done <- true
+		}(t)
+
+		clientAlert := client.Handshake()
+		assertEquals(t, clientAlert, AlertNoAlert)
+		_, err = client.Read(make([]byte, 1))
+		assertNotError(t, err, "Couldn't read one byte")
+		<-done
+		return client
+	}
+
+	client := handshake()
+	assertTrue(t, !client.state.Params.UsingPSK, "First session used a PSK")
+
+	// A new cache loaded from the file resumes the session
+	client = handshake()
+	assertTrue(t, client.state.Params.UsingPSK, "Session did not resume from the file")
+	assertEquals(t, len(client.ConnectionState().PeerCertificates), 1)
+}
@@ -0,0 +1,128 @@
+package mint
+
+import (
+	"crypto"
+	"fmt"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Importing external PSKs (RFC 9258) derives a distinct PSK for each protocol
+// and hash function it will be used with, so that one external PSK can
+// safely be offered under several cipher suites.
+const (
+	labelImportedBinder = "imp binder"
+	labelDerivedPSK     = "derived psk"
+)
+
+// The target_kdf values are the HPKE KDF identifiers
+const (
+	importTargetKDFSHA256 uint16 = 0x0001
+	importTargetKDFSHA384 uint16 = 0x0002
+)
+
+//	struct {
+//	   opaque external_identity<1...2^16-1>;
+//	   opaque context<0..2^16-1>;
+//	   uint16 target_protocol;
+//	   uint16 target_kdf;
+//	} ImportedIdentity;
+type ImportedIdentity struct {
+	ExternalIdentity []byte `tls:"head=2,min=1"`
+	Context          []byte `tls:"head=2"`
+	TargetProtocol   uint16
+	TargetKDF        uint16
+}
+
+// A PSKImporter holds an external PSK that is only ever used in TLS 1.3 as a
+// set of imported PSKs.  The client and the server must agree on Identity,
+// Key, Hash and Context.
+type PSKImporter struct {
+	// Identity is the external identity of the PSK
+	Identity []byte
+	// Key is the external PSK itself
+	Key []byte
+	// Hash is the hash function associated with the external PSK.  If zero,
+	// SHA-256 is used.
+	Hash crypto.Hash
+	// Context, if not empty, binds the imported PSKs to some shared
+	// application context, such as the peers' identities
+	Context []byte
+}
+
+func targetKDFForHash(hash crypto.Hash) (uint16, error) {
+	switch hash {
+	case crypto.SHA256:
+		return importTargetKDFSHA256, nil
+	case crypto.SHA384:
+		return importTargetKDFSHA384, nil
+	}
+	return 0, fmt.Errorf("tls.importer: Unsupported hash function [%v]", hash)
+}
+
+// Import derives the imported PSK for TLS 1.3 cipher suites that use the same
+// hash as suite.  The returned PSK can be used under any of them.
+func (imp PSKImporter) Import(suite CipherSuite) (PreSharedKey, error) {
+	params, ok := cipherSuiteMap[suite]
+	if !ok {
+		return PreSharedKey{}, fmt.Errorf("tls.importer: Unsupported ciphersuite [%v]", suite)
+	}
+
+	targetKDF, err := targetKDFForHash(params.Hash)
+	if err != nil {
+		return PreSharedKey{}, err
+	}
+
+	identity, err := syntax.Marshal(ImportedIdentity{
+		ExternalIdentity: imp.Identity,
+		Context:          imp.Context,
+		TargetProtocol:   tls13Version,
+		TargetKDF:        targetKDF,
+	})
+	if err != nil {
+		return PreSharedKey{}, err
+	}
+
+	hash := imp.Hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	if !hash.Available() {
+		return PreSharedKey{}, fmt.Errorf("tls.importer: Unavailable hash function [%v]", hash)
+	}
+
+	// epskx = HKDF-Extract(0, epsk)
+	// ipskx = HKDF-Expand-Label(epskx, "derived psk", Hash(ImportedIdentity), L)
+	h := hash.New()
+	h.Write(identity)
+	epskx := HkdfExtract(hash, nil, imp.Key)
+	ipskx := HkdfExpandLabel(hash, epskx, labelDerivedPSK, h.Sum(nil), params.Hash.Size())
+
+	return PreSharedKey{
+		CipherSuite: suite,
+		IsImported:  true,
+		Identity:    identity,
+		Key:         ipskx,
+	}, nil
+}
+
+// ImportAll derives one imported PSK for each hash function used by the given
+// cipher suites, in order of first use.
+func (imp PSKImporter) ImportAll(suites []CipherSuite) ([]PreSharedKey, error) {
+	psks := []PreSharedKey{}
+	seen := map[crypto.Hash]bool{}
+	for _, suite := range suites {
+		params, ok := cipherSuiteMap[suite]
+		if !ok || seen[params.Hash] {
+			continue
+		}
+		seen[params.Hash] = true
+
+		psk, err := imp.Import(suite)
+		if err != nil {
+			return nil, err
+		}
+		psks = append(psks, psk)
+	}
+	return psks, nil
+}
@@ -0,0 +1,67 @@
+package mint
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+func TestPSKImporter(t *testing.T) {
+	imp := PSKImporter{
+		Identity: []byte("client-17"),
+		Key:      bytes.Repeat([]byte{0xa5}, 32),
+		Context:  []byte{0x01, 0x02},
+	}
+
+	psk, err := imp.Import(TLS_AES_128_GCM_SHA256)
+	assertNotError(t, err, "Failed to import PSK")
+	assertEquals(t, psk.CipherSuite, TLS_AES_128_GCM_SHA256)
+	assertTrue(t, psk.IsImported && !psk.IsResumption, "Wrong PSK type")
+	assertEquals(t, psk.binderLabel(), labelImportedBinder)
+	assertEquals(t, len(psk.Key), 32)
+
+	// The identity is the encoded ImportedIdentity
+	identityHex := "0009" + "636c69656e742d3137" + "00020102" + "0304" + "0001"
+	assertByteEquals(t, psk.Identity, unhex(identityHex))
+	var identity ImportedIdentity
+	_, err = syntax.Unmarshal(psk.Identity, &identity)
+	assertNotError(t, err, "Failed to decode ImportedIdentity")
+	assertByteEquals(t, identity.ExternalIdentity, imp.Identity)
+
+	// Import is deterministic
+	again, err := imp.Import(TLS_AES_128_GCM_SHA256)
+	assertNotError(t, err, "Failed to import PSK")
+	assertByteEquals(t, again.Identity, psk.Identity)
+	assertByteEquals(t, again.Key, psk.Key)
+
+	// A different target hash, context or EPSK hash gives a different PSK
+	sha384, err := imp.Import(TLS_AES_256_GCM_SHA384)
+	assertNotError(t, err, "Failed to import PSK for SHA-384")
+	assertEquals(t, len(sha384.Key), 48)
+	assertTrue(t, !bytes.Equal(sha384.Identity, psk.Identity), "Same identity for different hash")
+
+	otherContext := imp
+	otherContext.Context = []byte{0x03}
+	other, err := otherContext.Import(TLS_AES_128_GCM_SHA256)
+	assertNotError(t, err, "Failed to import PSK with other context")
+	assertTrue(t, !bytes.Equal(other.Key, psk.Key), "Same key for different context")
+
+	otherHash := imp
+	otherHash.Hash = crypto.SHA384
+	other, err = otherHash.Import(TLS_AES_128_GCM_SHA256)
+	assertNotError(t, err, "Failed to import PSK with SHA-384 EPSK")
+	assertByteEquals(t, other.Identity, psk.Identity)
+	assertTrue(t, !bytes.Equal(other.Key, psk.Key), "Same key for different EPSK hash")
+
+	// ImportAll gives one PSK per hash
+	all, err := imp.ImportAll([]CipherSuite{TLS_AES_128_GCM_SHA256, TLS_AES_256_GCM_SHA384, TLS_AES_128_GCM_SHA256})
+	assertNotError(t, err, "Failed to import all PSKs")
+	assertEquals(t, len(all), 2)
+	assertByteEquals(t, all[0].Key, psk.Key)
+	assertByteEquals(t, all[1].Key, sha384.Key)
+
+	_, err = imp.Import(CipherSuite(0x0000))
+	assertError(t, err, "Imported a PSK for an unknown ciphersuite")
+}
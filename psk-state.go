@@ -0,0 +1,193 @@
+package mint
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// The version of the PreSharedKey encoding written by MarshalBinary
+const pskStateVersion uint16 = 1
+
+const (
+	pskStateFlagResumption uint8 = 1 << iota
+	pskStateFlagImported
+)
+
+type pskStateCertificate struct {
+	Raw []byte `tls:"head=3,min=1"`
+}
+
+type pskStateChain struct {
+	Certificates []pskStateCertificate `tls:"head=3"`
+}
+
+//	struct {
+//	   uint16 version;
+//	   CipherSuite cipher_suite;
+//	   uint8 flags;
+//	   opaque identity<1..2^16-1>;
+//	   opaque key<1..2^8-1>;
+//	   opaque next_proto<0..2^8-1>;
+//	   uint64 received_at;
+//	   uint64 expires_at;
+//	   uint32 ticket_age_add;
+//	   uint32 max_early_data_size;
+//	   Certificate peer_certificates<0..2^24-1>;
+//	   Chain verified_chains<0..2^24-1>;
+//	   opaque peer_public_key<0..2^16-1>;
+//	} PSKState;
+//
+// Times are nanoseconds since the Unix epoch, or zero if unset.
+type pskState struct {
+	Version          uint16
+	CipherSuite      CipherSuite
+	Flags            uint8
+	Identity         []byte `tls:"head=2,min=1"`
+	Key              []byte `tls:"head=1,min=1"`
+	NextProto        []byte `tls:"head=1"`
+	ReceivedAt       uint64
+	ExpiresAt        uint64
+	TicketAgeAdd     uint32
+	MaxEarlyDataSize uint32
+	PeerCertificates []pskStateCertificate `tls:"head=3"`
+	VerifiedChains   []pskStateChain       `tls:"head=3"`
+	PeerPublicKey    []byte                `tls:"head=2"`
+}
+
+func marshalPSKTime(t time.Time) uint64 {
+	if t.IsZero() {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+func unmarshalPSKTime(t uint64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(t))
+}
+
+func marshalPSKCertificates(certs []*x509.Certificate) []pskStateCertificate {
+	out := make([]pskStateCertificate, len(certs))
+	for i, cert := range certs {
+		out[i].Raw = cert.Raw
+	}
+	return out
+}
+
+func unmarshalPSKCertificates(certs []pskStateCertificate) ([]*x509.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, nil
+	}
+
+	out := make([]*x509.Certificate, len(certs))
+	for i, cert := range certs {
+		var err error
+		out[i], err = x509.ParseCertificate(cert.Raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// MarshalBinary encodes the PSK, including the key itself, so that it can be
+// stored and used in a later process.  The encoding is versioned, and will be
+// accepted by later versions of UnmarshalBinary.
+func (psk PreSharedKey) MarshalBinary() ([]byte, error) {
+	state := pskState{
+		Version:          pskStateVersion,
+		CipherSuite:      psk.CipherSuite,
+		Identity:         psk.Identity,
+		Key:              psk.Key,
+		NextProto:        []byte(psk.NextProto),
+		ReceivedAt:       marshalPSKTime(psk.ReceivedAt),
+		ExpiresAt:        marshalPSKTime(psk.ExpiresAt),
+		TicketAgeAdd:     psk.TicketAgeAdd,
+		MaxEarlyDataSize: psk.MaxEarlyDataSize,
+		PeerCertificates: marshalPSKCertificates(psk.PeerCertificates),
+	}
+
+	if psk.IsResumption {
+		state.Flags |= pskStateFlagResumption
+	}
+	if psk.IsImported {
+		state.Flags |= pskStateFlagImported
+	}
+
+	for _, chain := range psk.VerifiedChains {
+		state.VerifiedChains = append(state.VerifiedChains, pskStateChain{
+			Certificates: marshalPSKCertificates(chain),
+		})
+	}
+
+	if psk.PeerPublicKey != nil {
+		var err error
+		state.PeerPublicKey, err = x509.MarshalPKIXPublicKey(psk.PeerPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("tls.psk: Error marshaling peer public key [%v]", err)
+		}
+	}
+
+	return syntax.Marshal(state)
+}
+
+// UnmarshalBinary decodes a PSK encoded by MarshalBinary.
+func (psk *PreSharedKey) UnmarshalBinary(data []byte) error {
+	var version uint16
+	if _, err := syntax.Unmarshal(data, &version); err != nil {
+		return fmt.Errorf("tls.psk: Error decoding version [%v]", err)
+	}
+	if version != pskStateVersion {
+		return fmt.Errorf("tls.psk: Unsupported encoding version [%d]", version)
+	}
+
+	var state pskState
+	read, err := syntax.Unmarshal(data, &state)
+	if err != nil {
+		return fmt.Errorf("tls.psk: Error decoding PSK [%v]", err)
+	}
+	if read != len(data) {
+		return fmt.Errorf("tls.psk: Extra data after PSK")
+	}
+
+	out := PreSharedKey{
+		CipherSuite:      state.CipherSuite,
+		IsResumption:     state.Flags&pskStateFlagResumption != 0,
+		IsImported:       state.Flags&pskStateFlagImported != 0,
+		Identity:         state.Identity,
+		Key:              state.Key,
+		NextProto:        string(state.NextProto),
+		ReceivedAt:       unmarshalPSKTime(state.ReceivedAt),
+		ExpiresAt:        unmarshalPSKTime(state.ExpiresAt),
+		TicketAgeAdd:     state.TicketAgeAdd,
+		MaxEarlyDataSize: state.MaxEarlyDataSize,
+	}
+
+	out.PeerCertificates, err = unmarshalPSKCertificates(state.PeerCertificates)
+	if err != nil {
+		return fmt.Errorf("tls.psk: Error parsing peer certificate [%v]", err)
+	}
+
+	for _, chain := range state.VerifiedChains {
+		certs, err := unmarshalPSKCertificates(chain.Certificates)
+		if err != nil {
+			return fmt.Errorf("tls.psk: Error parsing verified chain [%v]", err)
+		}
+		out.VerifiedChains = append(out.VerifiedChains, certs)
+	}
+
+	if len(state.PeerPublicKey) > 0 {
+		out.PeerPublicKey, err = x509.ParsePKIXPublicKey(state.PeerPublicKey)
+		if err != nil {
+			return fmt.Errorf("tls.psk: Error parsing peer public key [%v]", err)
+		}
+	}
+
+	*psk = out
+	return nil
+}
@@ -0,0 +1,61 @@
+package mint
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestPSKMarshalBinary(t *testing.T) {
+	now := time.Unix(1700000000, 123456789)
+	ticket := PreSharedKey{
+		CipherSuite:      TLS_AES_256_GCM_SHA384,
+		IsResumption:     true,
+		Identity:         []byte{0x01, 0x02, 0x03},
+		Key:              []byte{0x04, 0x05, 0x06, 0x07},
+		NextProto:        "h2",
+		ReceivedAt:       now,
+		ExpiresAt:        now.Add(time.Hour),
+		TicketAgeAdd:     0xa0b0c0d0,
+		MaxEarlyDataSize: 16384,
+		PeerCertificates: []*x509.Certificate{serverCert},
+		VerifiedChains:   [][]*x509.Certificate{{serverCert}},
+		PeerPublicKey:    serverKey.Public(),
+	}
+
+	data, err := ticket.MarshalBinary()
+	assertNotError(t, err, "Failed to marshal PSK")
+
+	var decoded PreSharedKey
+	err = decoded.UnmarshalBinary(data)
+	assertNotError(t, err, "Failed to unmarshal PSK")
+	assertEquals(t, decoded.CipherSuite, ticket.CipherSuite)
+	assertTrue(t, decoded.IsResumption && !decoded.IsImported, "Wrong PSK type")
+	assertByteEquals(t, decoded.Identity, ticket.Identity)
+	assertByteEquals(t, decoded.Key, ticket.Key)
+	assertEquals(t, decoded.NextProto, ticket.NextProto)
+	assertTrue(t, decoded.ReceivedAt.Equal(ticket.ReceivedAt), "Wrong received time")
+	assertTrue(t, decoded.ExpiresAt.Equal(ticket.ExpiresAt), "Wrong expiry time")
+	assertEquals(t, decoded.TicketAgeAdd, ticket.TicketAgeAdd)
+	assertEquals(t, decoded.MaxEarlyDataSize, ticket.MaxEarlyDataSize)
+	assertEquals(t, len(decoded.PeerCertificates), 1)
+	assertTrue(t, decoded.PeerCertificates[0].Equal(serverCert), "Wrong peer certificate")
+	assertEquals(t, len(decoded.VerifiedChains), 1)
+	assertTrue(t, decoded.VerifiedChains[0][0].Equal(serverCert), "Wrong verified chain")
+	assertDeepEquals(t, decoded.PeerPublicKey, ticket.PeerPublicKey)
+
+	// An external PSK with nothing optional set
+	data, err = psk.MarshalBinary()
+	assertNotError(t, err, "Failed to marshal external PSK")
+	err = decoded.UnmarshalBinary(data)
+	assertNotError(t, err, "Failed to unmarshal external PSK")
+	assertDeepEquals(t, decoded, psk)
+
+	// Unknown versions and trailing data are rejected
+	err = decoded.UnmarshalBinary(append([]byte{0xff, 0xff}, data[2:]...))
+	assertError(t, err, "Unmarshaled an unknown version")
+	err = decoded.UnmarshalBinary(append(data, 0x00))
+	assertError(t, err, "Unmarshaled with trailing data")
+	err = decoded.UnmarshalBinary(data[:len(data)-1])
+	assertError(t, err, "Unmarshaled a truncated PSK")
+}
@@ -12,6 +12,7 @@ const (
 	recordHeaderLenTLS  = 5       // record header length (TLS)
 	recordHeaderLenDTLS = 13      // record header length (DTLS)
 	maxFragmentLen      = 1 << 14 // max number of bytes in a record
+	explicitNonceLen    = 8       // explicit nonce length (TLS 1.2)
 	labelForKey         = "key"
 	labelForIV          = "iv"
 )
@@ -62,6 +63,7 @@ type cipherState struct {
 	seq      uint64      // Zero-padded sequence number
 	iv       []byte      // Buffer for the IV
 	cipher   cipher.AEAD // AEAD cipher
+	tls12    bool        // Use the TLS 1.2 record format
 }
 
 type RecordLayerFactory interface {
@@ -123,7 +125,7 @@ func (d recordLayerFrameDetails) frameLen(hdr []byte) (int, error) {
 }
 
 func newCipherStateNull() *cipherState {
-	return &cipherState{EpochClear, 0, 0, nil, nil}
+	return &cipherState{EpochClear, 0, 0, nil, nil, false}
 }
 
 func newCipherStateAead(epoch Epoch, factory AEADFactory, key []byte, iv []byte) (*cipherState, error) {
@@ -132,7 +134,7 @@ func newCipherStateAead(epoch Epoch, factory AEADFactory, key []byte, iv []byte)
 		return nil, err
 	}
 
-	return &cipherState{epoch, len(iv), 0, iv, cipher}, nil
+	return &cipherState{epoch, len(iv), 0, iv, cipher, false}, nil
 }
 
 func NewRecordLayerTLS(conn io.ReadWriter, dir Direction) *DefaultRecordLayer {
@@ -181,6 +183,7 @@ func (r *DefaultRecordLayer) Rekey(epoch Epoch, factory AEADFactory, keys *KeySe
 	if err != nil {
 		return err
 	}
+	cipher.tls12 = keys.TLS12
 	r.cipher = cipher
 	if r.datagram && r.direction == DirectionRead {
 		r.readCiphers[epoch] = cipher
@@ -298,6 +301,55 @@ func (r *DefaultRecordLayer) decrypt(seq uint64, header []byte, pt *TLSPlaintext
 	return out, padLen, nil
 }
 
+// In TLS 1.2, the nonce is the IV followed by an explicit part that is sent
+// with the record, and the additional data covers the sequence number and
+// the plaintext header.  There is no inner content type or padding.
+func (c *cipherState) additionalDataTLS12(seq uint64, contentType RecordType, version uint16, length int) []byte {
+	ad := make([]byte, sequenceNumberLen+recordHeaderLenTLS)
+	rest := encodeUint(seq, sequenceNumberLen, ad)
+	rest[0] = byte(contentType)
+	rest = encodeUint(uint64(version), 2, rest[1:])
+	encodeUint(uint64(length), 2, rest)
+	return ad
+}
+
+func (r *DefaultRecordLayer) encryptTLS12(cipher *cipherState, seq uint64, pt *TLSPlaintext) []byte {
+	assert(r.direction == DirectionWrite)
+	logf(logTypeIO, "%s Encrypt seq=[%x]", r.label, seq)
+	ciphertext := make([]byte, explicitNonceLen, explicitNonceLen+len(pt.fragment)+cipher.overhead())
+	encodeUint(seq, explicitNonceLen, ciphertext)
+
+	nonce := append(append([]byte{}, cipher.iv...), ciphertext...)
+	ad := cipher.additionalDataTLS12(seq, pt.contentType, r.version, len(pt.fragment))
+	return cipher.cipher.Seal(ciphertext, nonce, pt.fragment, ad)
+}
+
+func (r *DefaultRecordLayer) decryptTLS12(seq uint64, pt *TLSPlaintext) (*TLSPlaintext, error) {
+	assert(r.direction == DirectionRead)
+	logf(logTypeIO, "%s Decrypt seq=[%x]", r.label, seq)
+	if len(pt.fragment) < explicitNonceLen+r.cipher.overhead() {
+		msg := fmt.Sprintf("tls.record.decrypt: Record too short [%d] < [%d]", len(pt.fragment), explicitNonceLen+r.cipher.overhead())
+		return nil, DecryptError(msg)
+	}
+
+	nonce := append(append([]byte{}, r.cipher.iv...), pt.fragment[:explicitNonceLen]...)
+	ciphertext := pt.fragment[explicitNonceLen:]
+	decryptLen := len(ciphertext) - r.cipher.overhead()
+	ad := r.cipher.additionalDataTLS12(seq, pt.contentType, r.version, decryptLen)
+
+	out := &TLSPlaintext{
+		contentType: pt.contentType,
+		seq:         seq,
+	}
+	var err error
+	out.fragment, err = r.cipher.cipher.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		logf(logTypeIO, "%s AEAD decryption failure [%x]", r.label, pt)
+		return nil, DecryptError("tls.record.decrypt: AEAD decrypt failed")
+	}
+	return out, nil
+}
+
 func (r *DefaultRecordLayer) PeekRecordType(block bool) (RecordType, error) {
 	var pt *TLSPlaintext
 	var err error
@@ -385,6 +437,11 @@ func (r *DefaultRecordLayer) nextRecord(allowOldEpoch bool) (*TLSPlaintext, erro
 		return nil, fmt.Errorf("tls.record: Unknown content type %02x", header[0])
 	case RecordTypeAlert, RecordTypeHandshake, RecordTypeApplicationData, RecordTypeAck:
 		pt.contentType = RecordType(header[0])
+	case RecordTypeChangeCipherSpec:
+		if r.datagram {
+			return nil, fmt.Errorf("tls.record: Unknown content type %02x", header[0])
+		}
+		pt.contentType = RecordType(header[0])
 	}
 
 	// Validate version
@@ -402,6 +459,14 @@ func (r *DefaultRecordLayer) nextRecord(allowOldEpoch bool) (*TLSPlaintext, erro
 	pt.fragment = make([]byte, size)
 	copy(pt.fragment, body)
 
+	// ChangeCipherSpec is never protected and doesn't consume a sequence
+	// number, so it is passed up as-is for the handshake layer to check
+	if pt.contentType == RecordTypeChangeCipherSpec {
+		pt.epoch = cipher.epoch
+		r.cachedRecord = pt
+		return pt, nil
+	}
+
 	// TODO(ekr@rtfm.com): Enforce that for epoch > 0, the content type is app data.
 
 	// Attempt to decrypt fragment
@@ -428,7 +493,14 @@ func (r *DefaultRecordLayer) nextRecord(allowOldEpoch bool) (*TLSPlaintext, erro
 		}
 	}
 
-	if cipher.cipher != nil {
+	if cipher.tls12 {
+		logf(logTypeIO, "%s RecordLayer.ReadRecord epoch=[%s] seq=[%x] [%d] ciphertext=[%x]", r.label, cipher.epoch.label(), seq, pt.contentType, pt.fragment)
+		pt, err = r.decryptTLS12(seq, pt)
+		if err != nil {
+			logf(logTypeIO, "%s Decryption failed", r.label)
+			return nil, err
+		}
+	} else if cipher.cipher != nil {
 		logf(logTypeIO, "%s RecordLayer.ReadRecord epoch=[%s] seq=[%x] [%d] ciphertext=[%x]", r.label, cipher.epoch.label(), seq, pt.contentType, pt.fragment)
 		pt, _, err = r.decrypt(seq, header, pt)
 		if err != nil {
@@ -462,7 +534,10 @@ func (r *DefaultRecordLayer) writeRecordWithPadding(pt *TLSPlaintext, cipher *ci
 	seq := cipher.combineSeq(r.datagram)
 	length := len(pt.fragment)
 	var contentType RecordType
-	if cipher.cipher != nil {
+	if cipher.tls12 {
+		length += explicitNonceLen + cipher.cipher.Overhead()
+		contentType = pt.contentType
+	} else if cipher.cipher != nil {
 		length += 1 + padLen + cipher.cipher.Overhead()
 		contentType = RecordTypeApplicationData
 	} else {
@@ -485,7 +560,13 @@ func (r *DefaultRecordLayer) writeRecordWithPadding(pt *TLSPlaintext, cipher *ci
 	}
 
 	var ciphertext []byte
-	if cipher.cipher != nil {
+	if cipher.tls12 {
+		if padLen > 0 {
+			return fmt.Errorf("tls.record: Padding is not supported in TLS 1.2")
+		}
+		logf(logTypeIO, "%s RecordLayer.WriteRecord epoch=[%s] seq=[%x] [%d] plaintext=[%x]", r.label, cipher.epoch.label(), cipher.seq, pt.contentType, pt.fragment)
+		ciphertext = r.encryptTLS12(cipher, seq, pt)
+	} else if cipher.cipher != nil {
 		logf(logTypeIO, "%s RecordLayer.WriteRecord epoch=[%s] seq=[%x] [%d] plaintext=[%x]", r.label, cipher.epoch.label(), cipher.seq, pt.contentType, pt.fragment)
 		ciphertext = r.encrypt(cipher, seq, header, pt, padLen)
 	} else {
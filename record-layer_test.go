@@ -256,6 +256,48 @@ func TestReadWriteTLS(t *testing.T) {
 	assertByteEquals(t, ptIn.fragment, ptOut.fragment)
 }
 
+func TestReadWriteTLS12(t *testing.T) {
+	key := unhex(keyHex)
+	iv := unhex(ivHex)[:4]
+	plaintext := unhex(plaintextHex)
+
+	b := bytes.NewBuffer(nil)
+	out := NewRecordLayerTLS(b, DirectionWrite)
+	in := NewRecordLayerTLS(b, DirectionRead)
+
+	ks := &KeySet{Keys: map[string][]byte{"key": key, "iv": iv}, TLS12: true}
+	assertNotError(t, in.Rekey(EpochApplicationData, newAESGCM, ks), "Failed to rekey")
+	assertNotError(t, out.Rekey(EpochApplicationData, newAESGCM, ks), "Failed to rekey")
+
+	ptIn := &TLSPlaintext{
+		contentType: RecordType(plaintext[0]),
+		fragment:    plaintext[5:],
+	}
+	for seq := 0; seq < 2; seq++ {
+		err := out.WriteRecord(ptIn)
+		assertNotError(t, err, "Failed to write record")
+
+		// The record keeps its content type and starts with the explicit
+		// nonce, which is the sequence number
+		record := b.Bytes()
+		assertEquals(t, RecordType(record[0]), ptIn.contentType)
+		assertEquals(t, len(record), 5+explicitNonceLen+len(ptIn.fragment)+16)
+		assertByteEquals(t, record[5:5+explicitNonceLen], []byte{0, 0, 0, 0, 0, 0, 0, byte(seq)})
+
+		ptOut, err := in.ReadRecord()
+		assertNotError(t, err, "Failed to read record")
+		assertEquals(t, ptIn.contentType, ptOut.contentType)
+		assertByteEquals(t, ptIn.fragment, ptOut.fragment)
+	}
+
+	// Test that a corrupted record fails to decrypt
+	err := out.WriteRecord(ptIn)
+	assertNotError(t, err, "Failed to write record")
+	b.Bytes()[b.Len()-1] ^= 0xff
+	_, err = in.ReadRecord()
+	assertError(t, err, "Read a corrupted record")
+}
+
 func TestReadWriteDTLS(t *testing.T) {
 	key := unhex(keyHex)
 	iv := unhex(ivHex)
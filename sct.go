@@ -0,0 +1,162 @@
+package mint
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// Signed certificate timestamps are verified offline, by checking the log's
+// signature over the leaf certificate (RFC 6962, Section 3.2).  We only
+// support v1 SCTs over X.509 entries, signed with SHA-256.
+const (
+	sctVersionV1                         uint8  = 0
+	sctSignatureTypeCertificateTimestamp uint8  = 0
+	sctEntryTypeX509                     uint16 = 0
+	sctHashAlgorithmSHA256               uint8  = 4
+	sctSignatureAlgorithmRSA             uint8  = 1
+	sctSignatureAlgorithmECDSA           uint8  = 3
+)
+
+//	struct {
+//	    Version sct_version;
+//	    LogID id;
+//	    uint64 timestamp;
+//	    CtExtensions extensions;
+//	    digitally-signed struct {
+//	        ...
+//	    };
+//	} SignedCertificateTimestamp;
+type signedCertificateTimestamp struct {
+	Version            uint8
+	LogID              [32]byte
+	Timestamp          uint64
+	Extensions         []byte `tls:"head=2"`
+	HashAlgorithm      uint8
+	SignatureAlgorithm uint8
+	Signature          []byte `tls:"head=2"`
+}
+
+//	digitally-signed struct {
+//	    Version sct_version;
+//	    SignatureType signature_type = certificate_timestamp;
+//	    uint64 timestamp;
+//	    LogEntryType entry_type;
+//	    ASN.1Cert certificate;
+//	    CtExtensions extensions;
+//	};
+type sctSignatureInput struct {
+	Version       uint8
+	SignatureType uint8
+	Timestamp     uint64
+	EntryType     uint16
+	Certificate   []byte `tls:"head=3,min=1"`
+	Extensions    []byte `tls:"head=2"`
+}
+
+// The ID of a log is the SHA-256 hash of its public key
+func ctLogID(logKey crypto.PublicKey) ([32]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(logKey)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(der), nil
+}
+
+func verifySCT(rawSCT []byte, leaf *x509.Certificate, logKeys map[[32]byte]crypto.PublicKey) ([32]byte, error) {
+	var sct signedCertificateTimestamp
+	read, err := syntax.Unmarshal(rawSCT, &sct)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if read != len(rawSCT) {
+		return [32]byte{}, fmt.Errorf("tls.sct: Extra data after SCT")
+	}
+
+	if sct.Version != sctVersionV1 {
+		return [32]byte{}, fmt.Errorf("tls.sct: Unsupported SCT version [%d]", sct.Version)
+	}
+
+	logKey, ok := logKeys[sct.LogID]
+	if !ok {
+		return [32]byte{}, fmt.Errorf("tls.sct: Unknown log [%x]", sct.LogID)
+	}
+
+	if sct.HashAlgorithm != sctHashAlgorithmSHA256 {
+		return [32]byte{}, fmt.Errorf("tls.sct: Unsupported hash algorithm [%d]", sct.HashAlgorithm)
+	}
+
+	sigInput, err := syntax.Marshal(sctSignatureInput{
+		Version:       sct.Version,
+		SignatureType: sctSignatureTypeCertificateTimestamp,
+		Timestamp:     sct.Timestamp,
+		EntryType:     sctEntryTypeX509,
+		Certificate:   leaf.Raw,
+		Extensions:    sct.Extensions,
+	})
+	if err != nil {
+		return [32]byte{}, err
+	}
+	digest := sha256.Sum256(sigInput)
+
+	switch pub := logKey.(type) {
+	case *rsa.PublicKey:
+		if sct.SignatureAlgorithm != sctSignatureAlgorithmRSA {
+			return [32]byte{}, fmt.Errorf("tls.sct: Unsupported algorithm for RSA key")
+		}
+		err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sct.Signature)
+
+	case *ecdsa.PublicKey:
+		if sct.SignatureAlgorithm != sctSignatureAlgorithmECDSA {
+			return [32]byte{}, fmt.Errorf("tls.sct: Unsupported algorithm for ECDSA key")
+		}
+
+		ecdsaSig := new(ecdsaSignature)
+		if rest, err := asn1.Unmarshal(sct.Signature, ecdsaSig); err != nil {
+			return [32]byte{}, err
+		} else if len(rest) != 0 {
+			return [32]byte{}, fmt.Errorf("tls.sct: trailing data after ECDSA signature")
+		}
+		if !ecdsa.Verify(pub, digest[:], ecdsaSig.R, ecdsaSig.S) {
+			err = fmt.Errorf("tls.sct: ECDSA signature failed to verify")
+		}
+
+	default:
+		return [32]byte{}, fmt.Errorf("tls.sct: Unsupported log key type")
+	}
+
+	return sct.LogID, err
+}
+
+// Checks that at least minValid SCTs carry valid signatures from distinct logs
+func verifySCTs(scts [][]byte, leaf *x509.Certificate, logKeys []crypto.PublicKey, minValid int) error {
+	keysByID := map[[32]byte]crypto.PublicKey{}
+	for _, logKey := range logKeys {
+		logID, err := ctLogID(logKey)
+		if err != nil {
+			return err
+		}
+		keysByID[logID] = logKey
+	}
+
+	validLogs := map[[32]byte]bool{}
+	for _, sct := range scts {
+		logID, err := verifySCT(sct, leaf, keysByID)
+		if err != nil {
+			logf(logTypeHandshake, "Ignoring invalid SCT [%v]", err)
+			continue
+		}
+		validLogs[logID] = true
+	}
+
+	if len(validLogs) < minValid {
+		return fmt.Errorf("tls.sct: Found %d valid SCTs, but %d are required", len(validLogs), minValid)
+	}
+	return nil
+}
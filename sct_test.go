@@ -0,0 +1,84 @@
+package mint
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"testing"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+func newTestSCT(t *testing.T, logKey crypto.Signer, leaf *x509.Certificate, timestamp uint64) []byte {
+	logID, err := ctLogID(logKey.Public())
+	assertNotError(t, err, "Failed to compute log ID")
+
+	sigInput, err := syntax.Marshal(sctSignatureInput{
+		Version:       sctVersionV1,
+		SignatureType: sctSignatureTypeCertificateTimestamp,
+		Timestamp:     timestamp,
+		EntryType:     sctEntryTypeX509,
+		Certificate:   leaf.Raw,
+	})
+	assertNotError(t, err, "Failed to marshal SCT signature input")
+	digest := sha256.Sum256(sigInput)
+
+	sigAlg := sctSignatureAlgorithmECDSA
+	if _, ok := logKey.(*rsa.PrivateKey); ok {
+		sigAlg = sctSignatureAlgorithmRSA
+	}
+	sig, err := logKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	assertNotError(t, err, "Failed to sign SCT")
+
+	sct, err := syntax.Marshal(signedCertificateTimestamp{
+		Version:            sctVersionV1,
+		LogID:              logID,
+		Timestamp:          timestamp,
+		HashAlgorithm:      sctHashAlgorithmSHA256,
+		SignatureAlgorithm: sigAlg,
+		Signature:          sig,
+	})
+	assertNotError(t, err, "Failed to marshal SCT")
+	return sct
+}
+
+func TestVerifySCTs(t *testing.T) {
+	ecdsaLog, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNotError(t, err, "Failed to generate ECDSA log key")
+	rsaLog, err := rsa.GenerateKey(rand.Reader, 2048)
+	assertNotError(t, err, "Failed to generate RSA log key")
+	unknownLog, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assertNotError(t, err, "Failed to generate unknown log key")
+
+	logKeys := []crypto.PublicKey{ecdsaLog.Public(), rsaLog.Public()}
+	ecdsaSCT := newTestSCT(t, ecdsaLog, serverCert, 1)
+	rsaSCT := newTestSCT(t, rsaLog, serverCert, 2)
+	unknownSCT := newTestSCT(t, unknownLog, serverCert, 3)
+	otherCertSCT := newTestSCT(t, ecdsaLog, clientCert, 4)
+
+	// Valid SCTs from distinct logs
+	err = verifySCTs([][]byte{ecdsaSCT, rsaSCT}, serverCert, logKeys, 2)
+	assertNotError(t, err, "Failed to verify valid SCTs")
+
+	// Two SCTs from the same log only count once
+	ecdsaSCT2 := newTestSCT(t, ecdsaLog, serverCert, 5)
+	err = verifySCTs([][]byte{ecdsaSCT, ecdsaSCT2}, serverCert, logKeys, 2)
+	assertError(t, err, "Counted two SCTs from the same log")
+
+	// SCTs from unknown logs, for other certificates, or that fail to parse
+	// are ignored
+	err = verifySCTs([][]byte{ecdsaSCT, unknownSCT, otherCertSCT, {0x00}}, serverCert, logKeys, 1)
+	assertNotError(t, err, "Failed to verify with ignored SCTs")
+	err = verifySCTs([][]byte{unknownSCT, otherCertSCT, {0x00}}, serverCert, logKeys, 1)
+	assertError(t, err, "Verified without any valid SCTs")
+
+	// Tampered signatures are rejected
+	tampered := append([]byte{}, rsaSCT...)
+	tampered[len(tampered)-1] ^= 0xff
+	err = verifySCTs([][]byte{tampered}, serverCert, logKeys, 1)
+	assertError(t, err, "Verified SCT with tampered signature")
+}
@@ -0,0 +1,647 @@
+package mint
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/x509"
+)
+
+// TLS 1.2 Server State Machine
+//
+// The server leaves the TLS 1.3 state machine in START if version
+// negotiation selects TLS 1.2.
+//
+//                            START
+//                              | Recv ClientHello (TLS 1.2)
+//                              v
+//                          NEGOTIATED
+//                              | Send ServerHello, Certificate,
+//                              | [CertificateStatus,] ServerKeyExchange,
+//                              | [CertificateRequest,] ServerHelloDone
+//                   No auth    |    Client auth
+//                  +-----------+-----------+
+//                  |                       v
+//                  |                   WAIT_CERT
+//                  |                       | Recv Certificate
+//                  v                       v
+//               WAIT_CKE <-----------------+
+//                  | Recv ClientKeyExchange
+//         No cert  |  Client cert
+//           +------+------+
+//           |             v
+//           |          WAIT_CV
+//           |             | Recv CertificateVerify
+//           v             v
+//         WAIT_FINISHED <-+
+//                  | Recv ChangeCipherSpec, Finished
+//                  | Send ChangeCipherSpec, Finished
+//                  v
+//              CONNECTED
+//
+//  State          Instructions
+//  START          {}
+//  NEGOTIATED     Send(SH); Send(Cert); [Send(CS);] Send(SKE); [Send(CR);] Send(SHD)
+//  WAIT_CERT      {}
+//  WAIT_CKE       [RekeyIn]
+//  WAIT_CV        RekeyIn
+//  WAIT_FINISHED  SendCCS; RekeyOut; Send(Fin)
+
+func (state serverStateStart) negotiateTLS12(ch *ClientHelloBody, clientHello *HandshakeMessage, connParams ConnectionParameters,
+	chInfo *ClientHelloInfo, foundExts map[ExtensionType]bool) (HandshakeState, []HandshakeAction, Alert) {
+	// ECH and HelloRetryRequest only exist in TLS 1.3, and a server that
+	// rejected ECH can't send retry configs in TLS 1.2
+	if connParams.UsingECH || foundExts[ExtensionTypeCookie] {
+		logf(logTypeHandshake, "[ServerStateStart] TLS 1.2 negotiated after ECH or HelloRetryRequest")
+		return nil, nil, AlertIllegalParameter
+	}
+	connParams.RejectedECH = false
+
+	clientEMS := &ExtendedMasterSecretExtension{}
+	clientRenegotiation := &RenegotiationInfoExtension{}
+	clientPointFormats := &ECPointFormatsExtension{}
+	found, err := ch.Extensions.Parse(
+		[]ExtensionBody{
+			clientEMS,
+			clientRenegotiation,
+			clientPointFormats,
+		})
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateStart] Error parsing extensions [%v]", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	// We never renegotiate, so a client can only signal that it supports
+	// secure renegotiation (RFC 5746)
+	if found[ExtensionTypeRenegotiationInfo] && len(clientRenegotiation.RenegotiatedConnection) > 0 {
+		logf(logTypeHandshake, "[ServerStateStart] Non-empty renegotiation_info")
+		return nil, nil, AlertHandshakeFailure
+	}
+	secureRenegotiation := found[ExtensionTypeRenegotiationInfo]
+	for _, suite := range ch.CipherSuites {
+		secureRenegotiation = secureRenegotiation || (suite == scsvRenegotiationInfo)
+	}
+
+	if found[ExtensionTypeECPointFormats] && !bytes.Contains(clientPointFormats.Formats, []byte{pointFormatUncompressed}) {
+		logf(logTypeHandshake, "[ServerStateStart] Client does not support uncompressed points")
+		return nil, nil, AlertIllegalParameter
+	}
+
+	if !foundExts[ExtensionTypeSupportedGroups] || !foundExts[ExtensionTypeSignatureAlgorithms] {
+		logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v)", foundExts)
+		return nil, nil, AlertMissingExtension
+	}
+
+	// Select the client's most preferred group that we can do ECDHE with
+	var group NamedGroup
+	supportedGroups := groupsTLS12(state.Config.Groups)
+	for _, g := range chInfo.SupportedGroups {
+		if namedGroupListContains(supportedGroups, g) {
+			group = g
+			break
+		}
+	}
+	if group == 0 {
+		logf(logTypeHandshake, "[ServerStateStart] No common group for ECDHE")
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	// The ciphersuite fixes the type of key the certificate has, so select
+	// them together, following the client's ciphersuite preferences.
+	// Raw public keys and delegated credentials need TLS 1.3.
+	schemes := signatureSchemesTLS12(chInfo.SignatureSchemes)
+	supportedSuites := state.Config.cipherSuitesFor(tls12Version)
+	var cert *Certificate
+	var certScheme SignatureScheme
+	selectCertificate := func(serverName *string, certs []*Certificate) bool {
+		for _, suite := range ch.CipherSuites {
+			params, ok := tls12CipherSuiteMap[suite]
+			if !ok || !cipherSuiteListContains(supportedSuites, suite) {
+				continue
+			}
+
+			candidates := []*Certificate{}
+			for _, c := range certificatesOfType(certs, CertificateTypeX509) {
+				if c.DelegatedCredential == nil && c.PrivateKey != nil && params.validForKey(c.PrivateKey.Public()) {
+					candidates = append(candidates, c)
+				}
+			}
+
+			selected, scheme, err := CertificateSelection(serverName, schemes, candidates)
+			if err == nil {
+				cert, certScheme = selected, scheme
+				connParams.CipherSuite = suite
+				return true
+			}
+		}
+		return false
+	}
+
+	// Select a certificate, asking the application first if it wants to
+	var appCert *Certificate
+	if state.Config.GetCertificate != nil {
+		appCert, err = state.Config.GetCertificate(chInfo)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error getting certificate from application [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
+	if appCert != nil {
+		selectCertificate(nil, []*Certificate{appCert})
+	} else {
+		selected := false
+		if foundExts[ExtensionTypeServerName] {
+			name := connParams.ServerName
+			if len(certificatesForName(state.Config.Certificates, name)) == 0 && state.Config.RejectUnrecognizedName {
+				logf(logTypeHandshake, "[ServerStateStart] No certificate for server name [%s]", name)
+				return nil, nil, AlertUnrecognizedName
+			}
+			selected = selectCertificate(&name, state.Config.Certificates)
+		}
+		if !selected && state.Config.DefaultCertificate != nil {
+			selectCertificate(nil, []*Certificate{state.Config.DefaultCertificate})
+		}
+	}
+	if cert == nil {
+		logf(logTypeHandshake, "[ServerStateStart] No certificate and ciphersuite found for TLS 1.2")
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	// Select a next protocol
+	connParams.NextProto, err = ALPNNegotiation(nil, chInfo.SupportedProtos, state.Config.NextProtos)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateStart] No common application-layer protocol found [%v]", err)
+		return nil, nil, AlertNoApplicationProtocol
+	}
+
+	// A stapled OCSP response is only announced if we have one to send
+	var ocspStaple []byte
+	if foundExts[ExtensionTypeStatusRequest] {
+		ocspStaple = cert.ocspStaple()
+	}
+
+	connParams.Version = tls12Version
+	connParams.UsingDH = true
+
+	logf(logTypeHandshake, "[ServerStateStart] -> [ServerStateNegotiatedTLS12]")
+	state.hsCtx.SetVersion(tls12Version)
+	return serverStateNegotiatedTLS12{
+		Config: state.Config,
+		Params: connParams,
+		hsCtx:  state.hsCtx,
+		hs: handshakeTLS12{
+			suite:                tls12CipherSuiteMap[connParams.CipherSuite],
+			clientRandom:         ch.Random,
+			extendedMasterSecret: found[ExtensionTypeExtendedMasterSecret],
+			statusRequested:      len(ocspStaple) > 0,
+		},
+		clientHello:         clientHello,
+		cert:                cert,
+		certScheme:          certScheme,
+		dhGroup:             group,
+		ocspStaple:          ocspStaple,
+		secureRenegotiation: secureRenegotiation,
+		pointFormats:        found[ExtensionTypeECPointFormats],
+	}, nil, AlertNoAlert
+}
+
+func cipherSuiteListContains(suites []CipherSuite, suite CipherSuite) bool {
+	for _, s := range suites {
+		if s == suite {
+			return true
+		}
+	}
+	return false
+}
+
+type serverStateNegotiatedTLS12 struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	clientHello         *HandshakeMessage
+	cert                *Certificate
+	certScheme          SignatureScheme
+	dhGroup             NamedGroup
+	ocspStaple          []byte
+	secureRenegotiation bool
+	pointFormats        bool
+}
+
+var _ HandshakeState = &serverStateNegotiatedTLS12{}
+
+func (state serverStateNegotiatedTLS12) State() State {
+	return StateServerNegotiated
+}
+
+func (state serverStateNegotiatedTLS12) Next(_ handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	// Create the ServerHello.  We don't resume sessions, so there's no session
+	// ID.
+	sh := &ServerHelloBody{
+		Version:                 tls12Version,
+		CipherSuite:             state.Params.CipherSuite,
+		LegacySessionID:         []byte{},
+		LegacyCompressionMethod: 0,
+	}
+	if _, err := prng.Read(sh.Random[:]); err != nil {
+		logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error creating server random [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+
+	// Tell a TLS 1.3 client that we could have done TLS 1.3, so that it can
+	// detect a downgrade
+	if versionListContains(state.Config.supportedVersions(), tls13Version) {
+		copy(sh.Random[len(sh.Random)-len(downgradeSentinelTLS12):], downgradeSentinelTLS12[:])
+	}
+	state.hs.serverRandom = sh.Random
+
+	shExtensions := []ExtensionBody{}
+	if state.Params.NextProto != "" {
+		shExtensions = append(shExtensions, &ALPNExtension{Protocols: []string{state.Params.NextProto}})
+	}
+	if state.hs.extendedMasterSecret {
+		shExtensions = append(shExtensions, &ExtendedMasterSecretExtension{})
+	}
+	if state.secureRenegotiation {
+		shExtensions = append(shExtensions, &RenegotiationInfoExtension{})
+	}
+	if state.pointFormats {
+		shExtensions = append(shExtensions, &ECPointFormatsExtension{Formats: []uint8{pointFormatUncompressed}})
+	}
+	if state.hs.statusRequested {
+		shExtensions = append(shExtensions, &StatusRequestExtension{HandshakeType: HandshakeTypeServerHello})
+	}
+	for _, ext := range shExtensions {
+		if err := sh.Extensions.Add(ext); err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error adding extension type=[%v] [%v]", ext.Type(), err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
+	// Run the external extension handler.
+	if state.Config.ExtensionHandler != nil {
+		err := state.Config.ExtensionHandler.Send(HandshakeTypeServerHello, &sh.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error running external extension sender [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+
+	bodies := []HandshakeMessageBody{
+		sh,
+		&certificateBodyTLS12{Certificates: state.cert.Chain},
+	}
+	if state.hs.statusRequested {
+		bodies = append(bodies, &CertificateStatusBody{StatusType: certStatusTypeOCSP, OCSPResponse: state.ocspStaple})
+	}
+
+	// Generate our key share, and sign it along with the hello randoms
+	dhPublic, dhPrivate, err := newKeyShare(state.dhGroup)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error generating key share [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	ske := &ServerKeyExchangeBody{
+		CurveType: curveTypeNamedCurve,
+		Group:     state.dhGroup,
+		Point:     dhPublic,
+		Algorithm: state.certScheme,
+	}
+	ske.Signature, err = sign(state.certScheme, state.cert.PrivateKey, ske.signatureInput(state.hs.clientRandom, state.hs.serverRandom))
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error signing ServerKeyExchange [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+	bodies = append(bodies, ske)
+
+	// Send a CertificateRequest message if we want client auth
+	if state.Config.clientAuth() != NoClientCert {
+		state.Params.UsingClientAuth = true
+
+		cr := &certificateRequestBodyTLS12{
+			CertificateTypes: []uint8{certTypeECDSASign, certTypeRSASign},
+			SignatureSchemes: signatureSchemesTLS12(state.Config.SignatureSchemes),
+		}
+		if state.Config.ClientCAs != nil {
+			cr.Authorities = state.Config.ClientCAs.Subjects()
+		}
+		bodies = append(bodies, cr)
+	}
+	bodies = append(bodies, &ServerHelloDoneBody{})
+
+	state.hs.add(state.clientHello)
+	toSend := []HandshakeAction{}
+	for _, body := range bodies {
+		hm, err := state.hsCtx.hOut.HandshakeMessageFromBody(body)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] Error marshaling %v [%v]", body.Type(), err)
+			return nil, nil, AlertInternalError
+		}
+
+		toSend = append(toSend, QueueHandshakeMessage{hm})
+		state.hs.add(hm)
+	}
+	toSend = append(toSend, SendQueuedHandshake{})
+
+	if state.Params.UsingClientAuth {
+		logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] -> [ServerStateWaitCertTLS12]")
+		return serverStateWaitCertTLS12{
+			Config:    state.Config,
+			Params:    state.Params,
+			hsCtx:     state.hsCtx,
+			hs:        state.hs,
+			dhGroup:   state.dhGroup,
+			dhPrivate: dhPrivate,
+		}, toSend, AlertNoAlert
+	}
+
+	logf(logTypeHandshake, "[ServerStateNegotiatedTLS12] -> [ServerStateWaitCKE]")
+	return serverStateWaitCKE{
+		Config:    state.Config,
+		Params:    state.Params,
+		hsCtx:     state.hsCtx,
+		hs:        state.hs,
+		dhGroup:   state.dhGroup,
+		dhPrivate: dhPrivate,
+	}, toSend, AlertNoAlert
+}
+
+type serverStateWaitCertTLS12 struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	dhGroup   NamedGroup
+	dhPrivate []byte
+}
+
+var _ HandshakeState = &serverStateWaitCertTLS12{}
+
+func (state serverStateWaitCertTLS12) State() State {
+	return StateServerWaitCert
+}
+
+func (state serverStateWaitCertTLS12) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeCertificate {
+		logf(logTypeHandshake, "[ServerStateWaitCertTLS12] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	cert := &certificateBodyTLS12{}
+	if err := safeUnmarshal(cert, hm.body); err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCertTLS12] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	if len(cert.Certificates) == 0 {
+		logf(logTypeHandshake, "[ServerStateWaitCertTLS12] WARNING client did not provide a certificate")
+
+		clientAuth := state.Config.clientAuth()
+		if clientAuth == RequireAnyClientCert || clientAuth == RequireAndVerifyClientCert {
+			logf(logTypeHandshake, "[ServerStateWaitCertTLS12] Client certificate required")
+			return nil, nil, AlertHandshakeFailure
+		}
+	}
+
+	state.hs.add(hm)
+
+	logf(logTypeHandshake, "[ServerStateWaitCertTLS12] -> [ServerStateWaitCKE]")
+	nextState := serverStateWaitCKE{
+		Config:            state.Config,
+		Params:            state.Params,
+		hsCtx:             state.hsCtx,
+		hs:                state.hs,
+		dhGroup:           state.dhGroup,
+		dhPrivate:         state.dhPrivate,
+		clientCertificate: cert.Certificates,
+	}
+	return nextState, nil, AlertNoAlert
+}
+
+type serverStateWaitCKE struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	dhGroup           NamedGroup
+	dhPrivate         []byte
+	clientCertificate []*x509.Certificate
+}
+
+var _ HandshakeState = &serverStateWaitCKE{}
+
+func (state serverStateWaitCKE) State() State {
+	return StateServerWaitCKE
+}
+
+func (state serverStateWaitCKE) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeClientKeyExchange || state.hsCtx.hIn.receivedCCS {
+		logf(logTypeHandshake, "[ServerStateWaitCKE] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	cke := &ClientKeyExchangeBody{}
+	if err := safeUnmarshal(cke, hm.body); err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCKE] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	preMasterSecret, err := keyAgreement(state.dhGroup, cke.Point, state.dhPrivate)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCKE] Error in key agreement [%v]", err)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	state.hs.add(hm)
+
+	params := state.hs.suite.params
+	masterSecret := masterSecretTLS12(params, preMasterSecret, state.hs.extendedMasterSecret,
+		state.hs.messages, state.hs.helloRandoms())
+	logf(logTypeCrypto, "master secret: [%d] %x", len(masterSecret), masterSecret)
+
+	clientKeys, serverKeys := makeTrafficKeysTLS12(params, masterSecret, state.hs.clientRandom, state.hs.serverRandom)
+
+	if len(state.clientCertificate) > 0 {
+		logf(logTypeHandshake, "[ServerStateWaitCKE] -> [ServerStateWaitCVTLS12]")
+		nextState := serverStateWaitCVTLS12{
+			Config:            state.Config,
+			Params:            state.Params,
+			hsCtx:             state.hsCtx,
+			hs:                state.hs,
+			masterSecret:      masterSecret,
+			clientKeys:        clientKeys,
+			serverKeys:        serverKeys,
+			clientCertificate: state.clientCertificate,
+		}
+		return nextState, nil, AlertNoAlert
+	}
+
+	logf(logTypeHandshake, "[ServerStateWaitCKE] -> [ServerStateWaitFinishedTLS12]")
+	nextState := serverStateWaitFinishedTLS12{
+		Params:       state.Params,
+		hsCtx:        state.hsCtx,
+		hs:           state.hs,
+		masterSecret: masterSecret,
+		serverKeys:   serverKeys,
+	}
+	toSend := []HandshakeAction{
+		RekeyIn{epoch: EpochApplicationData, KeySet: clientKeys},
+	}
+	return nextState, toSend, AlertNoAlert
+}
+
+type serverStateWaitCVTLS12 struct {
+	Config *Config
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	masterSecret      []byte
+	clientKeys        KeySet
+	serverKeys        KeySet
+	clientCertificate []*x509.Certificate
+}
+
+var _ HandshakeState = &serverStateWaitCVTLS12{}
+
+func (state serverStateWaitCVTLS12) State() State {
+	return StateServerWaitCV
+}
+
+func (state serverStateWaitCVTLS12) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeCertificateVerify || state.hsCtx.hIn.receivedCCS {
+		logf(logTypeHandshake, "[ServerStateWaitCVTLS12] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	certVerify := &CertificateVerifyBody{}
+	if err := safeUnmarshal(certVerify, hm.body); err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCVTLS12] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	// The client can only sign with a scheme we asked for
+	if !schemeListContains(signatureSchemesTLS12(state.Config.SignatureSchemes), certVerify.Algorithm) {
+		logf(logTypeHandshake, "[ServerStateWaitCVTLS12] Client used unrequested signature scheme [%04x]", certVerify.Algorithm)
+		return nil, nil, AlertIllegalParameter
+	}
+
+	// The CertificateVerify signs all of the handshake messages before it
+	clientPublicKey := state.clientCertificate[0].PublicKey
+	if err := verify(certVerify.Algorithm, clientPublicKey, state.hs.messages, certVerify.Signature); err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitCVTLS12] Failure in client auth verification [%v]", err)
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	verifiedChains, alert := verifyClientCertificates(state.Config, state.clientCertificate)
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+
+	state.hs.add(hm)
+
+	logf(logTypeHandshake, "[ServerStateWaitCVTLS12] -> [ServerStateWaitFinishedTLS12]")
+	nextState := serverStateWaitFinishedTLS12{
+		Params:            state.Params,
+		hsCtx:             state.hsCtx,
+		hs:                state.hs,
+		masterSecret:      state.masterSecret,
+		serverKeys:        state.serverKeys,
+		clientCertificate: state.clientCertificate,
+		verifiedChains:    verifiedChains,
+	}
+	toSend := []HandshakeAction{
+		RekeyIn{epoch: EpochApplicationData, KeySet: state.clientKeys},
+	}
+	return nextState, toSend, AlertNoAlert
+}
+
+type serverStateWaitFinishedTLS12 struct {
+	Params ConnectionParameters
+	hsCtx  *HandshakeContext
+	hs     handshakeTLS12
+
+	masterSecret      []byte
+	serverKeys        KeySet
+	clientCertificate []*x509.Certificate
+	verifiedChains    [][]*x509.Certificate
+}
+
+var _ HandshakeState = &serverStateWaitFinishedTLS12{}
+
+func (state serverStateWaitFinishedTLS12) State() State {
+	return StateServerWaitFinished
+}
+
+func (state serverStateWaitFinishedTLS12) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
+	hm, alert := hr.ReadMessage()
+	if alert != AlertNoAlert {
+		return nil, nil, alert
+	}
+	if hm == nil || hm.msgType != HandshakeTypeFinished || !state.hsCtx.hIn.receivedCCS {
+		logf(logTypeHandshake, "[ServerStateWaitFinishedTLS12] Unexpected message")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
+	params := state.hs.suite.params
+	clientFinishedData := computeFinishedDataTLS12(params, state.masterSecret, labelClientFinishedTLS12, state.hs.messages)
+
+	fin := &FinishedBody{VerifyDataLen: verifyDataLenTLS12}
+	if err := safeUnmarshal(fin, hm.body); err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitFinishedTLS12] Error decoding message: %v", err)
+		return nil, nil, AlertDecodeError
+	}
+
+	if !hmac.Equal(fin.VerifyData, clientFinishedData) {
+		logf(logTypeHandshake, "[ServerStateWaitFinishedTLS12] Client's Finished failed to verify")
+		return nil, nil, AlertHandshakeFailure
+	}
+
+	state.hs.add(hm)
+
+	serverFin := &FinishedBody{
+		VerifyDataLen: verifyDataLenTLS12,
+		VerifyData:    computeFinishedDataTLS12(params, state.masterSecret, labelServerFinishedTLS12, state.hs.messages),
+	}
+	finm, err := state.hsCtx.hOut.HandshakeMessageFromBody(serverFin)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateWaitFinishedTLS12] Error marshaling server Finished [%v]", err)
+		return nil, nil, AlertInternalError
+	}
+
+	logf(logTypeHandshake, "[ServerStateWaitFinishedTLS12] -> [StateConnected]")
+	nextState := stateConnected{
+		Params:           state.Params,
+		hsCtx:            state.hsCtx,
+		isClient:         false,
+		cryptoParams:     params,
+		peerCertificates: state.clientCertificate,
+		verifiedChains:   state.verifiedChains,
+		helloRandoms:     state.hs.helloRandoms(),
+	}
+	if state.hs.extendedMasterSecret {
+		nextState.exporterSecret = state.masterSecret
+	}
+	toSend := []HandshakeAction{
+		SendChangeCipherSpec{},
+		RekeyOut{epoch: EpochApplicationData, KeySet: state.serverKeys},
+		QueueHandshakeMessage{finm},
+		SendQueuedHandshake{},
+	}
+	return nextState, toSend, AlertNoAlert
+}
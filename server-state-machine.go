@@ -2,11 +2,14 @@ package mint
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/x509"
 	"fmt"
 	"hash"
 	"reflect"
+	"time"
 
+	"github.com/bifurcation/mint/hpke"
 	"github.com/bifurcation/mint/syntax"
 )
 
@@ -55,7 +58,7 @@ import (
 //
 //  State          Instructions
 //  START          {}
-//  NEGOTIATED     Send(SH); [RekeyIn;] RekeyOut; Send(EE); [Send(CertReq);] [Send(Cert); Send(CV)]
+//  NEGOTIATED     Send(SH); [SendCCS;] [RekeyIn;] RekeyOut; Send(EE); [Send(CertReq);] [Send(Cert); Send(CV)]
 //  WAIT_EOED      RekeyIn;
 //  READ_PAST      {}
 //  WAIT_FLIGHT2   {}
@@ -79,6 +82,13 @@ type serverStateStart struct {
 	Config *Config
 	conn   *Conn
 	hsCtx  *HandshakeContext
+
+	// Set once GetConfigForClient has chosen the Config, so that it isn't
+	// consulted again for a second ClientHello
+	configSelected bool
+
+	// What we did with ECH in a ClientHello we sent a HelloRetryRequest for
+	echRetry *echRetry
 }
 
 var _ HandshakeState = &serverStateStart{}
@@ -112,25 +122,81 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 	clientHello := hm
 	connParams := ConnectionParameters{}
 
+	// If the client offered ECH and we can decrypt its ClientHelloInner, the
+	// handshake continues with that in place of the ClientHelloOuter
+	var echInnerRandom []byte
+	var echContext *hpke.ReceiverContext
+	var echHRRConfirmation []byte
+	acceptedECH := state.echRetry != nil && state.echRetry.accepted
+	if acceptedECH {
+		echHRRConfirmation = state.echRetry.confirmation
+	}
+	clientECH := &ECHExtension{HandshakeType: HandshakeTypeClientHello}
+	foundECH, err := ch.Extensions.Find(clientECH)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateStart] Error decoding encrypted_client_hello extension [%v]", err)
+		return nil, nil, AlertDecodeError
+	}
+	if !foundECH && acceptedECH {
+		logf(logTypeHandshake, "[ServerStateStart] No encrypted_client_hello after accepting ECH")
+		return nil, nil, AlertMissingExtension
+	}
+	if foundECH && (len(state.Config.ECHKeys) > 0 || state.echRetry != nil) {
+		if clientECH.ClientHelloType != ECHClientHelloOuter {
+			logf(logTypeHandshake, "[ServerStateStart] Received a ClientHelloInner in the clear")
+			return nil, nil, AlertIllegalParameter
+		}
+
+		// Having rejected ECH in the first ClientHello, we follow the second
+		// ClientHelloOuter too
+		var inner *ClientHelloBody
+		var innerBody []byte
+		if state.echRetry == nil || acceptedECH {
+			var retry *echRetry
+			if acceptedECH {
+				retry = state.echRetry
+			}
+
+			inner, innerBody, echContext, alert = openClientHelloInner(ch, clientECH, state.Config.ECHKeys, retry)
+			if alert != AlertNoAlert {
+				return nil, nil, alert
+			}
+		}
+
+		if inner != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Accepted ECH")
+			ch = inner
+			clientHello = &HandshakeMessage{
+				msgType: HandshakeTypeClientHello,
+				body:    innerBody,
+				length:  uint32(len(innerBody)),
+			}
+			echInnerRandom = ch.Random[:]
+			connParams.UsingECH = true
+		} else {
+			logf(logTypeHandshake, "[ServerStateStart] Rejected ECH")
+			connParams.RejectedECH = true
+		}
+	}
+
 	supportedVersions := &SupportedVersionsExtension{HandshakeType: HandshakeTypeClientHello}
 	serverName := new(ServerNameExtension)
 	supportedGroups := new(SupportedGroupsExtension)
 	signatureAlgorithms := new(SignatureAlgorithmsExtension)
+	signatureAlgorithmsCert := new(SignatureAlgorithmsCertExtension)
 	clientKeyShares := &KeyShareExtension{HandshakeType: HandshakeTypeClientHello}
 	clientPSK := &PreSharedKeyExtension{HandshakeType: HandshakeTypeClientHello}
 	clientEarlyData := &EarlyDataExtension{}
 	clientALPN := new(ALPNExtension)
 	clientPSKModes := new(PSKKeyExchangeModesExtension)
 	clientCookie := new(CookieExtension)
-
-	// Handle external extensions.
-	if state.Config.ExtensionHandler != nil {
-		err := state.Config.ExtensionHandler.Receive(HandshakeTypeClientHello, &ch.Extensions)
-		if err != nil {
-			logf(logTypeHandshake, "[ServerStateStart] Error running external extension handler [%v]", err)
-			return nil, nil, AlertInternalError
-		}
-	}
+	clientAuthorities := new(CertificateAuthoritiesExtension)
+	clientStatusRequest := &StatusRequestExtension{HandshakeType: HandshakeTypeClientHello}
+	clientSCT := &SCTExtension{HandshakeType: HandshakeTypeClientHello}
+	clientCertTypes := &ClientCertTypeExtension{HandshakeType: HandshakeTypeClientHello}
+	serverCertTypes := &ServerCertTypeExtension{HandshakeType: HandshakeTypeClientHello}
+	clientCompression := new(CompressCertificateExtension)
+	clientDelegation := &DelegatedCredentialExtension{HandshakeType: HandshakeTypeClientHello}
 
 	foundExts, err := ch.Extensions.Parse(
 		[]ExtensionBody{
@@ -138,12 +204,20 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 			serverName,
 			supportedGroups,
 			signatureAlgorithms,
+			signatureAlgorithmsCert,
 			clientEarlyData,
 			clientKeyShares,
 			clientPSK,
 			clientALPN,
 			clientPSKModes,
 			clientCookie,
+			clientAuthorities,
+			clientStatusRequest,
+			clientSCT,
+			clientCertTypes,
+			serverCertTypes,
+			clientCompression,
+			clientDelegation,
 		})
 
 	if err != nil {
@@ -151,23 +225,77 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		return nil, nil, AlertDecodeError
 	}
 
+	// A status_request for a type other than OCSP doesn't ask for a staple
+	if clientStatusRequest.StatusType != CertificateStatusTypeOCSP {
+		foundExts[ExtensionTypeStatusRequest] = false
+	}
+
 	clientSentCookie := len(clientCookie.Cookie) > 0
 
+	// A ChangeCipherSpec can't come before the first ClientHello, only
+	// between a HelloRetryRequest and the second one
+	if state.hsCtx.hIn.receivedCCS && !clientSentCookie {
+		logf(logTypeHandshake, "[ServerStateStart] ChangeCipherSpec before ClientHello")
+		return nil, nil, AlertUnexpectedMessage
+	}
+
 	if foundExts[ExtensionTypeServerName] {
 		connParams.ServerName = string(*serverName)
 	}
 
-	// If the client didn't send supportedVersions or doesn't support 1.3,
-	// then we're done here.
-	if !foundExts[ExtensionTypeSupportedVersions] {
-		logf(logTypeHandshake, "[ServerStateStart] Client did not send supported_versions")
-		return nil, nil, AlertProtocolVersion
+	chInfo := &ClientHelloInfo{
+		CipherSuites:     ch.CipherSuites,
+		ServerName:       connParams.ServerName,
+		SupportedGroups:  supportedGroups.Groups,
+		SignatureSchemes: signatureAlgorithms.Algorithms,
+		SupportedProtos:  clientALPN.Protocols,
+
+		CertificateAuthorities:      clientAuthorities.Authorities,
+		CertificateSignatureSchemes: signatureAlgorithmsCert.Algorithms,
+	}
+	if state.conn != nil {
+		chInfo.RemoteAddr = state.conn.RemoteAddr()
+	}
+
+	// Let the application choose the Config for this connection
+	if state.Config.GetConfigForClient != nil && !state.configSelected {
+		config, err := state.Config.GetConfigForClient(chInfo)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error getting config from application [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		if config != nil {
+			if alert := state.selectConfig(config); alert != AlertNoAlert {
+				return nil, nil, alert
+			}
+		}
+	}
+
+	// Handle external extensions.
+	if state.Config.ExtensionHandler != nil {
+		err := state.Config.ExtensionHandler.Receive(HandshakeTypeClientHello, &ch.Extensions)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error running external extension handler [%v]", err)
+			return nil, nil, AlertInternalError
+		}
 	}
-	versionOK, _ := VersionNegotiation(supportedVersions.Versions, []uint16{tls13Version})
+
+	// A client that doesn't send supported_versions only offers its legacy
+	// version, which can at most be TLS 1.2
+	offeredVersions := []uint16{ch.LegacyVersion}
+	if foundExts[ExtensionTypeSupportedVersions] {
+		offeredVersions = supportedVersions.Versions
+	}
+	versionOK, version := VersionNegotiation(offeredVersions, state.Config.supportedVersions())
 	if !versionOK {
 		logf(logTypeHandshake, "[ServerStateStart] Client does not support the same version")
 		return nil, nil, AlertProtocolVersion
 	}
+	if version == tls12Version {
+		return state.negotiateTLS12(ch, clientHello, connParams, chInfo, foundExts)
+	}
+	connParams.Version = tls13Version
 
 	// The client sent a cookie. So this is probably the second ClientHello (sent as a response to a HRR)
 	var firstClientHello *HandshakeMessage
@@ -221,7 +349,7 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 			// fill in the cookie sent by the client. Needed to calculate the correct hash
 			cookieExt := &CookieExtension{Cookie: clientCookie.Cookie}
 			hrr, err := state.generateHRR(params.Suite,
-				ch.LegacySessionID, cookieExt)
+				ch.LegacySessionID, cookieExt, echHRRConfirmation)
 			if err != nil {
 				return nil, nil, AlertInternalError
 			}
@@ -234,7 +362,19 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		}
 		context := append(contextBase, chTrunc...)
 
-		canDoPSK, selectedPSK, psk, params, err = PSKNegotiation(clientPSK.Identities, clientPSK.Binders, context, state.Config.PSKs)
+		cacheLookup := pskCacheLookup(state.Config.PSKs)
+		lookup := func(identity []byte) (*PreSharedKey, error) {
+			if state.Config.GetPSK != nil {
+				psk, err := state.Config.GetPSK(identity, chInfo)
+				if err != nil || psk != nil {
+					return psk, err
+				}
+			}
+			return cacheLookup(identity)
+		}
+
+		canDoPSK, selectedPSK, psk, params, err = pskNegotiation(clientPSK.Identities, clientPSK.Binders, context, lookup,
+			state.Config.time(), ch.CipherSuites, state.Config.cipherSuitesFor(tls13Version))
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] Error in PSK negotiation [%v]", err)
 			return nil, nil, AlertInternalError
@@ -245,7 +385,7 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 	connParams.UsingDH, connParams.UsingPSK = PSKModeNegotiation(canDoDH, canDoPSK, clientPSKModes.KEModes)
 
 	// Select a ciphersuite
-	connParams.CipherSuite, err = CipherSuiteNegotiation(psk, ch.CipherSuites, state.Config.CipherSuites)
+	connParams.CipherSuite, err = CipherSuiteNegotiation(psk, ch.CipherSuites, state.Config.cipherSuitesFor(tls13Version))
 	if err != nil {
 		logf(logTypeHandshake, "[ServerStateStart] No common ciphersuite found [%v]", err)
 		return nil, nil, AlertHandshakeFailure
@@ -299,6 +439,26 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 			cookieExt = &CookieExtension{Cookie: clientCookie.Cookie}
 		}
 
+		// If we accepted ECH, the HelloRetryRequest confirms it, over the
+		// transcript with the confirmation zeroed
+		if shouldSendHRR && connParams.UsingECH {
+			zeroed, err := state.generateHRR(connParams.CipherSuite,
+				ch.LegacySessionID, cookieExt, make([]byte, echAcceptConfirmationLen))
+			if err != nil {
+				return nil, nil, AlertInternalError
+			}
+
+			params := cipherSuiteMap[connParams.CipherSuite]
+			h := params.Hash.New()
+			h.Write(clientHello.Marshal())
+			firstClientHello := &HandshakeMessage{
+				msgType: HandshakeTypeMessageHash,
+				body:    h.Sum(nil),
+			}
+			echHRRConfirmation = echAcceptConfirmation(params, echHRRAcceptConfirmationLabel, echInnerRandom,
+				firstClientHello, zeroed)
+		}
+
 		// Generate a HRR. We will need it in both of the two cases:
 		// 1. We need to send a Cookie. Then this HRR will be sent on the wire
 		// 2. We need to validate a cookie. Then we need its hash
@@ -306,17 +466,29 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		// shouldn't be marshal errors
 		if shouldSendHRR || clientSentCookie {
 			helloRetryRequest, err = state.generateHRR(connParams.CipherSuite,
-				ch.LegacySessionID, cookieExt)
+				ch.LegacySessionID, cookieExt, echHRRConfirmation)
 			if err != nil {
 				return nil, nil, AlertInternalError
 			}
 		}
 
 		if shouldSendHRR {
+			// The second ClientHello has to follow what we decided about ECH
+			if connParams.UsingECH || connParams.RejectedECH {
+				state.echRetry = &echRetry{
+					accepted:     connParams.UsingECH,
+					configID:     clientECH.ConfigID,
+					suite:        clientECH.CipherSuite,
+					context:      echContext,
+					confirmation: echHRRConfirmation,
+				}
+			}
+
 			toSend := []HandshakeAction{
 				QueueHandshakeMessage{helloRetryRequest},
 				SendQueuedHandshake{},
 			}
+			toSend = append(toSend, state.hsCtx.compatibilityCCS()...)
 			logf(logTypeHandshake, "[ServerStateStart] -> [ServerStateStart]")
 			return state, toSend, AlertStatelessRetry
 		}
@@ -336,32 +508,127 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 	} else {
 		psk = nil
 
-		// If we're not using a PSK mode, then we need to have certain extensions
-		if !(foundExts[ExtensionTypeServerName] &&
+		// A raw public key can be used if the client accepts one and we have one
+		var rawKeys []*Certificate
+		if certTypeListContains(serverCertTypes.CertificateTypes, CertificateTypeRawPublicKey) {
+			rawKeys = certificatesOfType(state.Config.Certificates, CertificateTypeRawPublicKey)
+		}
+
+		// If we're not using a PSK mode, then we need to have certain extensions.
+		// The server_name can be omitted if we have a default certificate or a
+		// raw public key.
+		if !((foundExts[ExtensionTypeServerName] || state.Config.DefaultCertificate != nil || len(rawKeys) > 0) &&
 			foundExts[ExtensionTypeSupportedGroups] &&
 			foundExts[ExtensionTypeSignatureAlgorithms]) {
 			logf(logTypeHandshake, "[ServerStateStart] Insufficient extensions (%v)", foundExts)
 			return nil, nil, AlertMissingExtension
 		}
 
-		// Select a certificate
-		name := string(*serverName)
-		var err error
-		cert, certScheme, err = CertificateSelection(&name, signatureAlgorithms.Algorithms, state.Config.Certificates)
+		// Certificates with delegated credentials can only be used if the client
+		// accepts them
+		usable := func(certs []*Certificate) []*Certificate {
+			return certificatesForDelegation(certs, clientDelegation.Algorithms, signatureAlgorithms.Algorithms, state.Config.time())
+		}
+
+		// Select a certificate, asking the application first if it wants to
+		if state.Config.GetCertificate != nil {
+			cert, err = state.Config.GetCertificate(chInfo)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateStart] Error getting certificate from application [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+
+		if cert != nil {
+			_, certScheme, err = certificateSelection(nil, signatureAlgorithms.Algorithms, signatureAlgorithmsCert.Algorithms, usable([]*Certificate{cert}))
+		} else {
+			if len(rawKeys) > 0 {
+				cert, certScheme, err = CertificateSelection(nil, signatureAlgorithms.Algorithms, rawKeys)
+			}
+
+			unrecognizedName := false
+			if cert == nil && foundExts[ExtensionTypeServerName] {
+				// Prefer certificates the client says it will accept, but fall back
+				// to the others rather than failing the handshake
+				name := string(*serverName)
+				certs := usable(state.Config.Certificates)
+				preferred := certificatesForAuthorities(certs, clientAuthorities.Authorities)
+				if len(preferred) > 0 {
+					cert, certScheme, err = certificateSelection(&name, signatureAlgorithms.Algorithms, signatureAlgorithmsCert.Algorithms, preferred)
+				}
+				if cert == nil {
+					cert, certScheme, err = certificateSelection(&name, signatureAlgorithms.Algorithms, signatureAlgorithmsCert.Algorithms, certs)
+				}
+				unrecognizedName = len(certificatesForName(state.Config.Certificates, name)) == 0
+			}
+
+			if unrecognizedName && state.Config.RejectUnrecognizedName {
+				logf(logTypeHandshake, "[ServerStateStart] No certificate for server name [%s]", string(*serverName))
+				return nil, nil, AlertUnrecognizedName
+			}
+
+			if cert == nil && state.Config.DefaultCertificate != nil {
+				cert, certScheme, err = certificateSelection(nil, signatureAlgorithms.Algorithms, signatureAlgorithmsCert.Algorithms, usable([]*Certificate{state.Config.DefaultCertificate}))
+			}
+		}
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateStart] No appropriate certificate found [%v]", err)
 			return nil, nil, AlertAccessDenied
 		}
+
+		// Make sure the client can accept the type of certificate we selected.
+		// A client that doesn't say only accepts X.509.
+		if cert.isRawPublicKey() {
+			connParams.ServerCertificateType = CertificateTypeRawPublicKey
+		}
+		acceptedCertTypes := []CertificateType{CertificateTypeX509}
+		if foundExts[ExtensionTypeServerCertType] {
+			acceptedCertTypes = serverCertTypes.CertificateTypes
+		}
+		if !certTypeListContains(acceptedCertTypes, connParams.ServerCertificateType) {
+			logf(logTypeHandshake, "[ServerStateStart] Client does not accept certificate type [%d]", connParams.ServerCertificateType)
+			return nil, nil, AlertUnsupportedCertificate
+		}
+	}
+
+	// Accept a raw public key from the client if it offers one and we have
+	// keys to check it against
+	if state.Config.clientAuth() != NoClientCert && len(state.Config.PeerPublicKeys) > 0 &&
+		certTypeListContains(clientCertTypes.CertificateTypes, CertificateTypeRawPublicKey) {
+		connParams.ClientCertificateType = CertificateTypeRawPublicKey
 	}
 
 	if !connParams.UsingDH {
 		dhSecret = nil
 	}
 
+	// Select a next protocol
+	connParams.NextProto, err = ALPNNegotiation(psk, clientALPN.Protocols, state.Config.NextProtos)
+	if err != nil {
+		logf(logTypeHandshake, "[ServerStateStart] No common application-layer protocol found [%v]", err)
+		return nil, nil, AlertNoApplicationProtocol
+	}
+
 	// Figure out if we're going to do early data
 	var clientEarlyTrafficSecret []byte
+	// Early data is only ever sent under the first PSK the client offered,
+	// and only if that PSK allows it
+	allowEarlyData := state.Config.AllowEarlyData && selectedPSK == 0 &&
+		psk != nil && psk.MaxEarlyDataSize > 0
 	connParams.ClientSendingEarlyData = foundExts[ExtensionTypeEarlyData]
-	connParams.UsingEarlyData, connParams.RejectedEarlyData = EarlyDataNegotiation(connParams.UsingPSK, foundExts[ExtensionTypeEarlyData], state.Config.AllowEarlyData)
+	if allowEarlyData && connParams.UsingPSK && connParams.ClientSendingEarlyData && state.Config.AcceptEarlyData != nil {
+		info := &EarlyDataInfo{
+			ServerName:  connParams.ServerName,
+			NextProto:   connParams.NextProto,
+			PSKIdentity: psk.Identity,
+		}
+		if psk.IsResumption {
+			ticketAge := clientPSK.Identities[selectedPSK].ObfuscatedTicketAge - psk.TicketAgeAdd
+			info.TicketAge = time.Duration(ticketAge) * time.Millisecond
+		}
+		allowEarlyData = state.Config.AcceptEarlyData(info)
+	}
+	connParams.UsingEarlyData, connParams.RejectedEarlyData = EarlyDataNegotiation(connParams.UsingPSK, foundExts[ExtensionTypeEarlyData], allowEarlyData)
 	if connParams.UsingEarlyData {
 		h := params.Hash.New()
 		h.Write(clientHello.Marshal())
@@ -372,13 +639,6 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		clientEarlyTrafficSecret = deriveSecret(params, earlySecret, labelEarlyTrafficSecret, chHash)
 	}
 
-	// Select a next protocol
-	connParams.NextProto, err = ALPNNegotiation(psk, clientALPN.Protocols, state.Config.NextProtos)
-	if err != nil {
-		logf(logTypeHandshake, "[ServerStateStart] No common application-layer protocol found [%v]", err)
-		return nil, nil, AlertNoApplicationProtocol
-	}
-
 	state.hsCtx.receivedEndOfFlight()
 
 	logf(logTypeHandshake, "[ServerStateStart] -> [ServerStateNegotiated]")
@@ -392,10 +652,17 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 		dhSecret:                 dhSecret,
 		pskSecret:                pskSecret,
 		selectedPSK:              selectedPSK,
+		psk:                      psk,
 		cert:                     cert,
 		certScheme:               certScheme,
+		statusRequested:          foundExts[ExtensionTypeStatusRequest],
+		sctRequested:             foundExts[ExtensionTypeSCT],
+		clientCertTypes:          clientCertTypes.CertificateTypes,
+		serverCertTypes:          serverCertTypes.CertificateTypes,
+		certCompressor:           selectCertificateCompressor(state.Config.CertificateCompressors, clientCompression.Algorithms),
 		legacySessionId:          ch.LegacySessionID,
 		clientEarlyTrafficSecret: clientEarlyTrafficSecret,
+		echInnerRandom:           echInnerRandom,
 
 		firstClientHello:  firstClientHello,
 		helloRetryRequest: helloRetryRequest,
@@ -403,8 +670,33 @@ func (state serverStateStart) Next(hr handshakeMessageReader) (HandshakeState, [
 	}, nil, AlertNoAlert
 }
 
+// selectConfig switches the connection over to a Config returned by
+// GetConfigForClient.
+func (state *serverStateStart) selectConfig(config *Config) Alert {
+	if config.NonBlocking != state.Config.NonBlocking || config.UseDTLS != state.Config.UseDTLS {
+		logf(logTypeHandshake, "[ServerStateStart] Config for client changes NonBlocking or UseDTLS")
+		return AlertInternalError
+	}
+
+	if err := config.Init(false); err != nil {
+		logf(logTypeHandshake, "[ServerStateStart] Error initializing config for client: %v", err)
+		return AlertInternalError
+	}
+
+	if alert := setDefaultCookieProtector(config); alert != AlertNoAlert {
+		return alert
+	}
+
+	state.Config = config
+	state.configSelected = true
+	if state.conn != nil {
+		state.conn.config = config
+	}
+	return AlertNoAlert
+}
+
 func (state *serverStateStart) generateHRR(cs CipherSuite, legacySessionId []byte,
-	cookieExt *CookieExtension) (*HandshakeMessage, error) {
+	cookieExt *CookieExtension, echConfirmation []byte) (*HandshakeMessage, error) {
 	var helloRetryRequest *HandshakeMessage
 	hrr := &ServerHelloBody{
 		Version:                 tls12Version,
@@ -428,6 +720,14 @@ func (state *serverStateStart) generateHRR(cs CipherSuite, legacySessionId []byt
 		logf(logTypeHandshake, "[ServerStateStart] Error adding CookieExtension [%v]", err)
 		return nil, err
 	}
+
+	if echConfirmation != nil {
+		ech := &ECHExtension{HandshakeType: HandshakeTypeHelloRetryRequest, Confirmation: echConfirmation}
+		if err := hrr.Extensions.Add(ech); err != nil {
+			logf(logTypeHandshake, "[ServerStateStart] Error adding ECH confirmation [%v]", err)
+			return nil, err
+		}
+	}
 	// Run the external extension handler.
 	if state.Config.ExtensionHandler != nil {
 		err := state.Config.ExtensionHandler.Send(HandshakeTypeHelloRetryRequest, &hrr.Extensions)
@@ -454,9 +754,16 @@ type serverStateNegotiated struct {
 	pskSecret                []byte
 	clientEarlyTrafficSecret []byte
 	selectedPSK              int
+	psk                      *PreSharedKey
 	cert                     *Certificate
 	certScheme               SignatureScheme
+	statusRequested          bool
+	sctRequested             bool
+	clientCertTypes          []CertificateType
+	serverCertTypes          []CertificateType
+	certCompressor           CertificateCompressor
 	legacySessionId          []byte
+	echInnerRandom           []byte
 	firstClientHello         *HandshakeMessage
 	helloRetryRequest        *HandshakeMessage
 	clientHello              *HandshakeMessage
@@ -521,6 +828,26 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 		}
 	}
 
+	// Signal that we accepted ECH in the last bytes of the random, computed
+	// with those bytes zeroed
+	if state.Params.UsingECH {
+		confirmation := sh.Random[len(sh.Random)-echAcceptConfirmationLen:]
+		copy(confirmation, make([]byte, echAcceptConfirmationLen))
+		data, err := sh.Marshal()
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error marshaling ServerHello [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+
+		zeroed := &HandshakeMessage{
+			msgType: HandshakeTypeServerHello,
+			body:    data,
+			length:  uint32(len(data)),
+		}
+		copy(confirmation, echAcceptConfirmation(cipherSuiteMap[sh.CipherSuite], echAcceptConfirmationLabel, state.echInnerRandom,
+			state.firstClientHello, state.helloRetryRequest, state.clientHello, zeroed))
+	}
+
 	serverHello, err := state.hsCtx.hOut.HandshakeMessageFromBody(sh)
 	if err != nil {
 		logf(logTypeHandshake, "[ServerStateNegotiated] Error marshaling ServerHello [%v]", err)
@@ -591,6 +918,45 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 			return nil, nil, AlertInternalError
 		}
 	}
+	if !state.Params.UsingPSK && len(state.serverCertTypes) > 0 {
+		logf(logTypeHandshake, "[server] sending server_certificate_type extension")
+		err = eeList.Add(&ServerCertTypeExtension{
+			HandshakeType:    HandshakeTypeEncryptedExtensions,
+			CertificateTypes: []CertificateType{state.Params.ServerCertificateType},
+		})
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error adding server_certificate_type to EncryptedExtensions [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if !state.Params.UsingPSK && state.Config.clientAuth() != NoClientCert &&
+		certTypeListContains(state.clientCertTypes, state.Params.ClientCertificateType) {
+		logf(logTypeHandshake, "[server] sending client_certificate_type extension")
+		err = eeList.Add(&ClientCertTypeExtension{
+			HandshakeType:    HandshakeTypeEncryptedExtensions,
+			CertificateTypes: []CertificateType{state.Params.ClientCertificateType},
+		})
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error adding client_certificate_type to EncryptedExtensions [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
+	if state.Params.RejectedECH {
+		logf(logTypeHandshake, "[server] sending ECH retry configs")
+		retryConfigs, err := echRetryConfigs(state.Config.ECHKeys)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error marshaling ECH retry configs [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+		err = eeList.Add(&ECHExtension{
+			HandshakeType: HandshakeTypeEncryptedExtensions,
+			RetryConfigs:  retryConfigs,
+		})
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateNegotiated] Error adding ECH retry configs to EncryptedExtensions [%v]", err)
+			return nil, nil, AlertInternalError
+		}
+	}
 	ee := &EncryptedExtensionsBody{eeList}
 
 	// Run the external extension handler.
@@ -612,18 +978,25 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 
 	toSend := []HandshakeAction{
 		QueueHandshakeMessage{serverHello},
+	}
+	// After a HelloRetryRequest, the ChangeCipherSpec followed that, even if
+	// it was sent by a different instance
+	if state.helloRetryRequest == nil {
+		toSend = append(toSend, state.hsCtx.compatibilityCCS()...)
+	}
+	toSend = append(toSend, []HandshakeAction{
 		RekeyOut{epoch: EpochHandshakeData, KeySet: serverHandshakeKeys},
 		QueueHandshakeMessage{eem},
-	}
+	}...)
 
 	// Authenticate with a certificate if required
 	if !state.Params.UsingPSK {
 		// Send a CertificateRequest message if we want client auth
-		if state.Config.RequireClientAuth {
+		if state.Config.clientAuth() != NoClientCert {
 			state.Params.UsingClientAuth = true
 
 			// XXX: We don't support sending any constraints besides a list of
-			// supported signature algorithms
+			// supported signature algorithms and certificate authorities
 			cr := &CertificateRequestBody{}
 			schemes := &SignatureAlgorithmsExtension{Algorithms: state.Config.SignatureSchemes}
 			err := cr.Extensions.Add(schemes)
@@ -632,6 +1005,48 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 				return nil, nil, AlertInternalError
 			}
 
+			if len(state.Config.CertificateSignatureSchemes) > 0 {
+				certSchemes := &SignatureAlgorithmsCertExtension{Algorithms: state.Config.CertificateSignatureSchemes}
+				err = cr.Extensions.Add(certSchemes)
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateNegotiated] Error adding certificate signature schemes to CertificateRequest [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+			}
+
+			if len(state.Config.CertificateCompressors) > 0 {
+				algorithms := certificateCompressionAlgorithms(state.Config.CertificateCompressors)
+				err = cr.Extensions.Add(&CompressCertificateExtension{Algorithms: algorithms})
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateNegotiated] Error adding compression algorithms to CertificateRequest [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+			}
+
+			if state.Config.ClientCAs != nil {
+				authorities := state.Config.ClientCAs.Subjects()
+				if len(authorities) > 0 {
+					err = cr.Extensions.Add(&CertificateAuthoritiesExtension{Authorities: authorities})
+					if err != nil {
+						logf(logTypeHandshake, "[ServerStateNegotiated] Error adding certificate authorities to CertificateRequest [%v]", err)
+						return nil, nil, AlertInternalError
+					}
+				}
+			}
+
+			if state.Config.GREASE {
+				grease, err := newGREASEValues()
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateNegotiated] Error creating GREASE values [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+				err = cr.Extensions.Add(&greaseExtension{grease.extension})
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateNegotiated] Error adding GREASE extension to CertificateRequest [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+			}
+
 			crm, err := state.hsCtx.hOut.HandshakeMessageFromBody(cr)
 			if err != nil {
 				logf(logTypeHandshake, "[ServerStateNegotiated] Error marshaling CertificateRequest [%v]", err)
@@ -645,12 +1060,64 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 
 		// Create and send Certificate, CertificateVerify
 		certificate := &CertificateBody{
+			CertificateType: state.Params.ServerCertificateType,
 			CertificateList: make([]CertificateEntry, len(state.cert.Chain)),
 		}
 		for i, entry := range state.cert.Chain {
 			certificate.CertificateList[i] = CertificateEntry{CertData: entry}
 		}
-		certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificate)
+		if state.cert.isRawPublicKey() {
+			rawPublicKey, err := state.cert.rawPublicKey()
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateNegotiated] Error encoding raw public key [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+			certificate.CertificateList = []CertificateEntry{{RawPublicKey: rawPublicKey}}
+		}
+
+		// Staple an OCSP response to the leaf certificate, if requested
+		if state.statusRequested && !state.cert.isRawPublicKey() {
+			if staple := state.cert.ocspStaple(); len(staple) > 0 {
+				ocspStatus := &StatusRequestExtension{HandshakeType: HandshakeTypeCertificate, OCSPResponse: staple}
+				err := certificate.CertificateList[0].Extensions.Add(ocspStatus)
+				if err != nil {
+					logf(logTypeHandshake, "[ServerStateNegotiated] Error adding OCSP response to Certificate [%v]", err)
+					return nil, nil, AlertInternalError
+				}
+			}
+		}
+
+		// Likewise for SCTs
+		if state.sctRequested && !state.cert.isRawPublicKey() && len(state.cert.SignedCertificateTimestamps) > 0 {
+			scts := &SCTExtension{HandshakeType: HandshakeTypeCertificate, SCTs: state.cert.SignedCertificateTimestamps}
+			err := certificate.CertificateList[0].Extensions.Add(scts)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateNegotiated] Error adding SCTs to Certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+
+		// Attach the delegated credential we're signing with
+		if state.cert.DelegatedCredential != nil {
+			dc := &DelegatedCredentialExtension{HandshakeType: HandshakeTypeCertificate, Credential: *state.cert.DelegatedCredential}
+			err := certificate.CertificateList[0].Extensions.Add(dc)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateNegotiated] Error adding delegated credential to Certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+
+		// Compress the Certificate if the client supports one of our algorithms
+		var certificateBody HandshakeMessageBody = certificate
+		if state.certCompressor != nil {
+			certificateBody, err = compressCertificate(state.certCompressor, certificate)
+			if err != nil {
+				logf(logTypeHandshake, "[ServerStateNegotiated] Error compressing Certificate [%v]", err)
+				return nil, nil, AlertInternalError
+			}
+		}
+
+		certm, err := state.hsCtx.hOut.HandshakeMessageFromBody(certificateBody)
 		if err != nil {
 			logf(logTypeHandshake, "[ServerStateNegotiated] Error marshaling Certificate [%v]", err)
 			return nil, nil, AlertInternalError
@@ -730,6 +1197,7 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 			clientTrafficSecret:          clientTrafficSecret,
 			serverTrafficSecret:          serverTrafficSecret,
 			exporterSecret:               exporterSecret,
+			psk:                          state.psk,
 		}
 		toSend = append(toSend, []HandshakeAction{
 			RekeyIn{epoch: EpochEarlyData, KeySet: clientEarlyTrafficKeys},
@@ -753,11 +1221,14 @@ func (state serverStateNegotiated) Next(_ handshakeMessageReader) (HandshakeStat
 		clientTrafficSecret:          clientTrafficSecret,
 		serverTrafficSecret:          serverTrafficSecret,
 		exporterSecret:               exporterSecret,
+		psk:                          state.psk,
 	}
 	if state.Params.RejectedEarlyData {
+		// Point at a copy, so that the early data reader doesn't point to itself
+		waitFlight2 := nextState
 		nextState = serverStateReadPastEarlyData{
 			hsCtx: state.hsCtx,
-			next:  &nextState,
+			next:  &waitFlight2,
 		}
 	}
 	return nextState, toSend, AlertNoAlert
@@ -774,6 +1245,7 @@ type serverStateWaitEOED struct {
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
 	exporterSecret               []byte
+	psk                          *PreSharedKey
 }
 
 var _ HandshakeState = &serverStateWaitEOED{}
@@ -798,6 +1270,15 @@ func (state serverStateWaitEOED) Next(hr handshakeMessageReader) (HandshakeState
 
 		logf(logTypeHandshake, "Server got record type(1): %v", t)
 
+		// The client's ChangeCipherSpec comes before its early data
+		if t == RecordTypeChangeCipherSpec {
+			if err := state.hsCtx.hIn.readChangeCipherSpecRecord(); err != nil {
+				logf(logTypeHandshake, "Server error reading ChangeCipherSpec: %v", err)
+				return nil, nil, AlertUnexpectedMessage
+			}
+			continue
+		}
+
 		if t != RecordTypeApplicationData {
 			break
 		}
@@ -811,8 +1292,19 @@ func (state serverStateWaitEOED) Next(hr handshakeMessageReader) (HandshakeState
 			return nil, nil, AlertInternalError
 		}
 
+		// The client can't send more than the PSK allows
+		state.hsCtx.earlyDataReceived += uint64(len(pt.fragment))
+		if state.hsCtx.earlyDataReceived > uint64(state.psk.MaxEarlyDataSize) {
+			logf(logTypeHandshake, "Server received too much early data [%d > %d]", state.hsCtx.earlyDataReceived, state.psk.MaxEarlyDataSize)
+			return nil, nil, AlertUnexpectedMessage
+		}
+
+		// EarlyData reads the buffer from another goroutine, under the lock
+		// on the input record layer
 		logf(logTypeHandshake, "Server read early data: %x", pt.fragment)
+		state.hsCtx.hIn.conn.Lock()
 		state.hsCtx.earlyData = append(state.hsCtx.earlyData, pt.fragment...)
+		state.hsCtx.hIn.conn.Unlock()
 	}
 
 	hm, alert := hr.ReadMessage()
@@ -848,6 +1340,7 @@ func (state serverStateWaitEOED) Next(hr handshakeMessageReader) (HandshakeState
 		clientTrafficSecret:          state.clientTrafficSecret,
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
+		psk:                          state.psk,
 	}
 	return waitFlight2, toSend, AlertNoAlert
 }
@@ -862,8 +1355,16 @@ type serverStateReadPastEarlyData struct {
 func (state serverStateReadPastEarlyData) Next(hr handshakeMessageReader) (HandshakeState, []HandshakeAction, Alert) {
 	for {
 		logf(logTypeHandshake, "Server reading past early data...")
-		// Scan past all records that fail to decrypt
-		_, err := state.hsCtx.hIn.conn.PeekRecordType(!state.hsCtx.hIn.nonblocking)
+		// Scan past all records that fail to decrypt, and the client's
+		// ChangeCipherSpec, which comes before its early data
+		t, err := state.hsCtx.hIn.conn.PeekRecordType(!state.hsCtx.hIn.nonblocking)
+		if err == nil && t == RecordTypeChangeCipherSpec {
+			if err := state.hsCtx.hIn.readChangeCipherSpecRecord(); err != nil {
+				logf(logTypeHandshake, "Server error reading ChangeCipherSpec: %v", err)
+				return nil, nil, AlertUnexpectedMessage
+			}
+			continue
+		}
 		if err == nil {
 			break
 		}
@@ -897,6 +1398,7 @@ type serverStateWaitFlight2 struct {
 	clientTrafficSecret          []byte
 	serverTrafficSecret          []byte
 	exporterSecret               []byte
+	psk                          *PreSharedKey
 }
 
 var _ HandshakeState = &serverStateWaitFlight2{}
@@ -935,6 +1437,13 @@ func (state serverStateWaitFlight2) Next(_ handshakeMessageReader) (HandshakeSta
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
 	}
+	if state.psk != nil {
+		// The client authenticated, if at all, in the handshake that issued
+		// the ticket
+		nextState.peerCertificates = state.psk.PeerCertificates
+		nextState.verifiedChains = state.psk.VerifiedChains
+		nextState.peerPublicKey = state.psk.PeerPublicKey
+	}
 	return nextState, nil, AlertNoAlert
 }
 
@@ -962,15 +1471,15 @@ func (state serverStateWaitCert) Next(hr handshakeMessageReader) (HandshakeState
 	if alert != AlertNoAlert {
 		return nil, nil, alert
 	}
-	if hm == nil || hm.msgType != HandshakeTypeCertificate {
+	if hm == nil || (hm.msgType != HandshakeTypeCertificate && hm.msgType != HandshakeTypeCompressedCertificate) {
 		logf(logTypeHandshake, "[ServerStateWaitCert] Unexpected message")
 		return nil, nil, AlertUnexpectedMessage
 	}
 
-	cert := &CertificateBody{}
-	if err := safeUnmarshal(cert, hm.body); err != nil {
-		logf(logTypeHandshake, "[ServerStateWaitCert] Unexpected message")
-		return nil, nil, AlertDecodeError
+	cert, alert := readCertificateMessage(hm, state.Params.ClientCertificateType, state.Config.CertificateCompressors)
+	if alert != AlertNoAlert {
+		logf(logTypeHandshake, "[ServerStateWaitCert] Error reading certificate")
+		return nil, nil, alert
 	}
 
 	state.handshakeHash.Write(hm.Marshal())
@@ -978,6 +1487,12 @@ func (state serverStateWaitCert) Next(hr handshakeMessageReader) (HandshakeState
 	if len(cert.CertificateList) == 0 {
 		logf(logTypeHandshake, "[ServerStateWaitCert] WARNING client did not provide a certificate")
 
+		clientAuth := state.Config.clientAuth()
+		if clientAuth == RequireAnyClientCert || clientAuth == RequireAndVerifyClientCert {
+			logf(logTypeHandshake, "[ServerStateWaitCert] Client certificate required")
+			return nil, nil, AlertCertificateRequired
+		}
+
 		logf(logTypeHandshake, "[ServerStateWaitCert] -> [ServerStateWaitFinished]")
 		nextState := serverStateWaitFinished{
 			Params:                       state.Params,
@@ -1049,28 +1564,41 @@ func (state serverStateWaitCV) Next(hr handshakeMessageReader) (HandshakeState,
 		return nil, nil, AlertDecodeError
 	}
 
-	rawCerts := make([][]byte, len(state.clientCertificate.CertificateList))
-	certs := make([]*x509.Certificate, len(state.clientCertificate.CertificateList))
-	for i, certEntry := range state.clientCertificate.CertificateList {
-		certs[i] = certEntry.CertData
-		rawCerts[i] = certEntry.CertData.Raw
+	// A raw public key is authenticated by matching one of the pinned keys,
+	// in place of building a chain
+	usingRawPublicKey := state.Params.ClientCertificateType == CertificateTypeRawPublicKey
+	var clientPublicKey, peerPublicKey crypto.PublicKey
+	var certs []*x509.Certificate
+	if usingRawPublicKey {
+		var err error
+		peerPublicKey, err = verifyPinnedPublicKey(state.clientCertificate.CertificateList[0].RawPublicKey, state.Config.PeerPublicKeys)
+		if err != nil {
+			logf(logTypeHandshake, "[ServerStateWaitCV] Raw public key verification failed: %s", err)
+			return nil, nil, AlertBadCertificate
+		}
+		clientPublicKey = peerPublicKey
+	} else {
+		certs = make([]*x509.Certificate, len(state.clientCertificate.CertificateList))
+		for i, certEntry := range state.clientCertificate.CertificateList {
+			certs[i] = certEntry.CertData
+		}
+		clientPublicKey = certs[0].PublicKey
 	}
 
 	// Verify client signature over handshake hash
 	hcv := state.handshakeHash.Sum(nil)
 	logf(logTypeHandshake, "Handshake Hash to be verified: [%d] %x", len(hcv), hcv)
 
-	clientPublicKey := state.clientCertificate.CertificateList[0].CertData.PublicKey
 	if err := certVerify.Verify(clientPublicKey, hcv); err != nil {
 		logf(logTypeHandshake, "[ServerStateWaitCV] Failure in client auth verification [%v]", err)
 		return nil, nil, AlertHandshakeFailure
 	}
 
-	if state.Config.VerifyPeerCertificate != nil {
-		// TODO(#171): pass in the verified chains, once we support different client auth types
-		if err := state.Config.VerifyPeerCertificate(rawCerts, nil); err != nil {
-			logf(logTypeHandshake, "[ServerStateWaitCV] Application rejected client certificate: %s", err)
-			return nil, nil, AlertBadCertificate
+	var verifiedChains [][]*x509.Certificate
+	if !usingRawPublicKey {
+		verifiedChains, alert = verifyClientCertificates(state.Config, certs)
+		if alert != AlertNoAlert {
+			return nil, nil, alert
 		}
 	}
 
@@ -1089,11 +1617,54 @@ func (state serverStateWaitCV) Next(hr handshakeMessageReader) (HandshakeState,
 		serverTrafficSecret:          state.serverTrafficSecret,
 		exporterSecret:               state.exporterSecret,
 		peerCertificates:             certs,
-		verifiedChains:               nil, // TODO(#171): set this value
+		verifiedChains:               verifiedChains,
+		peerPublicKey:                peerPublicKey,
 	}
 	return nextState, nil, AlertNoAlert
 }
 
+// Verifies the client's certificate chain, if the Config's ClientAuth policy
+// calls for it, and passes it to VerifyPeerCertificate
+func verifyClientCertificates(config *Config, certs []*x509.Certificate) ([][]*x509.Certificate, Alert) {
+	rawCerts := make([][]byte, len(certs))
+	for i, cert := range certs {
+		rawCerts[i] = cert.Raw
+	}
+
+	var verifiedChains [][]*x509.Certificate
+	clientAuth := config.clientAuth()
+	if clientAuth == VerifyClientCertIfGiven || clientAuth == RequireAndVerifyClientCert {
+		opts := x509.VerifyOptions{
+			Roots:         config.ClientCAs,
+			CurrentTime:   config.time(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+
+		for i, cert := range certs {
+			if i == 0 {
+				continue
+			}
+			opts.Intermediates.AddCert(cert)
+		}
+		var err error
+		verifiedChains, err = certs[0].Verify(opts)
+		if err != nil {
+			logf(logTypeHandshake, "Certificate verification failed: %s", err)
+			return nil, AlertBadCertificate
+		}
+	}
+
+	if config.VerifyPeerCertificate != nil {
+		if err := config.VerifyPeerCertificate(rawCerts, verifiedChains); err != nil {
+			logf(logTypeHandshake, "Application rejected client certificate: %s", err)
+			return nil, AlertBadCertificate
+		}
+	}
+
+	return verifiedChains, AlertNoAlert
+}
+
 type serverStateWaitFinished struct {
 	Params       ConnectionParameters
 	hsCtx        *HandshakeContext
@@ -1103,6 +1674,7 @@ type serverStateWaitFinished struct {
 	clientHandshakeTrafficSecret []byte
 	peerCertificates             []*x509.Certificate
 	verifiedChains               [][]*x509.Certificate
+	peerPublicKey                crypto.PublicKey
 
 	handshakeHash       hash.Hash
 	clientTrafficSecret []byte
@@ -1168,6 +1740,7 @@ func (state serverStateWaitFinished) Next(hr handshakeMessageReader) (HandshakeS
 		serverTrafficSecret: state.serverTrafficSecret,
 		exporterSecret:      state.exporterSecret,
 		peerCertificates:    state.peerCertificates,
+		peerPublicKey:       state.peerPublicKey,
 		verifiedChains:      state.verifiedChains,
 	}
 	toSend := []HandshakeAction{
@@ -0,0 +1,129 @@
+package mint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// A ClientSessionCache stores the session tickets a client receives, so that
+// later connections to the same server can resume.  Unlike the server's
+// PreSharedKeyCache, it can hold several tickets under one key.
+type ClientSessionCache interface {
+	// Get returns the tickets stored under the key, in any order
+	Get(key string) []PreSharedKey
+	// Put stores a new ticket under the key
+	Put(key string, psk PreSharedKey)
+}
+
+// A ClientSessionCache can also implement ClientSessionRemover, so that a
+// ticket isn't offered again once a server has accepted it.  Tickets are
+// meant to be used only once (RFC 8446, Appendix C.4).
+type ClientSessionRemover interface {
+	// Remove deletes the ticket with the given identity from under the key
+	Remove(key string, identity []byte)
+}
+
+const defaultTicketsPerSession = 4
+
+// ClientSessionMapCache is an in-memory ClientSessionCache that keeps the
+// most recently received tickets for each key, dropping ones that have
+// expired or been used.
+type ClientSessionMapCache struct {
+	mutex         sync.Mutex
+	ticketsPerKey int
+	tickets       map[string][]PreSharedKey
+}
+
+// NewClientSessionMapCache returns a cache that keeps at most ticketsPerKey
+// tickets for each key, or a default number if ticketsPerKey is not
+// positive.
+func NewClientSessionMapCache(ticketsPerKey int) *ClientSessionMapCache {
+	if ticketsPerKey <= 0 {
+		ticketsPerKey = defaultTicketsPerSession
+	}
+	return &ClientSessionMapCache{
+		ticketsPerKey: ticketsPerKey,
+		tickets:       map[string][]PreSharedKey{},
+	}
+}
+
+func (cache *ClientSessionMapCache) Get(key string) []PreSharedKey {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return append([]PreSharedKey{}, cache.tickets[key]...)
+}
+
+func (cache *ClientSessionMapCache) Put(key string, psk PreSharedKey) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	tickets := []PreSharedKey{}
+	for _, ticket := range append(cache.tickets[key], psk) {
+		if !ticket.expired(now) {
+			tickets = append(tickets, ticket)
+		}
+	}
+	if len(tickets) > cache.ticketsPerKey {
+		tickets = tickets[len(tickets)-cache.ticketsPerKey:]
+	}
+	cache.tickets[key] = tickets
+}
+
+func (cache *ClientSessionMapCache) Remove(key string, identity []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.tickets[key] = removeTicket(cache.tickets[key], identity)
+}
+
+// Returns the tickets other than the one with the given identity
+func removeTicket(tickets []PreSharedKey, identity []byte) []PreSharedKey {
+	remaining := []PreSharedKey{}
+	for _, ticket := range tickets {
+		if !bytes.Equal(ticket.Identity, identity) {
+			remaining = append(remaining, ticket)
+		}
+	}
+	return remaining
+}
+
+func (c *Conn) sessionCacheKey() string {
+	var addr net.Addr
+	if c.conn != nil {
+		addr = c.conn.RemoteAddr()
+	}
+	return clientSessionCacheKey(c.config, addr)
+}
+
+// The key a client stores tickets under.  A ticket is only offered to the
+// same server name at the same address, with the same ALPN offer and the
+// same configured client certificate as the connection that received it.
+func clientSessionCacheKey(config *Config, addr net.Addr) string {
+	var address string
+	if addr != nil {
+		address = addr.String()
+	}
+
+	// A certificate chosen by GetClientCertificate is not known until the
+	// server asks for it, so only the static certificate is part of the key
+	var clientIdentity []byte
+	if len(config.Certificates) > 0 {
+		cert := config.Certificates[0]
+		if len(cert.Chain) > 0 {
+			digest := sha256.Sum256(cert.Chain[0].Raw)
+			clientIdentity = digest[:]
+		} else if cert.PrivateKey != nil {
+			// A raw public key
+			if spki, err := cert.rawPublicKey(); err == nil {
+				digest := sha256.Sum256(spki)
+				clientIdentity = digest[:]
+			}
+		}
+	}
+
+	return fmt.Sprintf("%q %q %q %x", config.ServerName, address, config.NextProtos, clientIdentity)
+}
@@ -0,0 +1,82 @@
+package mint
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientSessionMapCache(t *testing.T) {
+	cache := NewClientSessionMapCache(2)
+	tickets := []PreSharedKey{
+		{Identity: []byte{1}},
+		{Identity: []byte{2}},
+		{Identity: []byte{3}},
+	}
+
+	assertEquals(t, len(cache.Get("a")), 0)
+
+	// Several tickets are kept per key, up to the limit
+	cache.Put("a", tickets[0])
+	cache.Put("a", tickets[1])
+	assertDeepEquals(t, cache.Get("a"), tickets[:2])
+
+	// The oldest ticket is dropped when the limit is reached
+	cache.Put("a", tickets[2])
+	assertDeepEquals(t, cache.Get("a"), tickets[1:])
+
+	// Keys are independent
+	cache.Put("b", tickets[0])
+	assertDeepEquals(t, cache.Get("b"), tickets[:1])
+	assertDeepEquals(t, cache.Get("a"), tickets[1:])
+
+	// A ticket is removed once it has been used
+	cache.Remove("a", tickets[1].Identity)
+	assertDeepEquals(t, cache.Get("a"), tickets[2:])
+	cache.Remove("a", []byte{9})
+	assertDeepEquals(t, cache.Get("a"), tickets[2:])
+
+	// Expired tickets are dropped when a new one is stored
+	expired := PreSharedKey{Identity: []byte{4}, ExpiresAt: time.Now().Add(-time.Second)}
+	cache.Put("b", expired)
+	assertDeepEquals(t, cache.Get("b"), tickets[:1])
+
+	// A non-positive limit gives the default
+	assertEquals(t, NewClientSessionMapCache(0).ticketsPerKey, defaultTicketsPerSession)
+}
+
+func TestClientSessionCacheKey(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443}
+	otherPort := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8443}
+
+	base := &Config{ServerName: serverName, NextProtos: []string{"h2"}}
+	key := clientSessionCacheKey(base, addr)
+	assertEquals(t, clientSessionCacheKey(base.Clone(), addr), key)
+
+	otherName := base.Clone()
+	otherName.ServerName = "other.example.com"
+
+	otherALPN := base.Clone()
+	otherALPN.NextProtos = []string{"http/1.1"}
+
+	withCert := base.Clone()
+	withCert.Certificates = clientCertificates
+
+	withOtherCert := base.Clone()
+	withOtherCert.Certificates = certificates
+
+	keys := []string{
+		key,
+		clientSessionCacheKey(base, otherPort),
+		clientSessionCacheKey(base, nil),
+		clientSessionCacheKey(otherName, addr),
+		clientSessionCacheKey(otherALPN, addr),
+		clientSessionCacheKey(withCert, addr),
+		clientSessionCacheKey(withOtherCert, addr),
+	}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		assertTrue(t, !seen[k], "Duplicate session cache key")
+		seen[k] = true
+	}
+}
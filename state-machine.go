@@ -1,6 +1,7 @@
 package mint
 
 import (
+	"crypto"
 	"crypto/x509"
 	"time"
 )
@@ -17,6 +18,8 @@ type SendQueuedHandshake struct{}
 
 type SendEarlyData struct{}
 
+type SendChangeCipherSpec struct{}
+
 type RekeyIn struct {
 	epoch  Epoch
 	KeySet KeySet
@@ -50,6 +53,9 @@ type AppExtensionHandler interface {
 type ConnectionOptions struct {
 	ServerName string
 	NextProtos []string
+
+	// The key for the client's ClientSessionCache
+	SessionCacheKey string
 }
 
 // ConnectionParameters objects represent the parameters negotiated for a
@@ -62,9 +68,17 @@ type ConnectionParameters struct {
 	RejectedEarlyData      bool
 	UsingClientAuth        bool
 
+	Version     uint16
 	CipherSuite CipherSuite
 	ServerName  string
 	NextProto   string
+
+	ClientCertificateType CertificateType
+	ServerCertificateType CertificateType
+
+	UsingECH        bool
+	RejectedECH     bool
+	ECHRetryConfigs []byte
 }
 
 // Working state for the handshake.
@@ -76,6 +90,8 @@ type HandshakeContext struct {
 	hIn, hOut         *HandshakeLayer
 	waitingNextFlight bool
 	earlyData         []byte
+	earlyDataReceived uint64
+	sentCCS           bool
 }
 
 func (hc *HandshakeContext) SetVersion(version uint16) {
@@ -87,6 +103,18 @@ func (hc *HandshakeContext) SetVersion(version uint16) {
 	}
 }
 
+// In middlebox compatibility mode, each side sends a single ChangeCipherSpec
+// before its first encrypted handshake record, so that a TLS 1.3 handshake
+// looks like a TLS 1.2 resumption (RFC 8446, Appendix D.4).  DTLS doesn't do
+// this.
+func (hc *HandshakeContext) compatibilityCCS() []HandshakeAction {
+	if hc.hOut.datagram || hc.sentCCS {
+		return nil
+	}
+	hc.sentCCS = true
+	return []HandshakeAction{SendChangeCipherSpec{}}
+}
+
 // stateConnected is symmetric between client and server
 type stateConnected struct {
 	Params              ConnectionParameters
@@ -99,6 +127,15 @@ type stateConnected struct {
 	exporterSecret      []byte
 	peerCertificates    []*x509.Certificate
 	verifiedChains      [][]*x509.Certificate
+	ocspResponse        []byte
+	peerPublicKey       crypto.PublicKey
+	delegatedCredential *DelegatedCredential
+
+	signedCertificateTimestamps [][]byte
+
+	// For TLS 1.2, the exporter secret is the master secret, which is
+	// combined with the hello randoms
+	helloRandoms []byte
 }
 
 var _ HandshakeState = &stateConnected{}
@@ -136,17 +173,27 @@ func (state *stateConnected) KeyUpdate(request KeyUpdateRequest) ([]HandshakeAct
 	return toSend, AlertNoAlert
 }
 
-func (state *stateConnected) NewSessionTicket(length int, lifetime, earlyDataLifetime uint32) ([]HandshakeAction, Alert) {
-	tkt, err := NewSessionTicket(length, lifetime)
+func (state *stateConnected) NewSessionTicket(length int, opts SessionTicketOptions) ([]HandshakeAction, Alert) {
+	tkt, err := NewSessionTicket(length, opts.Lifetime)
 	if err != nil {
 		logf(logTypeHandshake, "[StateConnected] Error generating NewSessionTicket: %v", err)
 		return nil, AlertInternalError
 	}
 
-	err = tkt.Extensions.Add(&TicketEarlyDataInfoExtension{earlyDataLifetime})
-	if err != nil {
-		logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
-		return nil, AlertInternalError
+	if opts.MaxEarlyDataSize > 0 {
+		err = tkt.Extensions.Add(&TicketEarlyDataInfoExtension{opts.MaxEarlyDataSize})
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
+			return nil, AlertInternalError
+		}
+	}
+
+	for _, ext := range opts.Extensions {
+		err = tkt.Extensions.Add(ext)
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error adding extension to NewSessionTicket: %v", err)
+			return nil, AlertInternalError
+		}
 	}
 
 	resumptionKey := HkdfExpandLabel(state.cryptoParams.Hash, state.resumptionSecret,
@@ -161,6 +208,12 @@ func (state *stateConnected) NewSessionTicket(length int, lifetime, earlyDataLif
 		ReceivedAt:   time.Now(),
 		ExpiresAt:    time.Now().Add(time.Duration(tkt.TicketLifetime) * time.Second),
 		TicketAgeAdd: tkt.TicketAgeAdd,
+
+		MaxEarlyDataSize: opts.MaxEarlyDataSize,
+
+		PeerCertificates: state.peerCertificates,
+		VerifiedChains:   state.verifiedChains,
+		PeerPublicKey:    state.peerPublicKey,
 	}
 
 	tktm, err := state.hsCtx.hOut.HandshakeMessageFromBody(tkt)
@@ -188,6 +241,17 @@ func (state stateConnected) ProcessMessage(hm *HandshakeMessage) (HandshakeState
 		return nil, nil, AlertUnexpectedMessage
 	}
 
+	// TLS 1.2 has no post-handshake messages, and renegotiation is refused by
+	// ignoring HelloRequest (RFC 5246, Section 7.4.1.1)
+	if state.Params.Version == tls12Version {
+		if state.isClient && hm.msgType == HandshakeTypeHelloRequest && len(hm.body) == 0 {
+			logf(logTypeHandshake, "[StateConnected] Ignoring HelloRequest")
+			return state, nil, AlertNoAlert
+		}
+		logf(logTypeHandshake, "[StateConnected] Unexpected message type %v in TLS 1.2", hm.msgType)
+		return nil, nil, AlertUnexpectedMessage
+	}
+
 	bodyGeneric, err := hm.ToBody()
 	if err != nil {
 		logf(logTypeHandshake, "[StateConnected] Error decoding message: %v", err)
@@ -225,6 +289,13 @@ func (state stateConnected) ProcessMessage(hm *HandshakeMessage) (HandshakeState
 			return nil, nil, AlertUnexpectedMessage
 		}
 
+		var earlyDataInfo TicketEarlyDataInfoExtension
+		_, err := body.Extensions.Find(&earlyDataInfo)
+		if err != nil {
+			logf(logTypeHandshake, "[StateConnected] Error decoding early data info: %v", err)
+			return nil, nil, AlertDecodeError
+		}
+
 		resumptionKey := HkdfExpandLabel(state.cryptoParams.Hash, state.resumptionSecret,
 			labelResumption, body.TicketNonce, state.cryptoParams.Hash.Size())
 		psk := PreSharedKey{
@@ -236,6 +307,12 @@ func (state stateConnected) ProcessMessage(hm *HandshakeMessage) (HandshakeState
 			ReceivedAt:   time.Now(),
 			ExpiresAt:    time.Now().Add(time.Duration(body.TicketLifetime) * time.Second),
 			TicketAgeAdd: body.TicketAgeAdd,
+
+			MaxEarlyDataSize: earlyDataInfo.MaxEarlyDataSize,
+
+			PeerCertificates: state.peerCertificates,
+			VerifiedChains:   state.verifiedChains,
+			PeerPublicKey:    state.peerPublicKey,
 		}
 
 		toSend := []HandshakeAction{StorePSK{psk}}
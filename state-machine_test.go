@@ -1,6 +1,7 @@
 package mint
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"reflect"
 	"testing"
@@ -461,3 +462,35 @@ func TestStateMachineIntegration(t *testing.T) {
 		})
 	}
 }
+
+func TestClientEarlyDataUnderSecondPSK(t *testing.T) {
+	ee := &EncryptedExtensionsBody{}
+	assertNotError(t, ee.Extensions.Add(&EarlyDataExtension{}), "Failed to add early_data")
+	body, err := ee.Marshal()
+	assertNotError(t, err, "Failed to marshal EncryptedExtensions")
+	eeMessage := &HandshakeMessage{
+		msgType: HandshakeTypeEncryptedExtensions,
+		body:    body,
+		length:  uint32(len(body)),
+	}
+
+	// The server can only accept early data under the first PSK offered
+	for _, selectedIdentity := range []uint16{0, 1} {
+		state := clientStateWaitEE{
+			Config:           &Config{},
+			Params:           ConnectionParameters{UsingPSK: true, ClientSendingEarlyData: true},
+			cryptoParams:     cipherSuiteMap[TLS_AES_128_GCM_SHA256],
+			handshakeHash:    sha256.New(),
+			selectedPSK:      &psk,
+			selectedIdentity: selectedIdentity,
+		}
+
+		hr := &mockHandshakeMessageReader{queue: []*HandshakeMessage{eeMessage}}
+		_, _, alert := state.Next(hr)
+		if selectedIdentity == 0 {
+			assertEquals(t, alert, AlertNoAlert)
+		} else {
+			assertEquals(t, alert, AlertIllegalParameter)
+		}
+	}
+}
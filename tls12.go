@@ -0,0 +1,426 @@
+package mint
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/bifurcation/mint/syntax"
+)
+
+// TLS 1.2 (RFC 5246) is supported as a fallback for peers that don't speak
+// TLS 1.3, with ECDHE key exchange and AEAD ciphers only.  There is no
+// session resumption or renegotiation.
+
+const (
+	labelMasterSecret         = "master secret"
+	labelExtendedMasterSecret = "extended master secret"
+	labelKeyExpansion         = "key expansion"
+	labelClientFinishedTLS12  = "client finished"
+	labelServerFinishedTLS12  = "server finished"
+
+	masterSecretLenTLS12 = 48
+	verifyDataLenTLS12   = 12
+
+	curveTypeNamedCurve     uint8 = 3 // ECCurveType named_curve
+	pointFormatUncompressed uint8 = 0 // ECPointFormat uncompressed
+	certStatusTypeOCSP      uint8 = 1 // CertificateStatusType ocsp
+
+	// ClientCertificateType
+	certTypeRSASign   uint8 = 1
+	certTypeECDSASign uint8 = 64
+
+	// TLS_EMPTY_RENEGOTIATION_INFO_SCSV (RFC 5746)
+	scsvRenegotiationInfo CipherSuite = 0x00ff
+)
+
+type tls12CipherSuite struct {
+	params CipherSuiteParams
+	ecdsa  bool // Whether the server authenticates with ECDSA, or RSA
+}
+
+// The IV of a TLS 1.2 GCM suite is the four-byte salt from the key block
+var tls12CipherSuiteMap = map[CipherSuite]tls12CipherSuite{
+	TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: {
+		params: CipherSuiteParams{
+			Suite:      TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			Cipher:     newAESGCM,
+			Hash:       crypto.SHA256,
+			KeyLengths: map[string]int{labelForKey: 16, labelForIV: 4},
+		},
+		ecdsa: true,
+	},
+	TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: {
+		params: CipherSuiteParams{
+			Suite:      TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			Cipher:     newAESGCM,
+			Hash:       crypto.SHA384,
+			KeyLengths: map[string]int{labelForKey: 32, labelForIV: 4},
+		},
+		ecdsa: true,
+	},
+	TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256: {
+		params: CipherSuiteParams{
+			Suite:      TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			Cipher:     newAESGCM,
+			Hash:       crypto.SHA256,
+			KeyLengths: map[string]int{labelForKey: 16, labelForIV: 4},
+		},
+	},
+	TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384: {
+		params: CipherSuiteParams{
+			Suite:      TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			Cipher:     newAESGCM,
+			Hash:       crypto.SHA384,
+			KeyLengths: map[string]int{labelForKey: 32, labelForIV: 4},
+		},
+	},
+}
+
+// Whether a certificate's key can authenticate the server for a suite
+func (suite tls12CipherSuite) validForKey(pub crypto.PublicKey) bool {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return suite.ecdsa
+	case *rsa.PublicKey:
+		return !suite.ecdsa
+	default:
+		return false
+	}
+}
+
+func isRSAKey(key crypto.Signer) bool {
+	if key == nil {
+		return false
+	}
+	_, ok := key.Public().(*rsa.PublicKey)
+	return ok
+}
+
+// TLS 1.2 signatures can use any of the schemes of TLS 1.3, plus PKCS#1 v1.5,
+// but never SHA-1
+func signatureSchemesTLS12(schemes []SignatureScheme) []SignatureScheme {
+	allowed := []SignatureScheme{}
+	for _, scheme := range schemes {
+		hash, ok := hashMap[scheme]
+		if !ok || hash == crypto.SHA1 {
+			continue
+		}
+		allowed = append(allowed, scheme)
+	}
+	return allowed
+}
+
+// Only elliptic curve groups can be used for ECDHE
+func groupsTLS12(groups []NamedGroup) []NamedGroup {
+	allowed := []NamedGroup{}
+	for _, group := range groups {
+		switch group {
+		case P256, P384, P521, X25519:
+			allowed = append(allowed, group)
+		}
+	}
+	return allowed
+}
+
+// P_hash from RFC 5246, Section 5, which is the PRF with the suite's hash
+func prfTLS12(hash crypto.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	labelAndSeed := append([]byte(label), seed...)
+
+	out := make([]byte, 0, length)
+	mac := hmac.New(hash.New, secret)
+	a := labelAndSeed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(labelAndSeed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
+
+func transcriptHashTLS12(params CipherSuiteParams, transcript []byte) []byte {
+	h := params.Hash.New()
+	h.Write(transcript)
+	return h.Sum(nil)
+}
+
+// With the extended master secret (RFC 7627), the master secret covers the
+// transcript up to the ClientKeyExchange, and not just the hello randoms
+func masterSecretTLS12(params CipherSuiteParams, preMasterSecret []byte, extendedMasterSecret bool, transcript, helloRandoms []byte) []byte {
+	if extendedMasterSecret {
+		return prfTLS12(params.Hash, preMasterSecret, labelExtendedMasterSecret,
+			transcriptHashTLS12(params, transcript), masterSecretLenTLS12)
+	}
+	return prfTLS12(params.Hash, preMasterSecret, labelMasterSecret, helloRandoms, masterSecretLenTLS12)
+}
+
+// An AEAD suite takes the client and server keys from the key block, then
+// their IVs; there are no MAC keys
+func makeTrafficKeysTLS12(params CipherSuiteParams, masterSecret []byte, clientRandom, serverRandom [32]byte) (client KeySet, server KeySet) {
+	keyLen := params.KeyLengths[labelForKey]
+	ivLen := params.KeyLengths[labelForIV]
+
+	seed := append(serverRandom[:], clientRandom[:]...)
+	keyBlock := prfTLS12(params.Hash, masterSecret, labelKeyExpansion, seed, 2*keyLen+2*ivLen)
+	logf(logTypeCrypto, "key block: [%d] %x", len(keyBlock), keyBlock)
+
+	client = KeySet{
+		Cipher: params.Cipher,
+		Keys: map[string][]byte{
+			labelForKey: keyBlock[:keyLen],
+			labelForIV:  keyBlock[2*keyLen : 2*keyLen+ivLen],
+		},
+		TLS12: true,
+	}
+	server = KeySet{
+		Cipher: params.Cipher,
+		Keys: map[string][]byte{
+			labelForKey: keyBlock[keyLen : 2*keyLen],
+			labelForIV:  keyBlock[2*keyLen+ivLen:],
+		},
+		TLS12: true,
+	}
+	return client, server
+}
+
+func computeFinishedDataTLS12(params CipherSuiteParams, masterSecret []byte, label string, transcript []byte) []byte {
+	return prfTLS12(params.Hash, masterSecret, label, transcriptHashTLS12(params, transcript), verifyDataLenTLS12)
+}
+
+// The RFC 5705 exporter, which is only allowed if the master secret is bound
+// to the handshake by the extended master secret (RFC 7627, Section 5.4).
+// Unlike in TLS 1.3, a nil context is distinct from an empty one.
+func (state stateConnected) exportKeyingMaterialTLS12(label string, context []byte, length int) ([]byte, error) {
+	if state.exporterSecret == nil {
+		return nil, fmt.Errorf("Cannot compute exporter without extended master secret")
+	}
+
+	seed := append([]byte{}, state.helloRandoms...)
+	if context != nil {
+		if len(context) >= 1<<16 {
+			return nil, fmt.Errorf("Exporter context too long")
+		}
+		seed = append(seed, byte(len(context)>>8), byte(len(context)))
+		seed = append(seed, context...)
+	}
+	return prfTLS12(state.cryptoParams.Hash, state.exporterSecret, label, seed, length), nil
+}
+
+// struct {
+//     ECCurveType curve_type = named_curve;
+//     NamedGroup namedcurve;
+//     opaque point<1..2^8-1>;
+//     SignatureAndHashAlgorithm algorithm;
+//     opaque signature<0..2^16-1>;
+// } ServerKeyExchange;
+type ServerKeyExchangeBody struct {
+	CurveType uint8
+	Group     NamedGroup
+	Point     []byte `tls:"head=1,min=1"`
+	Algorithm SignatureScheme
+	Signature []byte `tls:"head=2"`
+}
+
+func (ske ServerKeyExchangeBody) Type() HandshakeType {
+	return HandshakeTypeServerKeyExchange
+}
+
+func (ske ServerKeyExchangeBody) Marshal() ([]byte, error) {
+	return syntax.Marshal(ske)
+}
+
+func (ske *ServerKeyExchangeBody) Unmarshal(data []byte) (int, error) {
+	read, err := syntax.Unmarshal(data, ske)
+	if err != nil {
+		return 0, err
+	}
+	if ske.CurveType != curveTypeNamedCurve {
+		return 0, fmt.Errorf("tls.serverkeyexchange: Unsupported curve type [%d]", ske.CurveType)
+	}
+	return read, nil
+}
+
+// The server signs the hello randoms followed by the ECDH parameters
+func (ske ServerKeyExchangeBody) signatureInput(clientRandom, serverRandom [32]byte) []byte {
+	data := append(clientRandom[:], serverRandom[:]...)
+	data = append(data, ske.CurveType, byte(ske.Group>>8), byte(ske.Group), byte(len(ske.Point)))
+	return append(data, ske.Point...)
+}
+
+// struct {} ServerHelloDone;
+type ServerHelloDoneBody struct{}
+
+func (shd ServerHelloDoneBody) Type() HandshakeType {
+	return HandshakeTypeServerHelloDone
+}
+
+func (shd ServerHelloDoneBody) Marshal() ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (shd *ServerHelloDoneBody) Unmarshal(data []byte) (int, error) {
+	return 0, nil
+}
+
+// struct {
+//     opaque point<1..2^8-1>;
+// } ClientKeyExchange;
+type ClientKeyExchangeBody struct {
+	Point []byte `tls:"head=1,min=1"`
+}
+
+func (cke ClientKeyExchangeBody) Type() HandshakeType {
+	return HandshakeTypeClientKeyExchange
+}
+
+func (cke ClientKeyExchangeBody) Marshal() ([]byte, error) {
+	return syntax.Marshal(cke)
+}
+
+func (cke *ClientKeyExchangeBody) Unmarshal(data []byte) (int, error) {
+	return syntax.Unmarshal(data, cke)
+}
+
+// struct {
+//     CertificateStatusType status_type = ocsp;
+//     opaque OCSPResponse<1..2^24-1>;
+// } CertificateStatus;
+type CertificateStatusBody struct {
+	StatusType   uint8
+	OCSPResponse []byte `tls:"head=3,min=1"`
+}
+
+func (cs CertificateStatusBody) Type() HandshakeType {
+	return HandshakeTypeCertificateStatus
+}
+
+func (cs CertificateStatusBody) Marshal() ([]byte, error) {
+	return syntax.Marshal(cs)
+}
+
+func (cs *CertificateStatusBody) Unmarshal(data []byte) (int, error) {
+	read, err := syntax.Unmarshal(data, cs)
+	if err != nil {
+		return 0, err
+	}
+	if cs.StatusType != certStatusTypeOCSP {
+		return 0, fmt.Errorf("tls.certificatestatus: Unsupported status type [%d]", cs.StatusType)
+	}
+	return read, nil
+}
+
+// opaque ASN1Cert<1..2^24-1>;
+//
+// struct {
+//     ASN1Cert certificate_list<0..2^24-1>;
+// } Certificate;
+type certificateBodyTLS12 struct {
+	Certificates []*x509.Certificate
+}
+
+type asn1CertInner struct {
+	CertData []byte `tls:"head=3,min=1"`
+}
+
+type certificateBodyTLS12Inner struct {
+	CertificateList []asn1CertInner `tls:"head=3"`
+}
+
+func (c certificateBodyTLS12) Type() HandshakeType {
+	return HandshakeTypeCertificate
+}
+
+func (c certificateBodyTLS12) Marshal() ([]byte, error) {
+	inner := certificateBodyTLS12Inner{make([]asn1CertInner, len(c.Certificates))}
+	for i, cert := range c.Certificates {
+		inner.CertificateList[i] = asn1CertInner{cert.Raw}
+	}
+	return syntax.Marshal(inner)
+}
+
+func (c *certificateBodyTLS12) Unmarshal(data []byte) (int, error) {
+	var inner certificateBodyTLS12Inner
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	c.Certificates = make([]*x509.Certificate, len(inner.CertificateList))
+	for i, entry := range inner.CertificateList {
+		c.Certificates[i], err = x509.ParseCertificate(entry.CertData)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return read, nil
+}
+
+// struct {
+//     ClientCertificateType certificate_types<1..2^8-1>;
+//     SignatureAndHashAlgorithm supported_signature_algorithms<2..2^16-2>;
+//     DistinguishedName certificate_authorities<0..2^16-1>;
+// } CertificateRequest;
+type certificateRequestBodyTLS12 struct {
+	CertificateTypes []uint8
+	SignatureSchemes []SignatureScheme
+	Authorities      [][]byte
+}
+
+type certificateRequestBodyTLS12Inner struct {
+	CertificateTypes []uint8                  `tls:"head=1,min=1"`
+	SignatureSchemes []SignatureScheme        `tls:"head=2,min=2"`
+	Authorities      []distinguishedNameInner `tls:"head=2"`
+}
+
+func (cr certificateRequestBodyTLS12) Type() HandshakeType {
+	return HandshakeTypeCertificateRequest
+}
+
+func (cr certificateRequestBodyTLS12) Marshal() ([]byte, error) {
+	inner := certificateRequestBodyTLS12Inner{
+		CertificateTypes: cr.CertificateTypes,
+		SignatureSchemes: cr.SignatureSchemes,
+		Authorities:      make([]distinguishedNameInner, len(cr.Authorities)),
+	}
+	for i, name := range cr.Authorities {
+		inner.Authorities[i] = distinguishedNameInner{name}
+	}
+	return syntax.Marshal(inner)
+}
+
+func (cr *certificateRequestBodyTLS12) Unmarshal(data []byte) (int, error) {
+	var inner certificateRequestBodyTLS12Inner
+	read, err := syntax.Unmarshal(data, &inner)
+	if err != nil {
+		return 0, err
+	}
+
+	cr.CertificateTypes = inner.CertificateTypes
+	cr.SignatureSchemes = inner.SignatureSchemes
+	cr.Authorities = make([][]byte, len(inner.Authorities))
+	for i, name := range inner.Authorities {
+		cr.Authorities[i] = name.Name
+	}
+	return read, nil
+}
+
+// Whether a client certificate's key is one of the types the server asked for
+func (cr certificateRequestBodyTLS12) allowsKey(key crypto.Signer) bool {
+	for _, certType := range cr.CertificateTypes {
+		switch {
+		case certType == certTypeECDSASign && isECDSAKey(key):
+			return true
+		case certType == certTypeRSASign && isRSAKey(key):
+			return true
+		}
+	}
+	return false
+}
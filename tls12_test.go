@@ -0,0 +1,198 @@
+package mint
+
+import (
+	"crypto"
+	"crypto/x509"
+	"testing"
+)
+
+var (
+	// TLS 1.2 PRF test vector for SHA-256
+	prfSecretHex = "9bbe436ba940f017b17652849a71db35"
+	prfSeedHex   = "a0ba9f936cda311827a6f796ffd5198c"
+	prfLabel     = "test label"
+	prfOutputHex = "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+
+	skeValidIn = ServerKeyExchangeBody{
+		CurveType: curveTypeNamedCurve,
+		Group:     P256,
+		Point:     []byte{0x04, 0x01, 0x02, 0x03},
+		Algorithm: ECDSA_P256_SHA256,
+		Signature: []byte{0x05, 0x06},
+	}
+	skeValidHex = "03" + "0017" + "0404010203" + "0403" + "00020506"
+)
+
+func TestPRFTLS12(t *testing.T) {
+	out := prfTLS12(crypto.SHA256, unhex(prfSecretHex), prfLabel, unhex(prfSeedHex), len(unhex(prfOutputHex)))
+	assertByteEquals(t, out, unhex(prfOutputHex))
+}
+
+func TestTrafficKeysTLS12(t *testing.T) {
+	params := tls12CipherSuiteMap[TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384].params
+	master := make([]byte, masterSecretLenTLS12)
+	client, server := makeTrafficKeysTLS12(params, master, [32]byte{1}, [32]byte{2})
+
+	// Each side gets its own key and a four-byte IV from the key block
+	assertTrue(t, client.TLS12 && server.TLS12, "Keys not marked for TLS 1.2")
+	assertEquals(t, len(client.Keys[labelForKey]), 32)
+	assertEquals(t, len(client.Keys[labelForIV]), 4)
+	assertEquals(t, len(server.Keys[labelForKey]), 32)
+	assertEquals(t, len(server.Keys[labelForIV]), 4)
+	assertNotByteEquals(t, client.Keys[labelForKey], server.Keys[labelForKey])
+
+	// The extended master secret depends on the transcript, and the classic
+	// one on the hello randoms
+	pms := []byte{0x01, 0x02, 0x03}
+	ems1 := masterSecretTLS12(params, pms, true, []byte{0x01}, nil)
+	ems2 := masterSecretTLS12(params, pms, true, []byte{0x02}, nil)
+	assertNotByteEquals(t, ems1, ems2)
+	assertEquals(t, len(ems1), masterSecretLenTLS12)
+	ms1 := masterSecretTLS12(params, pms, false, []byte{0x01}, []byte{0x01})
+	ms2 := masterSecretTLS12(params, pms, false, []byte{0x02}, []byte{0x01})
+	assertByteEquals(t, ms1, ms2)
+}
+
+func TestSignatureSchemesTLS12(t *testing.T) {
+	schemes := []SignatureScheme{RSA_PKCS1_SHA1, ECDSA_P256_SHA256, Ed25519, RSA_PKCS1_SHA256, 0x0a0a}
+	allowed := signatureSchemesTLS12(schemes)
+	assertDeepEquals(t, allowed, []SignatureScheme{ECDSA_P256_SHA256, RSA_PKCS1_SHA256})
+
+	groups := groupsTLS12([]NamedGroup{FFDHE2048, X25519, P256})
+	assertDeepEquals(t, groups, []NamedGroup{X25519, P256})
+}
+
+func TestServerKeyExchangeMarshalUnmarshal(t *testing.T) {
+	skeValid := unhex(skeValidHex)
+
+	assertEquals(t, (ServerKeyExchangeBody{}).Type(), HandshakeTypeServerKeyExchange)
+
+	out, err := skeValidIn.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid ServerKeyExchange")
+	assertByteEquals(t, out, skeValid)
+
+	var ske ServerKeyExchangeBody
+	read, err := ske.Unmarshal(skeValid)
+	assertNotError(t, err, "Failed to unmarshal a valid ServerKeyExchange")
+	assertEquals(t, read, len(skeValid))
+	assertDeepEquals(t, ske, skeValidIn)
+
+	// Test unmarshal failure on an explicit curve
+	skeValid[0] = 0x01
+	_, err = ske.Unmarshal(skeValid)
+	assertError(t, err, "Unmarshaled a ServerKeyExchange with explicit parameters")
+
+	// The signature covers the randoms and the ECDH parameters
+	input := skeValidIn.signatureInput([32]byte{1}, [32]byte{2})
+	assertEquals(t, len(input), 64+4+len(skeValidIn.Point))
+	assertByteEquals(t, input[64:], unhex("03001704"+"04010203"))
+}
+
+func TestClientKeyExchangeMarshalUnmarshal(t *testing.T) {
+	cke := ClientKeyExchangeBody{Point: []byte{0x04, 0x01}}
+	out, err := cke.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid ClientKeyExchange")
+	assertByteEquals(t, out, []byte{0x02, 0x04, 0x01})
+
+	var cke2 ClientKeyExchangeBody
+	err = safeUnmarshal(&cke2, out)
+	assertNotError(t, err, "Failed to unmarshal a valid ClientKeyExchange")
+	assertDeepEquals(t, cke2, cke)
+
+	// Test unmarshal failure on an empty point
+	err = safeUnmarshal(&cke2, []byte{0x00})
+	assertError(t, err, "Unmarshaled a ClientKeyExchange with an empty point")
+
+	// A ServerHelloDone is always empty
+	err = safeUnmarshal(&ServerHelloDoneBody{}, []byte{0x00})
+	assertError(t, err, "Unmarshaled a non-empty ServerHelloDone")
+}
+
+func TestCertificateStatusMarshalUnmarshal(t *testing.T) {
+	cs := CertificateStatusBody{StatusType: certStatusTypeOCSP, OCSPResponse: []byte{0x30, 0x00}}
+	out, err := cs.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid CertificateStatus")
+	assertByteEquals(t, out, unhex("01"+"000002"+"3000"))
+
+	var cs2 CertificateStatusBody
+	err = safeUnmarshal(&cs2, out)
+	assertNotError(t, err, "Failed to unmarshal a valid CertificateStatus")
+	assertDeepEquals(t, cs2, cs)
+
+	out[0] = 0x02
+	err = safeUnmarshal(&cs2, out)
+	assertError(t, err, "Unmarshaled a CertificateStatus with an unknown type")
+}
+
+func TestCertificateTLS12MarshalUnmarshal(t *testing.T) {
+	cert := certificateBodyTLS12{Certificates: []*x509.Certificate{serverCert, clientCert}}
+	out, err := cert.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid Certificate")
+
+	var cert2 certificateBodyTLS12
+	err = safeUnmarshal(&cert2, out)
+	assertNotError(t, err, "Failed to unmarshal a valid Certificate")
+	assertEquals(t, len(cert2.Certificates), 2)
+	assertTrue(t, cert2.Certificates[0].Equal(serverCert), "Certificate mismatch")
+	assertTrue(t, cert2.Certificates[1].Equal(clientCert), "Certificate mismatch")
+
+	// An empty list is how a client declines to authenticate
+	out, err = certificateBodyTLS12{}.Marshal()
+	assertNotError(t, err, "Failed to marshal an empty Certificate")
+	assertByteEquals(t, out, []byte{0x00, 0x00, 0x00})
+}
+
+func TestCertificateRequestTLS12MarshalUnmarshal(t *testing.T) {
+	cr := certificateRequestBodyTLS12{
+		CertificateTypes: []uint8{certTypeECDSASign},
+		SignatureSchemes: []SignatureScheme{ECDSA_P256_SHA256},
+		Authorities:      [][]byte{serverCert.RawSubject},
+	}
+	out, err := cr.Marshal()
+	assertNotError(t, err, "Failed to marshal a valid CertificateRequest")
+
+	var cr2 certificateRequestBodyTLS12
+	err = safeUnmarshal(&cr2, out)
+	assertNotError(t, err, "Failed to unmarshal a valid CertificateRequest")
+	assertDeepEquals(t, cr2, cr)
+
+	// Only an ECDSA key was asked for
+	assertTrue(t, cr2.allowsKey(clientKey), "ECDSA key not allowed")
+	rsaKey, err := newSigningKey(RSA_PSS_SHA256)
+	assertNotError(t, err, "Failed to generate RSA key")
+	assertTrue(t, !cr2.allowsKey(rsaKey), "RSA key allowed")
+}
+
+func TestDowngradeSentinel(t *testing.T) {
+	hOut := &HandshakeLayer{}
+	ch, err := hOut.HandshakeMessageFromBody(&ClientHelloBody{CipherSuites: []CipherSuite{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+	assertNotError(t, err, "Failed to marshal ClientHello")
+
+	sh := &ServerHelloBody{
+		Version:     tls12Version,
+		CipherSuite: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	}
+	copy(sh.Random[len(sh.Random)-len(downgradeSentinelTLS12):], downgradeSentinelTLS12[:])
+	hm, err := hOut.HandshakeMessageFromBody(sh)
+	assertNotError(t, err, "Failed to marshal ServerHello")
+
+	state := clientStateWaitSH{
+		Config:          &Config{CipherSuites: []CipherSuite{TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		offeredVersions: []uint16{tls13Version, tls12Version},
+		clientHello:     ch,
+	}
+
+	// A client that offered TLS 1.3 rejects the sentinel
+	_, _, alert := state.negotiateTLS12(hm, sh)
+	assertEquals(t, alert, AlertIllegalParameter)
+
+	// A client that only offered TLS 1.2 ignores it
+	state.offeredVersions = []uint16{tls12Version}
+	next, _, alert := state.negotiateTLS12(hm, sh)
+	assertEquals(t, alert, AlertNoAlert)
+	assertEquals(t, next.State(), StateClientWaitCert)
+	assertTrue(t, state.Params.Version == 0, "Negotiation modified the original state")
+}